@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// adminRoutes returns the handler for the admin listener, with the healthcheck and the operational endpoints, see
+// opsRoutes. It's only reachable from inside the network, so requests aren't rate limited, but the endpoints still
+// need the same permissions as they do on the public port. They're left out of the request metrics, so that scraping
+// the metrics doesn't count towards them
+func (app *application) adminRoutes() http.Handler {
+	router := httprouter.New()
+
+	api := routeGroup{router: router, stack: stack{
+		app.requestDeadline, app.circuitBreaker, app.authenticate, app.maintenanceMode,
+	}}
+	health := routeGroup{router: router, stack: stack{app.requestDeadline, app.authenticate}}
+
+	router.NotFound = api.stack.thenFunc(app.notFoundResponse)
+	router.MethodNotAllowed = api.stack.thenFunc(app.methodNotAllowedResponse)
+
+	health.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	app.opsRoutes(api)
+
+	return stack{app.requestID, app.compress, app.recoverPanic, app.ipFilter}.then(router)
+}
+
+// serveAdmin starts the admin listener on admin-addr. It returns the server, so that it can be shut down with the main
+// one, or nil if admin-addr isn't set
+func (app *application) serveAdmin() *http.Server {
+	if app.config.adminAddr == "" {
+		return nil
+	}
+
+	srv := &http.Server{
+		Addr:         app.config.adminAddr,
+		Handler:      app.adminRoutes(),
+		IdleTimeout:  app.config.server.idleTimeout,
+		ReadTimeout:  app.config.server.readTimeout,
+		WriteTimeout: app.config.server.writeTimeout,
+	}
+
+	go func() {
+		app.logger.PrintInfo("starting admin server", map[string]string{"addr": srv.Addr})
+
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.logger.PrintError(err, map[string]string{"addr": srv.Addr, "task": "admin endpoints"})
+		}
+	}()
+
+	return srv
+}
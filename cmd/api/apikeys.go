@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+)
+
+// createAPIKeyHandler for the "POST /v1/me/api-keys" endpoint. This mints a long-lived API key for a service
+// integration to authenticate with, using an "Authorization: ApiKey <key>" header. The key is limited to the scopes
+// it's created with, and the plaintext key is only ever included in this response
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		RateLimit *int     `json:"rate_limit"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	key := &data.APIKey{
+		UserID:    user.ID,
+		Name:      input.Name,
+		Scopes:    input.Scopes,
+		RateLimit: app.config.apiKeys.defaultRateLimit,
+	}
+
+	if input.RateLimit != nil {
+		key.RateLimit = *input.RateLimit
+	}
+
+	permissions, err := app.requestModels(r).Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateAPIKey(v, key, permissions, app.config.apiKeys.maxRateLimit); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.requestModels(r).APIKeys.New(key)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listAPIKeysHandler for the "GET /v1/me/api-keys" endpoint. The keys are identified by their prefix, as the
+// plaintext keys aren't stored
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keys, err := app.requestModels(r).APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAPIKeyHandler for the "DELETE /v1/me/api-keys/:id" endpoint. The key stops working straight away
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.requestModels(r).APIKeys.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "API key successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/jsonlog"
+	"github.com/eazylaykzy/greenlight/internal/prom"
+	"net/http"
+)
+
+// The Prometheus metrics for the database circuit breakers, served from the "/metrics" endpoint. The state is 0 while
+// the breaker is closed, 1 while it's half-open and 2 while it's open
+var (
+	dbBreakerState = prom.NewGauge("greenlight_db_circuit_breaker_state",
+		"State of the database circuit breaker, by pool: 0 closed, 1 half-open, 2 open.", "pool")
+	dbBreakerTrips = prom.NewCounter("greenlight_db_circuit_breaker_trips_total",
+		"Times the database circuit breaker has opened, by pool.", "pool")
+)
+
+// newDBBreaker returns the circuit breaker for a database connection pool, which logs and exports each change of its
+// state. It returns nil when the breaker is switched off with a db-breaker-failures of 0
+func newDBBreaker(cfg config, pool string, logger *jsonlog.Logger) *data.Breaker {
+	if cfg.db.breaker.failures == 0 {
+		return nil
+	}
+
+	breaker := data.NewBreaker(cfg.db.breaker.failures, cfg.db.breaker.cooldown)
+	logger = logger.With("component", "models")
+
+	dbBreakerState.Set(float64(data.BreakerClosed), pool)
+
+	breaker.OnStateChange = func(state data.BreakerState) {
+		dbBreakerState.Set(float64(state), pool)
+
+		properties := map[string]string{"pool": pool, "state": state.String()}
+
+		if state == data.BreakerOpen {
+			dbBreakerTrips.Inc(pool)
+			logger.PrintError(data.ErrCircuitOpen, properties)
+			return
+		}
+
+		logger.PrintInfo("database circuit breaker "+state.String(), properties)
+	}
+
+	return breaker
+}
+
+// circuitBreaker middleware turns requests away with a 503 Service Unavailable response while the circuit breaker for
+// the primary database is open, before the authenticate middleware looks the user up, so that they fail straight away
+// rather than waiting on a database which is down. It's left out of the healthcheck's and the metrics' middleware, so
+// that the breaker's state can be seen. Once the cooldown has passed, requests are let through again, and the first
+// query made is the probe which finds out whether the database has recovered
+func (app *application) circuitBreaker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.dbBreaker == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if app.dbBreaker.State() == data.BreakerOpen {
+			app.databaseUnavailableResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"github.com/eazylaykzy/greenlight/internal/cache"
+	"github.com/felixge/httpsnoop"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxCachedBytes is the largest response body which is cached. Bigger responses are sent as usual, but not kept
+const maxCachedBytes = 1 << 20
+
+// cacheMetrics publishes how often responses are served from the cache, alongside the other metrics under the
+// "/debug/vars" endpoint
+var cacheMetrics = expvar.NewMap("response_cache")
+
+// cachedResponse is a response kept in the cache. Only the headers which were set by the handler are kept, as the
+// middleware outside it, such as the request ID and CORS middleware, sets its own headers for each request
+type cachedResponse struct {
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// cacheResponse middleware serves successful responses to GET requests from the cache for up to the ttl, when caching
+// is enabled. The route's handler is only called when there isn't a cached response. Responses are cached by their
+// path and query string, and the values of the request headers named in the Vary header, which is set by the
+// middleware outside this one before the handler runs. That includes the Authorization header, so users never see
+// each other's responses. The cache is emptied by the invalidateCache middleware whenever a movie changes
+func (app *application) cacheResponse(ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.cache == nil || r.Method != http.MethodGet {
+			next(w, r)
+			return
+		}
+
+		key := responseCacheKey(r, w.Header())
+
+		value, generation, err := app.cache.Get(key)
+		switch {
+		case err == nil:
+			var cached cachedResponse
+
+			if err := json.Unmarshal(value, &cached); err == nil {
+				cacheMetrics.Add("hits", 1)
+				app.writeCachedResponse(w, r, &cached)
+				return
+			}
+		case !errors.Is(err, cache.ErrMiss):
+			// The response can still be made without the cache, so this is only logged
+			app.logError(r, err)
+		}
+
+		cacheMetrics.Add("misses", 1)
+		w.Header().Set("X-Cache", "MISS")
+
+		// Keep a copy of the headers from before the handler ran, so that the ones it sets can be told apart
+		before := w.Header().Clone()
+
+		var (
+			status  int
+			header  http.Header
+			body    bytes.Buffer
+			tooLong bool
+		)
+
+		hooks := httpsnoop.Hooks{
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					if status == 0 {
+						status = code
+						header = handlerHeaders(before, w.Header())
+					}
+
+					next(code)
+				}
+			},
+			Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return func(b []byte) (int, error) {
+					if status == 0 {
+						status = http.StatusOK
+						header = handlerHeaders(before, w.Header())
+					}
+
+					if body.Len()+len(b) > maxCachedBytes {
+						tooLong = true
+					} else if !tooLong {
+						body.Write(b)
+					}
+
+					return next(b)
+				}
+			},
+		}
+
+		next(httpsnoop.Wrap(w, hooks), r)
+
+		if status != http.StatusOK || tooLong || !cacheable(header) {
+			return
+		}
+
+		value, err = json.Marshal(cachedResponse{Header: header, Body: body.Bytes()})
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+
+		if err := app.cache.Set(key, generation, value, ttl); err != nil {
+			app.logError(r, err)
+		}
+	}
+}
+
+// writeCachedResponse sends a response from the cache. As when the handler sends it, a client which already has the
+// response, going by its ETag, is sent a 304 Not Modified response instead
+func (app *application) writeCachedResponse(w http.ResponseWriter, r *http.Request, cached *cachedResponse) {
+	for name, values := range cached.Header {
+		w.Header()[name] = values
+	}
+
+	w.Header().Set("X-Cache", "HIT")
+
+	if etag := cached.Header.Get("ETag"); etag != "" && ifNoneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(cached.Body)
+}
+
+// invalidateCache middleware empties the response cache when a request which changes a movie, or something shown
+// with it, succeeds. It's done before the response is sent, so that the client never gets an old response afterwards
+func (app *application) invalidateCache(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.cache == nil {
+			next(w, r)
+			return
+		}
+
+		invalidated := false
+
+		invalidate := func(code int) {
+			if invalidated || code >= http.StatusBadRequest {
+				return
+			}
+
+			invalidated = true
+
+			if err := app.cache.Invalidate(); err != nil {
+				app.logError(r, err)
+				return
+			}
+
+			cacheMetrics.Add("invalidations", 1)
+		}
+
+		hooks := httpsnoop.Hooks{
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					invalidate(code)
+					next(code)
+				}
+			},
+			Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return func(b []byte) (int, error) {
+					invalidate(http.StatusOK)
+					return next(b)
+				}
+			},
+		}
+
+		next(httpsnoop.Wrap(w, hooks), r)
+	}
+}
+
+// responseCacheKey returns the cache key for a request, which is a hash of its path, its query string with the
+// parameters in order, and the values of the request headers named in the Vary header. It's hashed so that
+// authentication tokens aren't kept in the cache in plain text
+func responseCacheKey(r *http.Request, header http.Header) string {
+	var names []string
+
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	h := sha256.New()
+	h.Write([]byte(r.URL.Path + "?" + r.URL.Query().Encode() + "\n"))
+
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+
+		h.Write([]byte(name + ": " + strings.Join(r.Header.Values(name), ", ") + "\n"))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// handlerHeaders returns the headers which were set or changed by the handler, going by the headers from before it ran
+func handlerHeaders(before, after http.Header) http.Header {
+	header := make(http.Header)
+
+	for name, values := range after {
+		if strings.Join(values, "\n") != strings.Join(before[name], "\n") {
+			header[name] = values
+		}
+	}
+
+	return header
+}
+
+// cacheable reports whether a response can be cached, going by the headers the handler set. Responses which set a
+// cookie, or say that they mustn't be cached, aren't. Nor are those whose handler added to the Vary header, as the
+// cache key only takes the headers named in it before the handler ran into account
+func cacheable(header http.Header) bool {
+	if header.Get("Set-Cookie") != "" || header.Get("Vary") != "" {
+		return false
+	}
+
+	cacheControl := strings.ToLower(header.Get("Cache-Control"))
+
+	return !strings.Contains(cacheControl, "no-store") && !strings.Contains(cacheControl, "private")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// middleware wraps a handler with some behaviour of its own, such as authenticating the request
+type middleware func(next http.Handler) http.Handler
+
+// stack is a list of middleware which are applied to a handler together. The first middleware in the list is the
+// outermost, so it sees the request first
+type stack []middleware
+
+// then returns the handler wrapped in each of the middleware in the stack
+func (s stack) then(h http.Handler) http.Handler {
+	for i := len(s) - 1; i >= 0; i-- {
+		h = s[i](h)
+	}
+
+	return h
+}
+
+// thenFunc is like then, for a handler function
+func (s stack) thenFunc(fn http.HandlerFunc) http.Handler {
+	return s.then(fn)
+}
+
+// routeGroup registers routes on the router with a stack of middleware, so that each route's handler is wrapped in
+// the middleware it needs rather than every request going through the same chain
+type routeGroup struct {
+	router *httprouter.Router
+	stack  stack
+}
+
+// Handler registers the handler for the method and path, wrapped in the group's middleware
+func (g routeGroup) Handler(method, path string, h http.Handler) {
+	g.router.Handler(method, path, g.stack.then(h))
+}
+
+// HandlerFunc registers the handler function for the method and path, wrapped in the group's middleware
+func (g routeGroup) HandlerFunc(method, path string, fn http.HandlerFunc) {
+	g.router.Handler(method, path, g.stack.thenFunc(fn))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseNetworks parses a space separated list of networks in CIDR notation, such as those that the reverse proxies and
+// load balancers in front of the server send requests from. A bare IP address is taken to be a network of one address
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, field := range strings.Fields(s) {
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or a network in CIDR notation", field)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or a network in CIDR notation", field)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// clientIP returns the IP address of the client which made the request. This is the address the request came from,
+// unless that's one of the trusted proxies, in which case the Forwarded header (or X-Forwarded-For, if there isn't
+// one) is read from right to left, skipping the addresses of trusted proxies, to find the address that the first of
+// them received the request from. The headers are ignored when the request didn't come through a trusted proxy, as
+// anyone can send them. Requests made over a Unix domain socket, see the listen setting, come from a proxy on the same
+// machine, so they're trusted too
+func (app *application) clientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = host
+	}
+
+	if !app.isTrustedProxy(net.ParseIP(peer)) && !fromUnixSocket(r) {
+		return peer
+	}
+
+	var hops []string
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		hops = forwardedFor(forwarded)
+	} else {
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+
+	// Each proxy adds the address it received the request from to the end of the list. Stop at the first address
+	// which isn't a trusted proxy, or at one that isn't an IP address at all, such as "unknown", in which case the
+	// last proxy with a valid address is the best there is
+	client := peer
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+
+		client = ip.String()
+
+		if !app.isTrustedProxy(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// fromUnixSocket reports whether the request was received on a Unix domain socket
+func fromUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+// isTrustedProxy reports whether ip is in one of the trusted proxy networks
+func (app *application) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range app.config.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedFor returns the addresses in the "for" parameters of the Forwarded header values, as described in RFC 7239,
+// without their ports. For example `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"` gives "192.0.2.60" and
+// "2001:db8:cafe::17". Elements without a "for" parameter are given as empty strings, which aren't valid addresses
+func forwardedFor(values []string) []string {
+	var hops []string
+
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+
+			for _, pair := range strings.Split(element, ";") {
+				parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(parts) != 2 || !strings.EqualFold(parts[0], "for") {
+					continue
+				}
+
+				hop = strings.Trim(parts[1], `"`)
+
+				if strings.HasPrefix(hop, "[") {
+					// An IPv6 address is in brackets, followed by an optional port
+					if end := strings.Index(hop, "]"); end > 0 {
+						hop = hop[1:end]
+					}
+				} else if host, _, err := net.SplitHostPort(hop); err == nil {
+					hop = host
+				}
+			}
+
+			hops = append(hops, hop)
+		}
+	}
+
+	return hops
+}
+
+// joinNetworks returns the networks in CIDR notation, separated by spaces, as they're given to parseNetworks
+func joinNetworks(networks []*net.IPNet) string {
+	s := make([]string, len(networks))
+	for i, network := range networks {
+		s[i] = network.String()
+	}
+
+	return strings.Join(s, " ")
+}
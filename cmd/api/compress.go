@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The compressors are pooled, as each one allocates a good deal of memory for its state
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return w
+	}}
+	zlibWriters = sync.Pool{New: func() interface{} {
+		w, _ := zlib.NewWriterLevel(io.Discard, zlib.DefaultCompression)
+		return w
+	}}
+)
+
+// compressor is what gzip.Writer and zlib.Writer have in common
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compress middleware compresses responses with gzip or deflate, whichever the client prefers in its Accept-Encoding
+// header, when they have one of the configured content types and are at least the minimum size. Small responses
+// aren't worth the CPU time, and most images and archives are compressed already. Note that the deflate content
+// coding is the zlib format (RFC 1950) around the compressed data, as section 8.4.1.2 of RFC 9110 defines it, rather
+// than the raw DEFLATE data which compress/flate writes
+func (app *application) compress(next http.Handler) http.Handler {
+	if !app.config.compression.enabled {
+		return next
+	}
+
+	types := make(map[string]bool, len(app.config.compression.types))
+	for _, t := range app.config.compression.types {
+		types[t] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Whether the response is compressed depends on the Accept-Encoding header, so caches need to know that
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			types:          types,
+			minSize:        app.config.compression.minSize,
+		}
+		defer cw.Close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the encoding to compress a response with, "gzip" or "deflate", going by the client's
+// Accept-Encoding header, or an empty string if the response shouldn't be compressed. gzip wins a tie, as it's the
+// more widely supported of the two
+func negotiateEncoding(header string) string {
+	quality := map[string]float64{}
+
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		quality[name] = q
+	}
+
+	var (
+		best  string
+		bestQ float64
+	)
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		q, ok := quality[encoding]
+		if !ok {
+			q = quality["*"]
+		}
+
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+// compressResponseWriter buffers the start of a response until it knows whether to compress it, which is once the
+// response has reached the minimum size, is flushed, or is finished. If it's compressed, the Content-Length header is
+// dropped, as the length changes, and the content coding is added to a strong ETag, as the compressed bytes aren't the
+// same as those the ETag was made for. The ETag stays strong, so it can still be used with If-Match
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	types    map[string]bool
+	minSize  int
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         bytes.Buffer
+	writer      compressor
+}
+
+// WriteHeader holds on to the status code until it's known whether the response will be compressed
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+
+	cw.wroteHeader = true
+	cw.status = status
+
+	// Responses without a body are passed straight through
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decided = true
+		cw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// Write buffers the response body until there's enough of it to decide whether to compress it, and after that either
+// compresses it or passes it through
+func (cw *compressResponseWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		cw.buf.Write(b)
+		if cw.buf.Len() < cw.minSize {
+			return len(b), nil
+		}
+
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+
+		return len(b), nil
+	}
+
+	if cw.writer != nil {
+		return cw.writer.Write(b)
+	}
+
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been written so far, for streamed responses. A response which is flushed before it reaches
+// the minimum size is still compressed, as there's likely to be more of it
+func (cw *compressResponseWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		if err := cw.decide(true); err != nil {
+			return
+		}
+	}
+
+	if cw.writer != nil {
+		_ = cw.writer.Flush()
+	}
+
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the response, sending anything still buffered and the end of the compressed stream
+func (cw *compressResponseWriter) Close() {
+	if !cw.wroteHeader {
+		return
+	}
+
+	if !cw.decided {
+		_ = cw.decide(cw.buf.Len() > 0 && cw.buf.Len() >= cw.minSize)
+	}
+
+	if cw.writer != nil {
+		_ = cw.writer.Close()
+
+		switch w := cw.writer.(type) {
+		case *gzip.Writer:
+			w.Reset(io.Discard)
+			gzipWriters.Put(w)
+		case *zlib.Writer:
+			w.Reset(io.Discard)
+			zlibWriters.Put(w)
+		}
+
+		cw.writer = nil
+	}
+}
+
+// decide works out whether to compress the response, sends the header, and writes out what has been buffered. big is
+// whether the response is big enough to be worth compressing
+func (cw *compressResponseWriter) decide(big bool) error {
+	cw.decided = true
+
+	h := cw.ResponseWriter.Header()
+
+	if big && cw.compressible(h) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", encodedETag(etag, cw.encoding))
+		}
+
+		if cw.encoding == "gzip" {
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(cw.ResponseWriter)
+			cw.writer = gz
+		} else {
+			zw := zlibWriters.Get().(*zlib.Writer)
+			zw.Reset(cw.ResponseWriter)
+			cw.writer = zw
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.writer != nil {
+		_, err = cw.writer.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+
+	cw.buf.Reset()
+
+	return err
+}
+
+// compressible reports whether the response can be compressed: it mustn't be encoded already or be part of a
+// representation, and it must have one of the configured content types
+func (cw *compressResponseWriter) compressible(h http.Header) bool {
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" || cw.status == http.StatusPartialContent {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return cw.types[mediaType]
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	app := newTestApplication()
+	app.config.compression.enabled = true
+	app.config.compression.minSize = 1024
+	app.config.compression.types = []string{"application/json"}
+
+	large := `{"movies": "` + strings.Repeat("Casablanca ", 200) + `"}`
+	small := `{"movie": "Casablanca"}`
+
+	handler := func(body, contentType string) http.Handler {
+		return app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Header().Set("ETag", `"1-abc"`)
+			_, _ = io.WriteString(w, body)
+		}))
+	}
+
+	// Each compressed response is decoded in the way that a client which follows RFC 9110 would, with gzip for gzip
+	// and zlib for deflate
+	decoders := map[string]func(io.Reader) (io.ReadCloser, error){
+		"gzip":    func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		"deflate": zlib.NewReader,
+	}
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		body           string
+		contentType    string
+		wantEncoding   string
+	}{
+		{name: "gzip", acceptEncoding: "gzip", body: large, contentType: "application/json", wantEncoding: "gzip"},
+		{name: "deflate", acceptEncoding: "deflate", body: large, contentType: "application/json", wantEncoding: "deflate"},
+		{name: "Preferred encoding", acceptEncoding: "gzip;q=0.5, deflate", body: large, contentType: "application/json", wantEncoding: "deflate"},
+		{name: "Tie", acceptEncoding: "deflate, gzip", body: large, contentType: "application/json", wantEncoding: "gzip"},
+		{name: "Not accepted", acceptEncoding: "br", body: large, contentType: "application/json"},
+		{name: "Refused", acceptEncoding: "gzip;q=0", body: large, contentType: "application/json"},
+		{name: "Too small", acceptEncoding: "gzip", body: small, contentType: "application/json"},
+		{name: "Other content type", acceptEncoding: "gzip", body: large, contentType: "image/png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+
+			rr := httptest.NewRecorder()
+			handler(tt.body, tt.contentType).ServeHTTP(rr, r)
+
+			rs := rr.Result()
+
+			if got := rs.Header.Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("got Vary %q; want %q", got, "Accept-Encoding")
+			}
+
+			if got := rs.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("got Content-Encoding %q; want %q", got, tt.wantEncoding)
+			}
+
+			body := io.Reader(rs.Body)
+
+			if tt.wantEncoding == "" {
+				if got := rs.Header.Get("ETag"); got != `"1-abc"` {
+					t.Errorf("got ETag %s; want it to be left as it was", got)
+				}
+			} else {
+				if got := rs.Header.Get("Content-Length"); got != "" {
+					t.Errorf("got Content-Length %s; want none", got)
+				}
+
+				if want := `"1-abc-` + tt.wantEncoding + `"`; rs.Header.Get("ETag") != want {
+					t.Errorf("got ETag %s; want %s", rs.Header.Get("ETag"), want)
+				}
+
+				dec, err := decoders[tt.wantEncoding](rs.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				defer dec.Close()
+				body = dec
+			}
+
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.body {
+				t.Errorf("got body %q; want %q", got, tt.body)
+			}
+		})
+	}
+}
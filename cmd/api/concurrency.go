@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/eazylaykzy/greenlight/internal/prom"
+	"net/http"
+)
+
+// requestsShed is the Prometheus metric for the requests turned away by the concurrency limiters, served from the
+// "/metrics" endpoint. The scope is "global" for the limit for the whole server, and "route" for the limit for a route
+var requestsShed = prom.NewCounter("greenlight_http_requests_shed_total",
+	"Requests turned away because too many were being handled, by the scope of the limit.", "scope")
+
+// limitConcurrency returns a middleware which turns requests away with a 503 Service Unavailable response while
+// concurrency-max requests are already being handled, so that slow requests can't pile up until the server runs out of
+// database connections or memory. Unlike the rate limiters it doesn't matter how quickly the requests arrive, only how
+// many are waiting on a response at once. The routes it's used on share the limit
+func (app *application) limitConcurrency() middleware {
+	var slots chan struct{}
+	if app.config.concurrency.max > 0 {
+		slots = make(chan struct{}, app.config.concurrency.max)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slots == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			select {
+			case slots <- struct{}{}:
+			default:
+				app.shedRequest(w, r, "global")
+				return
+			}
+
+			defer func() { <-slots }()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitRouteConcurrency middleware is like limitConcurrency, with a limit of concurrency-route-max requests for each
+// route, so that a slow endpoint such as a search can't take all of the server's capacity for itself. A route is a
+// method and path pattern, and has its limit to itself as the middleware is applied to each route's handler separately
+func (app *application) limitRouteConcurrency(next http.Handler) http.Handler {
+	if app.config.concurrency.routeMax == 0 {
+		return next
+	}
+
+	slots := make(chan struct{}, app.config.concurrency.routeMax)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			app.shedRequest(w, r, "route")
+			return
+		}
+
+		defer func() { <-slots }()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shedRequest turns a request away when the concurrency limit with the scope has been reached
+func (app *application) shedRequest(w http.ResponseWriter, r *http.Request, scope string) {
+	requestsShed.Inc(scope)
+
+	app.loggers.limiter.PrintDebug("concurrency limit reached", app.logProperties(r, map[string]string{
+		"scope": scope,
+	}))
+
+	app.overloadedResponse(w, r)
+}
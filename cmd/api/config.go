@@ -0,0 +1,671 @@
+package main
+
+import (
+	"context"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/jsonlog"
+	"github.com/eazylaykzy/greenlight/internal/reporter"
+	"github.com/eazylaykzy/greenlight/internal/secrets"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"mime"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envProfiles holds the defaults for each environment, keyed by flag name. They take the place of the flags' own
+// defaults, so a setting given as a flag, an environment variable or in the config file still overrides them.
+// Production turns on the rate limiter, hides the debug endpoints and leaves the stack traces out of error log entries
+// to cut their volume, while development relaxes all three, and catches the emails rather than sending them
+var envProfiles = map[string]map[string]string{
+	"development": {
+		"limiter-enabled": "false",
+		"debug-endpoints": "true",
+		"mail-provider":   "catcher",
+	},
+	"staging": {
+		"limiter-enabled": "true",
+		"debug-endpoints": "true",
+	},
+	"production": {
+		"limiter-enabled":  "true",
+		"debug-endpoints":  "false",
+		"log-stack-traces": "false",
+	},
+}
+
+// resolveSecrets replaces the settings which refer to a secret in a secrets manager, such as
+// "vault:secret/greenlight#db_dsn", with the value of the secret. Only the settings which hold credentials or keys
+// can be references. Any other value is left as it is
+func resolveSecrets(ctx context.Context, r *secrets.Resolver, cfg *config) error {
+	settings := []*string{
+		&cfg.db.dsn,
+		&cfg.db.read.dsn,
+		&cfg.smtp.password,
+		&cfg.mail.ses.secretKey,
+		&cfg.mail.sendgrid.apiKey,
+		&cfg.mail.mailgun.apiKey,
+		&cfg.mail.dkim.key,
+		&cfg.mail.dkim.nextKey,
+		&cfg.tokens.peppers,
+		&cfg.exports.secret,
+		&cfg.oidc.clientSecret,
+		&cfg.storage.s3.secretKey,
+		&cfg.cache.redisURL,
+		&cfg.reporter.sentryDSN,
+		&cfg.reporter.rollbarToken,
+	}
+
+	for _, setting := range settings {
+		value, err := r.Resolve(ctx, *setting)
+		if err != nil {
+			return err
+		}
+
+		*setting = value
+	}
+
+	return nil
+}
+
+// validateConfig checks the assembled config before the server starts, so that a mistake in the flags, environment
+// or config file stops the server straight away instead of causing errors later on, part way through a request. Every
+// problem is added to the validator under the name of its flag, so that they can all be reported at once
+func validateConfig(v *validator.Validator, cfg config) {
+	v.Check(cfg.port >= 1 && cfg.port <= 65535, "port", "must be between 1 and 65535")
+	if cfg.listen.addr != "" {
+		path, found := strings.CutPrefix(cfg.listen.addr, "unix:")
+		v.Check(found && path != "", "listen", `must be a Unix domain socket, such as "unix:/run/greenlight/api.sock"`)
+		_, err := strconv.ParseUint(cfg.listen.socketMode, 8, 32)
+		v.Check(err == nil, "listen-socket-mode", `must be permissions in octal, such as "0660"`)
+	}
+	v.Check(validator.In(cfg.env, "development", "staging", "production"), "env",
+		"must be one of development, staging or production")
+	_, err := jsonlog.ParseLevel(cfg.logLevel)
+	v.Check(err == nil, "log-level", "must be one of debug, info, error or fatal")
+	_, err = parseComponentLevels(cfg.log.components)
+	v.Check(err == nil, "log-component-levels", "must be component=level pairs, with levels of debug, info, error or fatal")
+	v.Check(cfg.log.dedup.interval >= 0, "log-dedup-interval", "must not be negative")
+	if cfg.log.dedup.interval > 0 {
+		v.Check(cfg.log.dedup.burst >= 1, "log-dedup-burst", "must be at least 1")
+	}
+	switch cfg.log.sink.kind {
+	case "":
+	case "syslog":
+		if cfg.log.sink.url != "" {
+			u, err := url.Parse(cfg.log.sink.url)
+			v.Check(err == nil && validator.In(u.Scheme, "udp", "tcp", "unix", "unixgram"), "log-sink-url",
+				`must be a syslog address such as "udp://host:514" or "unix:///dev/log"`)
+		}
+	case "loki", "otlp":
+		v.Check(isAbsoluteURL(cfg.log.sink.url), "log-sink-url", "must be an absolute URL")
+	default:
+		v.AddError("log-sink", "must be one of syslog, loki or otlp")
+	}
+	if cfg.log.sink.kind != "" {
+		v.Check(cfg.log.sink.bufferSize >= 1, "log-sink-buffer", "must be at least 1")
+		v.Check(cfg.log.sink.maxRetries >= 0, "log-sink-retries", "must not be negative")
+	}
+	if cfg.log.file != "" {
+		v.Check(cfg.log.maxSize >= 0, "log-max-size", "must not be negative")
+		v.Check(cfg.log.maxAge >= 0, "log-max-age", "must not be negative")
+		v.Check(cfg.log.maxBackups >= 0, "log-max-backups", "must not be negative")
+	}
+
+	// The debug endpoints' own listener is only for the local machine, as it doesn't authenticate requests
+	if cfg.debugAddr != "" {
+		v.Check(isLoopbackAddr(cfg.debugAddr), "debug-addr", "must be a loopback address with a port, such as localhost:6060")
+	}
+
+	// The admin listener has endpoints which mustn't be reachable from the internet, so it has to be bound to an
+	// internal interface rather than to every interface
+	if cfg.adminAddr != "" {
+		v.Check(isInternalAddr(cfg.adminAddr), "admin-addr",
+			"must be an internal address with a port, such as localhost:9090 or a private IP address")
+		v.Check(cfg.adminAddr != cfg.debugAddr, "admin-addr", "must not be the same as debug-addr")
+	}
+
+	// Server timeouts
+	checkPositiveDuration(v, cfg.server.readTimeout, "server-read-timeout")
+	checkPositiveDuration(v, cfg.server.writeTimeout, "server-write-timeout")
+	checkPositiveDuration(v, cfg.server.idleTimeout, "server-idle-timeout")
+	checkPositiveDuration(v, cfg.server.shutdownTimeout, "server-shutdown-timeout")
+	checkPositiveDuration(v, cfg.server.tasksTimeout, "server-tasks-timeout")
+	v.Check(cfg.server.requestTimeout >= 0, "server-request-timeout", "must not be negative")
+	v.Check(cfg.server.requestTimeout <= cfg.server.writeTimeout, "server-request-timeout",
+		"must not be more than server-write-timeout")
+
+	// TLS, either from a certificate and key or from Let's Encrypt but not both
+	v.Check((cfg.tls.certFile == "") == (cfg.tls.keyFile == ""), "tls-cert", "must be provided together with tls-key")
+	v.Check(validator.In(cfg.tls.minVersion, "1.2", "1.3"), "tls-min-version", "must be 1.2 or 1.3")
+	v.Check(cfg.tls.redirectPort >= 0 && cfg.tls.redirectPort <= 65535, "tls-redirect-port", "must be between 0 and 65535")
+	if cfg.tls.redirectPort != 0 {
+		v.Check(cfg.tls.certFile != "", "tls-redirect-port", "must only be used with tls-cert and tls-key")
+		v.Check(cfg.tls.redirectPort != cfg.port, "tls-redirect-port", "must not be the same as port")
+	}
+	if len(cfg.tls.autocert.domains) > 0 {
+		v.Check(cfg.tls.certFile == "", "tls-autocert-domains", "must not be used with tls-cert and tls-key")
+		v.Check(cfg.tls.autocert.cacheDir != "", "tls-autocert-cache", "must be provided when tls-autocert-domains is set")
+		v.Check(cfg.tls.autocert.httpPort >= 0 && cfg.tls.autocert.httpPort <= 65535, "tls-autocert-http-port",
+			"must be between 0 and 65535")
+		v.Check(cfg.tls.autocert.httpPort != cfg.port, "tls-autocert-http-port", "must not be the same as port")
+		if cfg.tls.autocert.email != "" {
+			_, err = mail.ParseAddress(cfg.tls.autocert.email)
+			v.Check(err == nil, "tls-autocert-email", "must be an email address")
+		}
+	}
+
+	// HTTP/3 is only served alongside HTTPS, on the same port number
+	if cfg.tls.http3 {
+		v.Check(cfg.tlsEnabled(), "enable-http3", "must only be used with tls-cert and tls-key, or tls-autocert-domains")
+		v.Check(cfg.listen.addr == "", "enable-http3", "must not be used with listen")
+	}
+
+	// Database
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be provided")
+	v.Check(cfg.db.maxOpenConns >= 1, "db-max-open-conns", "must be at least 1")
+	v.Check(cfg.db.maxIdleConns >= 0, "db-max-idle-conns", "must not be negative")
+	v.Check(cfg.db.maxIdleConns <= cfg.db.maxOpenConns, "db-max-idle-conns", "must not be more than db-max-open-conns")
+	checkDurationString(v, cfg.db.maxIdleTime, "db-max-idle-time")
+	checkPositiveDuration(v, cfg.db.queryTimeout, "db-query-timeout")
+	v.Check(cfg.db.breaker.failures >= 0, "db-breaker-failures", "must not be negative")
+	if cfg.db.breaker.failures > 0 {
+		checkPositiveDuration(v, cfg.db.breaker.cooldown, "db-breaker-cooldown")
+	}
+
+	// The read replica's pool is only checked when it has a DSN, as otherwise reads use the primary pool
+	if cfg.db.read.dsn != "" {
+		v.Check(cfg.db.read.maxOpenConns >= 1, "db-read-max-open-conns", "must be at least 1")
+		v.Check(cfg.db.read.maxIdleConns >= 0, "db-read-max-idle-conns", "must not be negative")
+		v.Check(cfg.db.read.maxIdleConns <= cfg.db.read.maxOpenConns, "db-read-max-idle-conns",
+			"must not be more than db-read-max-open-conns")
+		checkDurationString(v, cfg.db.read.maxIdleTime, "db-read-max-idle-time")
+	}
+
+	// Rate limiting
+	if cfg.limiter.enabled {
+		v.Check(cfg.limiter.rps > 0, "limiter-rps", "must be greater than zero")
+		v.Check(cfg.limiter.burst >= 1, "limiter-burst", "must be at least 1")
+		v.Check(cfg.limiter.userRPS > 0, "limiter-user-rps", "must be greater than zero")
+		v.Check(cfg.limiter.userBurst >= 1, "limiter-user-burst", "must be at least 1")
+		v.Check(cfg.anonymous.rps > 0, "anonymous-limiter-rps", "must be greater than zero")
+		v.Check(cfg.anonymous.burst >= 1, "anonymous-limiter-burst", "must be at least 1")
+		_, err = parseLimiterPolicies(cfg.limiter.policies)
+		v.Check(err == nil, "limiter-policies", "must be name=rps:burst pairs, with rps greater than zero and burst at least 1")
+	}
+
+	// Concurrency limiting
+	v.Check(cfg.concurrency.max >= 0, "concurrency-max", "must not be negative")
+	v.Check(cfg.concurrency.routeMax >= 0, "concurrency-route-max", "must not be negative")
+	if cfg.concurrency.max > 0 {
+		v.Check(cfg.concurrency.routeMax <= cfg.concurrency.max, "concurrency-route-max",
+			"must not be more than concurrency-max")
+	}
+
+	v.Check(cfg.apiKeys.defaultRateLimit >= 1, "api-key-rate-limit", "must be at least 1")
+	v.Check(cfg.apiKeys.maxRateLimit >= cfg.apiKeys.defaultRateLimit, "api-key-max-rate-limit",
+		"must not be less than api-key-rate-limit")
+
+	// Email
+	_, err = mail.ParseAddress(cfg.smtp.sender)
+	v.Check(err == nil, "smtp-sender", `must be an email address, such as "Greenlight <no-reply@example.com>"`)
+	switch cfg.mail.provider {
+	case "smtp":
+		v.Check(cfg.smtp.host != "", "smtp-host", "must be provided")
+		v.Check(cfg.smtp.port >= 1 && cfg.smtp.port <= 65535, "smtp-port", "must be between 1 and 65535")
+		v.Check(cfg.smtp.username != "" || cfg.smtp.password == "", "smtp-username", "must be provided with smtp-password")
+	case "ses":
+		v.Check(cfg.mail.ses.region != "", "mail-ses-region", "must be provided")
+		v.Check(cfg.mail.ses.accessKey != "", "mail-ses-access-key", "must be provided when using ses")
+		v.Check(cfg.mail.ses.secretKey != "", "mail-ses-secret-key", "must be provided when using ses")
+	case "sendgrid":
+		v.Check(isAbsoluteURL(cfg.mail.sendgrid.url), "mail-sendgrid-url", "must be an absolute URL")
+		v.Check(cfg.mail.sendgrid.apiKey != "", "mail-sendgrid-api-key", "must be provided when using sendgrid")
+	case "mailgun":
+		v.Check(isAbsoluteURL(cfg.mail.mailgun.url), "mail-mailgun-url", "must be an absolute URL")
+		v.Check(cfg.mail.mailgun.domain != "", "mail-mailgun-domain", "must be provided when using mailgun")
+		v.Check(cfg.mail.mailgun.apiKey != "", "mail-mailgun-api-key", "must be provided when using mailgun")
+	case "catcher":
+		v.Check(cfg.env == "development", "mail-provider", "must not be catcher outside development")
+	default:
+		v.AddError("mail-provider", "must be one of smtp, ses, sendgrid, mailgun or catcher")
+	}
+	if cfg.mail.dkim.domain != "" {
+		v.Check(cfg.mail.dkim.selector != "", "mail-dkim-selector", "must be provided with mail-dkim-domain")
+		v.Check(cfg.mail.dkim.key != "", "mail-dkim-key", "must be provided with mail-dkim-domain")
+		v.Check(cfg.mail.dkim.nextKey == "" || cfg.mail.dkim.nextSelector != "", "mail-dkim-next-selector",
+			"must be provided with mail-dkim-next-key")
+		v.Check(cfg.mail.dkim.nextSelector != cfg.mail.dkim.selector, "mail-dkim-next-selector",
+			"must be different from mail-dkim-selector")
+		v.Check(validator.In(cfg.mail.dkim.canonicalization, "simple", "relaxed", "simple/simple", "simple/relaxed",
+			"relaxed/simple", "relaxed/relaxed"), "mail-dkim-canonicalize",
+			`must be the header and body canonicalization, such as "relaxed/relaxed"`)
+	}
+	v.Check(cfg.mail.brand.Name != "", "mail-brand-name", "must be provided")
+	v.Check(cfg.mail.brand.URL == "" || isAbsoluteURL(cfg.mail.brand.URL), "mail-brand-url", "must be an absolute URL")
+	v.Check(cfg.mail.brand.LogoURL == "" || isAbsoluteURL(cfg.mail.brand.LogoURL), "mail-brand-logo-url",
+		"must be an absolute URL")
+	v.Check(validator.Matches(cfg.mail.brand.Color, hexColorRX), "mail-brand-color", `must be a hex colour, such as "#1a73e8"`)
+	v.Check(cfg.emails.workers >= 1, "email-workers", "must be at least 1")
+	v.Check(cfg.emails.maxAttempts >= 1, "email-max-attempts", "must be at least 1")
+	checkPositiveDuration(v, cfg.emails.retryBackoff, "email-retry-backoff")
+	checkPositiveDuration(v, cfg.emails.pollInterval, "email-poll-interval")
+	v.Check(cfg.digest.interval >= 0, "digest-interval", "must not be negative")
+
+	for _, origin := range cfg.cors.trustedOrigins {
+		v.Check(isOrigin(strings.Replace(origin, "://*.", "://wildcard.", 1)), "cors-trusted-origins",
+			"must be origins such as https://example.com or https://*.example.com")
+	}
+
+	for _, method := range cfg.cors.allowedMethods {
+		v.Check(validator.Matches(method, httpMethodRX), "cors-allowed-methods", "must be HTTP methods such as PUT")
+	}
+
+	for _, header := range cfg.cors.allowedHeaders {
+		v.Check(validator.Matches(header, headerNameRX), "cors-allowed-headers", "must be header names such as Content-Type")
+	}
+
+	for _, header := range cfg.cors.exposedHeaders {
+		v.Check(validator.Matches(header, headerNameRX), "cors-exposed-headers", "must be header names such as ETag")
+	}
+
+	v.Check(cfg.cors.maxAge >= 0, "cors-max-age", "must not be negative")
+
+	checkPositiveDuration(v, cfg.maintenance.retryAfter, "maintenance-retry-after")
+	checkPositiveDuration(v, cfg.ipFilter.refreshInterval, "ip-blocks-interval")
+
+	v.Check(cfg.body.maxSize >= 1, "body-max-size", "must be at least 1")
+	v.Check(cfg.body.authMaxSize >= 1, "body-auth-max-size", "must be at least 1")
+	v.Check(cfg.body.importMaxSize >= 1, "body-import-max-size", "must be at least 1")
+
+	v.Check(cfg.compression.minSize >= 0, "compress-min-size", "must not be negative")
+	for _, t := range cfg.compression.types {
+		mediaType, _, err := mime.ParseMediaType(t)
+		v.Check(err == nil && mediaType == t, "compress-types", "must be content types such as application/json")
+	}
+
+	// Passwords
+	v.Check(cfg.passwords.minLength >= 1, "password-min-length", "must be at least 1")
+	v.Check(cfg.passwords.minEntropy >= 0, "password-min-entropy", "must not be negative")
+	if err := data.ValidateHashing(cfg.passwords.hashing); err != nil {
+		v.AddError("password-hash", err.Error())
+	}
+	if cfg.passwords.breachCheck {
+		v.Check(isAbsoluteURL(cfg.passwords.breachURL), "password-breach-url", "must be an absolute URL")
+	}
+
+	// Tokens
+	checkPositiveDuration(v, cfg.tokens.activationTTL, "activation-token-ttl")
+	checkPositiveDuration(v, cfg.tokens.deviceTTL, "device-token-ttl")
+	checkPositiveDuration(v, cfg.tokens.impersonationTTL, "impersonation-token-ttl")
+	checkPositiveDuration(v, cfg.invitations.ttl, "invitation-ttl")
+	v.Check(cfg.tokens.cleanupInterval >= 0, "token-cleanup-interval", "must not be negative")
+	v.Check(cfg.tokens.cleanupRetention >= 0, "token-cleanup-retention", "must not be negative")
+	v.Check(cfg.tokens.cleanupBatchSize >= 1, "token-cleanup-batch-size", "must be at least 1")
+	if _, err := data.ParseTokenPeppers(cfg.tokens.peppers); err != nil {
+		v.AddError("token-peppers", err.Error())
+	}
+	v.Check(cfg.tokens.unpepperedUntil.IsZero() || cfg.tokens.peppers != "", "token-unpeppered-until",
+		"must only be set along with token-peppers")
+
+	// Single sign-on, which is only checked when it's switched on by setting an issuer
+	if cfg.oidc.issuer != "" {
+		v.Check(isAbsoluteURL(cfg.oidc.issuer), "oidc-issuer", "must be an absolute URL")
+		v.Check(cfg.oidc.clientID != "", "oidc-client-id", "must be provided when oidc-issuer is set")
+		v.Check(isAbsoluteURL(cfg.oidc.redirectURL), "oidc-redirect-url", "must be an absolute URL when oidc-issuer is set")
+	}
+
+	// Background jobs, exports and enrichment
+	checkPositiveDuration(v, cfg.views.flushInterval, "views-flush-interval")
+	v.Check(isAbsoluteURL(cfg.exports.baseURL), "export-base-url", "must be an absolute URL")
+	checkPositiveDuration(v, cfg.exports.linkTTL, "export-link-ttl")
+	v.Check(cfg.exports.attachMaxSize >= 0, "export-attach-max-size", "must not be negative")
+	if cfg.enrich.omdbKey != "" {
+		v.Check(isAbsoluteURL(cfg.enrich.omdbURL), "enrich-omdb-url", "must be an absolute URL")
+		v.Check(cfg.enrich.rps > 0, "enrich-rps", "must be greater than zero")
+		v.Check(cfg.enrich.burst >= 1, "enrich-burst", "must be at least 1")
+	}
+
+	// Error reporting
+	switch cfg.reporter.name {
+	case "none":
+	case "sentry":
+		_, err := reporter.NewSentry(cfg.reporter.sentryDSN, cfg.env, version)
+		v.Check(err == nil, "sentry-dsn", "must be a Sentry DSN, such as https://key@o0.ingest.sentry.io/0")
+	case "rollbar":
+		v.Check(cfg.reporter.rollbarToken != "", "rollbar-token", "must be provided when using the rollbar error reporter")
+		v.Check(isAbsoluteURL(cfg.reporter.rollbarURL), "rollbar-url", "must be an absolute URL")
+	default:
+		v.AddError("error-reporter", "must be one of none, sentry or rollbar")
+	}
+
+	// Poster storage
+	switch cfg.storage.backend {
+	case "local":
+		v.Check(cfg.storage.local.dir != "", "storage-local-dir", "must be provided")
+		v.Check(isAbsoluteURL(cfg.storage.local.url), "storage-local-url", "must be an absolute URL")
+	case "s3":
+		v.Check(isAbsoluteURL(cfg.storage.s3.endpoint), "storage-s3-endpoint", "must be an absolute URL")
+		v.Check(cfg.storage.s3.region != "", "storage-s3-region", "must be provided")
+		v.Check(cfg.storage.s3.bucket != "", "storage-s3-bucket", "must be provided when using the s3 storage backend")
+		v.Check(cfg.storage.s3.publicURL == "" || isAbsoluteURL(cfg.storage.s3.publicURL), "storage-s3-public-url",
+			"must be an absolute URL")
+	default:
+		v.AddError("storage-backend", "must be one of local or s3")
+	}
+
+	// Response cache
+	if cfg.cache.enabled {
+		switch cfg.cache.backend {
+		case "memory":
+			v.Check(cfg.cache.maxEntries >= 1, "cache-max-entries", "must be at least 1")
+		case "redis":
+			u, err := url.Parse(cfg.cache.redisURL)
+			v.Check(err == nil && validator.In(u.Scheme, "redis", "rediss") && u.Host != "", "cache-redis-url",
+				"must be a redis:// or rediss:// URL")
+		default:
+			v.AddError("cache-backend", "must be one of memory or redis")
+		}
+	}
+}
+
+// checkDurationString checks that a duration which is kept as a string in the config, for parsing later, is valid
+func checkDurationString(v *validator.Validator, value, key string) {
+	d, err := time.ParseDuration(value)
+	v.Check(err == nil, key, `must be a duration, such as "15m"`)
+	v.Check(d >= 0, key, "must not be negative")
+}
+
+// hexColorRX matches a hex colour, such as "#1a73e8" or "#fff"
+var hexColorRX = regexp.MustCompile(`^#([0-9a-fA-F]{3}){1,2}$`)
+
+// httpMethodRX matches an HTTP method, such as "PUT"
+var httpMethodRX = regexp.MustCompile(`^[A-Z]+$`)
+
+// headerNameRX matches an HTTP header name, such as "Content-Type", which is a token in the terms of RFC 9110
+var headerNameRX = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// checkPositiveDuration checks that a duration, such as a lifetime or an interval, is greater than zero
+func checkPositiveDuration(v *validator.Validator, d time.Duration, key string) {
+	v.Check(d > 0, key, "must be greater than zero")
+}
+
+// isAbsoluteURL reports whether s is an absolute http or https URL
+func isAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && validator.In(u.Scheme, "http", "https") && u.Host != ""
+}
+
+// isLoopbackAddr reports whether s is a host and port where the host is localhost or a loopback IP address
+func isLoopbackAddr(s string) bool {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || port == "" {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isInternalAddr reports whether s is a host and port where the host is a loopback address, or an IP address in a
+// private or link-local network. Host names other than localhost aren't accepted, as they could resolve to anything
+func isInternalAddr(s string) bool {
+	if isLoopbackAddr(s) {
+		return true
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || port == "" {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// isOrigin reports whether s is an http or https origin, which is a scheme and host, and a port if it isn't the
+// scheme's default, without a path
+func isOrigin(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && isAbsoluteURL(s) && u.Path == "" && u.RawQuery == "" && u.User == nil &&
+		!strings.Contains(u.Host, "*")
+}
+
+// redacted replaces the value of a secret setting in the output of print-config
+const redacted = "[redacted]"
+
+// configSettings returns every setting in the config, keyed by its flag name and written the way it would be given on
+// the command line, for the print-config flag. Passwords, keys and other secrets are redacted, as are the passwords in
+// the database DSNs. A secret which isn't set is left empty, so that it's clear whether one was loaded
+func configSettings(cfg *config) map[string]string {
+	claimRules := make([]string, len(cfg.oidc.claimRules))
+	for i, rule := range cfg.oidc.claimRules {
+		claimRules[i] = rule.Claim + "=" + rule.Value + "=>" + strings.Join(rule.Permissions, ",")
+	}
+
+	return map[string]string{
+		"port":                     strconv.Itoa(cfg.port),
+		"listen":                   cfg.listen.addr,
+		"listen-socket-mode":       cfg.listen.socketMode,
+		"env":                      cfg.env,
+		"log-level":                cfg.logLevel,
+		"log-stack-traces":         strconv.FormatBool(cfg.log.stackTrace),
+		"log-component-levels":     cfg.log.components,
+		"log-file":                 cfg.log.file,
+		"log-max-size":             strconv.Itoa(cfg.log.maxSize),
+		"log-max-age":              cfg.log.maxAge.String(),
+		"log-max-backups":          strconv.Itoa(cfg.log.maxBackups),
+		"log-compress":             strconv.FormatBool(cfg.log.compress),
+		"log-dedup-interval":       cfg.log.dedup.interval.String(),
+		"log-dedup-burst":          strconv.Itoa(cfg.log.dedup.burst),
+		"log-sink":                 cfg.log.sink.kind,
+		"log-sink-url":             redactDSN(cfg.log.sink.url),
+		"log-sink-buffer":          strconv.Itoa(cfg.log.sink.bufferSize),
+		"log-sink-retries":         strconv.Itoa(cfg.log.sink.maxRetries),
+		"debug-endpoints":          strconv.FormatBool(cfg.debugEndpoints),
+		"debug-addr":               cfg.debugAddr,
+		"admin-addr":               cfg.adminAddr,
+		"server-read-timeout":      cfg.server.readTimeout.String(),
+		"server-write-timeout":     cfg.server.writeTimeout.String(),
+		"server-idle-timeout":      cfg.server.idleTimeout.String(),
+		"server-request-timeout":   cfg.server.requestTimeout.String(),
+		"server-shutdown-timeout":  cfg.server.shutdownTimeout.String(),
+		"server-tasks-timeout":     cfg.server.tasksTimeout.String(),
+		"tls-cert":                 cfg.tls.certFile,
+		"tls-key":                  cfg.tls.keyFile,
+		"tls-min-version":          cfg.tls.minVersion,
+		"tls-redirect-port":        strconv.Itoa(cfg.tls.redirectPort),
+		"tls-autocert-domains":     strings.Join(cfg.tls.autocert.domains, " "),
+		"tls-autocert-cache":       cfg.tls.autocert.cacheDir,
+		"tls-autocert-email":       cfg.tls.autocert.email,
+		"tls-autocert-http-port":   strconv.Itoa(cfg.tls.autocert.httpPort),
+		"enable-http3":             strconv.FormatBool(cfg.tls.http3),
+		"db-dsn":                   redactDSN(cfg.db.dsn),
+		"db-max-open-conns":        strconv.Itoa(cfg.db.maxOpenConns),
+		"db-max-idle-conns":        strconv.Itoa(cfg.db.maxIdleConns),
+		"db-max-idle-time":         cfg.db.maxIdleTime,
+		"db-query-timeout":         cfg.db.queryTimeout.String(),
+		"db-auto-migrate":          strconv.FormatBool(cfg.db.autoMigrate),
+		"db-breaker-failures":      strconv.Itoa(cfg.db.breaker.failures),
+		"db-breaker-cooldown":      cfg.db.breaker.cooldown.String(),
+		"db-read-dsn":              redactDSN(cfg.db.read.dsn),
+		"db-read-max-open-conns":   strconv.Itoa(cfg.db.read.maxOpenConns),
+		"db-read-max-idle-conns":   strconv.Itoa(cfg.db.read.maxIdleConns),
+		"db-read-max-idle-time":    cfg.db.read.maxIdleTime,
+		"limiter-enabled":          strconv.FormatBool(cfg.limiter.enabled),
+		"limiter-rps":              strconv.FormatFloat(cfg.limiter.rps, 'f', -1, 64),
+		"limiter-burst":            strconv.Itoa(cfg.limiter.burst),
+		"limiter-user-rps":         strconv.FormatFloat(cfg.limiter.userRPS, 'f', -1, 64),
+		"limiter-user-burst":       strconv.Itoa(cfg.limiter.userBurst),
+		"limiter-policies":         cfg.limiter.policies,
+		"concurrency-max":          strconv.Itoa(cfg.concurrency.max),
+		"concurrency-route-max":    strconv.Itoa(cfg.concurrency.routeMax),
+		"anonymous-reads":          strconv.FormatBool(cfg.anonymous.reads),
+		"anonymous-limiter-rps":    strconv.FormatFloat(cfg.anonymous.rps, 'f', -1, 64),
+		"anonymous-limiter-burst":  strconv.Itoa(cfg.anonymous.burst),
+		"api-key-rate-limit":       strconv.Itoa(cfg.apiKeys.defaultRateLimit),
+		"api-key-max-rate-limit":   strconv.Itoa(cfg.apiKeys.maxRateLimit),
+		"smtp-host":                cfg.smtp.host,
+		"smtp-port":                strconv.Itoa(cfg.smtp.port),
+		"smtp-username":            cfg.smtp.username,
+		"smtp-password":            redactSecret(cfg.smtp.password),
+		"smtp-sender":              cfg.smtp.sender,
+		"mail-provider":            cfg.mail.provider,
+		"mail-ses-region":          cfg.mail.ses.region,
+		"mail-ses-access-key":      cfg.mail.ses.accessKey,
+		"mail-ses-secret-key":      redactSecret(cfg.mail.ses.secretKey),
+		"mail-sendgrid-url":        cfg.mail.sendgrid.url,
+		"mail-sendgrid-api-key":    redactSecret(cfg.mail.sendgrid.apiKey),
+		"mail-mailgun-url":         cfg.mail.mailgun.url,
+		"mail-mailgun-domain":      cfg.mail.mailgun.domain,
+		"mail-mailgun-api-key":     redactSecret(cfg.mail.mailgun.apiKey),
+		"mail-dkim-domain":         cfg.mail.dkim.domain,
+		"mail-dkim-selector":       cfg.mail.dkim.selector,
+		"mail-dkim-key":            redactSecret(cfg.mail.dkim.key),
+		"mail-dkim-next-selector":  cfg.mail.dkim.nextSelector,
+		"mail-dkim-next-key":       redactSecret(cfg.mail.dkim.nextKey),
+		"mail-dkim-canonicalize":   cfg.mail.dkim.canonicalization,
+		"mail-brand-name":          cfg.mail.brand.Name,
+		"mail-brand-url":           cfg.mail.brand.URL,
+		"mail-brand-logo-url":      cfg.mail.brand.LogoURL,
+		"mail-brand-color":         cfg.mail.brand.Color,
+		"mail-template-dir":        cfg.mail.templateDir,
+		"email-workers":            strconv.Itoa(cfg.emails.workers),
+		"email-max-attempts":       strconv.Itoa(cfg.emails.maxAttempts),
+		"email-retry-backoff":      cfg.emails.retryBackoff.String(),
+		"email-poll-interval":      cfg.emails.pollInterval.String(),
+		"digest-interval":          cfg.digest.interval.String(),
+		"cors-trusted-origins":     strings.Join(cfg.cors.trustedOrigins, " "),
+		"cors-allowed-methods":     strings.Join(cfg.cors.allowedMethods, " "),
+		"cors-allowed-headers":     strings.Join(cfg.cors.allowedHeaders, " "),
+		"cors-exposed-headers":     strings.Join(cfg.cors.exposedHeaders, " "),
+		"cors-max-age":             cfg.cors.maxAge.String(),
+		"cors-allow-credentials":   strconv.FormatBool(cfg.cors.allowCredentials),
+		"maintenance":              strconv.FormatBool(cfg.maintenance.enabled),
+		"maintenance-file":         cfg.maintenance.file,
+		"maintenance-retry-after":  cfg.maintenance.retryAfter.String(),
+		"body-max-size":            strconv.FormatInt(cfg.body.maxSize, 10),
+		"body-auth-max-size":       strconv.FormatInt(cfg.body.authMaxSize, 10),
+		"body-import-max-size":     strconv.FormatInt(cfg.body.importMaxSize, 10),
+		"compress":                 strconv.FormatBool(cfg.compression.enabled),
+		"compress-min-size":        strconv.Itoa(cfg.compression.minSize),
+		"compress-types":           strings.Join(cfg.compression.types, " "),
+		"trusted-proxies":          joinNetworks(cfg.trustedProxies),
+		"ip-allow":                 joinNetworks(cfg.ipFilter.allow),
+		"ip-deny":                  joinNetworks(cfg.ipFilter.deny),
+		"ip-blocks-interval":       cfg.ipFilter.refreshInterval.String(),
+		"password-min-length":      strconv.Itoa(cfg.passwords.minLength),
+		"password-min-entropy":     strconv.FormatFloat(cfg.passwords.minEntropy, 'f', -1, 64),
+		"password-require-classes": strings.Join(cfg.passwords.requiredClasses, ","),
+		"password-hash":            cfg.passwords.hashing.Algorithm,
+		"argon2-memory":            strconv.FormatUint(uint64(cfg.passwords.hashing.Argon2id.Memory), 10),
+		"argon2-iterations":        strconv.FormatUint(uint64(cfg.passwords.hashing.Argon2id.Iterations), 10),
+		"argon2-parallelism":       strconv.FormatUint(uint64(cfg.passwords.hashing.Argon2id.Parallelism), 10),
+		"bcrypt-cost":              strconv.Itoa(cfg.passwords.hashing.BcryptCost),
+		"password-banned-list":     cfg.passwords.bannedList,
+		"password-breach-check":    strconv.FormatBool(cfg.passwords.breachCheck),
+		"password-breach-url":      cfg.passwords.breachURL,
+		"activation-token-ttl":     cfg.tokens.activationTTL.String(),
+		"device-token-ttl":         cfg.tokens.deviceTTL.String(),
+		"impersonation-token-ttl":  cfg.tokens.impersonationTTL.String(),
+		"token-cleanup-interval":   cfg.tokens.cleanupInterval.String(),
+		"token-cleanup-retention":  cfg.tokens.cleanupRetention.String(),
+		"token-cleanup-batch-size": strconv.Itoa(cfg.tokens.cleanupBatchSize),
+		"token-peppers":            redactSecret(cfg.tokens.peppers),
+		"token-unpeppered-until":   formatTime(cfg.tokens.unpepperedUntil),
+		"invite-only":              strconv.FormatBool(cfg.invitations.required),
+		"invitation-ttl":           cfg.invitations.ttl.String(),
+		"oidc-issuer":              cfg.oidc.issuer,
+		"oidc-client-id":           cfg.oidc.clientID,
+		"oidc-client-secret":       redactSecret(cfg.oidc.clientSecret),
+		"oidc-redirect-url":        cfg.oidc.redirectURL,
+		"oidc-scopes":              strings.Join(cfg.oidc.scopes, " "),
+		"oidc-claim-rules":         strings.Join(claimRules, " "),
+		"movies-duplicate-check":   strconv.FormatBool(cfg.movies.duplicateCheck),
+		"views-flush-interval":     cfg.views.flushInterval.String(),
+		"error-reporter":           cfg.reporter.name,
+		"sentry-dsn":               redactSecret(cfg.reporter.sentryDSN),
+		"rollbar-token":            redactSecret(cfg.reporter.rollbarToken),
+		"rollbar-url":              cfg.reporter.rollbarURL,
+		"storage-backend":          cfg.storage.backend,
+		"storage-local-dir":        cfg.storage.local.dir,
+		"storage-local-url":        cfg.storage.local.url,
+		"storage-s3-endpoint":      cfg.storage.s3.endpoint,
+		"storage-s3-region":        cfg.storage.s3.region,
+		"storage-s3-bucket":        cfg.storage.s3.bucket,
+		"storage-s3-access-key":    cfg.storage.s3.accessKey,
+		"storage-s3-secret-key":    redactSecret(cfg.storage.s3.secretKey),
+		"storage-s3-public-url":    cfg.storage.s3.publicURL,
+		"cache":                    strconv.FormatBool(cfg.cache.enabled),
+		"cache-backend":            cfg.cache.backend,
+		"cache-redis-url":          redactDSN(cfg.cache.redisURL),
+		"cache-max-entries":        strconv.Itoa(cfg.cache.maxEntries),
+		"export-base-url":          cfg.exports.baseURL,
+		"export-link-secret":       redactSecret(cfg.exports.secret),
+		"export-link-ttl":          cfg.exports.linkTTL.String(),
+		"export-attach-max-size":   strconv.Itoa(cfg.exports.attachMaxSize),
+		"enrich-omdb-url":          cfg.enrich.omdbURL,
+		"enrich-omdb-key":          redactSecret(cfg.enrich.omdbKey),
+		"enrich-rps":               strconv.FormatFloat(cfg.enrich.rps, 'f', -1, 64),
+		"enrich-burst":             strconv.Itoa(cfg.enrich.burst),
+	}
+}
+
+// redactSecret hides the value of a secret setting, unless it's empty
+func redactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	return redacted
+}
+
+// formatTime returns a time in RFC 3339 format, as it's given on the command line, or an empty string for the zero
+// time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// redactDSN hides the password in a database DSN, keeping the rest so that the host and database can be checked. A
+// URL DSN has its password replaced with "xxxxx", as url.URL.Redacted does. A DSN in the "key=value" format has the
+// value of its password key replaced, and anything else is redacted completely
+func redactDSN(dsn string) string {
+	if dsn == "" {
+		return ""
+	}
+
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		query := u.Query()
+		if query.Has("password") {
+			query.Set("password", "xxxxx")
+			u.RawQuery = query.Encode()
+		}
+
+		return u.Redacted()
+	}
+
+	if !strings.Contains(dsn, "=") {
+		return redacted
+	}
+
+	fields := strings.Fields(dsn)
+	for i, field := range fields {
+		if strings.HasPrefix(field, "password=") {
+			fields[i] = "password=" + redacted
+		}
+	}
+
+	return strings.Join(fields, " ")
+}
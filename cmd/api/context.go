@@ -13,9 +13,43 @@ type contextKey string
 // We'll use this constant as the key for getting and setting user information in the request context.
 const userContextKey = contextKey("user")
 
+// userRefContextKey is the key for the userRef that the recoverPanic middleware looks at to see who made the request
+const userRefContextKey = contextKey("userRef")
+
+// tokenContextKey is the key for the plaintext authentication token that the request was authenticated with
+const tokenContextKey = contextKey("token")
+
+// apiKeyContextKey is the key for the API key that the request was authenticated with, if any
+const apiKeyContextKey = contextKey("apiKey")
+
+// impersonationContextKey is the key for the details of the impersonation, when the request was made by an
+// administrator acting as another user
+const impersonationContextKey = contextKey("impersonation")
+
+// requestIDContextKey is the key for the ID of the request, which is included in its log entries and error responses
+const requestIDContextKey = contextKey("requestID")
+
+// resourceContextKey is the key for the resource loaded by the requireOwnership middleware
+const resourceContextKey = contextKey("resource")
+
+// bodyLimitContextKey is the key for the largest request body accepted by the route, when it has its own limit
+const bodyLimitContextKey = contextKey("bodyLimit")
+
+// authFailedContextKey is the key for the function which charges a failed authentication to the client's IP address
+const authFailedContextKey = contextKey("authFailed")
+
+// deadlineParentContextKey is the key for the request's context from before the requestDeadline middleware gave it a
+// deadline, which routes that allow themselves longer start again from
+const deadlineParentContextKey = contextKey("deadlineParent")
+
 // contextSetUser method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the key.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	// Let the middleware which runs before the user is known, and only has the original request, see them too
+	if ref, ok := r.Context().Value(userRefContextKey).(*userRef); ok {
+		ref.user = user
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -31,3 +65,133 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// contextSetToken method returns a new copy of the request with the plaintext authentication token added to the
+// context, so that handlers can tell which of the user's tokens the current request is using
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken retrieves the plaintext authentication token from the request context. It returns an empty string
+// if the request wasn't authenticated
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// contextSetAPIKey method returns a new copy of the request with the API key that it was authenticated with added to
+// the context
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey retrieves the API key from the request context. It returns nil if the request wasn't authenticated
+// with an API key
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// contextSetImpersonation method returns a new copy of the request with the details of the impersonation that it was
+// made under added to the context
+func (app *application) contextSetImpersonation(r *http.Request, impersonation *data.Impersonation) *http.Request {
+	ctx := context.WithValue(r.Context(), impersonationContextKey, impersonation)
+	return r.WithContext(ctx)
+}
+
+// contextGetImpersonation retrieves the details of the impersonation from the request context. It returns nil if the
+// request wasn't made by an administrator impersonating the user
+func (app *application) contextGetImpersonation(r *http.Request) *data.Impersonation {
+	impersonation, _ := r.Context().Value(impersonationContextKey).(*data.Impersonation)
+	return impersonation
+}
+
+// contextSetResource method returns a new copy of the request with the resource that it acts on added to the context
+func (app *application) contextSetResource(r *http.Request, resource ownedResource) *http.Request {
+	ctx := context.WithValue(r.Context(), resourceContextKey, resource)
+	return r.WithContext(ctx)
+}
+
+// contextGetResource retrieves the resource loaded by the requireOwnership middleware. Like contextGetUser, it's only
+// used where the resource is logically expected to be in the context, so it panics if it isn't
+func (app *application) contextGetResource(r *http.Request) ownedResource {
+	resource, ok := r.Context().Value(resourceContextKey).(ownedResource)
+	if !ok {
+		panic("missing resource value in request context")
+	}
+
+	return resource
+}
+
+// contextSetRequestID method returns a new copy of the request with its request ID added to the context
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID retrieves the request ID from the request context, or an empty string if it hasn't been set,
+// which is the case for requests which haven't been through the requestID middleware
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// contextSetBodyLimit method returns a new copy of the request with the route's own limit on the size of the request
+// body added to the context
+func (app *application) contextSetBodyLimit(r *http.Request, limit int64) *http.Request {
+	ctx := context.WithValue(r.Context(), bodyLimitContextKey, limit)
+	return r.WithContext(ctx)
+}
+
+// contextGetBodyLimit retrieves the route's own limit on the size of the request body from the request context, or 0
+// if the route doesn't have one
+func (app *application) contextGetBodyLimit(r *http.Request) int64 {
+	limit, _ := r.Context().Value(bodyLimitContextKey).(int64)
+	return limit
+}
+
+// contextSetDeadlineParent method returns a new copy of the request with its context from before it was given a
+// deadline added to the context
+func (app *application) contextSetDeadlineParent(r *http.Request, parent context.Context) *http.Request {
+	ctx := context.WithValue(r.Context(), deadlineParentContextKey, parent)
+	return r.WithContext(ctx)
+}
+
+// contextGetDeadlineParent retrieves the request's context from before it was given a deadline, or nil if the request
+// wasn't given one
+func (app *application) contextGetDeadlineParent(r *http.Request) context.Context {
+	parent, _ := r.Context().Value(deadlineParentContextKey).(context.Context)
+	return parent
+}
+
+// userRef holds the user who made the request, once contextSetUser has been called, for the middleware which runs
+// before the authenticate middleware and so only has the request from before the user was added to its context
+type userRef struct {
+	user *data.User
+}
+
+// contextSetUserRef method returns a new copy of the request with an empty userRef added to the context, and the
+// userRef itself, which contextSetUser fills in later
+func (app *application) contextSetUserRef(r *http.Request) (*http.Request, *userRef) {
+	ref := &userRef{}
+	ctx := context.WithValue(r.Context(), userRefContextKey, ref)
+
+	return r.WithContext(ctx), ref
+}
+
+// contextSetAuthFailed method returns a new copy of the request with the function to call if its credentials turn out
+// to be invalid added to the context
+func (app *application) contextSetAuthFailed(r *http.Request, fn func()) *http.Request {
+	ctx := context.WithValue(r.Context(), authFailedContextKey, fn)
+	return r.WithContext(ctx)
+}
+
+// authFailed charges a request whose credentials were invalid to the rate limit for its IP address, if the rateLimit
+// middleware gave it a function to call
+func (app *application) authFailed(r *http.Request) {
+	if fn, ok := r.Context().Value(authFailedContextKey).(func()); ok {
+		fn()
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/mailer"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// createDataExportHandler for the "POST /v1/me/export" endpoint. This starts gathering everything tied to the user's
+// account into a ZIP archive in the background, and emails them a download link once it's ready. The client can
+// follow the export's progress with the URL in the Location header. Only one export can be in progress at a time
+func (app *application) createDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// Free up the space used by any of the user's old archives which can no longer be downloaded
+	err := app.requestModels(r).DataExports.DeleteExpiredArchives(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	export := &data.DataExport{UserID: user.ID}
+
+	err = app.requestModels(r).DataExports.Insert(export)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrExportInProgress):
+			app.errorResponse(w, r, http.StatusConflict, "an export of your data is already in progress")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	app.background("data export", func() {
+		app.runDataExport(export, user)
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/me/exports/%d", export.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"export": export}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listDataExportsHandler for the "GET /v1/me/exports" endpoint. This lists the user's data exports, most recent first
+func (app *application) listDataExportsHandler(w http.ResponseWriter, r *http.Request) {
+	exports, err := app.requestModels(r).DataExports.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"exports": exports}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showDataExportHandler for the "GET /v1/me/exports/:id" endpoint. This shows the status of one of the user's data
+// exports
+func (app *application) showDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	export, err := app.requestModels(r).DataExports.Get(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"export": export}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// downloadDataExportHandler for the "GET /v1/exports/:id/download" endpoint. This is the link emailed to users when
+// their export is ready. It doesn't need an authentication token, so that it can be opened straight from the email,
+// and instead carries an expiry time and a signature over the export ID and expiry in its query string
+func (app *application) downloadDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	expires, err := strconv.ParseInt(qs.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		app.invalidDownloadLinkResponse(w, r)
+		return
+	}
+
+	signature, err := hex.DecodeString(qs.Get("signature"))
+	if err != nil || !hmac.Equal(signature, app.signExportLink(id, expires)) {
+		app.invalidDownloadLinkResponse(w, r)
+		return
+	}
+
+	archive, err := app.requestModels(r).DataExports.GetArchive(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidDownloadLinkResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="greenlight-export-%d.zip"`, id))
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(archive)
+}
+
+// runDataExport gathers the user's data into an archive, stores it and emails the user a link to download it. If
+// anything goes wrong the export is marked as failed, so that the user can ask for another one
+func (app *application) runDataExport(export *data.DataExport, user *data.User) {
+	completed := false
+
+	defer func() {
+		if !completed {
+			err := app.models.DataExports.Fail(export.ID)
+			if err != nil {
+				app.loggers.models.PrintError(err, nil)
+			}
+		}
+	}()
+
+	err := app.models.DataExports.SetRunning(export.ID)
+	if err != nil {
+		app.loggers.models.PrintError(err, nil)
+		return
+	}
+
+	archive, err := app.buildDataExportArchive(user)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"export_id": strconv.FormatInt(export.ID, 10)})
+		return
+	}
+
+	expiry := time.Now().Add(app.config.exports.linkTTL).Truncate(time.Second)
+
+	err = app.models.DataExports.Complete(export.ID, archive, expiry)
+	if err != nil {
+		app.loggers.models.PrintError(err, map[string]string{"export_id": strconv.FormatInt(export.ID, 10)})
+		return
+	}
+
+	completed = true
+
+	// Small archives are attached to the email as well, so that the user still gets their data if the link has
+	// expired or been lost by the time they read it
+	var attachments []mailer.Attachment
+	if len(archive) <= app.config.exports.attachMaxSize*1024*1024 {
+		attachments = append(attachments, mailer.Attachment{
+			Filename:    "data-export.zip",
+			ContentType: "application/zip",
+			Data:        archive,
+		})
+	}
+
+	err = app.sendEmail(user.Email, "data_export.tmpl", map[string]interface{}{
+		"userName":    user.Name,
+		"downloadURL": app.exportDownloadURL(export.ID, expiry),
+		"expiry":      humanDuration(app.config.exports.linkTTL),
+		"attached":    len(attachments) > 0,
+	}, attachments...)
+	if err != nil {
+		app.loggers.mailer.PrintError(err, nil)
+	}
+}
+
+// buildDataExportArchive returns a ZIP archive of everything tied to the user's account, with one JSON file for each
+// kind of data
+func (app *application) buildDataExportArchive(user *data.User) ([]byte, error) {
+	profile, err := app.models.Users.GetProfile(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	reviews, err := app.models.DataExports.GetReviews(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ratings, err := app.models.DataExports.GetRatings(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	watchlist, err := app.models.DataExports.GetWatchlist(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	loginHistory, err := app.models.DataExports.GetLoginEvents(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	files := []struct {
+		name     string
+		contents interface{}
+	}{
+		{"account.json", envelope{"user": user, "profile": profile, "permissions": permissions}},
+		{"reviews.json", envelope{"reviews": reviews}},
+		{"ratings.json", envelope{"ratings": ratings}},
+		{"watchlist.json", envelope{"watchlist": watchlist}},
+		{"login_history.json", envelope{"login_events": loginHistory}},
+		{"sessions.json", envelope{"sessions": sessions}},
+		{"api_keys.json", envelope{"api_keys": apiKeys}},
+	}
+
+	var buf bytes.Buffer
+
+	zw := zip.NewWriter(&buf)
+
+	for _, file := range files {
+		js, err := json.MarshalIndent(file.contents, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = f.Write(append(js, '\n'))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// exportDownloadURL returns the signed link for downloading an export, which works until the expiry time
+func (app *application) exportDownloadURL(id int64, expiry time.Time) string {
+	qs := url.Values{}
+	qs.Set("expires", strconv.FormatInt(expiry.Unix(), 10))
+	qs.Set("signature", hex.EncodeToString(app.signExportLink(id, expiry.Unix())))
+
+	baseURL := strings.TrimSuffix(app.config.exports.baseURL, "/")
+
+	return fmt.Sprintf("%s/v1/exports/%d/download?%s", baseURL, id, qs.Encode())
+}
+
+// signExportLink returns the HMAC-SHA256 signature of an export ID and link expiry time
+func (app *application) signExportLink(id, expires int64) []byte {
+	mac := hmac.New(sha256.New, []byte(app.config.exports.secret))
+	_, _ = fmt.Fprintf(mac, "%d:%d", id, expires)
+	return mac.Sum(nil)
+}
+
+// randomSecret returns a random 32-byte secret, hex encoded
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"net/http"
+	"time"
+)
+
+// requestDeadline middleware gives each request a deadline of server-request-timeout. The models used through
+// requestModels make their queries under the request's context, so once the deadline has passed they're cancelled,
+// rather than a slow query holding its connection until the server's write timeout. The handler then responds with a
+// 503 Service Unavailable, see serverErrorResponse. The context from before the deadline is kept, for routes which
+// allow themselves longer with the routeTimeout middleware
+func (app *application) requestDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.server.requestTimeout == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		parent := r.Context()
+
+		ctx, cancel := context.WithTimeout(parent, app.config.server.requestTimeout)
+		defer cancel()
+
+		r = app.contextSetDeadlineParent(r.WithContext(ctx), parent)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeTimeout middleware gives the route its own deadline in place of the one from server-request-timeout, for the
+// bulk endpoints which are expected to take longer. The request's context is still cancelled if the client goes away
+func (app *application) routeTimeout(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parent := app.contextGetDeadlineParent(r)
+		if parent == nil {
+			next(w, r)
+			return
+		}
+
+		// The new context keeps the values of the request's context, but not its deadline, so the cancellation of the
+		// context from before the deadline is passed on by hand
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), timeout)
+		defer cancel()
+
+		stop := context.AfterFunc(parent, cancel)
+		defer stop()
+
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// requestModels returns the models with their queries made under the request's context, so that they honour its
+// deadline. Work which carries on after the response has been sent, such as that started with app.background, uses
+// app.models instead, as the request's context is cancelled once the handler returns
+func (app *application) requestModels(r *http.Request) data.Models {
+	return app.models.WithContext(r.Context())
+}
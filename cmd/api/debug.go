@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// debugHandler returns a handler for the debug endpoints: /debug/vars, with the expvar metrics, and the runtime's
+// profiles under /debug/pprof/, as served by net/http/pprof. CPU profiles and execution traces are gathered with
+// "go tool pprof" for as long as the seconds query string parameter asks, up to the server's write timeout
+func (app *application) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+// serveDebug starts the server for the debug endpoints on debug-addr, which doesn't authenticate requests, so is only
+// reachable from the local machine. It has no write timeout, so that profiles can be gathered for as long as is needed.
+// It returns the server, so that it can be shut down with the main one, or nil if debug-addr isn't set
+func (app *application) serveDebug() *http.Server {
+	if app.config.debugAddr == "" {
+		return nil
+	}
+
+	srv := &http.Server{
+		Addr:        app.config.debugAddr,
+		Handler:     app.debugHandler(),
+		IdleTimeout: app.config.server.idleTimeout,
+		ReadTimeout: app.config.server.readTimeout,
+	}
+
+	go func() {
+		app.logger.PrintInfo("starting debug server", map[string]string{"addr": srv.Addr})
+
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.logger.PrintError(err, map[string]string{"addr": srv.Addr, "task": "debug endpoints"})
+		}
+	}()
+
+	return srv
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// digestCheckInterval is how often the digest job looks for users who are due a digest. Each user is sent one every
+// digest-interval, counted from their last one, so they're spread out rather than all sent at the same time
+const digestCheckInterval = time.Hour
+
+// digestBatchSize is how many users are claimed at a time, and digestMaxMovies the most movies listed in a digest
+const (
+	digestBatchSize = 100
+	digestMaxMovies = 10
+)
+
+// unsubscribeTTL is how long the unsubscribe token in a digest email works for
+const unsubscribeTTL = 90 * 24 * time.Hour
+
+// digestMetrics publishes how many digests have been sent, and how many were skipped because there were no new
+// movies in the user's favorite genres
+var digestMetrics = expvar.NewMap("digests")
+
+// startDigestSender launches a background goroutine which sends the weekly digest emails. A digest interval of zero
+// disables the digests. It returns a function which stops the goroutine, waiting for a run which is under way to
+// finish, and which should be called during shutdown
+func (app *application) startDigestSender() func() {
+	if app.config.digest.interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(digestCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := app.sendDigests(done)
+				if err != nil {
+					app.loggers.mailer.PrintError(err, map[string]string{"task": "send digests"})
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// sendDigests queues a digest email for every user who is due one, a batch at a time, until there are none left or
+// the sender is stopped
+func (app *application) sendDigests(done <-chan struct{}) error {
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+
+		recipients, err := app.models.Users.ClaimDigests(app.config.digest.interval, digestBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, recipient := range recipients {
+			err := app.sendDigest(recipient)
+			if err != nil {
+				app.loggers.mailer.PrintError(err, map[string]string{
+					"task":    "send digest",
+					"user_id": strconv.FormatInt(recipient.UserID, 10),
+				})
+			}
+		}
+
+		if len(recipients) < digestBatchSize {
+			return nil
+		}
+	}
+}
+
+// sendDigest queues a digest email listing the movies added in the last digest interval in the recipient's favorite
+// genres, along with a token for unsubscribing. Nothing is sent if there are no such movies
+func (app *application) sendDigest(recipient *data.DigestRecipient) error {
+	since := time.Now().Add(-app.config.digest.interval)
+
+	movies, err := app.models.Movies.GetAddedSince(since, recipient.FavoriteGenres, digestMaxMovies)
+	if err != nil {
+		return err
+	}
+
+	if len(movies) == 0 {
+		digestMetrics.Add("skipped", 1)
+		return nil
+	}
+
+	token, err := app.models.Tokens.New(recipient.UserID, unsubscribeTTL, data.ScopeUnsubscribe)
+	if err != nil {
+		return err
+	}
+
+	// The template data is stored with the queued email as JSON, so the movies are passed as plain values. The year
+	// is left out when it isn't known, as a JSON number of 0 would still count as set in the template
+	list := make([]map[string]interface{}, len(movies))
+	for i, movie := range movies {
+		list[i] = map[string]interface{}{
+			"title":  movie.Title,
+			"genres": strings.Join(movie.Genres, ", "),
+		}
+
+		if movie.Year != 0 {
+			list[i]["year"] = movie.Year
+		}
+	}
+
+	err = app.sendEmail(recipient.Email, "digest.tmpl", map[string]interface{}{
+		"userName":         recipient.Name,
+		"movies":           list,
+		"unsubscribeToken": token.Plaintext,
+	})
+	if err != nil {
+		return err
+	}
+
+	digestMetrics.Add("sent", 1)
+
+	return nil
+}
+
+// unsubscribeHandler for the "POST /v1/digest/unsubscribe" endpoint, which opts a user out of the digest with the
+// unsubscribe token from one of their digest emails. This works without logging in, so that the token on its own is
+// enough. Unsubscribing again with the same token succeeds too
+func (app *application) unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userID, err := app.requestModels(r).Tokens.Use(data.ScopeUnsubscribe, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired unsubscribe token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.requestModels(r).Users.Unsubscribe(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been unsubscribed from the weekly digest"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/mailer"
+	"github.com/eazylaykzy/greenlight/internal/prom"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// emailLease is how long a worker has to send an email it has claimed before another worker can claim it again. It's
+// well over the time the mailer can take, with its own retries and timeouts
+const emailLease = 5 * time.Minute
+
+// maxEmailRetryBackoff is the longest time an email waits between attempts
+const maxEmailRetryBackoff = time.Hour
+
+// emailQueueMetrics publishes how many emails have been queued, sent, retried and given up on, alongside the other
+// metrics under the "/debug/vars" endpoint
+var emailQueueMetrics = expvar.NewMap("email_queue")
+
+// The Prometheus metrics for attempts to send emails, served from the "/metrics" endpoint
+var (
+	emailSendAttempts = prom.NewCounter("greenlight_email_send_attempts_total",
+		"Attempts to send an email, by provider, template and outcome.", "provider", "template", "outcome")
+	emailSendDuration = prom.NewHistogram("greenlight_email_send_duration_seconds",
+		"How long attempts to send an email took, by provider and outcome.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "provider", "outcome")
+)
+
+// sendEmail queues an email to be sent by the email workers. The email is stored in the database, so it isn't lost if
+// the process stops or the SMTP server is down, and it's retried with backoff until it's sent or runs out of attempts.
+// It's rendered from its template straight away and stored rendered, so that the template data, which can hold
+// tokens, isn't kept in the database, and the attachments are read to be stored along with it
+func (app *application) sendEmail(recipient, templateFile string, templateData map[string]interface{}, attachments ...mailer.Attachment) error {
+	msg, err := app.mailer.Render(recipient, templateFile, templateData, attachments...)
+	if err != nil {
+		return err
+	}
+
+	email := &data.Email{
+		Recipient: recipient,
+		Template:  templateFile,
+		Message: &data.EmailMessage{
+			Subject:   msg.Subject,
+			PlainBody: msg.PlainBody,
+			HTMLBody:  msg.HTMLBody,
+		},
+	}
+
+	for _, a := range msg.Attachments {
+		email.Attachments = append(email.Attachments, data.EmailAttachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Content:     a.Data,
+		})
+	}
+
+	err = app.models.Emails.Insert(email)
+	if err != nil {
+		return err
+	}
+
+	emailQueueMetrics.Add("queued", 1)
+	app.mailer.Queued(recipient, templateFile)
+	app.wakeEmailWorker()
+
+	return nil
+}
+
+// wakeEmailWorker wakes up a waiting email worker to send a newly queued email, rather than leaving it until the next
+// poll. If a wake-up is already pending it does nothing, as the worker sends every email which is due
+func (app *application) wakeEmailWorker() {
+	select {
+	case app.emailWake <- struct{}{}:
+	default:
+	}
+}
+
+// startEmailWorkers launches the workers which send the queued emails. Each one sends emails until none are due, and
+// then waits to be woken by a new email or for the poll interval, which picks up the retries and any emails queued
+// by other instances. It returns a function which stops the workers, waiting for the emails they're sending, and
+// which should be called during shutdown
+func (app *application) startEmailWorkers() func() {
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < app.config.emails.workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			ticker := time.NewTicker(app.config.emails.pollInterval)
+			defer ticker.Stop()
+
+			for {
+				app.sendQueuedEmails(done)
+
+				select {
+				case <-app.emailWake:
+				case <-ticker.C:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// sendQueuedEmails claims and sends emails one at a time until none are due, or until the workers are stopped
+func (app *application) sendQueuedEmails(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		email, err := app.models.Emails.Claim(emailLease)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.loggers.mailer.PrintError(err, map[string]string{"task": "claim email"})
+			}
+			return
+		}
+
+		app.deliverEmail(email)
+	}
+}
+
+// deliverEmail sends a claimed email. If it can't be sent, it's put back in the queue to be retried after an
+// exponential backoff, or marked as dead once it has used up all of its attempts
+func (app *application) deliverEmail(email *data.Email) {
+	attachments := make([]mailer.Attachment, 0, len(email.Attachments))
+	for _, a := range email.Attachments {
+		attachments = append(attachments, mailer.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Data:        a.Content,
+		})
+	}
+
+	start := time.Now()
+
+	var sendErr error
+	if email.Message != nil {
+		sendErr = app.mailer.SendMessage(email.Template, &mailer.Message{
+			To:          email.Recipient,
+			Subject:     email.Message.Subject,
+			PlainBody:   email.Message.PlainBody,
+			HTMLBody:    email.Message.HTMLBody,
+			Attachments: attachments,
+		})
+	} else {
+		sendErr = app.mailer.Send(email.Recipient, email.Template, email.Data, attachments...)
+	}
+
+	elapsed := time.Since(start)
+
+	if sendErr == nil {
+		emailQueueMetrics.Add("sent", 1)
+		app.recordEmailDelivery(email, data.EmailDeliverySent, elapsed, nil)
+
+		err := app.models.Emails.Delete(email.ID)
+		if err != nil {
+			app.loggers.mailer.PrintError(err, map[string]string{"email_id": strconv.FormatInt(email.ID, 10)})
+		}
+		return
+	}
+
+	properties := map[string]string{
+		"email_id": strconv.FormatInt(email.ID, 10),
+		"template": email.Template,
+		"attempts": strconv.Itoa(email.Attempts),
+	}
+
+	var err error
+
+	if email.Attempts >= app.config.emails.maxAttempts {
+		emailQueueMetrics.Add("dead", 1)
+		app.recordEmailDelivery(email, data.EmailDeliveryDead, elapsed, sendErr)
+		app.loggers.mailer.PrintError(sendErr, properties)
+
+		err = app.models.Emails.Kill(email.ID, sendErr.Error())
+	} else {
+		retryAt := time.Now().Add(emailRetryBackoff(app.config.emails.retryBackoff, email.Attempts))
+
+		emailQueueMetrics.Add("retried", 1)
+		app.recordEmailDelivery(email, data.EmailDeliveryRetried, elapsed, sendErr)
+		properties["error"] = sendErr.Error()
+		properties["retry_at"] = retryAt.UTC().Format(time.RFC3339)
+		app.loggers.mailer.PrintInfo("email not sent, will retry", properties)
+
+		err = app.models.Emails.Retry(email.ID, retryAt, sendErr.Error())
+	}
+	if err != nil {
+		app.loggers.mailer.PrintError(err, map[string]string{"email_id": strconv.FormatInt(email.ID, 10)})
+	}
+}
+
+// recordEmailDelivery records an attempt to send an email in the Prometheus metrics and in the email deliveries audit
+// log. A failure to write the audit log is only logged, as the email has already been dealt with
+func (app *application) recordEmailDelivery(email *data.Email, outcome string, elapsed time.Duration, sendErr error) {
+	provider := app.config.mail.provider
+
+	emailSendAttempts.Inc(provider, email.Template, outcome)
+	emailSendDuration.Observe(elapsed.Seconds(), provider, outcome)
+
+	delivery := &data.EmailDelivery{
+		EmailID:       email.ID,
+		Template:      email.Template,
+		RecipientHash: data.HashRecipient(email.Recipient),
+		Provider:      provider,
+		Attempt:       email.Attempts,
+		DurationMS:    elapsed.Milliseconds(),
+		Outcome:       outcome,
+	}
+
+	if sendErr != nil {
+		delivery.Error = sendErr.Error()
+	}
+
+	err := app.models.Deliveries.Insert(delivery)
+	if err != nil {
+		app.loggers.models.PrintError(err, map[string]string{"email_id": strconv.FormatInt(email.ID, 10)})
+	}
+}
+
+// emailRetryBackoff returns how long to wait before the next attempt to send an email, which doubles after each
+// failed attempt, up to maxEmailRetryBackoff
+func emailRetryBackoff(base time.Duration, attempts int) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < maxEmailRetryBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxEmailRetryBackoff {
+		backoff = maxEmailRetryBackoff
+	}
+
+	return backoff
+}
+
+// listEmailsHandler for the "GET /v1/emails" endpoint, which lists the emails in the outgoing queue. The status query
+// string parameter limits the list to pending, sending or dead emails, and defaults to the dead ones
+func (app *application) listEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", data.EmailStatusDead)
+	v.Check(validator.In(input.Status, data.EmailStatusPending, data.EmailStatusSending, data.EmailStatusDead),
+		"status", "must be one of pending, sending or dead")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{"created_at", "-created_at", "next_attempt_at", "-next_attempt_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	emails, metadata, err := app.requestModels(r).Emails.GetAll(input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"emails": emails, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listEmailDeliveriesHandler for the "GET /v1/emails/deliveries" endpoint, which lists the recorded attempts to send
+// emails, most recent first. The outcome query string parameter limits the list to sent, retried or dead attempts,
+// and defaults to "failed", which is both of the last two. The recipient parameter takes an email address, which is
+// hashed to find its deliveries
+func (app *application) listEmailDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Outcome   string
+		Template  string
+		Recipient string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Outcome = app.readString(qs, "outcome", "failed")
+	v.Check(validator.In(input.Outcome, "failed", data.EmailDeliverySent, data.EmailDeliveryRetried,
+		data.EmailDeliveryDead), "outcome", "must be one of failed, sent, retried or dead")
+
+	input.Template = app.readString(qs, "template", "")
+	input.Recipient = app.readString(qs, "recipient", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{"created_at", "-created_at", "duration_ms", "-duration_ms"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	outcomes := []string{input.Outcome}
+	if input.Outcome == "failed" {
+		outcomes = []string{data.EmailDeliveryRetried, data.EmailDeliveryDead}
+	}
+
+	var recipientHash string
+	if input.Recipient != "" {
+		recipientHash = data.HashRecipient(input.Recipient)
+	}
+
+	deliveries, metadata, err := app.requestModels(r).Deliveries.GetAll(outcomes, input.Template, recipientHash, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
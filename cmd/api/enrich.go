@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/enrich"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+// lookupMetadata fetches a movie's metadata from the external provider. The timeout allows for waiting behind the
+// outbound rate limiter as well as for the request itself
+func (app *application) lookupMetadata(movie *data.Movie) (*enrich.Metadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	return app.enricher.Lookup(ctx, movie.Title, movie.Year)
+}
+
+// applyMetadata fills in any of the movie's details which are missing from the metadata, and reports whether anything
+// was changed. Details which the movie already has are never overwritten. A poster is only added when the movie
+// doesn't have one, and is linked to at the provider rather than copied into our own storage
+func applyMetadata(movie *data.Movie, metadata *enrich.Metadata) bool {
+	changed := false
+
+	if movie.Description == "" && metadata.Description != "" {
+		movie.Description = metadata.Description
+		changed = true
+	}
+
+	if movie.Year == 0 && metadata.Year != 0 {
+		movie.Year = metadata.Year
+		changed = true
+	}
+
+	if movie.Runtime == 0 && metadata.Runtime != 0 {
+		movie.Runtime = data.Runtime(metadata.Runtime)
+		changed = true
+	}
+
+	if len(movie.Genres) == 0 && len(metadata.Genres) > 0 {
+		movie.Genres = metadata.Genres
+		if len(movie.Genres) > 5 {
+			movie.Genres = movie.Genres[:5]
+		}
+		changed = true
+	}
+
+	if movie.PosterURL == "" && metadata.PosterURL != "" {
+		movie.PosterURL = metadata.PosterURL
+		changed = true
+	}
+
+	return changed
+}
+
+// enrichMovieHandler for the "POST /v1/movies/:id/enrich" endpoint. This fills in the movie's missing details from
+// the external metadata provider, and responds with the movie whether or not anything was changed
+func (app *application) enrichMovieHandler(w http.ResponseWriter, r *http.Request) {
+	if app.enricher == nil {
+		app.enrichmentUnavailableResponse(w, r)
+		return
+	}
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.requestModels(r).ForcePrimary().Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	metadata, err := app.lookupMetadata(movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, enrich.ErrNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "the metadata provider has no matching movie")
+		default:
+			app.badGatewayResponse(w, r, err)
+		}
+		return
+	}
+
+	poster := movie.PosterURL
+
+	if applyMetadata(movie, metadata) {
+		// The provider's data is validated like any other update. Update doesn't touch the poster columns, so a new
+		// poster is saved separately with UpdatePoster
+		v := validator.New()
+
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		err = app.requestModels(r).Movies.Update(movie)
+		if err == nil && movie.PosterURL != poster {
+			err = app.requestModels(r).Movies.UpdatePoster(movie)
+		}
+
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
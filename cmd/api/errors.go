@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"math"
 	"net/http"
+	"strconv"
 )
 
 // logError method is a generic helper for logging an error message. Later this will be upgraded to use
@@ -10,10 +15,18 @@ import (
 func (app *application) logError(r *http.Request, err error) {
 	// Use the PrintError method to log the error message, and include the current
 	// request method and URL as properties in the log entry
-	app.logger.PrintError(err, map[string]string{
+	properties := map[string]string{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
-	})
+		"client_ip":      app.clientIP(r),
+	}
+
+	// If an administrator is acting as another user, record who they really are
+	if impersonation := app.contextGetImpersonation(r); impersonation != nil {
+		properties["impersonator_id"] = strconv.FormatInt(impersonation.ImpersonatorID, 10)
+	}
+
+	app.logger.PrintError(err, app.logProperties(r, properties))
 }
 
 // rateLimitExceededResponse is evoked when there's too many request from the client than the server permits
@@ -28,17 +41,44 @@ func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
 
-// badRequestResponse for sending a 400 server response code and error back to the client
+// badRequestResponse for sending a 400 server response code and error back to the client. A request body which is
+// too large is sent as a 413 Payload Too Large instead, so that handlers don't need to check for it themselves
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *bodyTooLargeError
+	if errors.As(err, &tooLarge) {
+		app.bodyTooLargeResponse(w, r, tooLarge.limit)
+		return
+	}
+
 	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
 }
 
+// bodyTooLargeError is returned by readJSON when the request body is larger than the route accepts
+type bodyTooLargeError struct {
+	limit int64
+}
+
+func (e *bodyTooLargeError) Error() string {
+	return fmt.Sprintf("body must not be larger than %d bytes", e.limit)
+}
+
+// bodyTooLargeResponse for sending a 413 Payload Too Large response when the request body is larger than the route
+// accepts, with the limit in the message
+func (app *application) bodyTooLargeResponse(w http.ResponseWriter, r *http.Request, limit int64) {
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("body must not be larger than %d bytes", limit))
+}
+
 // errorResponse method is a generic helper for sending JSON-formatted error messages to the client with a given status
 // code. Note the use of interface{} type for the message parameter, rather than just a string type, as this gives us
 // more flexibility over the values that we can include in the response
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	env := envelope{"error": message}
 
+	// Include the request ID, so that it can be quoted when reporting the error
+	if id := app.contextGetRequestID(r); id != "" {
+		env["request_id"] = id
+	}
+
 	// Write the response using the writeJSON() helper. If this happens to return an error then log it, and fall back
 	// to sending the client an empty response with a 500 Internal Server Error status code.
 	err := app.writeJSON(w, status, env, nil)
@@ -59,6 +99,17 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 // the detailed error message, then uses the errorResponse helper to send a 500 Internal Server Error status code and
 // JSON response (containing a generic error message) to the client
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// A query turned away by the database circuit breaker isn't logged, as the breaker logs when it opens
+	if errors.Is(err, data.ErrCircuitOpen) {
+		app.databaseUnavailableResponse(w, r)
+		return
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) && errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		app.requestTimeoutResponse(w, r, err)
+		return
+	}
+
 	app.logError(r, err)
 	message := "the server encountered a problem and could not process your request"
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
@@ -84,12 +135,22 @@ func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *htt
 
 // invalidAuthenticationTokenResponse method will be used to send a 401 Unauthorized status code and JSON response to the client
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	// Invalid credentials count against the IP address's rate limit, so they can't be guessed at without limit
+	app.authFailed(r)
+
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authentication token"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+// invalidDeviceTokenResponse method will be used to send a 401 Unauthorized status code and JSON response to the
+// client when a remember-me device token is invalid, has expired, or was sent with the wrong device identifier
+func (app *application) invalidDeviceTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired device token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 // authenticationRequiredResponse method will be used to send a 401 Unauthorized status code and JSON response to the client
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
@@ -107,3 +168,148 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// ipBlockedResponse method will be used to send a 403 Forbidden status code and JSON response to the client when
+// requests from its IP address aren't allowed
+func (app *application) ipBlockedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "requests from your IP address are not allowed"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// invalidAPIKeyResponse method will be used to send a 401 Unauthorized status code and JSON response to the client
+// when the API key in the Authorization header isn't valid
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	// Invalid credentials count against the IP address's rate limit, so they can't be guessed at without limit
+	app.authFailed(r)
+
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// apiKeyScopeResponse method will be used to send a 403 Forbidden status code and JSON response to the client when
+// the API key that the request was made with doesn't have the scope needed for the resource
+func (app *application) apiKeyScopeResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your API key doesn't have the necessary scope to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// userSessionRequiredResponse method will be used to send a 403 Forbidden status code and JSON response to the
+// client when a resource which manages the user's account is requested with an API key
+func (app *application) userSessionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// invalidDownloadLinkResponse method will be used to send a 404 Not Found status code and JSON response to the client
+// when a data export download link is forged, has expired, or is for an archive which is no longer available
+func (app *application) invalidDownloadLinkResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this download link is invalid or has expired"
+	app.errorResponse(w, r, http.StatusNotFound, message)
+}
+
+// impersonationNotAllowedResponse method will be used to send a 403 Forbidden status code and JSON response to the
+// client when a resource which manages the user's account is requested by an administrator impersonating the user
+func (app *application) impersonationNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed while impersonating another user"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// unsupportedMediaTypeResponse method will be used to send a 415 Unsupported Media Type status code and JSON response
+// to the client
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("the %q content type is not supported for this resource", r.Header.Get("Content-Type"))
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
+// duplicateMovieResponse method will be used to send a 409 Conflict status code and JSON response to the client, with
+// a link to the existing movie that the new one duplicates
+func (app *application) duplicateMovieResponse(w http.ResponseWriter, r *http.Request, existingID int64) {
+	message := map[string]string{
+		"message":        "a movie with this title and year already exists, send allow_duplicate=true to create it anyway",
+		"existing_movie": fmt.Sprintf("/v1/movies/%d", existingID),
+	}
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// enrichmentUnavailableResponse method will be used to send a 503 Service Unavailable status code and JSON response to
+// the client when no metadata provider has been configured
+func (app *application) enrichmentUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "movie metadata enrichment is not configured on this server"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// singleSignOnUnavailableResponse method will be used to send a 503 Service Unavailable status code and JSON response
+// to the client when no OpenID Connect provider has been configured
+func (app *application) singleSignOnUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "single sign-on is not configured on this server"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// maintenanceResponse method will be used to send a 503 Service Unavailable status code and JSON response to the
+// client while the server is down for maintenance, with a Retry-After header saying when to try again
+func (app *application) maintenanceResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(app.config.maintenance.retryAfter.Seconds())))
+
+	message := "the server is down for maintenance, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// overloadedResponse method will be used to send a 503 Service Unavailable status code and JSON response to the
+// client when too many requests are being handled, see limitConcurrency, with a Retry-After header asking it to wait
+// a second
+func (app *application) overloadedResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+
+	message := "the server is too busy to process your request, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// databaseUnavailableResponse method will be used to send a 503 Service Unavailable status code and JSON response to
+// the client while the database circuit breaker is open, with a Retry-After header saying when it will next be tried
+func (app *application) databaseUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	retryAfter := app.config.db.breaker.cooldown
+	if app.dbBreaker != nil && app.dbBreaker.RetryAfter() > 0 {
+		retryAfter = app.dbBreaker.RetryAfter()
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	message := "the database is unavailable, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// requestTimeoutResponse method will be used when the request's deadline passed before the handler could finish,
+// see the requestDeadline middleware. It logs the error and sends a 503 Service Unavailable status code and JSON
+// response to the client
+func (app *application) requestTimeoutResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logError(r, err)
+	message := "the server took too long to process your request, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// badGatewayResponse method will be used when an external service that we depend on fails. It logs the error and
+// sends a 502 Bad Gateway status code and JSON response to the client
+func (app *application) badGatewayResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logError(r, err)
+	message := "an external service failed to process the request, please try again later"
+	app.errorResponse(w, r, http.StatusBadGateway, message)
+}
+
+// preconditionFailedResponse method will be used to send a 412 Precondition Failed status code and JSON response to
+// the client when an If-Match header doesn't match the current version of the resource
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource has been modified since the version given in the If-Match header"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+// twoFactorRequiredResponse method will be used to send a 401 Unauthorized status code and JSON response to the client
+// when the user's password is correct, but they also need to provide a two-factor authentication code
+func (app *application) twoFactorRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := map[string]interface{}{
+		"message":             "a two-factor authentication code is required, send it as totp_code or send a recovery_code",
+		"two_factor_required": true,
+	}
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// movieETag returns a strong ETag for a representation of a movie, in the format "<version>-<hash>". The version
+// identifies the edit of the movie that the representation came from, and is what If-Match preconditions are checked
+// against. The hash covers the representation itself, because some of what we send for a movie (such as the average
+// rating, or a sparse fieldset) can differ without the version changing
+func movieETag(version int32, representation interface{}) (string, error) {
+	js, err := json.Marshal(representation)
+	if err != nil {
+		return "", err
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write(js)
+
+	return fmt.Sprintf(`"%d-%x"`, version, h.Sum64()), nil
+}
+
+// etagList splits the value of an If-Match or If-None-Match header into its entity tags
+func etagList(header string) []string {
+	var etags []string
+
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.TrimSpace(etag)
+		if etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+
+	return etags
+}
+
+// encodedETag returns the strong ETag for a representation which has been compressed with the given content coding.
+// The coding is added to the opaque part of the tag, so each encoding of a representation has its own strong ETag, as
+// RFC 9110 requires for representations whose bytes differ
+func encodedETag(etag, encoding string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// unencodedETag removes the weak indicator and any content coding added by encodedETag from an entity tag, leaving
+// the ETag of the uncompressed representation
+func unencodedETag(etag string) string {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if strings.HasSuffix(etag, "-"+encoding+`"`) {
+			return strings.TrimSuffix(etag, "-"+encoding+`"`) + `"`
+		}
+	}
+
+	return etag
+}
+
+// ifNoneMatch reports whether the request has an If-None-Match header which matches the current ETag, in which case
+// the client's cached copy is still fresh and a 304 Not Modified response should be sent. It uses the weak comparison
+// of RFC 9110 section 13.1.2, and an ETag for a compressed copy of the representation also matches
+func ifNoneMatch(r *http.Request, etag string) bool {
+	for _, candidate := range etagList(r.Header.Get("If-None-Match")) {
+		if candidate == "*" || unencodedETag(candidate) == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ifMatch reports whether the request's If-Match precondition (if it has one) holds for the current version of a
+// movie. RFC 9110 section 13.1.1 requires the strong comparison, so a weak ETag never matches. Past that, only the
+// version part of each strong ETag is compared: a movie's representations differ in ways that don't change the movie
+// (such as the average rating, a sparse fieldset or the content coding), and an ETag for any of them shows that the
+// client has seen the current version, which is all that's needed to prevent a lost update. Requests without an
+// If-Match header always pass
+func ifMatch(r *http.Request, version int32) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	for _, candidate := range etagList(header) {
+		if candidate == "*" {
+			return true
+		}
+
+		if !strings.HasPrefix(candidate, `"`) {
+			continue
+		}
+
+		v := strings.SplitN(strings.Trim(candidate, `"`), "-", 2)[0]
+		if n, err := strconv.ParseInt(v, 10, 32); err == nil && int32(n) == version {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// exportFlushInterval is the number of movies written between each flush of the response, so that the client starts
+// receiving data straight away rather than when the server's buffers happen to fill up
+const exportFlushInterval = 500
+
+// exportMoviesHandler for the "GET /v1/movies/export" endpoint. This streams the whole catalog (optionally filtered
+// by title and genres, in the same way as listMoviesHandler) as either CSV or newline-delimited JSON. The response has
+// no Content-Length, so Go sends it using chunked transfer encoding
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title  string
+		Genres []string
+		Format string
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Title = app.readString(qs, "title", "")
+	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.Format = app.readString(qs, "format", "ndjson")
+
+	v.Check(validator.In(input.Format, "csv", "ndjson"), "format", "must be csv or ndjson")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// write is called once for every movie in the export, and flush pushes anything buffered by write out to the client
+	var (
+		write func(movie *data.Movie) error
+		flush func() error
+	)
+
+	switch input.Format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="movies.csv"`)
+
+		// The columns are compatible with the "POST /v1/movies/import" endpoint, which ignores the ones it doesn't need.
+		// Note that csv.Writer does its own buffering, so it doesn't need wrapping in a bufio.Writer
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"id", "title", "description", "year", "runtime", "genres", "average_rating", "ratings_count", "poster_url", "version"})
+
+		write = func(movie *data.Movie) error {
+			return cw.Write([]string{
+				strconv.FormatInt(movie.ID, 10),
+				movie.Title,
+				movie.Description,
+				strconv.FormatInt(int64(movie.Year), 10),
+				strconv.FormatInt(int64(movie.Runtime), 10),
+				strings.Join(movie.Genres, ","),
+				strconv.FormatFloat(movie.AverageRating, 'f', 2, 64),
+				strconv.FormatInt(int64(movie.RatingsCount), 10),
+				movie.PosterURL,
+				strconv.FormatInt(int64(movie.Version), 10),
+			})
+		}
+
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="movies.ndjson"`)
+
+		buf := bufio.NewWriter(w)
+		enc := json.NewEncoder(buf)
+
+		write = func(movie *data.Movie) error {
+			return enc.Encode(movie)
+		}
+
+		flush = buf.Flush
+	}
+
+	flusher, _ := w.(http.Flusher)
+
+	w.WriteHeader(http.StatusOK)
+
+	count := 0
+
+	err := app.requestModels(r).Movies.Export(input.Title, input.Genres, func(movie *data.Movie) error {
+		err := write(movie)
+		if err != nil {
+			return err
+		}
+
+		count++
+		if count%exportFlushInterval == 0 {
+			err = flush()
+			if err != nil {
+				return err
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		return nil
+	})
+
+	// Once the status code and some of the body have been sent, there is no way to report an error to the client
+	// other than cutting the response short. So we just log the error here, and the client will see a truncated export
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	err = flush()
+	if err != nil {
+		app.logError(r, err)
+	}
+}
@@ -1,18 +1,114 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"sync"
+	"time"
 )
 
-// Declare a handler which writes a plain-text response with information about the
-// application status, operating environment and version.
+// startTime is when the process started, which the healthcheck reports the uptime from
+var startTime = time.Now()
+
+// healthcheckTimeout is how long the healthcheck waits for each dependency to answer before reporting it as down
+const healthcheckTimeout = 2 * time.Second
+
+// dependencyStatus is the state of one of the services the API depends on, as reported by the healthcheck
+type dependencyStatus struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// CircuitBreaker is the state of the database's circuit breaker, when it has one
+	CircuitBreaker string `json:"circuit_breaker,omitempty"`
+}
+
+// checkDependency runs check with the healthcheck timeout, and returns the dependency's status with how long the check
+// took, along with the check's error
+func checkDependency(ctx context.Context, check func(ctx context.Context) error) (dependencyStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, healthcheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	latency := time.Since(start).Round(time.Microsecond).String()
+
+	if err != nil {
+		return dependencyStatus{Status: "down", Latency: latency, Error: err.Error()}, err
+	}
+
+	return dependencyStatus{Status: "up", Latency: latency}, nil
+}
+
+// Declare a handler which writes a response with information about the application status, operating environment,
+// version and uptime, and the status of each service it depends on: the database, the SMTP server when emails are
+// sent with SMTP, and Redis when it's the cache backend. The dependencies are checked at the same time
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		mu           sync.Mutex
+		wg           sync.WaitGroup
+		dependencies = make(map[string]dependencyStatus)
+	)
+
+	check := func(name string, fn func(ctx context.Context) error) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			status, err := checkDependency(r.Context(), fn)
+
+			// A dependency which can't be checked, such as an email provider with an HTTP API, isn't reported
+			if errors.Is(err, errors.ErrUnsupported) {
+				return
+			}
+
+			mu.Lock()
+			dependencies[name] = status
+			mu.Unlock()
+		}()
+	}
+
+	check("database", app.models.Ping)
+	check("smtp", app.mailer.Ping)
+
+	if c, ok := app.cache.(interface{ Ping() error }); ok {
+		check("cache", func(context.Context) error { return c.Ping() })
+	}
+
+	wg.Wait()
+
+	// The circuit breaker's state is reported with the database, as requests are turned away while it's open
+	if app.dbBreaker != nil {
+		database := dependencies["database"]
+		database.CircuitBreaker = app.dbBreaker.State().String()
+		dependencies["database"] = database
+	}
+
+	// The healthcheck is still served in maintenance mode, but reports it, so that it's easy to see which servers are
+	// being drained. It's also served while a dependency is down, as restarting the server won't bring it back, but
+	// it's reported as degraded
+	status := "available"
+	for _, dependency := range dependencies {
+		if dependency.Status != "up" {
+			status = "degraded"
+		}
+	}
+
+	if len(app.maintenanceSources()) > 0 {
+		status = "maintenance"
+	}
+
 	env := envelope{
-		"status": "available",
+		"status": status,
 		"system_info": map[string]string{
 			"environment": app.config.env,
 			"version":     version,
+			"build_time":  buildTime,
+			"uptime":      time.Since(startTime).Round(time.Second).String(),
 		},
+		"dependencies": dependencies,
 	}
 
 	err := app.writeJSON(w, http.StatusOK, env, nil)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -17,11 +19,16 @@ import (
 // Retrieve the "id" URL parameter from the current request context, then convert it to
 // an integer and return it. If the operation isn't successful, return 0 and an error.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readNamedIDParam(r, "id")
+}
+
+// readNamedIDParam works like readIDParam, but for routes where the ID URL parameter has a different name
+func (app *application) readNamedIDParam(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 
 	return id, nil
@@ -33,6 +40,16 @@ type envelope map[string]interface{}
 // writeJSON helper for sending responses. This takes the destination http.ResponseWriter, the HTTP status code to send,
 // the data to encode to JSON, and a header map containing any additional HTTP headers we want to include in the response
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
+	// If an administrator is impersonating the user, add the impersonation banner to the response. The envelope is
+	// copied so that the caller's map isn't changed
+	if iw := impersonationWriter(w); iw != nil {
+		withBanner := envelope{"impersonation": iw.banner}
+		for key, value := range data {
+			withBanner[key] = value
+		}
+		data = withBanner
+	}
+
 	// Encode the data to JSON, returning the error if there was one
 	js, err := json.MarshalIndent(data, "", "\t")
 	if err != nil {
@@ -58,14 +75,36 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 }
 
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
-	// Use http.MaxBytesReader() to limit the size of the request body to 1MB.
-	maxBytes := 1_048_576
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	// Use http.MaxBytesReader() to limit the size of the request body to the route's limit. A body which says up front
+	// that it's too large is turned away without reading any of it
+	maxBytes := app.bodyLimit(r)
+	if r.ContentLength > maxBytes {
+		return &bodyTooLargeError{limit: maxBytes}
+	}
 
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+	return app.decodeJSON(r.Body, dst, maxBytes)
+}
+
+// bodyLimit returns the largest request body accepted by the route, which is the body-max-size setting unless the
+// route has its own limit from the maxBodySize middleware
+func (app *application) bodyLimit(r *http.Request) int64 {
+	if limit := app.contextGetBodyLimit(r); limit > 0 {
+		return limit
+	}
+
+	return app.config.body.maxSize
+}
+
+// decodeJSON decodes a single JSON value from body into dst, translating any decoding errors into plain-english error
+// messages which are suitable for sending to the client. The maxBytes parameter is only used in the error message
+// for a body which has been cut short by http.MaxBytesReader
+func (app *application) decodeJSON(body io.Reader, dst interface{}, maxBytes int64) error {
 	// Initialize the json.Decoder, and call the DisallowUnknownFields method on it before decoding. This means that if
 	// the JSON from the client now includes any field which cannot be mapped to the target destination, the decoder
 	// will return an error instead of just ignoring the field
-	dec := json.NewDecoder(r.Body)
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields()
 
 	// Decode the request body into the target destination.
@@ -76,6 +115,7 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 			syntaxError           *json.SyntaxError
 			unmarshalTypeError    *json.UnmarshalTypeError
 			invalidUnmarshalError *json.InvalidUnmarshalError
+			maxBytesError         *http.MaxBytesError
 		)
 
 		switch {
@@ -112,10 +152,10 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
 			return fmt.Errorf("body contains unknown key %s", fieldName)
 
-		// If the request body exceeds 1MB in size JSON decode will fail with the error "http: request body too large".
-		// There is an open issue about turning this into a distinct error type at https://github.com/golang/go/issues/30715.
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		// If the request body exceeds the route's limit, JSON decode will fail with an *http.MaxBytesError. This is
+		// returned as a bodyTooLargeError, which badRequestResponse sends as a 413 Payload Too Large response
+		case errors.As(err, &maxBytesError):
+			return &bodyTooLargeError{limit: maxBytes}
 
 		// A json.InvalidUnmarshalError error will be returned if we pass a non-nil pointer to Decode. We catch this
 		// and panic, rather than returning an error to our handler
@@ -131,6 +171,77 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// readMergePatch reads an RFC 7396 JSON Merge Patch from the request body and applies it to the JSON representation
+// of current. The merged document is then decoded into dst, which should be a pointer to a new zero value of the same
+// type as current, so that any members removed by the patch end up as zero values. The patch object itself is also
+// returned, so that the caller can check which members the client sent
+func (app *application) readMergePatch(w http.ResponseWriter, r *http.Request, current, dst interface{}) (map[string]interface{}, error) {
+	var patch interface{}
+
+	err := app.readJSON(w, r, &patch)
+	if err != nil {
+		return nil, err
+	}
+
+	// A merge patch which isn't an object would replace the whole resource, which is never what we want
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("body must be a JSON object")
+	}
+
+	js, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+
+	var document interface{}
+
+	err = json.Unmarshal(js, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err = json.Marshal(mergePatch(document, patchObject))
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode the merged document in the same way as a request body, so that unknown keys and values of the wrong
+	// type produce the same error messages that the client would get from a regular JSON body
+	err = app.decodeJSON(bytes.NewReader(js), dst, int64(len(js)))
+	if err != nil {
+		return nil, err
+	}
+
+	return patchObject, nil
+}
+
+// mergePatch applies a JSON Merge Patch to a target document, following the algorithm in section 2 of RFC 7396. Both
+// the target and patch are expected to be the generic values produced by json.Unmarshal. A null member in the patch
+// removes the member from the target, objects are merged recursively, and any other value replaces the target's
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+
+		targetObject[name] = mergePatch(targetObject[name], value)
+	}
+
+	return targetObject
+}
+
 // readString helper returns a string value from the query string, or the provided
 // default value if no matching key could be found
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
@@ -161,6 +272,73 @@ func (app *application) readCSV(qs url.Values, key string, defaultValue []string
 	return strings.Split(csv, ",")
 }
 
+// The readFields helper reads a comma-separated list of field names from the query string, for use with
+// selectFields. If no key exists (or the value is empty) it returns nil, meaning all fields should be included. Any
+// field name which isn't in the safelist is recorded as an error in the provided Validator instance
+func (app *application) readFields(qs url.Values, key string, safelist []string, v *validator.Validator) []string {
+	fields := app.readCSV(qs, key, nil)
+
+	for _, field := range fields {
+		if !validator.In(field, safelist...) {
+			v.AddError(key, fmt.Sprintf("unknown field %q", field))
+			return nil
+		}
+	}
+
+	return fields
+}
+
+// selectFields returns a copy of value with only the given JSON fields, so that clients can ask for a sparse fieldset
+// rather than the whole resource. The value can be a struct or a slice of structs (or pointers to them), and is
+// round-tripped through JSON so that the field names match the ones the client sees. If fields is nil, value is
+// returned unchanged
+func selectFields(value interface{}, fields []string) (interface{}, error) {
+	if fields == nil {
+		return value, nil
+	}
+
+	js, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode numbers as json.Number, so that they're written back out exactly as they were
+	var decoded interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	err = dec.Decode(&decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	pick := func(object interface{}) interface{} {
+		m, ok := object.(map[string]interface{})
+		if !ok {
+			return object
+		}
+
+		picked := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			if v, ok := m[field]; ok {
+				picked[field] = v
+			}
+		}
+
+		return picked
+	}
+
+	if list, ok := decoded.([]interface{}); ok {
+		for i := range list {
+			list[i] = pick(list[i])
+		}
+		return list, nil
+	}
+
+	return pick(decoded), nil
+}
+
 // The readInt helper reads a string value from the query string and converts it to an integer before returning.
 // If no matching key could be found it returns the provided default value. If the value couldn't be converted to an
 // integer, then we record an error message in the provided Validator instance
@@ -185,20 +363,42 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-// background helper accepts an arbitrary function as a parameter.
-func (app *application) background(fn func()) {
-	// Increment the WaitGroup counter.
+// The readBool helper reads a string value from the query string and converts it to a bool before returning. If no
+// matching key could be found it returns the provided default value. If the value couldn't be converted to a bool,
+// then we record an error message in the provided Validator instance
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// background helper accepts an arbitrary function as a parameter, and runs it in a goroutine as a task with the name.
+func (app *application) background(name string, fn func()) {
+	// Increment the WaitGroup counter, and add the task to the running tasks under its name, so that it can be logged
+	// if it's still running when the server shuts down.
 	app.wg.Add(1)
+	finish := app.tasks.start(name)
 
 	// Launch a background goroutine.
 	go func() {
 		// Use defer to decrement the WaitGroup counter before the goroutine returns.
 		defer app.wg.Done()
+		defer finish()
 
 		// Recover any panic.
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+				app.logger.PrintError(fmt.Errorf("%s", err), map[string]string{"task": name})
 			}
 		}()
 
@@ -206,3 +406,27 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// humanDuration formats a duration for the emails we send, such as "3 days" or "36 hours". Whole numbers of days are
+// shown in days, other durations of an hour or more in whole hours, and anything shorter in whole minutes
+func humanDuration(d time.Duration) string {
+	var (
+		n    int64
+		unit string
+	)
+
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		n, unit = int64(d/(24*time.Hour)), "day"
+	case d >= time.Hour:
+		n, unit = int64(d/time.Hour), "hour"
+	default:
+		n, unit = int64(d/time.Minute), "minute"
+	}
+
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+
+	return fmt.Sprintf("%d %ss", n, unit)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/quic-go/quic-go/http3"
+	"net/http"
+)
+
+// altSvcMaxAge is how long, in seconds, clients can remember that the server speaks HTTP/3 (30 days)
+const altSvcMaxAge = 30 * 24 * 60 * 60
+
+// serveHTTP3 starts the experimental HTTP/3 server, which listens over QUIC on the UDP port with the same number as
+// the HTTPS server's TCP port, and handles requests with the same handler. Clients find out about it from the
+// Alt-Svc header, see advertiseHTTP3, and keep using HTTPS over TCP when UDP is blocked. It returns the server, so
+// that it can be closed with the main one, or nil if enable-http3 isn't set
+func (app *application) serveHTTP3(srv *http.Server) (*http3.Server, error) {
+	if !app.config.tls.http3 {
+		return nil, nil
+	}
+
+	// QUIC needs the certificate in the TLS config, rather than the files which ListenAndServeTLS loads
+	tlsConfig := srv.TLSConfig.Clone()
+
+	if app.config.tls.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(app.config.tls.certFile, app.config.tls.keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	h3 := &http3.Server{
+		Addr:      fmt.Sprintf(":%d", app.config.port),
+		Handler:   srv.Handler,
+		TLSConfig: tlsConfig,
+	}
+
+	go func() {
+		app.logger.PrintInfo("starting http/3 server", map[string]string{"addr": h3.Addr})
+
+		err := h3.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.logger.PrintError(err, map[string]string{"addr": h3.Addr, "task": "http/3"})
+		}
+	}()
+
+	return h3, nil
+}
+
+// advertiseHTTP3 middleware adds the Alt-Svc header to the responses to HTTPS requests when enable-http3 is set, which
+// tells clients that they can make their next requests with HTTP/3 on the same port
+func (app *application) advertiseHTTP3(next http.Handler) http.Handler {
+	if !app.config.tls.http3 {
+		return next
+	}
+
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=%d`, app.config.port, altSvcMaxAge)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
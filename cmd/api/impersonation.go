@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// impersonationBanner is added to every JSON response sent to an administrator who is impersonating a user, so that
+// it's always clear whose account is being used and by whom
+type impersonationBanner struct {
+	Message           string    `json:"message"`
+	UserID            int64     `json:"user_id"`
+	ImpersonatorID    int64     `json:"impersonator_id"`
+	ImpersonatorEmail string    `json:"impersonator_email"`
+	Expiry            time.Time `json:"expiry"`
+}
+
+func newImpersonationBanner(user *data.User, impersonation *data.Impersonation) impersonationBanner {
+	return impersonationBanner{
+		Message:           fmt.Sprintf("%s is impersonating %s", impersonation.ImpersonatorEmail, user.Email),
+		UserID:            user.ID,
+		ImpersonatorID:    impersonation.ImpersonatorID,
+		ImpersonatorEmail: impersonation.ImpersonatorEmail,
+		Expiry:            impersonation.Expiry,
+	}
+}
+
+// impersonationResponseWriter wraps the http.ResponseWriter for requests made by an administrator impersonating a
+// user. writeJSON looks for it to know when to add the banner to the response
+type impersonationResponseWriter struct {
+	http.ResponseWriter
+	banner impersonationBanner
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController
+func (iw *impersonationResponseWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+// impersonationWriter returns the impersonationResponseWriter that w is, or wraps, or nil if the request isn't being
+// made by an administrator impersonating a user. Middleware which wraps the writer again after the authenticate
+// middleware, such as the response cache, has to implement Unwrap for the banner to be found
+func impersonationWriter(w http.ResponseWriter) *impersonationResponseWriter {
+	for {
+		switch rw := w.(type) {
+		case *impersonationResponseWriter:
+			return rw
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// Flush passes flushes through to the wrapped http.ResponseWriter, so that streamed responses such as the movie
+// export still work while impersonating
+func (iw *impersonationResponseWriter) Flush() {
+	if flusher, ok := iw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// createImpersonationTokenHandler for the "POST /v1/users/:id/impersonation" endpoint. This mints a short-lived
+// authentication token which lets an administrator with the users:impersonate permission act as another user, for
+// example to see a problem the user has reported. The administrator is recorded against the token, in the log for
+// every request made with it and in the user's login events. Administrators can't impersonate users who have
+// permissions that they don't have themselves, as that would let them get around their own permissions
+func (app *application) createImpersonationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	admin := app.contextGetUser(r)
+
+	v := validator.New()
+
+	if v.Check(id != admin.ID, "id", "you can't impersonate yourself"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.requestModels(r).Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	adminPermissions, err := app.requestModels(r).Permissions.GetAllForUser(admin.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	userPermissions, err := app.requestModels(r).Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, code := range userPermissions {
+		if !adminPermissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
+	ip, userAgent := app.clientIP(r), r.UserAgent()
+
+	token, err := app.requestModels(r).Tokens.NewImpersonation(user.ID, admin.ID, app.config.tokens.impersonationTTL, ip,
+		userAgent)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("impersonation started", app.logProperties(r, map[string]string{
+		"impersonator_id": strconv.FormatInt(admin.ID, 10),
+		"user_id":         strconv.FormatInt(user.ID, 10),
+		"expiry":          token.Expiry.Format(time.RFC3339),
+	}))
+
+	event := &data.LoginEvent{
+		UserID:         &user.ID,
+		Email:          user.Email,
+		Method:         data.LoginMethodImpersonation,
+		Success:        true,
+		IP:             ip,
+		UserAgent:      userAgent,
+		ImpersonatorID: &admin.ID,
+	}
+
+	app.background("impersonation login event", func() {
+		err := app.models.LoginEvents.Insert(event)
+		if err != nil {
+			app.logger.PrintError(err, app.logProperties(r, nil))
+		}
+	})
+
+	banner := newImpersonationBanner(user, &data.Impersonation{
+		ImpersonatorID:    admin.ID,
+		ImpersonatorEmail: admin.Email,
+		Expiry:            token.Expiry,
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "impersonation": banner}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// importBatchSize is the number of movies sent to the database in each multi-row INSERT statement
+	importBatchSize = 500
+)
+
+// importResult holds the outcome for a single row of an import. Rows are numbered from 1, not counting the CSV header
+type importResult struct {
+	Row    int               `json:"row"`
+	ID     int64             `json:"id,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// importMoviesHandler for the "POST /v1/movies/import" endpoint. The request body is read as CSV if the Content-Type
+// is text/csv, or as newline-delimited JSON if it is application/x-ndjson. Every row is validated with ValidateMovie,
+// and the valid rows are inserted in a single transaction. The response reports the outcome for each row
+func (app *application) importMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		app.unsupportedMediaTypeResponse(w, r)
+		return
+	}
+
+	var parse func(body io.Reader, row func(movie *data.Movie, errs map[string]string)) error
+
+	switch mediaType {
+	case "text/csv":
+		parse = app.parseImportCSV
+	case "application/x-ndjson", "application/ndjson":
+		parse = app.parseImportNDJSON
+	default:
+		app.unsupportedMediaTypeResponse(w, r)
+		return
+	}
+
+	// The route has its own limit, see the body-import-max-size setting
+	maxBytes := app.bodyLimit(r)
+	if r.ContentLength > maxBytes {
+		app.bodyTooLargeResponse(w, r, maxBytes)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+	results := []*importResult{}
+	movies := []*data.Movie{}
+	accepted := []*importResult{}
+
+	// The body is read as a stream, one row at a time. Each row is validated straight away, and only the valid movies
+	// are kept around to be inserted once the whole body has been read
+	err = parse(r.Body, func(movie *data.Movie, errs map[string]string) {
+		result := &importResult{Row: len(results) + 1}
+		results = append(results, result)
+
+		if errs != nil {
+			result.Errors = errs
+			return
+		}
+
+		v := validator.New()
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			result.Errors = v.Errors
+			return
+		}
+
+		movies = append(movies, movie)
+		accepted = append(accepted, result)
+	})
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.bodyTooLargeResponse(w, r, maxBytes)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	if len(results) == 0 {
+		app.badRequestResponse(w, r, errors.New("body must contain at least one movie"))
+		return
+	}
+
+	err = app.requestModels(r).Movies.InsertMany(movies, importBatchSize)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for i, movie := range movies {
+		accepted[i].ID = movie.ID
+	}
+
+	env := envelope{
+		"imported": len(movies),
+		"failed":   len(results) - len(movies),
+		"results":  results,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// parseImportCSV reads movies from a CSV body. The first record must be a header naming the columns, of which title,
+// description, year, runtime and genres are recognised (in any order). The runtime may be given as "102" or "102 mins",
+// and the genres are separated by commas, so a movie with more than one genre needs that field quoting
+func (app *application) parseImportCSV(body io.Reader, row func(movie *data.Movie, errs map[string]string)) error {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	if _, ok := columns["title"]; !ok {
+		return errors.New("csv header must include a title column")
+	}
+
+	// field returns the value of the named column, or the empty string if there is no such column
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			var parseErr *csv.ParseError
+
+			switch {
+			case errors.Is(err, io.EOF):
+				return nil
+			case errors.As(err, &parseErr):
+				row(nil, map[string]string{"row": parseErr.Err.Error()})
+				continue
+			default:
+				return err
+			}
+		}
+
+		errs := make(map[string]string)
+		movie := &data.Movie{
+			Title:       field(record, "title"),
+			Description: field(record, "description"),
+			Genres:      []string{},
+		}
+
+		if s := field(record, "year"); s != "" {
+			year, err := strconv.ParseInt(s, 10, 32)
+			if err != nil {
+				errs["year"] = "must be an integer value"
+			}
+			movie.Year = int32(year)
+		}
+
+		if s := strings.TrimSuffix(field(record, "runtime"), " mins"); s != "" {
+			runtime, err := strconv.ParseInt(s, 10, 32)
+			if err != nil {
+				errs["runtime"] = "must be an integer number of minutes"
+			}
+			movie.Runtime = data.Runtime(runtime)
+		}
+
+		if s := field(record, "genres"); s != "" {
+			for _, genre := range strings.Split(s, ",") {
+				movie.Genres = append(movie.Genres, strings.TrimSpace(genre))
+			}
+		}
+
+		if len(errs) > 0 {
+			row(nil, errs)
+			continue
+		}
+
+		row(movie, nil)
+	}
+}
+
+// parseImportNDJSON reads movies from a newline-delimited JSON body. Each non-blank line must be a JSON object in the
+// same format as the body for the "POST /v1/movies" endpoint
+func (app *application) parseImportNDJSON(body io.Reader, row func(movie *data.Movie, errs map[string]string)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1_048_576)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var input struct {
+			Title       string       `json:"title"`
+			Description string       `json:"description"`
+			Year        int32        `json:"year"`
+			Runtime     data.Runtime `json:"runtime"`
+			Genres      []string     `json:"genres"`
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+
+		err := dec.Decode(&input)
+		if err != nil {
+			row(nil, map[string]string{"row": err.Error()})
+			continue
+		}
+
+		row(&data.Movie{
+			Title:       input.Title,
+			Description: input.Description,
+			Year:        input.Year,
+			Runtime:     input.Runtime,
+			Genres:      input.Genres,
+		}, nil)
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+)
+
+// createInvitationHandler for the "POST /v1/invitations" endpoint. This emails an invite code to someone so that they
+// can sign up, which is the only way to sign up when the server is running in invite-only mode. The code itself isn't
+// included in the response, so that it only ever reaches the person it was sent to
+func (app *application) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// There's no point inviting someone who already has an account
+	_, err = app.requestModels(r).Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	inviter := app.contextGetUser(r)
+
+	invitation, err := app.requestModels(r).Invitations.New(input.Email, inviter.ID, app.config.invitations.ttl)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background("invitation email", func() {
+		err := app.sendEmail(invitation.Email, "invitation.tmpl", map[string]interface{}{
+			"inviterName": inviter.Name,
+			"email":       invitation.Email,
+			"inviteCode":  invitation.Code,
+			"expiry":      humanDuration(app.config.invitations.ttl),
+		})
+		if err != nil {
+			app.loggers.mailer.PrintError(err, app.logProperties(r, nil))
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listInvitationsHandler for the "GET /v1/invitations" endpoint. The status query string parameter limits the list
+// to pending, used, revoked or expired invitations
+func (app *application) listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", "")
+	v.Check(input.Status == "" || validator.In(input.Status, data.InvitationStatusPending, data.InvitationStatusUsed,
+		data.InvitationStatusRevoked, data.InvitationStatusExpired), "status", "invalid status")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{"created_at", "email", "expiry", "-created_at", "-email", "-expiry"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	invitations, metadata, err := app.requestModels(r).Invitations.GetAll(input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"invitations": invitations, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeInvitationHandler for the "DELETE /v1/invitations/:id" endpoint. This stops a pending invitation from being
+// used. The invitation is kept, marked as revoked, so that there's still a record of it having been sent
+func (app *application) revokeInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.requestModels(r).Invitations.Revoke(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "invitation successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// consumeInvitation uses up the invitation that a new user is signing up with. The invite code is required when the
+// server is in invite-only mode, and if one is sent otherwise it's still used up so that the invitation shows as
+// used. It returns nil, with the problem added to the validator, if the invite code isn't valid
+func (app *application) consumeInvitation(r *http.Request, v *validator.Validator, code, email string) (*data.Invitation, error) {
+	if code == "" && !app.config.invitations.required {
+		return nil, nil
+	}
+
+	if data.ValidateInviteCode(v, code); !v.Valid() {
+		return nil, nil
+	}
+
+	invitation, err := app.requestModels(r).Invitations.Consume(code, email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("invite_code", "invalid or expired invitation")
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return invitation, nil
+}
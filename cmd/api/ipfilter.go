@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ipBlockList holds the networks which have been blocked with the "/v1/ip-blocks" endpoints, so that the ipFilter
+// middleware doesn't need to read them from the database for each request
+type ipBlockList struct {
+	mu       sync.RWMutex
+	networks []*net.IPNet
+}
+
+// set replaces the blocked networks
+func (l *ipBlockList) set(networks []*net.IPNet) {
+	l.mu.Lock()
+	l.networks = networks
+	l.mu.Unlock()
+}
+
+// contains reports whether ip is in one of the blocked networks
+func (l *ipBlockList) contains(ip net.IP) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return containsIP(l.networks, ip)
+}
+
+// containsIP reports whether ip is in one of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ipFilter middleware turns away requests from clients which aren't in the ip-allow networks, when there are any, or
+// which are in the ip-deny networks or a network blocked with the "/v1/ip-blocks" endpoints. It goes before the rate
+// limiter, so that blocked clients don't use up any of its memory
+func (app *application) ipFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := app.clientIP(r)
+		ip := net.ParseIP(clientIP)
+
+		allowed := ip != nil
+		if allowed && len(app.config.ipFilter.allow) > 0 {
+			allowed = containsIP(app.config.ipFilter.allow, ip)
+		}
+
+		if allowed {
+			allowed = !containsIP(app.config.ipFilter.deny, ip) && !app.ipBlocks.contains(ip)
+		}
+
+		if !allowed {
+			app.loggers.limiter.PrintDebug("ip address blocked", app.logProperties(r, map[string]string{
+				"client_ip": clientIP,
+			}))
+			app.ipBlockedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refreshIPBlocks reads the blocked networks from the database again
+func (app *application) refreshIPBlocks() error {
+	blocks, err := app.models.IPBlocks.GetActiveNetworks()
+	if err != nil {
+		return err
+	}
+
+	networks, err := parseNetworks(strings.Join(blocks, " "))
+	if err != nil {
+		return err
+	}
+
+	app.ipBlocks.set(networks)
+
+	return nil
+}
+
+// startIPBlockRefresher reads the blocked networks from the database, and launches a background goroutine which reads
+// them again at the configured interval, so that blocks made on other servers, and blocks which expire, take effect.
+// It returns a function which stops the goroutine, and which should be called during shutdown
+func (app *application) startIPBlockRefresher() func() {
+	if err := app.refreshIPBlocks(); err != nil {
+		app.loggers.models.PrintError(err, map[string]string{"task": "refresh ip blocks"})
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(app.config.ipFilter.refreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := app.refreshIPBlocks(); err != nil {
+					app.loggers.models.PrintError(err, map[string]string{"task": "refresh ip blocks"})
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// createIPBlockHandler for the "POST /v1/ip-blocks" endpoint, which blocks a network, such as the range that an abusive
+// client is sending requests from. The block is lifted after the duration, if one is given, and takes effect on this
+// server straight away, and on the others the next time they read the blocks from the database
+func (app *application) createIPBlockHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Network  string `json:"network"`
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	block := &data.IPBlock{
+		Network:   input.Network,
+		Reason:    input.Reason,
+		CreatedBy: &user.ID,
+	}
+
+	v := validator.New()
+
+	if input.Duration != "" {
+		duration, err := time.ParseDuration(input.Duration)
+		if v.Check(err == nil && duration > 0, "duration", `must be a positive duration, such as "24h"`); v.Valid() {
+			expiry := time.Now().Add(duration)
+			block.Expiry = &expiry
+		}
+	}
+
+	if data.ValidateIPBlock(v, block); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.requestModels(r).IPBlocks.Insert(block)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateIPBlock):
+			v.AddError("network", "this network is already blocked")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	if err = app.refreshIPBlocks(); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("blocked network", app.logProperties(r, map[string]string{
+		"network": block.Network,
+		"reason":  block.Reason,
+		"user_id": strconv.FormatInt(user.ID, 10),
+	}))
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/ip-blocks/%d", block.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"ip_block": block}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listIPBlocksHandler for the "GET /v1/ip-blocks" endpoint, which lists the networks which are blocked at the moment
+func (app *application) listIPBlocksHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{"created_at", "expiry", "-created_at", "-expiry"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	blocks, metadata, err := app.requestModels(r).IPBlocks.GetAll(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"ip_blocks": blocks, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteIPBlockHandler for the "DELETE /v1/ip-blocks/:id" endpoint, which lifts a block
+func (app *application) deleteIPBlockHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.requestModels(r).IPBlocks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	if err = app.refreshIPBlocks(); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("unblocked network", app.logProperties(r, map[string]string{
+		"ip_block_id": strconv.FormatInt(id, 10),
+		"user_id":     strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	}))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ip block successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/jsonlog"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// setLogLevel changes the minimum severity of the log entries which are written, while the server is running. The
+// live config is updated too, so that it shows the level in use, but the change only lasts until the config is next
+// reloaded, which sets the level from the log-level setting again
+func (app *application) setLogLevel(level jsonlog.Level) {
+	if app.reloader != nil {
+		app.reloader.mu.Lock()
+		defer app.reloader.mu.Unlock()
+	}
+
+	live := *app.liveConfig()
+	live.logLevel = strings.ToLower(level.String())
+
+	app.live.Store(&live)
+	app.logger.SetLevel(level)
+}
+
+// parseComponentLevels parses the log-component-levels setting, a space separated list of component=level pairs such
+// as "mailer=debug limiter=error", into the levels of the components which have their own
+func parseComponentLevels(s string) (map[string]jsonlog.Level, error) {
+	levels := make(map[string]jsonlog.Level)
+
+	for _, pair := range strings.Fields(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not a component=level pair", pair)
+		}
+
+		level, err := jsonlog.ParseLevel(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		levels[parts[0]] = level
+	}
+
+	return levels, nil
+}
+
+// showLogLevelHandler for the "GET /v1/config/log-level" endpoint
+func (app *application) showLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"log_level": strings.ToLower(app.logger.Level().String())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateLogLevelHandler for the "PUT /v1/config/log-level" endpoint, which changes the minimum severity of the log
+// entries which are written without restarting the server, for example to turn on debug logging during an incident
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level string `json:"level"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	level, err := jsonlog.ParseLevel(input.Level)
+	if v.Check(err == nil, "level", "must be one of debug, info, error or fatal"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	previous := app.logger.Level()
+	app.setLogLevel(level)
+
+	app.logger.PrintInfo("changed log level", app.logProperties(r, map[string]string{
+		"previous": strings.ToLower(previous.String()),
+		"level":    strings.ToLower(level.String()),
+		"user_id":  strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	}))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"log_level": strings.ToLower(level.String())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/eazylaykzy/greenlight/internal/jsonlog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// watchLogLevelSignals launches a background goroutine which changes the log level when the process receives a signal:
+// SIGUSR1 lowers the minimum severity by one level, so more is logged, down to debug, and SIGUSR2 raises it by one
+// level, up to error. Like the "PUT /v1/config/log-level" endpoint, the change lasts until the config is reloaded
+func (app *application) watchLogLevelSignals() {
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for s := range usr {
+			previous := app.logger.Level()
+
+			level := previous
+			switch {
+			case s == syscall.SIGUSR1 && level > jsonlog.LevelDebug:
+				level--
+			case s == syscall.SIGUSR2 && level < jsonlog.LevelError:
+				level++
+			}
+
+			app.setLogLevel(level)
+
+			app.logger.PrintInfo("changed log level", map[string]string{
+				"signal":   s.String(),
+				"previous": strings.ToLower(previous.String()),
+				"level":    strings.ToLower(level.String()),
+			})
+		}
+	}()
+}
@@ -0,0 +1,5 @@
+package main
+
+// watchLogLevelSignals does nothing on Windows, which doesn't have SIGUSR1 and SIGUSR2. The log level can still be
+// changed with the "PUT /v1/config/log-level" endpoint
+func (app *application) watchLogLevelSignals() {}
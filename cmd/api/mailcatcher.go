@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+)
+
+// listCaughtEmailsHandler for the "GET /debug/mail" endpoint, which lists the emails kept by the development mail
+// catcher, newest first
+func (app *application) listCaughtEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"emails": app.mailCatcher.List()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCaughtEmailHandler for the "GET /debug/mail/:id" endpoint, which shows an email kept by the development mail
+// catcher, with its headers and both of its bodies. With ?format=html or ?format=text, just that body is sent, so that
+// the HTML version can be looked at in a browser
+func (app *application) showCaughtEmailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	format := app.readString(r.URL.Query(), "format", "json")
+	v.Check(validator.In(format, "json", "html", "text"), "format", "must be one of json, html or text")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	msg, ok := app.mailCatcher.Get(id)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	switch format {
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(msg.HTMLBody))
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(msg.PlainBody))
+	default:
+		err = app.writeJSON(w, http.StatusOK, envelope{"email": msg}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+// clearCaughtEmailsHandler for the "DELETE /debug/mail" endpoint, which throws away the emails kept by the
+// development mail catcher
+func (app *application) clearCaughtEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	app.mailCatcher.Clear()
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "caught emails successfully cleared"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
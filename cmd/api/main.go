@@ -3,17 +3,35 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/cache"
+	"github.com/eazylaykzy/greenlight/internal/configfile"
 	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/enrich"
+	"github.com/eazylaykzy/greenlight/internal/hibp"
 	"github.com/eazylaykzy/greenlight/internal/jsonlog"
 	"github.com/eazylaykzy/greenlight/internal/mailer"
-	_ "github.com/lib/pq"
+	"github.com/eazylaykzy/greenlight/internal/oidc"
+	"github.com/eazylaykzy/greenlight/internal/reporter"
+	"github.com/eazylaykzy/greenlight/internal/secrets"
+	"github.com/eazylaykzy/greenlight/internal/storage"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,18 +49,77 @@ var (
 // environment for the application (development, staging, production, etc.). We will read in these
 // configuration settings from command-line flags when the application starts.
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port     int
+	env      string
+	logLevel string
+	log      struct {
+		file       string
+		maxSize    int
+		maxAge     time.Duration
+		maxBackups int
+		compress   bool
+		stackTrace bool
+		components string
+		dedup      struct {
+			interval time.Duration
+			burst    int
+		}
+		sink struct {
+			kind       string
+			url        string
+			bufferSize int
+			maxRetries int
+		}
+	}
+	debugEndpoints bool
+	debugAddr      string
+	adminAddr      string
+	server         struct {
+		readTimeout     time.Duration
+		writeTimeout    time.Duration
+		idleTimeout     time.Duration
+		requestTimeout  time.Duration
+		shutdownTimeout time.Duration
+		tasksTimeout    time.Duration
+	}
+	listen struct {
+		addr       string
+		socketMode string
+	}
+	db struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		queryTimeout time.Duration
+		autoMigrate  bool
+		breaker      struct {
+			failures int
+			cooldown time.Duration
+		}
+		read struct {
+			dsn          string
+			maxOpenConns int
+			maxIdleConns int
+			maxIdleTime  string
+		}
 	}
 	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
+		rps       float64
+		burst     int
+		userRPS   float64
+		userBurst int
+		enabled   bool
+		policies  string
+	}
+	concurrency struct {
+		max      int
+		routeMax int
+	}
+	anonymous struct {
+		reads bool
+		rps   float64
+		burst int
 	}
 	smtp struct {
 		host     string
@@ -51,19 +128,215 @@ type config struct {
 		password string
 		sender   string
 	}
+	mail struct {
+		provider    string
+		brand       mailer.Branding
+		templateDir string
+		ses         struct {
+			region    string
+			accessKey string
+			secretKey string
+		}
+		sendgrid struct {
+			url    string
+			apiKey string
+		}
+		mailgun struct {
+			url    string
+			domain string
+			apiKey string
+		}
+		dkim struct {
+			domain           string
+			selector         string
+			key              string
+			nextSelector     string
+			nextKey          string
+			canonicalization string
+		}
+	}
+	digest struct {
+		interval time.Duration
+	}
+	emails struct {
+		workers      int
+		maxAttempts  int
+		retryBackoff time.Duration
+		pollInterval time.Duration
+	}
 	cors struct {
-		trustedOrigins []string
+		trustedOrigins   []string
+		allowedMethods   []string
+		allowedHeaders   []string
+		exposedHeaders   []string
+		maxAge           time.Duration
+		allowCredentials bool
+	}
+	maintenance struct {
+		enabled    bool
+		file       string
+		retryAfter time.Duration
+	}
+	body struct {
+		maxSize       int64
+		authMaxSize   int64
+		importMaxSize int64
+	}
+	compression struct {
+		enabled bool
+		minSize int
+		types   []string
+	}
+	trustedProxies []*net.IPNet
+	ipFilter       struct {
+		allow           []*net.IPNet
+		deny            []*net.IPNet
+		refreshInterval time.Duration
+	}
+	tls struct {
+		certFile     string
+		keyFile      string
+		minVersion   string
+		redirectPort int
+		http3        bool
+		autocert     struct {
+			domains  []string
+			cacheDir string
+			email    string
+			httpPort int
+		}
+	}
+	movies struct {
+		duplicateCheck bool
+	}
+	views struct {
+		flushInterval time.Duration
+	}
+	tokens struct {
+		activationTTL    time.Duration
+		impersonationTTL time.Duration
+		deviceTTL        time.Duration
+		peppers          string
+		unpepperedUntil  time.Time
+		cleanupInterval  time.Duration
+		cleanupRetention time.Duration
+		cleanupBatchSize int
+	}
+	invitations struct {
+		required bool
+		ttl      time.Duration
+	}
+	passwords struct {
+		hashing         data.PasswordHashing
+		minLength       int
+		minEntropy      float64
+		requiredClasses []string
+		bannedList      string
+		breachCheck     bool
+		breachURL       string
+	}
+	apiKeys struct {
+		defaultRateLimit int
+		maxRateLimit     int
+	}
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+		scopes       []string
+		claimRules   []oidc.ClaimRule
+	}
+	exports struct {
+		baseURL       string
+		secret        string
+		linkTTL       time.Duration
+		attachMaxSize int
+	}
+	enrich struct {
+		omdbURL string
+		omdbKey string
+		rps     float64
+		burst   int
+	}
+	cache struct {
+		enabled    bool
+		backend    string
+		redisURL   string
+		maxEntries int
+	}
+	reporter struct {
+		name         string
+		sentryDSN    string
+		rollbarToken string
+		rollbarURL   string
+	}
+	storage struct {
+		backend string
+		local   struct {
+			dir string
+			url string
+		}
+		s3 struct {
+			endpoint  string
+			region    string
+			bucket    string
+			accessKey string
+			secretKey string
+			publicURL string
+		}
 	}
 }
 
 // Define an application struct to hold the dependencies for our HTTP handlers, helpers, and middleware.
 // At the moment this only contains a copy of the config struct and a logger.
 type application struct {
-	config config
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
-	logger *jsonlog.Logger
+	config    config
+	models    data.Models
+	mailer    mailer.Mailer
+	storage   storage.Storage
+	cache     cache.Cache
+	enricher  *enrich.Client
+	passwords *data.PasswordPolicy
+	oidc      *oidc.Provider
+	views     *viewCounter
+	emailWake chan struct{}
+	wg        sync.WaitGroup
+	logger    *jsonlog.Logger
+
+	// loggers holds the loggers for the parts of the application whose log entries are marked with a "component"
+	// property, so that they can be told apart, filtered, and given their own levels with log-component-levels
+	loggers struct {
+		mailer  *jsonlog.Logger
+		limiter *jsonlog.Logger
+		models  *jsonlog.Logger
+	}
+
+	// reporter is the error tracking service that panics are reported to, and is nil when error-reporter is "none"
+	reporter reporter.Reporter
+
+	// dbBreaker is the circuit breaker for the primary database, and is nil when db-breaker-failures is 0
+	dbBreaker *data.Breaker
+
+	// mailCatcher keeps the emails instead of sending them when mail-provider is "catcher", and is nil otherwise
+	mailCatcher *mailer.Catcher
+
+	// maintenance is whether maintenance mode has been switched on with the "PUT /v1/config/maintenance" endpoint
+	maintenance atomic.Bool
+
+	// ipBlocks holds the networks blocked with the "/v1/ip-blocks" endpoints, as last read from the database
+	ipBlocks ipBlockList
+
+	// tasks are the background tasks which are running, see background
+	tasks taskList
+
+	// tokenCleanup stops the scheduled and manual purges of expired tokens from running at the same time
+	tokenCleanup sync.Mutex
+
+	// live holds a *config with the latest values of the settings which can be reloaded while the server is running,
+	// and reloader holds what's needed to reload them. See liveConfig and reloadConfig
+	live     atomic.Value
+	reloader *configReloader
 }
 
 func main() {
@@ -73,7 +346,82 @@ func main() {
 	// Read the value of the port and env command-line flags into the config struct. Default to using the
 	// port number 8080 and the environment "development" if no corresponding flags are provided.
 	flag.IntVar(&cfg.port, "port", 8080, "API server port")
+
+	// Read the Unix domain socket to listen on instead of the TCP port, for when the server is behind a reverse proxy on
+	// the same machine, along with the permissions the socket is given so that the proxy can connect to it
+	flag.StringVar(&cfg.listen.addr, "listen", "", `Unix domain socket to listen on instead of port, such as "unix:/run/greenlight/api.sock"`)
+	flag.StringVar(&cfg.listen.socketMode, "listen-socket-mode", "0660", "Permissions of the Unix domain socket, in octal")
+
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.StringVar(&cfg.logLevel, "log-level", "info", "Minimum severity of log entries (debug|info|error|fatal)")
+	flag.StringVar(&cfg.log.components, "log-component-levels", "", `Minimum severity of log entries for particular components, such as "mailer=debug limiter=error"`)
+	flag.BoolVar(&cfg.log.stackTrace, "log-stack-traces", true, "Include stack traces and wrapped error chains in error log entries")
+
+	// Read where the logs are written. They go to stdout unless a log file is given, which is rotated once it reaches
+	// the maximum size or age, keeping a number of the rotated files compressed alongside it
+	flag.StringVar(&cfg.log.file, "log-file", "", "Log file (defaults to stdout)")
+	flag.IntVar(&cfg.log.maxSize, "log-max-size", 100, "Maximum size of the log file in megabytes before it's rotated (0 for no limit)")
+	flag.DurationVar(&cfg.log.maxAge, "log-max-age", 0, "Maximum age of the log file before it's rotated (0 for no limit)")
+	flag.IntVar(&cfg.log.maxBackups, "log-max-backups", 10, "Number of rotated log files to keep (0 to keep them all)")
+	flag.BoolVar(&cfg.log.compress, "log-compress", true, "Compress rotated log files with gzip")
+
+	// Read how identical error entries are deduplicated, so that an outage doesn't flood the log with the same error
+	// from every request. Only the first few in each interval are written, followed by a count of the rest
+	flag.DurationVar(&cfg.log.dedup.interval, "log-dedup-interval", time.Minute, "Interval for deduplicating identical error log entries (0 to disable)")
+	flag.IntVar(&cfg.log.dedup.burst, "log-dedup-burst", 5, "Number of identical error log entries written in each interval")
+
+	// Read where the logs are shipped to, as well as being written to stdout or the log file. Entries are buffered and
+	// sent in the background, so a slow sink doesn't hold up requests, and they're dropped once the buffer is full
+	flag.StringVar(&cfg.log.sink.kind, "log-sink", "", "Ship logs to a sink (syslog|loki|otlp)")
+	flag.StringVar(&cfg.log.sink.url, "log-sink-url", "", `Log sink address: a Loki or OTLP/HTTP base URL, or a syslog address such as "udp://host:514" (defaults to the local syslog)`)
+	flag.IntVar(&cfg.log.sink.bufferSize, "log-sink-buffer", 10000, "Number of log entries buffered for the log sink")
+	flag.IntVar(&cfg.log.sink.maxRetries, "log-sink-retries", 3, "Number of times sending log entries to the log sink is retried")
+
+	// Read whether the debug endpoints, /debug/vars and the /debug/pprof profiles, are served to administrators with the
+	// debug:read permission. Like the rate limiter, its default depends on the environment, see envProfiles. They can
+	// also be served without authentication on a listener of their own, which must be on a loopback address
+	flag.BoolVar(&cfg.debugEndpoints, "debug-endpoints", true, "Serve the debug endpoints to administrators (default depends on env)")
+	flag.StringVar(&cfg.debugAddr, "debug-addr", "", `Loopback address to serve the debug endpoints on without authentication, such as "localhost:6060"`)
+
+	// Read the address of the admin listener, which serves the metrics, the debug endpoints and the administrators'
+	// endpoints instead of the public port, so that they can be kept off the internet. It must be on an internal
+	// interface, such as a loopback or private IP address
+	flag.StringVar(&cfg.adminAddr, "admin-addr", "", `Internal address to serve the operational endpoints on instead of port, such as "10.0.0.5:9090"`)
+
+	// Read the server's timeouts, for reading each request, writing each response, and keeping idle keep-alive
+	// connections open
+	flag.DurationVar(&cfg.server.readTimeout, "server-read-timeout", 10*time.Second, "Maximum duration for reading each request")
+	flag.DurationVar(&cfg.server.writeTimeout, "server-write-timeout", 30*time.Second, "Maximum duration for writing each response")
+	flag.DurationVar(&cfg.server.idleTimeout, "server-idle-timeout", time.Minute, "Maximum duration to keep idle connections open")
+
+	// Read how long handlers have to make each response, after which their queries are cancelled. The import and
+	// export endpoints are allowed up to the write timeout instead
+	flag.DurationVar(&cfg.server.requestTimeout, "server-request-timeout", 10*time.Second, "Maximum duration for handling each request (0 to disable)")
+
+	// Read how long the server waits when it's shutting down, first for the requests being handled to finish, and then
+	// for the background tasks, such as sending emails, before giving up on them
+	flag.DurationVar(&cfg.server.shutdownTimeout, "server-shutdown-timeout", 5*time.Second, "Maximum duration to wait for requests to finish when shutting down")
+	flag.DurationVar(&cfg.server.tasksTimeout, "server-tasks-timeout", 30*time.Second, "Maximum duration to wait for background tasks to finish when shutting down")
+
+	// Read the settings for serving HTTPS directly, rather than behind a reverse proxy which terminates TLS. Either a
+	// certificate and key are given, or certificates for the listed domains are obtained from Let's Encrypt and kept in
+	// the cache directory. Let's Encrypt needs to reach the server on port 443, or on the HTTP port to answer its
+	// challenges, which also redirects everything else to HTTPS
+	flag.StringVar(&cfg.tls.certFile, "tls-cert", "", "TLS certificate file")
+	flag.StringVar(&cfg.tls.keyFile, "tls-key", "", "TLS private key file")
+	flag.StringVar(&cfg.tls.minVersion, "tls-min-version", "1.2", "Minimum TLS version to accept (1.2|1.3)")
+	flag.IntVar(&cfg.tls.redirectPort, "tls-redirect-port", 0, "HTTP port to redirect to HTTPS from, with tls-cert and tls-key (0 to disable)")
+	flag.Func("tls-autocert-domains", "Domains to obtain Let's Encrypt certificates for (space separated)", func(val string) error {
+		cfg.tls.autocert.domains = strings.Fields(val)
+		return nil
+	})
+	flag.StringVar(&cfg.tls.autocert.cacheDir, "tls-autocert-cache", "./certs", "Directory to cache Let's Encrypt certificates in")
+	flag.StringVar(&cfg.tls.autocert.email, "tls-autocert-email", "", "Contact email address for the Let's Encrypt account")
+	flag.IntVar(&cfg.tls.autocert.httpPort, "tls-autocert-http-port", 80, "HTTP port for Let's Encrypt challenges and redirects to HTTPS (0 to disable)")
+
+	// Read whether HTTP/3 is served over QUIC alongside HTTPS. It's experimental, and for clients on lossy networks,
+	// such as mobile ones, which it can speed up
+	flag.BoolVar(&cfg.tls.http3, "enable-http3", false, "Serve HTTP/3 over QUIC alongside HTTPS, on the same port number over UDP (experimental)")
 
 	// Use the empty string "" as the default value for the db-dsn command-line flag,
 	// rather than os.Getenv("GREENLIGHT_DB_DSN") that was previously used.
@@ -85,10 +433,54 @@ func main() {
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
 
-	// Read config variables for the rate limiter
+	// Read how long each database query can take before it's cancelled. Bulk operations allow themselves longer
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "PostgreSQL query timeout")
+
+	// Read whether to apply the migrations embedded in the binary at startup, so that the schema is brought up to date
+	// before any requests are served. They can also be applied on their own with the migrate command
+	flag.BoolVar(&cfg.db.autoMigrate, "db-auto-migrate", false, "Apply any pending database migrations at startup")
+
+	// Read the settings for the database circuit breakers. After the given number of queries in a row fail because a
+	// database can't be reached, its queries fail straight away for the cooldown, rather than each waiting out the
+	// query timeout, and then a single query is let through to find out whether it has recovered
+	flag.IntVar(&cfg.db.breaker.failures, "db-breaker-failures", 5, "Failures in a row which open the database circuit breaker (0 to disable)")
+	flag.DurationVar(&cfg.db.breaker.cooldown, "db-breaker-cooldown", 10*time.Second, "How long the database circuit breaker stays open before trying again")
+
+	// Read the DSN of a read replica, and the settings for its own connection pool. Queries which only read data can
+	// be sent to the replica, while writes always go to the primary. Without a read DSN, everything uses the primary
+	flag.StringVar(&cfg.db.read.dsn, "db-read-dsn", "", "PostgreSQL read replica DSN (defaults to the primary)")
+	flag.IntVar(&cfg.db.read.maxOpenConns, "db-read-max-open-conns", 25, "PostgreSQL read replica max open connections")
+	flag.IntVar(&cfg.db.read.maxIdleConns, "db-read-max-idle-conns", 25, "PostgreSQL read replica max idle connections")
+	flag.StringVar(&cfg.db.read.maxIdleTime, "db-read-max-idle-time", "15m", "PostgreSQL read replica max connection idle time")
+
+	// Read config variables for the rate limiter. It's switched off by default in development, see envProfiles
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
-	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter (default depends on env)")
+
+	// Read the rate limits for authenticated users, which are applied to each user rather than to each IP address
+	flag.Float64Var(&cfg.limiter.userRPS, "limiter-user-rps", 4, "Rate limiter maximum requests per second for each authenticated user")
+	flag.IntVar(&cfg.limiter.userBurst, "limiter-user-burst", 8, "Rate limiter maximum burst for each authenticated user")
+
+	// Read the stricter limits for groups of routes which are targets for abuse, such as logging in and signing up.
+	// They're applied on top of the limits above, to each client for each group
+	flag.StringVar(&cfg.limiter.policies, "limiter-policies", "auth=0.2:5 register=0.05:3", `Rate limits for groups of routes, as name=rps:burst pairs, such as "auth=0.2:5"`)
+
+	// Read the limits on how many requests can be handled at once, by the whole server and by each route. Requests
+	// over the limits are turned away straight away. 0 means no limit
+	flag.IntVar(&cfg.concurrency.max, "concurrency-max", 0, "Maximum requests handled at once (0 for no limit)")
+	flag.IntVar(&cfg.concurrency.routeMax, "concurrency-route-max", 0, "Maximum requests handled at once by each route (0 for no limit)")
+
+	// Read the settings for anonymous access. When it's enabled, clients which haven't authenticated can read movies,
+	// but all their requests are rate limited more strictly than those of authenticated clients
+	flag.BoolVar(&cfg.anonymous.reads, "anonymous-reads", false, "Allow unauthenticated clients to read movies")
+	flag.Float64Var(&cfg.anonymous.rps, "anonymous-limiter-rps", 0.5, "Rate limiter maximum requests per second for unauthenticated clients")
+	flag.IntVar(&cfg.anonymous.burst, "anonymous-limiter-burst", 2, "Rate limiter maximum burst for unauthenticated clients")
+
+	// Requests made with an API key are rate limited per key rather than per IP address. Each key has its own limit
+	// in requests per second, with bursts of up to twice that
+	flag.IntVar(&cfg.apiKeys.defaultRateLimit, "api-key-rate-limit", 10, "Default API key requests per second")
+	flag.IntVar(&cfg.apiKeys.maxRateLimit, "api-key-max-rate-limit", 100, "Maximum API key requests per second")
 
 	// Read the SMTP server configuration settings into the config struct, using the Mailtrap settings as the default values
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 2525, "SMTP port")
@@ -97,16 +489,285 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "7cddd41b44337a", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@adeleke.me>", "SMTP sender")
 
-	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
+	// Read which provider sends the emails. SMTP is the default, using the settings above, and the others use the
+	// provider's HTTP API with an API key instead. Every provider sends from the smtp-sender address. In development
+	// the emails are kept in memory by the mail catcher instead, and can be read from /debug/mail
+	flag.StringVar(&cfg.mail.provider, "mail-provider", "smtp", "Email provider (smtp|ses|sendgrid|mailgun|catcher)")
+	flag.StringVar(&cfg.mail.ses.region, "mail-ses-region", "us-east-1", "AWS SES region")
+	flag.StringVar(&cfg.mail.ses.accessKey, "mail-ses-access-key", "", "AWS SES access key ID")
+	flag.StringVar(&cfg.mail.ses.secretKey, "mail-ses-secret-key", "", "AWS SES secret access key")
+	flag.StringVar(&cfg.mail.sendgrid.url, "mail-sendgrid-url", "https://api.sendgrid.com", "SendGrid API URL")
+	flag.StringVar(&cfg.mail.sendgrid.apiKey, "mail-sendgrid-api-key", "", "SendGrid API key")
+	flag.StringVar(&cfg.mail.mailgun.url, "mail-mailgun-url", "https://api.mailgun.net", "Mailgun API URL (https://api.eu.mailgun.net for EU domains)")
+	flag.StringVar(&cfg.mail.mailgun.domain, "mail-mailgun-domain", "", "Mailgun sending domain")
+	flag.StringVar(&cfg.mail.mailgun.apiKey, "mail-mailgun-api-key", "", "Mailgun API key")
+
+	// Read the DKIM settings for emails sent over SMTP. Signing is switched off unless a domain is given. To rotate the
+	// key, publish the new one under a new selector and give it as the next key, so that emails are signed with both
+	// until the DNS change has spread, then make it the only key
+	flag.StringVar(&cfg.mail.dkim.domain, "mail-dkim-domain", "", "Domain that SMTP emails are DKIM signed for (empty to disable)")
+	flag.StringVar(&cfg.mail.dkim.selector, "mail-dkim-selector", "", "DKIM selector of the signing key")
+	flag.StringVar(&cfg.mail.dkim.key, "mail-dkim-key", "", "PEM encoded RSA or Ed25519 DKIM private key")
+	flag.StringVar(&cfg.mail.dkim.nextSelector, "mail-dkim-next-selector", "", "DKIM selector of a second signing key, while rotating keys")
+	flag.StringVar(&cfg.mail.dkim.nextKey, "mail-dkim-next-key", "", "PEM encoded second DKIM private key, while rotating keys")
+	flag.StringVar(&cfg.mail.dkim.canonicalization, "mail-dkim-canonicalize", "relaxed/relaxed", "DKIM header/body canonicalization (simple|relaxed)")
+
+	// Read the branding for the emails, which the shared layout uses for the header, the sign-off and the footer
+	flag.StringVar(&cfg.mail.brand.Name, "mail-brand-name", "Greenlight", "Name the emails are branded with")
+	flag.StringVar(&cfg.mail.brand.URL, "mail-brand-url", "", "Website linked from the emails")
+	flag.StringVar(&cfg.mail.brand.LogoURL, "mail-brand-logo-url", "", "URL of the logo shown at the top of the emails (defaults to the name)")
+	flag.StringVar(&cfg.mail.brand.Color, "mail-brand-color", "#1a73e8", "Colour of the email header and links, as a hex colour")
+
+	// Read the directory of email templates which override the ones built in, using the same file names
+	flag.StringVar(&cfg.mail.templateDir, "mail-template-dir", "", "Directory of email templates overriding the built-in ones")
+
+	// Read the settings for the outgoing email queue. Emails are stored in the database and sent by a pool of workers,
+	// which retry the ones that fail with a backoff that doubles each time, until they run out of attempts
+	flag.IntVar(&cfg.emails.workers, "email-workers", 2, "Number of workers sending queued emails")
+	flag.IntVar(&cfg.emails.maxAttempts, "email-max-attempts", 8, "Number of attempts to send an email before it's marked as dead")
+	flag.DurationVar(&cfg.emails.retryBackoff, "email-retry-backoff", 30*time.Second, "Wait before the first retry of an email, which doubles for each retry after it")
+	flag.DurationVar(&cfg.emails.pollInterval, "email-poll-interval", 5*time.Second, "Interval for checking the email queue for retries")
+
+	// Read how often the users who have opted in are sent the digest of new movies in their favorite genres
+	flag.DurationVar(&cfg.digest.interval, "digest-interval", 7*24*time.Hour, "Interval between digest emails to each user (0 to disable)")
+
+	// Read the CORS settings. Requests from the trusted origins, which can start with a wildcard subdomain such as
+	// https://*.example.com, are allowed to use the listed methods and headers, to read the exposed headers from the
+	// response and, if credentials are allowed, to send cookies. Browsers cache preflight responses for the max age
+	flag.Func("cors-trusted-origins", "Trusted CORS origins, such as https://example.com or https://*.example.com (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
 	})
 
+	cfg.cors.allowedMethods = []string{"OPTIONS", "PUT", "PATCH", "DELETE"}
+	flag.Func("cors-allowed-methods", "Methods allowed in CORS requests (space separated, default \"OPTIONS PUT PATCH DELETE\")", func(val string) error {
+		cfg.cors.allowedMethods = strings.Fields(val)
+		return nil
+	})
+
+	cfg.cors.allowedHeaders = []string{"Authorization", "Content-Type"}
+	flag.Func("cors-allowed-headers", "Request headers allowed in CORS requests (space separated, default \"Authorization Content-Type\")", func(val string) error {
+		cfg.cors.allowedHeaders = strings.Fields(val)
+		return nil
+	})
+
+	flag.Func("cors-exposed-headers", "Response headers which CORS requests can read (space separated)", func(val string) error {
+		cfg.cors.exposedHeaders = strings.Fields(val)
+		return nil
+	})
+
+	flag.DurationVar(&cfg.cors.maxAge, "cors-max-age", 0, "How long browsers can cache CORS preflight responses (0 to leave it to the browser)")
+	flag.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", false, "Allow CORS requests with credentials, such as cookies")
+
+	// Read the settings for maintenance mode, in which every request other than the healthcheck, the metrics and those
+	// from administrators gets a 503 Service Unavailable response. It's switched on by this flag, which can be
+	// reloaded, by the "PUT /v1/config/maintenance" endpoint, or while the file exists
+	flag.BoolVar(&cfg.maintenance.enabled, "maintenance", false, "Turn away requests with a 503 Service Unavailable response while the server is down for maintenance")
+	flag.StringVar(&cfg.maintenance.file, "maintenance-file", "", "File which puts the server in maintenance mode while it exists")
+	flag.DurationVar(&cfg.maintenance.retryAfter, "maintenance-retry-after", 5*time.Minute, "How long clients are told to wait before trying again during maintenance")
+
+	// Read the limits on the size of request bodies. Routes which only take a few small fields, such as logging in,
+	// accept much less than the rest, and the bulk import much more
+	flag.Int64Var(&cfg.body.maxSize, "body-max-size", 1_048_576, "Maximum size in bytes of a request body")
+	flag.Int64Var(&cfg.body.authMaxSize, "body-auth-max-size", 16_384, "Maximum size in bytes of a request body for the authentication and registration endpoints")
+	flag.Int64Var(&cfg.body.importMaxSize, "body-import-max-size", 64<<20, "Maximum size in bytes of a request body for the bulk movie import endpoint")
+
+	// Read the settings for compressing responses. Only responses with one of the content types, and at least the
+	// minimum size, are compressed
+	flag.BoolVar(&cfg.compression.enabled, "compress", true, "Compress responses with gzip or deflate when the client accepts it")
+	flag.IntVar(&cfg.compression.minSize, "compress-min-size", 1024, "Minimum size in bytes of a response to compress")
+
+	cfg.compression.types = []string{"application/json", "application/x-ndjson", "text/csv", "text/plain", "text/html"}
+	flag.Func("compress-types", "Content types of the responses to compress (space separated, default \"application/json application/x-ndjson text/csv text/plain text/html\")", func(val string) error {
+		cfg.compression.types = strings.Fields(val)
+		return nil
+	})
+
+	// Read the networks of the reverse proxies and load balancers in front of the server. The client's IP address,
+	// which the rate limiter, logs and audit records use, is only taken from the Forwarded and X-Forwarded-For
+	// headers of requests which come from one of these
+	flag.Func("trusted-proxies", "Trusted proxy networks in CIDR notation (space separated)", func(val string) error {
+		proxies, err := parseNetworks(val)
+		cfg.trustedProxies = proxies
+		return err
+	})
+
+	// Read the networks which clients are allowed to connect from, if they're limited at all, and those which are
+	// turned away. More networks can be blocked while the server is running, with the "/v1/ip-blocks" endpoints. Those
+	// are kept in the database, and each server reads them again at the refresh interval
+	flag.Func("ip-allow", "Only allow clients from these networks in CIDR notation (space separated)", func(val string) error {
+		networks, err := parseNetworks(val)
+		cfg.ipFilter.allow = networks
+		return err
+	})
+	flag.Func("ip-deny", "Turn away clients from these networks in CIDR notation (space separated)", func(val string) error {
+		networks, err := parseNetworks(val)
+		cfg.ipFilter.deny = networks
+		return err
+	})
+	flag.DurationVar(&cfg.ipFilter.refreshInterval, "ip-blocks-interval", time.Minute, "Interval between reads of the blocked networks from the database")
+
+	// Read the password policy for new passwords, and how they're hashed. By default only a minimum length is required,
+	// and passwords are hashed with Argon2id. Existing hashes are upgraded to the current settings when users log in
+	cfg.passwords.hashing = data.Hashing
+	flag.IntVar(&cfg.passwords.minLength, "password-min-length", 8, "Minimum password length in bytes")
+	flag.Float64Var(&cfg.passwords.minEntropy, "password-min-entropy", 0, "Minimum estimated password entropy in bits (0 to disable)")
+	flag.Func("password-require-classes", "Character classes required in passwords (comma separated: lower, upper, digit, symbol)", func(val string) error {
+		cfg.passwords.requiredClasses = nil
+		for _, class := range strings.Split(val, ",") {
+			if class = strings.TrimSpace(class); class != "" {
+				cfg.passwords.requiredClasses = append(cfg.passwords.requiredClasses, class)
+			}
+		}
+		return data.ValidatePasswordClasses(cfg.passwords.requiredClasses)
+	})
+	flag.StringVar(&cfg.passwords.hashing.Algorithm, "password-hash", data.Hashing.Algorithm, "Password hashing algorithm for new hashes (argon2id|bcrypt)")
+	flag.Func("argon2-memory", "Argon2id memory in KiB", uintFlag(&cfg.passwords.hashing.Argon2id.Memory))
+	flag.Func("argon2-iterations", "Argon2id iterations", uintFlag(&cfg.passwords.hashing.Argon2id.Iterations))
+	flag.Func("argon2-parallelism", "Argon2id parallelism", func(val string) error {
+		n, err := strconv.ParseUint(val, 10, 8)
+		cfg.passwords.hashing.Argon2id.Parallelism = uint8(n)
+		return err
+	})
+	flag.IntVar(&cfg.passwords.hashing.BcryptCost, "bcrypt-cost", data.Hashing.BcryptCost, "bcrypt cost")
+	flag.StringVar(&cfg.passwords.bannedList, "password-banned-list", "", "File of banned passwords, one on each line")
+	flag.BoolVar(&cfg.passwords.breachCheck, "password-breach-check", false, "Reject passwords found in data breaches, using the Pwned Passwords API")
+	flag.StringVar(&cfg.passwords.breachURL, "password-breach-url", "https://api.pwnedpasswords.com", "Pwned Passwords API URL")
+
+	// Read how long the activation tokens sent to new users last for
+	flag.DurationVar(&cfg.tokens.activationTTL, "activation-token-ttl", 3*24*time.Hour, "Activation token lifetime")
+
+	// Read how long the remember-me device tokens last for. Each time a device token is used it's replaced with a new
+	// one, so a device which is used regularly stays signed in
+	flag.DurationVar(&cfg.tokens.deviceTTL, "device-token-ttl", 30*24*time.Hour, "Remember-me device token lifetime")
+
+	// Read whether new users need an invitation to sign up, and how long the invitations sent by administrators last
+	// for. Invitations can be sent either way, but they're only required when open signup is switched off
+	flag.BoolVar(&cfg.invitations.required, "invite-only", false, "Require an invitation to sign up")
+	flag.DurationVar(&cfg.invitations.ttl, "invitation-ttl", 7*24*time.Hour, "Invitation lifetime")
+
+	// Read how long the tokens minted by administrators to impersonate other users last for. They're kept short, so
+	// that an administrator can't stay signed in as someone else for longer than it takes to look into a problem
+	flag.DurationVar(&cfg.tokens.impersonationTTL, "impersonation-token-ttl", 30*time.Minute, "Impersonation token lifetime")
+
+	// Read how often expired tokens are purged from the database, how long they're kept for after they expire, and how
+	// many are deleted by each statement. An interval of 0 disables the scheduled purge
+	flag.DurationVar(&cfg.tokens.cleanupInterval, "token-cleanup-interval", time.Hour, "Interval between purges of expired tokens (0 to disable)")
+	flag.DurationVar(&cfg.tokens.cleanupRetention, "token-cleanup-retention", 7*24*time.Hour, "How long expired tokens are kept before being purged")
+	flag.IntVar(&cfg.tokens.cleanupBatchSize, "token-cleanup-batch-size", 1000, "Number of expired tokens deleted in each batch")
+
+	// Read the pepper keys that token hashes are made with, as a comma-separated list of "version:secret" pairs. New
+	// tokens are hashed with the highest version, and tokens hashed with any of the listed versions are still accepted,
+	// so to rotate the pepper add a new version and drop the old one once its tokens are no longer needed
+	flag.StringVar(&cfg.tokens.peppers, "token-peppers", "", `Token hash pepper keys, as "version:secret" pairs separated by commas`)
+
+	// Read the time until which tokens hashed without a pepper are still accepted once there are pepper keys. It's
+	// only meant for when a pepper is first added, so that the tokens issued before then keep working, and should be
+	// set to when the longest-lived of them expires and removed after that. Without it, they stop working straight away
+	flag.Func("token-unpeppered-until", "Accept tokens hashed without a pepper until this time (RFC 3339), after adding token-peppers", func(val string) error {
+		if val == "" {
+			cfg.tokens.unpepperedUntil = time.Time{}
+			return nil
+		}
+
+		t, err := time.Parse(time.RFC3339, val)
+		cfg.tokens.unpepperedUntil = t
+		return err
+	})
+
+	// Read the settings for signing in with an OpenID Connect provider, such as Okta or Azure AD. Single sign-on is
+	// disabled unless an issuer is configured. The claim rules grant permissions based on the claims in users' ID
+	// tokens, for example "groups=greenlight-editors=>movies:read,movies:write"
+	flag.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect issuer URL")
+	flag.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	flag.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "", "OpenID Connect redirect URL")
+
+	cfg.oidc.scopes = []string{"openid", "email", "profile"}
+	flag.Func("oidc-scopes", "OpenID Connect scopes (space separated, default \"openid email profile\")", func(val string) error {
+		cfg.oidc.scopes = strings.Fields(val)
+		return nil
+	})
+
+	flag.Func("oidc-claim-rules", "OpenID Connect claim rules granting permissions (space separated)", func(val string) error {
+		rules, err := oidc.ParseClaimRules(val)
+		cfg.oidc.claimRules = rules
+		return err
+	})
+
+	// Read the setting which controls whether new movies are checked for duplicates of existing ones
+	flag.BoolVar(&cfg.movies.duplicateCheck, "movies-duplicate-check", true, "Reject new movies with the same title and year as an existing movie")
+
+	// Read how often the buffered movie view counts are written to the database
+	flag.DurationVar(&cfg.views.flushInterval, "views-flush-interval", 30*time.Second, "Interval between writes of buffered movie view counts")
+
+	// Read the object storage settings used for movie posters. The local backend is the default, so that the
+	// application works out of the box in development
+	flag.StringVar(&cfg.storage.backend, "storage-backend", "local", "Poster storage backend (local|s3)")
+	flag.StringVar(&cfg.storage.local.dir, "storage-local-dir", "./uploads", "Local storage directory")
+	flag.StringVar(&cfg.storage.local.url, "storage-local-url", "http://localhost:8080/uploads", "Public URL of the local storage directory")
+	flag.StringVar(&cfg.storage.s3.endpoint, "storage-s3-endpoint", "https://s3.amazonaws.com", "S3 endpoint")
+	flag.StringVar(&cfg.storage.s3.region, "storage-s3-region", "us-east-1", "S3 region")
+	flag.StringVar(&cfg.storage.s3.bucket, "storage-s3-bucket", "", "S3 bucket")
+	flag.StringVar(&cfg.storage.s3.accessKey, "storage-s3-access-key", "", "S3 access key ID")
+	flag.StringVar(&cfg.storage.s3.secretKey, "storage-s3-secret-key", "", "S3 secret access key")
+	flag.StringVar(&cfg.storage.s3.publicURL, "storage-s3-public-url", "", "Public URL of the S3 bucket (defaults to <endpoint>/<bucket>)")
+
+	// Read the settings for reporting panics to an error tracking service, as well as logging them
+	flag.StringVar(&cfg.reporter.name, "error-reporter", "none", "Error tracking service that panics are reported to (none|sentry|rollbar)")
+	flag.StringVar(&cfg.reporter.sentryDSN, "sentry-dsn", "", "Sentry DSN for the sentry error reporter")
+	flag.StringVar(&cfg.reporter.rollbarToken, "rollbar-token", "", "Rollbar project access token for the rollbar error reporter")
+	flag.StringVar(&cfg.reporter.rollbarURL, "rollbar-url", "https://api.rollbar.com", "Rollbar API base URL")
+
+	// Read the settings for caching the responses for listing movies and the like. The cache is kept in memory unless
+	// there's more than one server, when they should share a Redis cache, so that a change to a movie made through
+	// one server empties the cache for all of them
+	flag.BoolVar(&cfg.cache.enabled, "cache", false, "Cache responses for listing movies, reviews and trending movies")
+	flag.StringVar(&cfg.cache.backend, "cache-backend", "memory", "Response cache backend (memory|redis)")
+	flag.StringVar(&cfg.cache.redisURL, "cache-redis-url", "redis://localhost:6379/0", "Redis URL for the redis cache backend")
+	flag.IntVar(&cfg.cache.maxEntries, "cache-max-entries", 10_000, "Maximum number of responses kept by the memory cache backend")
+
+	// Read the settings for users' data exports. The download links emailed to users are built from the base URL
+	// that the API is publicly served from, and signed with the secret so that they can't be forged. If no secret is
+	// given a random one is used, which means that links stop working when the server restarts. Archives up to the
+	// attachment size are also attached to the email, in case the link can't be used before it expires
+	flag.StringVar(&cfg.exports.baseURL, "export-base-url", "http://localhost:8080", "Public base URL of the API, for data export download links")
+	flag.StringVar(&cfg.exports.secret, "export-link-secret", "", "Secret for signing data export download links")
+	flag.DurationVar(&cfg.exports.linkTTL, "export-link-ttl", 48*time.Hour, "Data export download link lifetime")
+	flag.IntVar(&cfg.exports.attachMaxSize, "export-attach-max-size", 5, "Maximum size in megabytes of a data export archive attached to its email (0 to disable)")
+
+	// Read the settings for the OMDb metadata provider used to enrich movies. Enrichment is disabled unless an API key
+	// is provided, and the outbound requests are rate limited to stay within the API key's quota
+	flag.StringVar(&cfg.enrich.omdbURL, "enrich-omdb-url", "https://www.omdbapi.com/", "OMDb API URL")
+	flag.StringVar(&cfg.enrich.omdbKey, "enrich-omdb-key", "", "OMDb API key")
+	flag.Float64Var(&cfg.enrich.rps, "enrich-rps", 1, "Maximum requests per second to the metadata provider")
+	flag.IntVar(&cfg.enrich.burst, "enrich-burst", 5, "Maximum burst of requests to the metadata provider")
+
+	// Read the path of a YAML or TOML config file to take settings from. The file's keys are the flag names, and
+	// flags given on the command line take precedence over environment variables, which take precedence over the
+	// config file. See the configfile package for the details
+	configPath := flag.String("config", "", "Config file (.yaml, .yml or .toml), or set GREENLIGHT_CONFIG")
+
+	// Create a print-config flag, which prints the settings the server would start with, after reading the flags,
+	// environment, config file and secrets, and then exits. Secrets are redacted
+	printConfig := flag.Bool("print-config", false, "Display the resolved config as JSON, with secrets redacted, and exit")
+
+	// Create a seed flag, which loads sample movies and users into the database for development and demo environments,
+	// and then exits. The sample data is read from seed-file, or is the set built into the binary
+	seedMode := flag.Bool("seed", false, "Load the sample movies and users into the database and exit (not in production)")
+	seedFile := flag.String("seed-file", "", "JSON file of sample movies and users for -seed (defaults to the built-in set)")
+
 	// Create a new version boolean flag with the default value of false.
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
 	flag.Parse()
 
+	// Remember which flags were given on the command line, as they keep their values when the config is reloaded
+	var cmdlineFlags []string
+	flag.Visit(func(f *flag.Flag) {
+		cmdlineFlags = append(cmdlineFlags, f.Name)
+	})
+
 	// If the version flag value is true, then print out the version number and immediately exit.
 	if *displayVersion {
 		fmt.Printf("Version:\t%s\n", version)
@@ -120,21 +781,171 @@ func main() {
 	// the INFO severity level to the standard out stream
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
-	// Call the openDB helper function to create the connection pool, passing in the config struct.
+	// The only command is migrate, which applies the database migrations and exits rather than starting the server
+	if flag.NArg() > 0 && flag.Arg(0) != "migrate" {
+		logger.PrintFatal(fmt.Errorf("unknown command %q", flag.Arg(0)), nil)
+	}
+
+	// Fill in the settings which weren't given as flags, from the GREENLIGHT_* environment variables and then from
+	// the config file, so that the order of precedence is flags, environment, config file and then the defaults
+	if *configPath == "" {
+		*configPath = os.Getenv("GREENLIGHT_CONFIG")
+	}
+
+	var fileValues map[string]string
+
+	if *configPath != "" {
+		var err error
+
+		fileValues, err = configfile.Load(*configPath)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	if err := configfile.Apply(flag.CommandLine, fileValues, "GREENLIGHT_", "config", "print-config", "version"); err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Now that the environment is known, apply its profile to the settings which haven't been given anywhere
+	if err := configfile.SetDefaults(flag.CommandLine, envProfiles[cfg.env]); err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Fetch the settings which refer to a secrets manager rather than holding the value themselves
+	secretsCtx, cancelSecrets := context.WithTimeout(context.Background(), 30*time.Second)
+
+	err := resolveSecrets(secretsCtx, secrets.FromEnvironment(), &cfg)
+	cancelSecrets()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// If the print-config flag value is true, print out the settings and immediately exit, before the config is
+	// checked, so that an invalid config can be looked at too
+	if *printConfig {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.SetEscapeHTML(false)
+
+		if err := enc.Encode(configSettings(&cfg)); err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		os.Exit(0)
+	}
+
+	// Check the whole config before connecting to anything, and report every invalid setting at once, keyed by the
+	// name of its flag
+	v := validator.New()
+
+	if validateConfig(v, cfg); !v.Valid() {
+		logger.PrintFatal(errors.New("invalid configuration"), v.Errors)
+	}
+
+	// Switch the logs over to the log file, if there is one, and ship them to the log sink too, if there is one. Until
+	// now they've gone to stdout, so that problems with the config are reported somewhere
+	var logOut io.Writer = os.Stdout
+
+	if cfg.log.file != "" {
+		logFile, err := jsonlog.OpenFile(cfg.log.file, jsonlog.RotationPolicy{
+			MaxSize:    int64(cfg.log.maxSize) * 1024 * 1024,
+			MaxAge:     cfg.log.maxAge,
+			MaxBackups: cfg.log.maxBackups,
+			Compress:   cfg.log.compress,
+		})
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		defer func() {
+			_ = logFile.Close()
+		}()
+
+		logOut = logFile
+	}
+
+	var logShipper *jsonlog.Shipper
+
+	if cfg.log.sink.kind != "" {
+		sink, err := openLogSink(cfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		logShipper = jsonlog.NewShipper(sink, jsonlog.ShipperOptions{
+			BufferSize: cfg.log.sink.bufferSize,
+			MaxRetries: cfg.log.sink.maxRetries,
+		})
+
+		// Closing the shipper sends whatever is still in its buffer
+		defer func() {
+			_ = logShipper.Close()
+		}()
+
+		logOut = io.MultiWriter(logOut, logShipper)
+	}
+
+	logger = jsonlog.New(logOut, jsonlog.LevelInfo)
+
+	logLevel, _ := jsonlog.ParseLevel(cfg.logLevel)
+	logger.SetLevel(logLevel)
+	logger.SetStackTraces(cfg.log.stackTrace)
+
+	componentLevels, _ := parseComponentLevels(cfg.log.components)
+	logger.SetComponentLevels(componentLevels)
+
+	if cfg.log.dedup.interval > 0 {
+		logger.Deduplicate(cfg.log.dedup.interval, cfg.log.dedup.burst)
+	}
+
+	// Send everything logged with log/slog, or with the standard log package, to the same place in the same format
+	slog.SetDefault(logger.Slog())
+
+	// Set up a circuit breaker for each connection pool, so that requests fail straight away while its database is down
+	dbBreaker := newDBBreaker(cfg, "primary", logger)
+	readBreaker := newDBBreaker(cfg, "read", logger)
+
+	// Call the openDB helper function to create the connection pools, passing in the config struct.
 	// If this returns an error, we log it and exit the application immediately
-	db, err := openDB(cfg)
+	db, readDB, err := openDB(cfg, dbBreaker, readBreaker)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
 
-	// Defer a call to db.Close so that the connection pool is closed before the main function exits
-	defer func(db *sql.DB) {
+	// Defer a call to db.Close so that the connection pools are closed before the main function exits
+	defer func(db, readDB dbPool) {
+		if readDB != db {
+			_ = readDB.Close()
+		}
 		_ = db.Close()
-	}(db)
+	}(db, readDB)
 
-	// Also log a message to say that the connection pool has been successfully established
+	// Also log a message to say that the connection pools have been successfully established
 	logger.PrintInfo("database connection pool established", nil)
 
+	if readDB != db {
+		logger.PrintInfo("read replica connection pool established", nil)
+	}
+
+	// Run the migrate command, or bring the schema up to date before anything uses it when db-auto-migrate is set.
+	// Migrations are always applied to the primary, which the read replica copies them from
+	if flag.Arg(0) == "migrate" {
+		err = runMigrateCommand(db.pgx, logger, flag.Args()[1:])
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		return
+	}
+
+	if cfg.db.autoMigrate {
+		err = migrateUp(db.pgx, logger)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
 	// Publish a new "version" variable in the expvar handler containing our application
 	// version number (currently the constant "1.0.0").
 	expvar.NewString("version").Set(version)
@@ -149,17 +960,175 @@ func main() {
 		return db.Stats()
 	}))
 
+	expvar.Publish("database_read", expvar.Func(func() interface{} {
+		return readDB.Stats()
+	}))
+
+	// Publish the statistics of the pgx pools that the connections are taken from
+	expvar.Publish("database_pgx", expvar.Func(func() interface{} {
+		return db.pgxStats()
+	}))
+
+	expvar.Publish("database_read_pgx", expvar.Func(func() interface{} {
+		return readDB.pgxStats()
+	}))
+
+	// Publish the number of error log entries written and suppressed as duplicates.
+	expvar.Publish("error_logs", expvar.Func(func() interface{} {
+		return logger.Stats()
+	}))
+
+	// Publish the number of log entries shipped to the log sink, and dropped or failed on the way.
+	if logShipper != nil {
+		expvar.Publish("log_shipping", expvar.Func(func() interface{} {
+			return logShipper.Stats()
+		}))
+	}
+
 	// Publish the current Unix timestamp.
 	expvar.Publish("timestamp", expvar.Func(func() interface{} {
 		return time.Now().Unix()
 	}))
 
+	// Create the models, applying any model settings from the config
+	data.QueryTimeout = cfg.db.queryTimeout
+	data.Hashing = cfg.passwords.hashing
+
+	models := data.NewModels(db.DB, readDB.DB)
+	models.Movies = models.Movies.WithDuplicateCheck(cfg.movies.duplicateCheck)
+
+	// In seed mode, load the sample data and exit rather than starting the server
+	if *seedMode {
+		err = runSeed(cfg, models, logger, *seedFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		return
+	}
+
+	// Set up the object storage backend for movie posters
+	store, err := openStorage(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Set up the error tracking service that panics are reported to, if there is one
+	errorReporter, err := openReporter(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Set up the response cache, if it's enabled
+	responseCache, err := openCache(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Set up the mailer. The email templates are read again for every email in development, so that changes to the
+	// overrides in the template directory show up without a restart
+	transport, err := openMailTransport(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	mail, err := mailer.New(transport, cfg.smtp.sender, cfg.mail.brand, cfg.mail.templateDir,
+		cfg.env == "development")
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	// Declare an instance of the application struct, containing the config struct and the logger.
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:  cfg,
+		logger:  logger,
+		models:  models,
+		mailer:  mail,
+		storage: store,
+		cache:   responseCache,
+		views:   newViewCounter(),
+	}
+
+	app.dbBreaker = dbBreaker
+	app.reporter = errorReporter
+
+	app.emailWake = make(chan struct{}, 1)
+
+	if catcher, ok := transport.(*mailer.Catcher); ok {
+		app.mailCatcher = catcher
+	}
+
+	app.loggers.mailer = logger.With("component", "mailer")
+	app.loggers.limiter = logger.With("component", "limiter")
+	app.loggers.models = logger.With("component", "models")
+
+	// Set up the password policy
+	app.passwords, err = newPasswordPolicy(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Set up the pepper keys for token hashes
+	data.Peppers, err = data.ParseTokenPeppers(cfg.tokens.peppers)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	data.Peppers.UnpepperedUntil = cfg.tokens.unpepperedUntil
+
+	if data.Peppers.Current == 0 {
+		logger.PrintInfo("no token-peppers set, token hashes will not be peppered", nil)
+	} else if time.Now().Before(data.Peppers.UnpepperedUntil) {
+		logger.PrintInfo("tokens hashed without a pepper are accepted until token-unpeppered-until", map[string]string{
+			"until": data.Peppers.UnpepperedUntil.Format(time.RFC3339),
+		})
+	}
+
+	// Without a configured secret for signing data export links, make up a random one for this process
+	if app.config.exports.secret == "" {
+		app.config.exports.secret, err = randomSecret()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		logger.PrintInfo("no export-link-secret set, data export links will stop working on restart", nil)
+	}
+
+	// Metadata enrichment is only available when an OMDb API key has been configured
+	if cfg.enrich.omdbKey != "" {
+		app.enricher = enrich.New(cfg.enrich.omdbURL, cfg.enrich.omdbKey, cfg.enrich.rps, cfg.enrich.burst)
+	}
+
+	// Single sign-on is only available when an OpenID Connect issuer has been configured. The provider's discovery
+	// document is fetched at startup, so that a misconfiguration is found straight away
+	if cfg.oidc.issuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		app.oidc, err = oidc.Discover(ctx, oidc.Config{
+			Issuer:       cfg.oidc.issuer,
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURL:  cfg.oidc.redirectURL,
+			Scopes:       cfg.oidc.scopes,
+		})
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		logger.PrintInfo("single sign-on provider discovered", map[string]string{"issuer": app.oidc.Issuer()})
+	}
+
+	// Keep a copy of the config for the settings which can be reloaded later, with the reloader holding on to the
+	// config that the flags are bound to
+	live := app.config
+	app.live.Store(&live)
+
+	app.reloader = &configReloader{
+		flags:   flag.CommandLine,
+		cfg:     &cfg,
+		path:    *configPath,
+		cmdline: cmdlineFlags,
 	}
 
 	err = app.serve()
@@ -168,28 +1137,152 @@ func main() {
 	}
 }
 
-// openDB function returns a sql.DB connection pool.
-func openDB(cfg config) (*sql.DB, error) {
-	// Use sql.Open to create an empty connection pool, using the DSN from the config struct
-	db, err := sql.Open("postgres", cfg.db.dsn)
+// uintFlag returns a flag.Func function which parses an unsigned 32-bit integer into dst
+func uintFlag(dst *uint32) func(string) error {
+	return func(val string) error {
+		n, err := strconv.ParseUint(val, 10, 32)
+		*dst = uint32(n)
+		return err
+	}
+}
+
+// newPasswordPolicy builds the password policy for new passwords from the config
+func newPasswordPolicy(cfg config) (*data.PasswordPolicy, error) {
+	policy := data.DefaultPasswordPolicy()
+	policy.MinLength = cfg.passwords.minLength
+	policy.MinEntropy = cfg.passwords.minEntropy
+	policy.RequiredClasses = cfg.passwords.requiredClasses
+
+	if cfg.passwords.bannedList != "" {
+		banned, err := data.LoadBannedPasswords(cfg.passwords.bannedList)
+		if err != nil {
+			return nil, err
+		}
+		policy.Banned = banned
+	}
+
+	if cfg.passwords.breachCheck {
+		policy.Breaches = hibp.New(cfg.passwords.breachURL)
+	}
+
+	return policy, nil
+}
+
+// dbPool is a sql.DB connection pool, which the models use, along with the pgx pool that its connections are taken
+// from. pgx keeps statistics of its own, such as how long queries wait for a connection, which are published alongside
+// those of the sql.DB pool
+type dbPool struct {
+	*sql.DB
+	pgx *pgxpool.Pool
+}
+
+// Close closes the sql.DB pool, and then the pgx pool's connections
+func (p dbPool) Close() error {
+	err := p.DB.Close()
+	p.pgx.Close()
+
+	return err
+}
+
+// pgxPoolStats are the statistics of a pgx pool, as published by the expvar handler
+type pgxPoolStats struct {
+	AcquireCount            int64
+	AcquireDuration         time.Duration
+	AcquiredConns           int32
+	CanceledAcquireCount    int64
+	ConstructingConns       int32
+	EmptyAcquireCount       int64
+	IdleConns               int32
+	MaxConns                int32
+	TotalConns              int32
+	NewConnsCount           int64
+	MaxLifetimeDestroyCount int64
+	MaxIdleDestroyCount     int64
+}
+
+// pgxStats returns the statistics of the pgx pool
+func (p dbPool) pgxStats() pgxPoolStats {
+	stat := p.pgx.Stat()
+
+	return pgxPoolStats{
+		AcquireCount:            stat.AcquireCount(),
+		AcquireDuration:         stat.AcquireDuration(),
+		AcquiredConns:           stat.AcquiredConns(),
+		CanceledAcquireCount:    stat.CanceledAcquireCount(),
+		ConstructingConns:       stat.ConstructingConns(),
+		EmptyAcquireCount:       stat.EmptyAcquireCount(),
+		IdleConns:               stat.IdleConns(),
+		MaxConns:                stat.MaxConns(),
+		TotalConns:              stat.TotalConns(),
+		NewConnsCount:           stat.NewConnsCount(),
+		MaxLifetimeDestroyCount: stat.MaxLifetimeDestroyCount(),
+		MaxIdleDestroyCount:     stat.MaxIdleDestroyCount(),
+	}
+}
+
+// openDB function returns the connection pools for the primary database and for reading. When no read replica DSN is
+// configured, the read pool is the primary pool, so callers can use it without checking. Each pool's connections are
+// guarded by its circuit breaker, if it has one
+func openDB(cfg config, breaker, readBreaker *data.Breaker) (dbPool, dbPool, error) {
+	db, err := openPool(cfg.db.dsn, cfg.db.maxOpenConns, cfg.db.maxIdleConns, cfg.db.maxIdleTime, breaker)
 	if err != nil {
-		return nil, err
+		return dbPool{}, dbPool{}, err
 	}
 
-	// Set the maximum number of open (in-use + idle) connections in the pool. Note,
-	// passing a value less than or equal to 0 will mean there is no limit
-	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	if cfg.db.read.dsn == "" {
+		return db, db, nil
+	}
 
-	// Set the maximum number of idle connections in the pool. Note, passing a value
-	// less than or equal to 0 will mean there is no limit.
-	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	readDB, err := openPool(cfg.db.read.dsn, cfg.db.read.maxOpenConns, cfg.db.read.maxIdleConns, cfg.db.read.maxIdleTime,
+		readBreaker)
+	if err != nil {
+		_ = db.Close()
+		return dbPool{}, dbPool{}, fmt.Errorf("read replica: %w", err)
+	}
 
+	return db, readDB, nil
+}
+
+// openPool function returns a connection pool for the DSN, sized with the given settings, whose connections are
+// guarded by the circuit breaker unless it's nil. The connections come from a pgx pool, and are used through sql.DB
+func openPool(dsn string, maxOpenConns, maxIdleConns int, maxIdleTime string, breaker *data.Breaker) (dbPool, error) {
 	// Use the time.ParseDuration function to convert the idle timeout duration string to a time.Duration type
-	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
+	duration, err := time.ParseDuration(maxIdleTime)
 	if err != nil {
-		return nil, err
+		return dbPool{}, err
+	}
+
+	// Use pgxpool.ParseConfig to check the DSN, and create the pgx pool with the same limits as the sql.DB pool. It
+	// doesn't connect until the first connection is needed
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return dbPool{}, err
+	}
+
+	poolConfig.MaxConns = int32(maxOpenConns)
+	poolConfig.MaxConnIdleTime = duration
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return dbPool{}, err
+	}
+
+	// Use sql.OpenDB to create an empty connection pool, which takes its connections from the pgx pool
+	connector := stdlib.GetPoolConnector(pool)
+	if breaker != nil {
+		connector = data.NewBreakerConnector(connector, breaker)
 	}
 
+	db := dbPool{DB: sql.OpenDB(connector), pgx: pool}
+
+	// Set the maximum number of open (in-use + idle) connections in the pool. Note,
+	// passing a value less than or equal to 0 will mean there is no limit
+	db.SetMaxOpenConns(maxOpenConns)
+
+	// Set the maximum number of idle connections in the pool. Note, passing a value
+	// less than or equal to 0 will mean there is no limit.
+	db.SetMaxIdleConns(maxIdleConns)
+
 	// Set the maximum idle timeout
 	db.SetConnMaxIdleTime(duration)
 
@@ -201,9 +1294,142 @@ func openDB(cfg config) (*sql.DB, error) {
 	// If the connection couldn't be established successfully within the 5 seconds deadline, then this will return an error
 	err = db.PingContext(ctx)
 	if err != nil {
-		return nil, err
+		_ = db.Close()
+		return dbPool{}, err
 	}
 
-	// Return the sql.DB connection pool
+	// Return the connection pool
 	return db, nil
 }
+
+// openStorage function returns the object storage backend selected by the storage-backend flag
+func openStorage(cfg config) (storage.Storage, error) {
+	switch cfg.storage.backend {
+	case "local":
+		return storage.NewLocal(cfg.storage.local.dir, cfg.storage.local.url)
+	case "s3":
+		if cfg.storage.s3.bucket == "" {
+			return nil, errors.New("storage-s3-bucket must be provided when using the s3 storage backend")
+		}
+
+		s3 := storage.NewS3(
+			cfg.storage.s3.endpoint,
+			cfg.storage.s3.region,
+			cfg.storage.s3.bucket,
+			cfg.storage.s3.accessKey,
+			cfg.storage.s3.secretKey,
+			cfg.storage.s3.publicURL,
+		)
+
+		return s3, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.storage.backend)
+	}
+}
+
+// openReporter function returns the error tracking service selected by the error-reporter flag, or nil if panics are
+// only logged
+func openReporter(cfg config) (reporter.Reporter, error) {
+	switch cfg.reporter.name {
+	case "none":
+		return nil, nil
+	case "sentry":
+		return reporter.NewSentry(cfg.reporter.sentryDSN, cfg.env, version)
+	case "rollbar":
+		return reporter.NewRollbar(cfg.reporter.rollbarURL, cfg.reporter.rollbarToken, cfg.env, version), nil
+	default:
+		return nil, fmt.Errorf("unknown error reporter %q", cfg.reporter.name)
+	}
+}
+
+// openCache function returns the response cache backend selected by the cache-backend flag, or nil if caching isn't
+// enabled
+func openCache(cfg config) (cache.Cache, error) {
+	if !cfg.cache.enabled {
+		return nil, nil
+	}
+
+	switch cfg.cache.backend {
+	case "memory":
+		return cache.NewMemory(cfg.cache.maxEntries), nil
+	case "redis":
+		return cache.NewRedis(cfg.cache.redisURL, "greenlight:cache:")
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.cache.backend)
+	}
+}
+
+// openMailTransport function returns the Sender for the email provider selected by the mail-provider flag, which
+// validation has already checked
+func openMailTransport(cfg config) (mailer.Sender, error) {
+	switch cfg.mail.provider {
+	case "ses":
+		return mailer.NewSES(cfg.mail.ses.region, cfg.mail.ses.accessKey, cfg.mail.ses.secretKey), nil
+	case "sendgrid":
+		return mailer.NewSendGrid(cfg.mail.sendgrid.url, cfg.mail.sendgrid.apiKey), nil
+	case "mailgun":
+		return mailer.NewMailgun(cfg.mail.mailgun.url, cfg.mail.mailgun.domain, cfg.mail.mailgun.apiKey), nil
+	case "catcher":
+		return mailer.NewCatcher(100), nil
+	}
+
+	smtp := mailer.NewSMTP(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password)
+
+	if cfg.mail.dkim.domain != "" {
+		key, err := mailer.ParseDKIMKey(cfg.mail.dkim.selector, cfg.mail.dkim.key)
+		if err != nil {
+			return nil, err
+		}
+
+		keys := []mailer.DKIMKey{key}
+
+		if cfg.mail.dkim.nextKey != "" {
+			next, err := mailer.ParseDKIMKey(cfg.mail.dkim.nextSelector, cfg.mail.dkim.nextKey)
+			if err != nil {
+				return nil, err
+			}
+
+			keys = append(keys, next)
+		}
+
+		smtp.DKIM, err = mailer.NewDKIMSigner(cfg.mail.dkim.domain, cfg.mail.dkim.canonicalization, keys...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return smtp, nil
+}
+
+// openLogSink function returns the log sink selected by the log-sink flag. Loki streams are labelled, and OTLP logs
+// described, with the service name and the environment
+func openLogSink(cfg config) (jsonlog.Sink, error) {
+	switch cfg.log.sink.kind {
+	case "syslog":
+		var network, raddr string
+
+		if cfg.log.sink.url != "" {
+			u, err := url.Parse(cfg.log.sink.url)
+			if err != nil {
+				return nil, err
+			}
+
+			network, raddr = u.Scheme, u.Host
+			if network == "unix" || network == "unixgram" {
+				raddr = u.Path
+			}
+		}
+
+		return jsonlog.NewSyslogSink(network, raddr, "greenlight")
+	case "loki":
+		return jsonlog.NewLokiSink(cfg.log.sink.url, map[string]string{"service": "greenlight", "env": cfg.env}), nil
+	case "otlp":
+		return jsonlog.NewOTLPSink(cfg.log.sink.url, map[string]string{
+			"service.name":           "greenlight",
+			"service.version":        version,
+			"deployment.environment": cfg.env,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown log sink %q", cfg.log.sink.kind)
+	}
+}
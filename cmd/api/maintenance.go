@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// maintenanceSources returns what has put the server in maintenance mode: the maintenance flag, the maintenance file
+// or the "PUT /v1/config/maintenance" endpoint. It's empty when the server isn't in maintenance mode. The file is
+// looked for on every call, so that it can be created and removed by deployment scripts without touching the server
+func (app *application) maintenanceSources() []string {
+	sources := []string{}
+
+	if app.liveConfig().maintenance.enabled {
+		sources = append(sources, "flag")
+	}
+
+	if app.config.maintenance.file != "" {
+		if _, err := os.Stat(app.config.maintenance.file); err == nil {
+			sources = append(sources, "file")
+		}
+	}
+
+	if app.maintenance.Load() {
+		sources = append(sources, "endpoint")
+	}
+
+	return sources
+}
+
+// maintenanceMode middleware turns away requests with a 503 Service Unavailable response while the server is in
+// maintenance mode, so that it can be drained before a migration. It's left out of the healthcheck's and the metrics'
+// middleware, so that the server isn't restarted by its orchestrator. Requests from administrators, that is users with
+// the security:write permission, are still served so that they can check on things and switch maintenance mode off
+// again. It goes after the authenticate middleware, as it needs the user
+func (app *application) maintenanceMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(app.maintenanceSources()) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if user := app.contextGetUser(r); !user.IsAnonymous() {
+			permissions, err := app.requestModels(r).Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if permissions.Include("security:write") {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		app.maintenanceResponse(w, r)
+	})
+}
+
+// showMaintenanceHandler for the "GET /v1/config/maintenance" endpoint, which shows whether the server is in
+// maintenance mode, and what has put it there
+func (app *application) showMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"maintenance": app.maintenanceStatus()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateMaintenanceHandler for the "PUT /v1/config/maintenance" endpoint, which switches maintenance mode on or off.
+// Switching it off here doesn't end maintenance mode which was switched on by the flag or the file, which the
+// response shows
+func (app *application) updateMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Enabled *bool `json:"enabled"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Enabled != nil, "enabled", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	previous := app.maintenance.Swap(*input.Enabled)
+
+	app.logger.PrintInfo("changed maintenance mode", app.logProperties(r, map[string]string{
+		"previous": strconv.FormatBool(previous),
+		"enabled":  strconv.FormatBool(*input.Enabled),
+		"user_id":  strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	}))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"maintenance": app.maintenanceStatus()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// maintenanceStatus returns whether the server is in maintenance mode, and what has put it there, for the responses
+// of the maintenance endpoints
+func (app *application) maintenanceStatus() map[string]interface{} {
+	sources := app.maintenanceSources()
+
+	return map[string]interface{}{
+		"enabled": len(sources) > 0,
+		"sources": sources,
+	}
+}
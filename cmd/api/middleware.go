@@ -5,9 +5,9 @@ import (
 	"expvar"
 	"fmt"
 	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/jsonlog"
 	"github.com/eazylaykzy/greenlight/internal/validator"
 	"github.com/felixge/httpsnoop"
-	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 	"net/http"
 	"strconv"
@@ -16,8 +16,13 @@ import (
 	"time"
 )
 
+// recoverPanic middleware turns a panic in a handler into a 500 Internal Server Error response, which is logged like
+// any other server error, and is also reported to the error tracking service along with its stack, the request ID
+// and the user who made the request, when there is one
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, ref := app.contextSetUserRef(r)
+
 		// Create a deferred function (which will always be run in the event of a panic as Go unwinds the stack)
 		defer func() {
 			// Use the builtin recover function to check if there has been a panic or not
@@ -27,6 +32,8 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 				// automatically close the current connection after a response has been sent
 				w.Header().Set("Connection", "close")
 
+				app.reportPanic(r, err, ref.user)
+
 				// The value returned by recover() has the type interface{}, so we use fmt.Errorf
 				// to normalize it into an error and call our serverErrorResponse() helper. In turn,
 				// this will log the error using our custom Logger type at the ERROR level and send
@@ -39,7 +46,9 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
+// rateLimit returns a middleware which rate limits anonymous requests, and requests with invalid credentials, by the
+// client's IP address. The routes it's used on share their limiters
+func (app *application) rateLimit() middleware {
 	// Define a client struct to hold the rate limiter and last seen time for each client
 	type client struct {
 		limiter  *rate.Limiter
@@ -72,33 +81,77 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		}
 	}()
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Only carry out the check if rate limiting is enabled
-		if app.config.limiter.enabled {
-			// Use the realip.FromRequest() function to get the client's real IP address.
-			ip := realip.FromRequest(r)
+	// limiterFor returns the limiter for the client that made the request, creating it if need be. The mutex must be
+	// held
+	limiterFor := func(r *http.Request, cfg *config) (string, *rate.Limiter) {
+		// Use the clientIP() helper to get the client's real IP address, from behind any trusted proxies.
+		ip := app.clientIP(r)
 
-			mu.Lock()
+		// When anonymous reads are enabled, unauthenticated requests have their own, stricter, tier of limits
+		key, rps, burst := ip, cfg.limiter.rps, cfg.limiter.burst
+		if app.config.anonymous.reads {
+			key, rps, burst = "anonymous:"+ip, cfg.anonymous.rps, cfg.anonymous.burst
+		}
 
-			if _, found := clients[ip]; !found {
-				// Create and add a new client struct to the map if it doesn't already exist
-				clients[ip] = &client{limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)}
-			}
+		if _, found := clients[key]; !found {
+			// Create and add a new client struct to the map if it doesn't already exist
+			clients[key] = &client{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+		}
 
-			// Update the last seen time for the client
-			clients[ip].lastSeen = time.Now()
+		// Bring the client's limiter up to date if the limits have been reloaded since it was created
+		updateLimiter(clients[key].limiter, rps, burst)
 
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
+		// Update the last seen time for the client
+		clients[key].lastSeen = time.Now()
+
+		return key, clients[key].limiter
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Only carry out the check if rate limiting is enabled. Authenticated requests are rate limited per account
+			// by the rateLimitAccount middleware instead, once the user or API key has been authenticated, so that users
+			// sharing an IP address (such as behind a NAT) don't use up each other's allowance
+			// The limits are read from the live config, as they can be reloaded while the server is running
+			cfg := app.liveConfig()
+
+			if !cfg.limiter.enabled {
+				next.ServeHTTP(w, r)
 				return
 			}
 
+			mu.Lock()
+			key, limiter := limiterFor(r, cfg)
+
+			// A request with credentials isn't charged to the IP address unless they turn out to be invalid, when the
+			// authenticate middleware calls the function added to the context. Until then, it's only turned away if the
+			// IP address has used up its allowance, so that made-up credentials can't be used to get around the limit
+			// and make a database lookup for each request
+			allowed := limiter.Tokens() >= 1
+			if r.Header.Get("Authorization") == "" {
+				allowed = limiter.Allow()
+			} else if allowed {
+				r = app.contextSetAuthFailed(r, func() {
+					mu.Lock()
+					defer mu.Unlock()
+
+					limiter.Allow()
+				})
+			}
+
 			mu.Unlock()
-		}
 
-		next.ServeHTTP(w, r)
-	})
+			if !allowed {
+				app.loggers.limiter.PrintDebug("rate limit exceeded", app.logProperties(r, map[string]string{
+					"bucket": key,
+				}))
+				app.rateLimitExceededResponse(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
 func (app *application) authenticate(next http.Handler) http.Handler {
@@ -119,10 +172,15 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		// Otherwise, we expect the value of the Authorization header to be in the format "Bearer <token>". We try to
-		// split this into its constituent parts, and if the header isn't in the expected format we return a
-		// 401 Unauthorized response using the invalidAuthenticationTokenResponse helper.
+		// Otherwise, we expect the value of the Authorization header to be in the format "Bearer <token>", or
+		// "ApiKey <key>" for machine clients. We try to split this into its constituent parts, and if the header isn't
+		// in an expected format we return a 401 Unauthorized response using the invalidAuthenticationTokenResponse helper.
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, headerParts[1], next)
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -143,7 +201,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		// Retrieve the details of the user associated with the authentication token, again calling the
 		// invalidAuthenticationTokenResponse helper if no matching record was found.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, impersonation, err := app.requestModels(r).Users.GetForSession(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -155,14 +213,276 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		// Call the contextSetUser helper to add the user information to the request context.
+		// Call the contextSetUser helper to add the user information to the request context, along with the token
+		// that they authenticated with.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
+
+		// If the token was minted by an administrator to act as the user, keep a record of who they really are. Every
+		// request they make is logged, and the JSON responses carry a banner saying that the user is being
+		// impersonated, so that it's never mistaken for the user's own session
+		if impersonation != nil {
+			r = app.contextSetImpersonation(r, impersonation)
+			w = &impersonationResponseWriter{ResponseWriter: w, banner: newImpersonationBanner(user, impersonation)}
+
+			app.logger.PrintInfo("impersonated request", app.logProperties(r, map[string]string{
+				"impersonator_id": strconv.FormatInt(impersonation.ImpersonatorID, 10),
+				"user_id":         strconv.FormatInt(user.ID, 10),
+				"request_method":  r.Method,
+				"request_url":     r.URL.String(),
+			}))
+		}
+
+		// Record when, and from where, the token was last used, for the user's list of sessions. This is done in the
+		// background so that it doesn't slow down the request.
+		ip, userAgent := app.clientIP(r), r.UserAgent()
+		app.background("token last used", func() {
+			err := app.models.Tokens.Touch(token, ip, userAgent)
+			if err != nil {
+				app.logger.PrintError(err, app.logProperties(r, nil))
+			}
+		})
 
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateAPIKey authenticates a request made with an API key. The user that the key belongs to is added to the
+// request context as for any other request, along with the key itself so that its scopes and rate limit can be applied
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, plaintext string, next http.Handler) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	key, user, err := app.requestModels(r).APIKeys.GetForPlaintext(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
+// updateLimiter changes the rate and burst of a limiter, if they're different
+func updateLimiter(limiter *rate.Limiter, rps float64, burst int) {
+	if limiter.Limit() != rate.Limit(rps) {
+		limiter.SetLimit(rate.Limit(rps))
+	}
+
+	if limiter.Burst() != burst {
+		limiter.SetBurst(burst)
+	}
+}
+
+// rateLimitAccount returns a middleware which applies the rate limits for authenticated requests, keyed on the account
+// rather than the client's IP address. It must come after the authenticate middleware in the stack. Requests made with
+// an API key use the key's own rate limit, and other authenticated requests the limit for the user tier. Anonymous
+// requests are passed straight through, as they've already been rate limited by IP address. The routes it's used on
+// share their limiters
+func (app *application) rateLimitAccount() middleware {
+	type client struct {
+		limiter  *rate.Limiter
+		lastSeen time.Time
+	}
+
+	var (
+		mu      sync.Mutex
+		clients = make(map[string]*client)
+	)
+
+	// Remove the limiters for accounts which haven't been seen within the last three minutes, as for the IP rate
+	// limiter
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			mu.Lock()
+
+			for key, client := range clients {
+				if time.Since(client.lastSeen) > 3*time.Minute {
+					delete(clients, key)
+				}
+			}
+
+			mu.Unlock()
+		}
+	}()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.contextGetUser(r)
+
+			cfg := app.liveConfig()
+
+			if cfg.limiter.enabled && !user.IsAnonymous() {
+				// API keys and users are kept in separate buckets, so a user's own requests don't use up the allowance
+				// of their service integrations (or the other way round)
+				key, rps, burst := "user:"+strconv.FormatInt(user.ID, 10), cfg.limiter.userRPS, cfg.limiter.userBurst
+				if apiKey := app.contextGetAPIKey(r); apiKey != nil {
+					key, rps, burst = "apikey:"+strconv.FormatInt(apiKey.ID, 10), float64(apiKey.RateLimit), 2*apiKey.RateLimit
+				}
+
+				mu.Lock()
+
+				if _, found := clients[key]; !found {
+					clients[key] = &client{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+				}
+
+				// As for the IP rate limiter, and also so that a change to an API key's rate limit takes effect
+				updateLimiter(clients[key].limiter, rps, burst)
+
+				clients[key].lastSeen = time.Now()
+
+				if !clients[key].limiter.Allow() {
+					mu.Unlock()
+					app.loggers.limiter.PrintDebug("rate limit exceeded", app.logProperties(r, map[string]string{
+						"bucket": key,
+					}))
+					app.rateLimitExceededResponse(w, r)
+					return
+				}
+
+				mu.Unlock()
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitPolicy is the rate limit for a group of routes, see the limiter-policies setting
+type limitPolicy struct {
+	rps   float64
+	burst int
+}
+
+// parseLimiterPolicies parses the rate limits for groups of routes, given as space separated name=rps:burst pairs such
+// as "auth=0.2:5 register=0.05:3", into the limit for each group
+func parseLimiterPolicies(s string) (map[string]limitPolicy, error) {
+	policies := make(map[string]limitPolicy)
+
+	for _, pair := range strings.Fields(s) {
+		name, limit, found := strings.Cut(pair, "=")
+		rps, burst, hasBurst := strings.Cut(limit, ":")
+		if !found || !hasBurst || name == "" {
+			return nil, fmt.Errorf("%q is not a name=rps:burst pair", pair)
+		}
+
+		var (
+			policy limitPolicy
+			err    error
+		)
+
+		policy.rps, err = strconv.ParseFloat(rps, 64)
+		if err != nil || policy.rps <= 0 {
+			return nil, fmt.Errorf("%q must have a rate greater than zero", pair)
+		}
+
+		policy.burst, err = strconv.Atoi(burst)
+		if err != nil || policy.burst < 1 {
+			return nil, fmt.Errorf("%q must have a burst of at least 1", pair)
+		}
+
+		policies[name] = policy
+	}
+
+	return policies, nil
+}
+
+// rateLimitPolicy returns a middleware for the routes in the named group, which limits each client to the group's
+// policy in the limiter-policies setting, on top of the global limits. The routes share their limiters, so a client
+// trying passwords can't get around the limit by moving between the ways to log in. Clients are told apart by their
+// account once they've authenticated, and by their IP address otherwise. A group without a policy isn't limited
+func (app *application) rateLimitPolicy(name string) func(next http.HandlerFunc) http.HandlerFunc {
+	type client struct {
+		limiter  *rate.Limiter
+		lastSeen time.Time
+	}
+
+	var (
+		mu      sync.Mutex
+		clients = make(map[string]*client)
+	)
+
+	// As for the IP rate limiter, but over a longer time, as the policies allow far fewer requests
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			mu.Lock()
+
+			for key, client := range clients {
+				if time.Since(client.lastSeen) > 10*time.Minute {
+					delete(clients, key)
+				}
+			}
+
+			mu.Unlock()
+		}
+	}()
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			cfg := app.liveConfig()
+
+			// The policies were checked when the config was loaded, so they can't fail to parse here
+			policies, _ := parseLimiterPolicies(cfg.limiter.policies)
+			policy, ok := policies[name]
+
+			if cfg.limiter.enabled && ok {
+				key := "ip:" + app.clientIP(r)
+				if user := app.contextGetUser(r); !user.IsAnonymous() {
+					key = "user:" + strconv.FormatInt(user.ID, 10)
+				}
+
+				mu.Lock()
+
+				if _, found := clients[key]; !found {
+					clients[key] = &client{limiter: rate.NewLimiter(rate.Limit(policy.rps), policy.burst)}
+				}
+
+				updateLimiter(clients[key].limiter, policy.rps, policy.burst)
+
+				clients[key].lastSeen = time.Now()
+
+				if !clients[key].limiter.Allow() {
+					mu.Unlock()
+					app.loggers.limiter.PrintDebug("rate limit exceeded", app.logProperties(r, map[string]string{
+						"bucket": name + ":" + key,
+					}))
+					app.rateLimitExceededResponse(w, r)
+					return
+				}
+
+				mu.Unlock()
+			}
+
+			next(w, r)
+		}
+	}
+}
+
+// maxBodySize middleware gives the route its own limit on the size of the request body, in place of the body-max-size
+// setting, which readJSON and the other handlers which read the body go by
+func (app *application) maxBodySize(limit int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, app.contextSetBodyLimit(r, limit))
+	}
+}
+
 /*
 // splitting the function up in the below implementation of requireAuthenticatedUser and requireActivatedUser
 func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
@@ -227,7 +547,7 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 		user := app.contextGetUser(r)
 
 		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.requestModels(r).Permissions.GetAllForUser(user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -239,6 +559,13 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 			return
 		}
 
+		// Requests made with an API key are also limited to the key's scopes. The scopes are checked as well as the
+		// user's permissions, rather than instead of them, so that a key loses any permission that the user loses.
+		if key := app.contextGetAPIKey(r); key != nil && !key.Scopes.Include(code) {
+			app.apiKeyScopeResponse(w, r)
+			return
+		}
+
 		// Otherwise, they have the required permission, so we call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	}
@@ -247,50 +574,175 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// ownedResource is implemented by the user-generated content which belongs to the user who created it, such as reviews
+type ownedResource interface {
+	OwnerID() int64
+}
+
+// resourceLoader loads the resource that a request acts on, usually using the ID in the URL. It should return
+// data.ErrRecordNotFound if there's no such resource
+type resourceLoader func(r *http.Request) (ownedResource, error)
+
+// requireOwnership checks that the resource a request acts on belongs to the authenticated user, or else that the user
+// has the moderator permission, which lets them act on anybody's. The resource is added to the request context, so
+// that the handler can get it with contextGetResource rather than loading it again. As with requirePermission,
+// requests made with an API key only get the moderator permission if it's in the key's scopes
+func (app *application) requireOwnership(load resourceLoader, moderatorPermission string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		resource, err := load(r)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		user := app.contextGetUser(r)
+
+		if resource.OwnerID() != user.ID {
+			permissions, err := app.requestModels(r).Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if !permissions.Include(moderatorPermission) {
+				app.notPermittedResponse(w, r)
+				return
+			}
+
+			if key := app.contextGetAPIKey(r); key != nil && !key.Scopes.Include(moderatorPermission) {
+				app.apiKeyScopeResponse(w, r)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, app.contextSetResource(r, resource))
+	}
+
+	return app.requireActivatedUser(fn)
+}
+
+// requireReadPermission is used in place of requirePermission for the endpoints which are public when anonymous reads
+// are enabled. Unauthenticated clients are then let through (having been rate limited by the anonymous tier in the
+// rateLimit middleware), while authenticated users still need the permission, as for any other endpoint.
+func (app *application) requireReadPermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	withPermission := app.requirePermission(code, next)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.config.anonymous.reads && app.contextGetUser(r).IsAnonymous() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		withPermission(w, r)
+	}
+}
+
+// requireUserSession checks that the user is authenticated with an authentication token rather than an API key. It's
+// used for the endpoints which manage the user's account, so that a leaked API key can't be used to take the
+// account over or to mint more keys. Administrators impersonating the user are turned away too, as they're there to
+// see what the user sees rather than to change the user's credentials.
+func (app *application) requireUserSession(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.userSessionRequiredResponse(w, r)
+			return
+		}
+		if app.contextGetImpersonation(r) != nil {
+			app.impersonationNotAllowedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+// enableCORS middleware lets browsers make cross-origin requests from the trusted origins. A preflight request, which
+// is an OPTIONS request with an Access-Control-Request-Method header, is answered here with the methods and headers
+// which are allowed, and goes no further. Other requests are passed on, with the headers that let the browser read the
+// response. The responses depend on the Origin header, and preflight responses on the headers which ask about the
+// request that's to follow, so they're all named in the Vary header for caches
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Add the "Vary: Origin" header.
+		cors := app.liveConfig().cors
+
 		w.Header().Add("Vary", "Origin")
 
-		// Add the "Vary: Access-Control-Request-Method" header.
-		w.Header().Add("Vary", "Access-Control-Request-Method")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if r.Method == http.MethodOptions {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
 
-		// Get the value of the request's Origin header.
 		origin := r.Header.Get("Origin")
+		if origin == "" || !originAllowed(cors.trustedOrigins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		// Only run this if there's an Origin request header present.
-		if origin != "" {
-			// Loop through the list of trusted origins, checking to see if the request origin exactly matches
-			// one of them. If there are no trusted origins, then the loop won't be iterated.
-			for i := range app.config.cors.trustedOrigins {
-				if origin == app.config.cors.trustedOrigins[i] {
-					// If there is a match, then set an "Access-Control-Allow-Origin"
-					// response header with the request origin as the value and break out of the loop.
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-
-					// Check if the request has the HTTP method OPTIONS and contains the
-					// "Access-Control-Request-Method" header. If it does, then we treat it as a preflight request.
-					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-						// Set the necessary preflight response headers.
-						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-
-						// Write the headers along with a 200 OK status and return from
-						// the middleware with no further action.
-						w.WriteHeader(http.StatusOK)
-						return
-					}
-
-					break
-				}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if cors.allowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(cors.exposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(cors.exposedHeaders, ", "))
 			}
+
+			next.ServeHTTP(w, r)
+			return
 		}
 
-		// Call the next handler in the chain.
-		next.ServeHTTP(w, r)
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(cors.allowedMethods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.allowedHeaders, ", "))
+
+		if cors.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cors.maxAge.Seconds())))
+		}
+
+		w.WriteHeader(http.StatusOK)
 	})
 }
 
+// originAllowed reports whether the origin is one of the trusted origins. A trusted origin such as
+// https://*.example.com matches the origin of any subdomain of example.com with the same scheme and port, but not
+// https://example.com itself
+func originAllowed(trustedOrigins []string, origin string) bool {
+	origin = strings.ToLower(origin)
+
+	for _, trusted := range trustedOrigins {
+		trusted = strings.ToLower(trusted)
+
+		if origin == trusted {
+			return true
+		}
+
+		scheme, domain, ok := strings.Cut(trusted, "://*.")
+		if !ok {
+			continue
+		}
+
+		subdomain, ok := strings.CutPrefix(origin, scheme+"://")
+		if !ok {
+			continue
+		}
+
+		subdomain, ok = strings.CutSuffix(subdomain, "."+domain)
+		if ok && subdomain != "" && !strings.ContainsAny(subdomain, "/:@") {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (app *application) metrics(next http.Handler) http.Handler {
 	// Initialize the new expvar variables when the middleware chain is first built.
 	totalRequestsReceived := expvar.NewInt("total_requests_received")
@@ -319,5 +771,16 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		// Note that the expvar map is string-keyed, so we need to use the strconv.Itoa()
 		// function to convert the status code (which is an integer) to a string.
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
+
+		// Log every request while debug logging is turned on
+		if app.logger.Level() <= jsonlog.LevelDebug {
+			app.logger.PrintDebug("handled request", app.logProperties(r, map[string]string{
+				"request_method": r.Method,
+				"request_url":    r.URL.String(),
+				"client_ip":      app.clientIP(r),
+				"status":         strconv.Itoa(metrics.Code),
+				"duration":       metrics.Duration.String(),
+			}))
+		}
 	})
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/eazylaykzy/greenlight/internal/jsonlog"
+	"github.com/eazylaykzy/greenlight/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	migratepgx "github.com/golang-migrate/migrate/v4/database/pgx/v5"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// migrateUsage is printed when the migrate command is given something it doesn't understand
+const migrateUsage = "usage: api migrate [up | down N | version | force V]"
+
+// migrateLogger sends golang-migrate's messages to the application's logger
+type migrateLogger struct {
+	logger *jsonlog.Logger
+}
+
+func (l migrateLogger) Printf(format string, v ...interface{}) {
+	l.logger.PrintInfo(strings.TrimSpace(fmt.Sprintf(format, v...)), nil)
+}
+
+func (l migrateLogger) Verbose() bool {
+	return false
+}
+
+// newMigrate returns a golang-migrate instance for the embedded migrations, which applies them to the database with
+// connections from the pool. Closing it closes a sql.DB of its own, so the application's connection pool is left open
+func newMigrate(pool *pgxpool.Pool, logger *jsonlog.Logger) (*migrate.Migrate, error) {
+	src, err := iofs.New(migrations.FS, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := migratepgx.WithInstance(sql.OpenDB(stdlib.GetPoolConnector(pool)), &migratepgx.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := migrate.NewWithInstance("iofs", src, "pgx5", driver)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Log = migrateLogger{logger: logger.With("component", "migrate")}
+
+	return m, nil
+}
+
+// migrationVersion returns the schema's version as a string for logging, which is "none" before the first migration,
+// with "(dirty)" after it when a migration failed part of the way through
+func migrationVersion(m *migrate.Migrate) (string, error) {
+	version, dirty, err := m.Version()
+	switch {
+	case errors.Is(err, migrate.ErrNilVersion):
+		return "none", nil
+	case err != nil:
+		return "", err
+	case dirty:
+		return fmt.Sprintf("%d (dirty)", version), nil
+	default:
+		return strconv.FormatUint(uint64(version), 10), nil
+	}
+}
+
+// migrateUp applies any of the embedded migrations which the database doesn't have yet, logging the schema's version
+// before and after. A schema which is already up to date isn't an error
+func migrateUp(pool *pgxpool.Pool, logger *jsonlog.Logger) error {
+	m, err := newMigrate(pool, logger)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_, _ = m.Close()
+	}()
+
+	from, err := migrationVersion(m)
+	if err != nil {
+		return err
+	}
+
+	err = m.Up()
+	if errors.Is(err, migrate.ErrNoChange) {
+		logger.PrintInfo("database schema is up to date", map[string]string{"version": from})
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	to, err := migrationVersion(m)
+	if err != nil {
+		return err
+	}
+
+	logger.PrintInfo("database migrations applied", map[string]string{"from": from, "to": to})
+
+	return nil
+}
+
+// runMigrateCommand runs the migrate command with its arguments: "up" (the default) applies the migrations the
+// database doesn't have yet, "down N" reverts the last N, "version" logs the schema's version, and "force V" sets the
+// version without running anything, to clear the dirty flag after a failed migration has been fixed by hand
+func runMigrateCommand(pool *pgxpool.Pool, logger *jsonlog.Logger, args []string) error {
+	if len(args) == 0 || (args[0] == "up" && len(args) == 1) {
+		return migrateUp(pool, logger)
+	}
+
+	if (len(args) == 1 && args[0] != "version") || len(args) > 2 {
+		return errors.New(migrateUsage)
+	}
+
+	m, err := newMigrate(pool, logger)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_, _ = m.Close()
+	}()
+
+	from, err := migrationVersion(m)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "version":
+		logger.PrintInfo("database schema version", map[string]string{"version": from})
+		return nil
+	case "down":
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return errors.New(migrateUsage)
+		}
+
+		err = m.Steps(-n)
+		if err != nil {
+			return err
+		}
+	case "force":
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < -1 {
+			return errors.New(migrateUsage)
+		}
+
+		err = m.Force(v)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	to, err := migrationVersion(m)
+	if err != nil {
+		return err
+	}
+
+	logger.PrintInfo("database schema version changed", map[string]string{"from": from, "to": to})
+
+	return nil
+}
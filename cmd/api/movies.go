@@ -4,8 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/enrich"
 	"github.com/eazylaykzy/greenlight/internal/validator"
+	"mime"
 	"net/http"
+	"strings"
 )
 
 // createMovieHandler for the "POST /v1/movies" endpoint
@@ -14,10 +17,12 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// field names and types in the struct are a subset of the Movie struct that we created earlier). This struct will
 	// be our *target decode destination*.
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
+		Title       string        `json:"title"`
+		Description string        `json:"description"`
+		Year        int32         `json:"year"`
+		Runtime     data.Runtime  `json:"runtime"`
+		Genres      []string      `json:"genres"`
+		People      []data.Credit `json:"people"`
 	}
 
 	// Initialize a new json.Decoder instance which reads from the request body, and then use the Decode method to
@@ -32,29 +37,87 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Copy the values from the input struct to a new Movie struct
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:       input.Title,
+		Description: input.Description,
+		Year:        input.Year,
+		Runtime:     input.Runtime,
+		Genres:      input.Genres,
 	}
 
 	// Initialize a new Validator.
 	v := validator.New()
 
-	// Call the ValidateMovie function and return a response containing the errors if any of the checks fail
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	// Clients can send enrich=true in the query string to fill in any missing details from the external metadata
+	// provider before the movie is validated, so that only the title needs to be sent. If the provider doesn't know
+	// the movie, it's validated as it is and any missing details are reported as usual
+	if app.readBool(r.URL.Query(), "enrich", false, v) {
+		if app.enricher == nil {
+			app.enrichmentUnavailableResponse(w, r)
+			return
+		}
+
+		metadata, err := app.lookupMetadata(movie)
+		switch {
+		case err == nil:
+			applyMetadata(movie, metadata)
+		case !errors.Is(err, enrich.ErrNotFound):
+			app.badGatewayResponse(w, r, err)
+			return
+		}
+	}
+
+	// Call the ValidateMovie function and the validateCredits helper, and return a response containing the errors if
+	// any of the checks fail
+	data.ValidateMovie(v, movie)
+
+	err = app.validateCredits(r, v, input.People)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Clients can send allow_duplicate=true in the query string to create a movie with the same title and year as an
+	// existing one (remakes released in the same year, for example). WithDuplicateCheck returns a copy of the store,
+	// so switching the check off here only affects this one insert
+	movies := app.requestModels(r).Movies
+	if app.readBool(r.URL.Query(), "allow_duplicate", false, v) {
+		movies = movies.WithDuplicateCheck(false)
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Call the Insert method on our movies model, passing in a pointer to the validated movie struct.
 	// This will create a record in the database and update the movie struct with the system-generated information
-	err = app.models.Movies.Insert(movie)
+	err = movies.Insert(movie)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		var duplicateErr *data.DuplicateMovieError
+
+		switch {
+		case errors.As(err, &duplicateErr):
+			app.duplicateMovieResponse(w, r, duplicateErr.ID)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
+	// Attach the cast and crew to the new movie, then read them back so that the response includes each person's name
+	if input.People != nil {
+		err = app.setMovieCredits(r, movie, input.People)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	// When sending an HTTP response, we want to include a 'Location header' to let the client know which URL they can
 	// find the newly-created resource at. We make an empty http.Header map and then use the Set() method to add a new
 	// 'Location header', interpolating the system-generated ID for our new movie in the URL
@@ -76,9 +139,18 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Clients can ask for a sparse fieldset in the same way as when listing movies
+	v := validator.New()
+
+	fields := app.readFields(r.URL.Query(), "fields", data.MovieFields, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Call the Get method to fetch the data for a specific movie. We also need to use the errors.Is function to check
 	// if it returns a data.ErrRecordNotFound error, in which case we send a 404 Not Found response to the client
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.requestModels(r).Movies.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -89,7 +161,47 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	// Count the view for the trending listings. This only updates an in-memory counter, the counts
+	// are written to the database in batches by a background goroutine
+	app.views.record(movie.ID)
+
+	// Include the cast and crew and the release dates when showing a single movie
+	movie.People, err = app.requestModels(r).People.GetCreditsForMovie(movie.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	movie.ReleaseDates, err = app.requestModels(r).ReleaseDates.GetForMovie(movie.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	selected, err := selectFields(movie, fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Send the ETag with the movie, so that the client can make conditional requests. If the client already has this
+	// representation of the movie, we send a 304 Not Modified response without a body instead
+	etag, err := movieETag(movie.Version, selected)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+
+	if ifNoneMatch(r, etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": selected}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -105,8 +217,9 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Fetch the existing movie record from the database, sending a 404 Not Found
-	// response to the client if we couldn't find a matching record
-	movie, err := app.models.Movies.Get(id)
+	// response to the client if we couldn't find a matching record. It's read from the primary, as a replica which is
+	// behind would hand us an old version, and the update would then fail with an edit conflict
+	movie, err := app.requestModels(r).ForcePrimary().Movies.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -117,53 +230,142 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Declare an input struct to hold the expected data from the client. Pointers will
-	// be used for the Title, Year and Runtime fields to allow clients to send partial updates
-	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
-	}
-
-	// Read the JSON request body data into the input struct
-	err = app.readJSON(w, r, &input)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
+	// If the client sent an If-Match header, only go ahead if it matches the version of the movie that we're updating
+	if !ifMatch(r, movie.Version) {
+		app.preconditionFailedResponse(w, r)
 		return
 	}
 
-	// If the input.Title value is nil then we know that no corresponding "title" key/ value pair was provided in the
-	// JSON request body. So we move on and leave the movie record unchanged. Otherwise, we update the movie record with
-	// the new title value. Importantly, because input.Title is a now a pointer to a string, we need to dereference the
-	// pointer using the * operator to get the underlying value before assigning it to our movie record, same with other
-	// fields in the input struct
-	if input.Title != nil {
-		movie.Title = *input.Title
-	}
+	// people holds the new cast and crew for the movie. The credits are only replaced if the client sent a "people" key,
+	// in which case updatePeople is set to true, and an empty array (or null) detaches everyone from the movie
+	var (
+		people       []data.Credit
+		updatePeople bool
+	)
 
-	if input.Year != nil {
-		movie.Year = *input.Year
-	}
+	// The validator is made up front, so that a merge patch which removes a required field can be reported with the
+	// rest of the validation errors
+	v := validator.New()
 
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
-	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "application/merge-patch+json":
+		// Apply the body to the editable fields of the movie as an RFC 7396 JSON Merge Patch. Unlike the pointer
+		// fields below, this lets the client remove a field entirely by setting it to null. The merged result is
+		// validated in exactly the same way as any other update. Only the description and the people are optional,
+		// so those are the only fields which can be removed; null for any of the others is a validation error
+		type document struct {
+			Title       string        `json:"title,omitempty"`
+			Description string        `json:"description,omitempty"`
+			Year        int32         `json:"year,omitempty"`
+			Runtime     data.Runtime  `json:"runtime,omitempty"`
+			Genres      []string      `json:"genres,omitempty"`
+			People      []data.Credit `json:"people,omitempty"`
+		}
+
+		current := document{
+			Title:       movie.Title,
+			Description: movie.Description,
+			Year:        movie.Year,
+			Runtime:     movie.Runtime,
+			Genres:      movie.Genres,
+		}
+
+		var merged document
+
+		patch, err := app.readMergePatch(w, r, current, &merged)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		for _, key := range []string{"title", "year", "runtime", "genres"} {
+			if value, ok := patch[key]; ok && value == nil {
+				v.AddError(key, "must not be null, as it can't be removed")
+			}
+		}
+
+		movie.Title = merged.Title
+		movie.Description = merged.Description
+		movie.Year = merged.Year
+		movie.Runtime = merged.Runtime
+		movie.Genres = merged.Genres
+
+		if _, ok := patch["people"]; ok {
+			people = merged.People
+			if people == nil {
+				people = []data.Credit{}
+			}
+			updatePeople = true
+		}
+	default:
+		// Declare an input struct to hold the expected data from the client. Pointers will
+		// be used for the Title, Year and Runtime fields to allow clients to send partial updates
+		var input struct {
+			Title       *string       `json:"title"`
+			Description *string       `json:"description"`
+			Year        *int32        `json:"year"`
+			Runtime     *data.Runtime `json:"runtime"`
+			Genres      []string      `json:"genres"`
+			People      []data.Credit `json:"people"`
+		}
+
+		// Read the JSON request body data into the input struct
+		err = app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		// If the input.Title value is nil then we know that no corresponding "title" key/ value pair was provided in
+		// the JSON request body. So we move on and leave the movie record unchanged. Otherwise, we update the movie
+		// record with the new title value. Importantly, because input.Title is a now a pointer to a string, we need to
+		// dereference the pointer using the * operator to get the underlying value before assigning it to our movie
+		// record, same with other fields in the input struct
+		if input.Title != nil {
+			movie.Title = *input.Title
+		}
+
+		if input.Description != nil {
+			movie.Description = *input.Description
+		}
+
+		if input.Year != nil {
+			movie.Year = *input.Year
+		}
+
+		if input.Runtime != nil {
+			movie.Runtime = *input.Runtime
+		}
 
-	if input.Genres != nil {
-		// Note that we don't need to dereference a slice, has its zero value is nil
-		movie.Genres = input.Genres
+		if input.Genres != nil {
+			// Note that we don't need to dereference a slice, has its zero value is nil
+			movie.Genres = input.Genres
+		}
+
+		people = input.People
+		updatePeople = input.People != nil
 	}
 
 	// Validate the updated movie record, sending the client a 422 Unprocessable Entity response if any checks fail
-	v := validator.New()
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	data.ValidateMovie(v, movie)
+
+	if updatePeople {
+		err = app.validateCredits(r, v, people)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Pass the updated movie record to our new Update method
-	err = app.models.Movies.Update(movie)
+	err = app.requestModels(r).Movies.Update(movie)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -174,8 +376,106 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Write the updated movie record in a JSON response
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if updatePeople {
+		err = app.setMovieCredits(r, movie, people)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		movie.People, err = app.requestModels(r).ForcePrimary().People.GetCreditsForMovie(movie.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// Include the release dates too, so that the response is the same representation of the movie as the one
+	// showMovieHandler sends, and the ETag matches the one a client gets by fetching the movie afterwards
+	movie.ReleaseDates, err = app.requestModels(r).ForcePrimary().ReleaseDates.GetForMovie(movie.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Write the updated movie record in a JSON response, along with its new ETag
+	etag, err := movieETag(movie.Version, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// maxBatchDelete is the largest number of movies which can be deleted with a single batch delete request
+const maxBatchDelete = 500
+
+// batchDeleteMoviesHandler for the "DELETE /v1/movies" endpoint. The request body holds the IDs of the movies to
+// delete, which are all deleted together. The response reports whether each movie was deleted or not found, in the
+// same order as the IDs in the request
+func (app *application) batchDeleteMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		IDs []int64 `json:"ids"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.IDs) >= 1, "ids", "must contain at least 1 id")
+	v.Check(len(input.IDs) <= maxBatchDelete, "ids", fmt.Sprintf("must not contain more than %d ids", maxBatchDelete))
+
+	seen := make(map[int64]bool, len(input.IDs))
+	for _, id := range input.IDs {
+		v.Check(id > 0, "ids", "must only contain positive integers")
+		v.Check(!seen[id], "ids", "must not contain duplicate values")
+		seen[id] = true
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deleted, err := app.requestModels(r).Movies.DeleteMany(input.IDs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	type result struct {
+		ID     int64  `json:"id"`
+		Status string `json:"status"`
+	}
+
+	results := make([]result, 0, len(input.IDs))
+
+	for _, id := range input.IDs {
+		posterKey, ok := deleted[id]
+		if !ok {
+			results = append(results, result{ID: id, Status: "not_found"})
+			continue
+		}
+
+		if posterKey != "" {
+			app.deletePoster(posterKey)
+		}
+
+		results = append(results, result{ID: id, Status: "deleted"})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"results": results, "deleted": len(deleted)}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -190,8 +490,26 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Fetch the movie first, so that we know which poster (if any) needs cleaning up once the movie has gone
+	movie, err := app.requestModels(r).ForcePrimary().Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// If the client sent an If-Match header, only go ahead if it matches the current version of the movie
+	if !ifMatch(r, movie.Version) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
 	// Delete the movie from the database, sending a 404 Not Found response to the client if there isn't a matching record
-	err = app.models.Movies.Delete(id)
+	err = app.requestModels(r).Movies.Delete(movie.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -202,6 +520,10 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if movie.PosterKey != "" {
+		app.deletePoster(movie.PosterKey)
+	}
+
 	// Return a 200 OK status code along with a success message
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 	if err != nil {
@@ -214,8 +536,11 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// To keep things consistent with our other handlers, we'll define an input struct
 	// to hold the expected values from the request query string
 	var input struct {
-		Title  string
-		Genres []string
+		Query        string
+		SearchFields []string
+		Genres       []string
+		Highlight    bool
+		Fields       []string
 		data.Filters
 	}
 
@@ -225,9 +550,18 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// Call r.URL.Query to get the url.Values map containing the query string data
 	qs := r.URL.Query()
 
-	// Use our helpers to extract the title and genres query string values, falling back
-	// to default of an empty string and an empty slice respectively if they are not provided by the client
-	input.Title = app.readString(qs, "title", "")
+	// Use our helpers to extract the q, search_fields and genres query string values. By default, q is searched for in
+	// every supported field. The older title parameter is still accepted, and is the same as searching the title only
+	input.Query = app.readString(qs, "q", "")
+	input.SearchFields = app.readCSV(qs, "search_fields", data.SearchFields)
+
+	if input.Query == "" {
+		input.Query = app.readString(qs, "title", "")
+		if input.Query != "" {
+			input.SearchFields = []string{"title"}
+		}
+	}
+
 	input.Genres = app.readCSV(qs, "genres", []string{})
 
 	// Get the page and page_size query string values as integers. Notice that we set the default page value to 1 and
@@ -235,28 +569,137 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
+	// Keyset pagination is opt-in. Sending the cursor parameter (empty for the first page) switches to it, and each
+	// response then includes the cursor for the next page in its metadata
+	input.Filters.UseCursor = qs.Has("cursor")
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+
+	// Get the optional year and runtime ranges. Each bound defaults to 0, which means it isn't applied
+	input.Filters.YearMin = app.readInt(qs, "year_min", 0, v)
+	input.Filters.YearMax = app.readInt(qs, "year_max", 0, v)
+	input.Filters.RuntimeMin = app.readInt(qs, "runtime_min", 0, v)
+	input.Filters.RuntimeMax = app.readInt(qs, "runtime_max", 0, v)
+
+	// Get the optional release filters, for movies released in a country (released_in=GB), before a date
+	// (released_before=2020-01-01), or both
+	input.Filters.ReleasedIn = strings.ToUpper(app.readString(qs, "released_in", ""))
+	input.Filters.ReleasedBefore = app.readString(qs, "released_before", "")
+
 	// Extract the sort query string value, falling back to "id" if it is not provided
-	// by the client (which will imply an ascending sort on movie ID)
-	input.Filters.Sort = app.readString(qs, "sort", "id")
+	// by the client (which will imply an ascending sort on movie ID). When searching, the default is to list the most
+	// relevant matches first instead
+	defaultSort := "id"
+	if input.Query != "" {
+		defaultSort = "-relevance"
+	}
+	input.Filters.Sort = app.readString(qs, "sort", defaultSort)
 
 	// Add the supported sort values for this endpoint to the sort safelist
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "relevance",
+		"-id", "-title", "-year", "-runtime", "-relevance"}
+
+	// When highlight=true, each matching movie includes its title with the matched words wrapped in <mark> tags
+	input.Highlight = app.readBool(qs, "highlight", false, v)
+
+	// Clients can ask for a sparse fieldset, such as fields=id,title,year, to only get back the fields they need
+	input.Fields = app.readFields(qs, "fields", data.MovieFields, v)
+
+	// Execute the validation checks on the search fields and the Filters struct,
+	// and send a response containing the errors if necessary
+	data.ValidateSearchFields(v, input.SearchFields)
 
-	// Execute the validation checks on the Filters struct and send a response containing the errors if necessary
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Call the GetAll method to retrieve the movies, passing in the various filter parameters
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.requestModels(r).Movies.GetAll(input.Query, input.SearchFields, input.Genres, input.Highlight,
+		input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Send a JSON response containing the movie data, trimmed down to the requested fields
+	selected, err := selectFields(movies, input.Fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": selected, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// similarMoviesHandler for the "GET /v1/movies/:id/similar" endpoint
+func (app *application) similarMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.requestModels(r).Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	limit := app.readInt(r.URL.Query(), "limit", 10, v)
+
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 50, "limit", "must be a maximum of 50")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Fetch a larger pool of candidates than we need, so that the ranking has something to choose between
+	candidates, err := app.requestModels(r).Movies.GetSimilarCandidates(movie, limit*5)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	similar := data.RankSimilar(movie, candidates, limit)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": similar}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// randomMovieHandler for the "GET /v1/movies/random" endpoint. This accepts the same title and genres filters as
+// listMoviesHandler, and responds with a single movie picked at random from the matches
+func (app *application) randomMovieHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	title := app.readString(qs, "title", "")
+	genres := app.readCSV(qs, "genres", []string{})
+
+	movie, err := app.requestModels(r).Movies.GetRandom(title, genres)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	// Send a JSON response containing the movie data
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
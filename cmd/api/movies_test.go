@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/eazylaykzy/greenlight/internal/data"
+)
+
+func TestShowMovie(t *testing.T) {
+	ts := newTestServer(t)
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		wantCode int
+		wantBody string
+	}{
+		{name: "Valid ID", path: "/v1/movies/1", token: data.MockTokenPlaintext, wantCode: http.StatusOK, wantBody: `"title": "Casablanca"`},
+		{name: "Non-existent ID", path: "/v1/movies/2", token: data.MockTokenPlaintext, wantCode: http.StatusNotFound},
+		{name: "Negative ID", path: "/v1/movies/-1", token: data.MockTokenPlaintext, wantCode: http.StatusNotFound},
+		{name: "String ID", path: "/v1/movies/foo", token: data.MockTokenPlaintext, wantCode: http.StatusNotFound},
+		{name: "Sparse fieldset", path: "/v1/movies/1?fields=id,title", token: data.MockTokenPlaintext, wantCode: http.StatusOK, wantBody: `"title": "Casablanca"`},
+		{name: "Unknown field", path: "/v1/movies/1?fields=budget", token: data.MockTokenPlaintext, wantCode: http.StatusUnprocessableEntity},
+		{name: "Anonymous", path: "/v1/movies/1", wantCode: http.StatusUnauthorized},
+		{name: "Invalid token", path: "/v1/movies/1", token: "ZZZZZZZZZZZZZZZZZZZZZZZZZZ", wantCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.get(t, tt.path, tt.token, nil)
+
+			if code != tt.wantCode {
+				t.Errorf("got status %d; want %d: %s", code, tt.wantCode, body)
+			}
+
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("got body %q; want it to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+
+	// A client which already has the movie, going by its ETag, gets a 304 Not Modified response without a body
+	t.Run("Not modified", func(t *testing.T) {
+		code, header, _ := ts.get(t, "/v1/movies/1", data.MockTokenPlaintext, nil)
+		if code != http.StatusOK {
+			t.Fatalf("got status %d; want %d", code, http.StatusOK)
+		}
+
+		etag := header.Get("ETag")
+		if etag == "" {
+			t.Fatal("no ETag header")
+		}
+
+		code, _, body := ts.get(t, "/v1/movies/1", data.MockTokenPlaintext, http.Header{"If-None-Match": {etag}})
+		if code != http.StatusNotModified {
+			t.Errorf("got status %d; want %d", code, http.StatusNotModified)
+		}
+
+		if body != "" {
+			t.Errorf("got body %q; want an empty body", body)
+		}
+
+		// If-None-Match uses the weak comparison, so the ETag of a compressed copy of the movie, or a weak one, also
+		// matches
+		compressed := `W/` + encodedETag(etag, "gzip")
+
+		code, _, _ = ts.get(t, "/v1/movies/1", data.MockTokenPlaintext, http.Header{"If-None-Match": {compressed}})
+		if code != http.StatusNotModified {
+			t.Errorf("got status %d for %s; want %d", code, compressed, http.StatusNotModified)
+		}
+	})
+}
+
+// The ETag sent with an updated movie is for the same representation of it as showMovieHandler sends, with the cast
+// and crew and the release dates, so that the client can use it for conditional requests straight away
+func TestUpdateMovieETag(t *testing.T) {
+	ts := newTestServer(t)
+
+	code, header, body := ts.do(t, http.MethodPatch, "/v1/movies/1", data.MockTokenPlaintext, nil, `{"year": 1942}`)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %s", code, http.StatusOK, body)
+	}
+
+	models := data.NewMockModels()
+
+	movie, err := models.Movies.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movie.Version++
+
+	movie.People, err = models.People.GetCreditsForMovie(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movie.ReleaseDates, err = models.ReleaseDates.GetForMovie(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := movieETag(movie.Version, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := header.Get("ETag"); got != want {
+		t.Errorf("got ETag %s; want %s", got, want)
+	}
+}
+
+func TestUpdateMovieMergePatch(t *testing.T) {
+	ts := newTestServer(t)
+
+	mergePatch := http.Header{"Content-Type": {"application/merge-patch+json"}}
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{name: "Valid patch", body: `{"title": "Casablanca (1942)"}`, wantCode: http.StatusOK, wantBody: `"title": "Casablanca (1942)"`},
+		{name: "Null description", body: `{"description": null, "year": 1943}`, wantCode: http.StatusOK, wantBody: `"year": 1943`},
+		{name: "Null people", body: `{"people": null}`, wantCode: http.StatusOK, wantBody: `"title": "Casablanca"`},
+		{name: "Null title", body: `{"title": null}`, wantCode: http.StatusUnprocessableEntity, wantBody: `"title": "must not be null, as it can't be removed"`},
+		{name: "Null year", body: `{"year": null}`, wantCode: http.StatusUnprocessableEntity, wantBody: `"year": "must not be null, as it can't be removed"`},
+		{name: "Null runtime", body: `{"runtime": null}`, wantCode: http.StatusUnprocessableEntity, wantBody: `"runtime": "must not be null, as it can't be removed"`},
+		{name: "Null genres", body: `{"genres": null}`, wantCode: http.StatusUnprocessableEntity, wantBody: `"genres": "must not be null, as it can't be removed"`},
+		{name: "Empty genres", body: `{"genres": []}`, wantCode: http.StatusUnprocessableEntity, wantBody: `"genres": "must contain at least 1 genre"`},
+		{name: "Not an object", body: `["title"]`, wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.do(t, http.MethodPatch, "/v1/movies/1", data.MockTokenPlaintext, mergePatch, tt.body)
+
+			if code != tt.wantCode {
+				t.Errorf("got status %d; want %d: %s", code, tt.wantCode, body)
+			}
+
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("got body %q; want it to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+// If-Match uses the strong comparison, so a weak ETag never matches, even one for the movie's current version. A
+// strong ETag for any representation of the current version does, including a compressed one
+func TestUpdateMovieIfMatch(t *testing.T) {
+	ts := newTestServer(t)
+
+	tests := []struct {
+		name     string
+		ifMatch  string
+		wantCode int
+	}{
+		{name: "Current version", ifMatch: `"1-abc"`, wantCode: http.StatusOK},
+		{name: "Compressed representation", ifMatch: `"1-abc-gzip"`, wantCode: http.StatusOK},
+		{name: "Any of several", ifMatch: `"2-abc", "1-abc"`, wantCode: http.StatusOK},
+		{name: "Any version", ifMatch: `*`, wantCode: http.StatusOK},
+		{name: "Weak", ifMatch: `W/"1-abc"`, wantCode: http.StatusPreconditionFailed},
+		{name: "Other version", ifMatch: `"2-abc"`, wantCode: http.StatusPreconditionFailed},
+		{name: "Not an ETag", ifMatch: `1-abc`, wantCode: http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"If-Match": {tt.ifMatch}}
+
+			code, _, body := ts.do(t, http.MethodPatch, "/v1/movies/1", data.MockTokenPlaintext, header, `{"year": 1942}`)
+			if code != tt.wantCode {
+				t.Errorf("got status %d; want %d: %s", code, tt.wantCode, body)
+			}
+		})
+	}
+}
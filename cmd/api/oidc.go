@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/oidc"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+// oidcStateTTL is how long a user has to sign in with the OpenID Connect provider and come back to us
+const oidcStateTTL = 10 * time.Minute
+
+var (
+	// errSSOMissingEmail is returned when a new user's ID token doesn't have an email address to create their account with
+	errSSOMissingEmail = errors.New("the identity provider didn't supply an email address")
+
+	// errSSOEmailInUse is returned when a new user's email address already belongs to an account, but the provider
+	// hasn't verified the address, so we can't tell that it's the same person
+	errSSOEmailInUse = errors.New("an account with this email address already exists")
+
+	// errSSOInviteOnly is returned when someone without an account signs in while the server is in invite-only mode.
+	// They need to sign up with an invitation first, and can then sign in with the provider
+	errSSOInviteOnly = errors.New("signing up is by invitation only")
+)
+
+// createSSOAuthorizationHandler for the "GET /v1/tokens/oidc" endpoint. This starts a sign in with the OpenID Connect
+// provider, returning the URL that the client should send the user to. The provider sends the user back to the
+// configured redirect URL with a code and state, which the client then sends to "POST /v1/tokens/oidc/callback"
+func (app *application) createSSOAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.singleSignOnUnavailableResponse(w, r)
+		return
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	codeVerifier, err := oidc.RandomString()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.requestModels(r).Identities.InsertState(state, &data.OIDCState{Nonce: nonce, CodeVerifier: codeVerifier}, oidcStateTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authorizationURL, err := app.oidc.AuthCodeURL(state, nonce, oidc.CodeChallenge(codeVerifier))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"authorization_url": authorizationURL}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// ssoCallbackHandler for the "POST /v1/tokens/oidc/callback" endpoint. This completes a sign in with the OpenID
+// Connect provider, exchanging the code for the user's ID token and then for a normal authentication token. Users
+// signing in for the first time have an account created for them, and the configured claim rules are applied to grant
+// permissions on every sign in
+func (app *application) ssoCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.singleSignOnUnavailableResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Code       string `json:"code"`
+		State      string `json:"state"`
+		RememberMe bool   `json:"remember_me"`
+		DeviceID   string `json:"device_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(input.State != "", "state", "must be provided")
+	if input.RememberMe {
+		data.ValidateDeviceID(v, input.DeviceID)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	oidcState, err := app.requestModels(r).Identities.ConsumeState(input.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The exchange is abandoned if the client goes away before the identity provider answers
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	rawIDToken, err := app.oidc.Exchange(ctx, input.Code, oidcState.CodeVerifier)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrExchangeFailed):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.badGatewayResponse(w, r, err)
+		}
+		return
+	}
+
+	claims, err := app.oidc.Verify(ctx, rawIDToken, oidcState.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrInvalidIDToken):
+			app.recordLogin(r, nil, "", data.LoginMethodSSO, data.LoginFailureInvalidToken)
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.badGatewayResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.provisionSSOUser(r, claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, errSSOMissingEmail):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		case errors.Is(err, errSSOEmailInUse):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		case errors.Is(err, errSSOInviteOnly):
+			app.errorResponse(w, r, http.StatusForbidden, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Permissions granted by the claim rules are added on every sign in, so that changes at the provider (such as the
+	// user joining a group) are picked up. They aren't removed when the claims change, as the same permissions could
+	// have been granted in other ways
+	if permissions := claims.Permissions(app.config.oidc.claimRules); len(permissions) > 0 {
+		err = app.requestModels(r).Permissions.AddForUser(user.ID, permissions...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	tokens, err := app.issueLoginTokens(r, user, input.RememberMe, input.DeviceID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.recordLogin(r, user, user.Email, data.LoginMethodSSO, "")
+
+	err = app.writeJSON(w, http.StatusCreated, tokens, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// provisionSSOUser returns the user for a verified ID token, creating their account just in time if this is their
+// first sign in. An existing account with the same email address is linked instead, but only if the provider has
+// verified that the address belongs to the user
+func (app *application) provisionSSOUser(r *http.Request, claims oidc.Claims) (*data.User, error) {
+	issuer, subject := app.oidc.Issuer(), claims.String("sub")
+
+	user, err := app.requestModels(r).Identities.GetUser(issuer, subject)
+	if err == nil || !errors.Is(err, data.ErrRecordNotFound) {
+		return user, err
+	}
+
+	email := claims.String("email")
+
+	v := validator.New()
+	if data.ValidateEmail(v, email); !v.Valid() {
+		return nil, errSSOMissingEmail
+	}
+
+	user, err = app.requestModels(r).Users.GetByEmail(email)
+	switch {
+	case err == nil:
+		if !claims.Bool("email_verified") {
+			return nil, errSSOEmailInUse
+		}
+
+	case errors.Is(err, data.ErrRecordNotFound):
+		if app.config.invitations.required {
+			return nil, errSSOInviteOnly
+		}
+
+		user = &data.User{
+			Name:      claims.String("name"),
+			Email:     email,
+			Activated: true,
+		}
+
+		if user.Name == "" || len(user.Name) > 500 {
+			user.Name = email
+		}
+
+		// Users who sign in with the provider don't have a password of their own, so they get a random one which
+		// nobody knows. Apart from the provider, they can only sign in with a magic link
+		password, err := oidc.RandomString()
+		if err != nil {
+			return nil, err
+		}
+
+		err = user.Password.Set(password)
+		if err != nil {
+			return nil, err
+		}
+
+		// The account is created, given the same permission as those who register and linked to the identity in one
+		// transaction, so that a failure part of the way through can't leave an account the user can't sign in to
+		err = app.requestModels(r).WithTx(r.Context(), func(models data.Models) error {
+			err := models.Users.Insert(user)
+			if err != nil {
+				return err
+			}
+
+			err = models.Permissions.AddForUser(user.ID, data.DefaultPermissions...)
+			if err != nil {
+				return err
+			}
+
+			return models.Identities.Link(issuer, subject, user.ID)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return user, nil
+
+	default:
+		return nil, err
+	}
+
+	err = app.requestModels(r).Identities.Link(issuer, subject, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
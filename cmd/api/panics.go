@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/reporter"
+	"net/http"
+	"time"
+)
+
+// reportPanic sends the details of a panic which was recovered while handling a request to the error tracking
+// service, if there is one. It must be called from the deferred function which recovered the panic, so that the stack
+// can be captured. The report is sent in the background, so that the response isn't held up by it
+func (app *application) reportPanic(r *http.Request, recovered interface{}, user *data.User) {
+	if app.reporter == nil {
+		return
+	}
+
+	report := &reporter.Report{
+		Time:      time.Now(),
+		Type:      fmt.Sprintf("%T", recovered),
+		Message:   fmt.Sprint(recovered),
+		Stack:     reporter.PanicStack(),
+		RequestID: app.contextGetRequestID(r),
+		Method:    r.Method,
+		URL:       r.URL.String(),
+		ClientIP:  app.clientIP(r),
+	}
+
+	if user != nil && !user.IsAnonymous() {
+		report.UserID = user.ID
+	}
+
+	properties := app.logProperties(r, nil)
+
+	app.background("panic report", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := app.reporter.Report(ctx, report); err != nil {
+			app.logger.PrintError(fmt.Errorf("reporting panic: %w", err), properties)
+		}
+	})
+}
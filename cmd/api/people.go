@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+)
+
+// createPersonHandler for the "POST /v1/people" endpoint
+func (app *application) createPersonHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	person := &data.Person{
+		Name: input.Name,
+	}
+
+	v := validator.New()
+
+	if data.ValidatePerson(v, person); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.requestModels(r).People.Insert(person)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/people/%d", person.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"person": person}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showPersonHandler for the "GET /v1/people/:id" endpoint
+func (app *application) showPersonHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	person, err := app.requestModels(r).People.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"person": person}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listPersonMoviesHandler for the "GET /v1/people/:id/movies" endpoint. The optional role query string parameter
+// limits the results to the movies where the person had that particular role
+func (app *application) listPersonMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.requestModels(r).People.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Role string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Role = app.readString(qs, "role", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-year")
+	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
+	if input.Role != "" {
+		v.Check(validator.In(input.Role, data.RoleActor, data.RoleDirector, data.RoleWriter), "role", "must be one of actor, director or writer")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, metadata, err := app.requestModels(r).People.GetMovies(id, input.Role, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// validateCredits checks the format of the provided credits and then makes sure that every person they refer to
+// actually exists, recording any problems in the provided Validator instance. We check this before writing anything
+// to the database, so that a movie is never saved with only some of its credits
+func (app *application) validateCredits(r *http.Request, v *validator.Validator, credits []data.Credit) error {
+	if data.ValidateCredits(v, credits); !v.Valid() {
+		return nil
+	}
+
+	ids := []int64{}
+	seen := make(map[int64]bool)
+
+	for _, credit := range credits {
+		if !seen[credit.PersonID] {
+			ids = append(ids, credit.PersonID)
+			seen[credit.PersonID] = true
+		}
+	}
+
+	count, err := app.requestModels(r).People.CountExisting(ids)
+	if err != nil {
+		return err
+	}
+
+	v.Check(count == len(ids), "people", "must only refer to existing people")
+
+	return nil
+}
+
+// setMovieCredits replaces the cast and crew of a movie, and then reads the credits back into the movie struct so
+// that they include each person's name
+func (app *application) setMovieCredits(r *http.Request, movie *data.Movie, credits []data.Credit) error {
+	err := app.requestModels(r).People.SetCreditsForMovie(movie.ID, credits)
+	if err != nil {
+		return err
+	}
+
+	movie.People, err = app.requestModels(r).ForcePrimary().People.GetCreditsForMovie(movie.ID)
+
+	return err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/storage"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxPosterBytes is the largest poster image that we accept. The request body as a whole is allowed to be a little
+// larger than this to make room for the multipart boundaries and headers
+const maxPosterBytes = 5 << 20
+
+// posterContentTypes maps the image types that we accept for posters to the file extension used for their keys
+var posterContentTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// uploadPosterHandler for the "PUT /v1/movies/:id/poster" endpoint. The image is expected in the "poster" field of a
+// multipart/form-data request body
+func (app *application) uploadPosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.requestModels(r).ForcePrimary().Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPosterBytes+1<<20)
+
+	err = r.ParseMultipartForm(maxPosterBytes)
+	if err != nil {
+		switch {
+		case err.Error() == "http: request body too large":
+			v.AddError("poster", fmt.Sprintf("must not be larger than %d bytes", maxPosterBytes))
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	file, header, err := r.FormFile("poster")
+	if err != nil {
+		switch {
+		case errors.Is(err, http.ErrMissingFile):
+			v.AddError("poster", "must be provided")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	// Sniff the content type from the first 512 bytes of the file, rather than trusting the Content-Type that the
+	// client sent, and then rewind the file so that the whole thing gets stored
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	contentType := http.DetectContentType(sniff[:n])
+	ext, ok := posterContentTypes[contentType]
+
+	v.Check(header.Size > 0, "poster", "must not be empty")
+	v.Check(header.Size <= maxPosterBytes, "poster", fmt.Sprintf("must not be larger than %d bytes", maxPosterBytes))
+	v.Check(ok, "poster", "must be a JPEG, PNG or WebP image")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Include the current time in the key, so that a new poster never has the same URL as the one it replaces and
+	// clients (or a CDN) won't keep serving a stale cached image
+	key := fmt.Sprintf("posters/%d-%d%s", movie.ID, time.Now().UnixNano(), ext)
+
+	url, err := app.storage.Put(r.Context(), key, file, header.Size, contentType)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	oldKey := movie.PosterKey
+	movie.PosterKey = key
+	movie.PosterURL = url
+
+	err = app.requestModels(r).Movies.UpdatePoster(movie)
+	if err != nil {
+		// The new image will never be referenced by the movie, so remove it again
+		app.deletePoster(key)
+
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The movie now points at the new poster, so it's safe to remove the old one
+	if oldKey != "" {
+		app.deletePoster(oldKey)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deletePoster removes a poster image from storage in a background goroutine, so that the client doesn't have to
+// wait on the storage backend. Failures are only logged, as there's nothing the client could do about them anyway
+func (app *application) deletePoster(key string) {
+	app.background("poster deletion", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		err := app.storage.Delete(ctx, key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			app.logger.PrintError(err, map[string]string{
+				"poster_key": key,
+			})
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// showCurrentUserHandler for the "GET /v1/me" endpoint. This is the private representation of the user, so unlike
+// the public one it includes their email address. It also has everything a client needs to set itself up for the
+// user in one request: their activation status, the permissions they have, and how the request was authenticated
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	profile, err := app.requestModels(r).Users.GetProfile(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeCurrentUser(w, r, http.StatusOK, user, profile)
+}
+
+// updateCurrentUserHandler for the "PATCH /v1/me" endpoint. This is a partial update of the user's profile, so only
+// the fields included in the request body are changed. Sending an empty string (or an empty list of genres) clears a
+// field. Setting digest to true opts the user in to the weekly digest email
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	profile, err := app.requestModels(r).Users.GetProfile(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		DisplayName    *string  `json:"display_name"`
+		Bio            *string  `json:"bio"`
+		AvatarURL      *string  `json:"avatar_url"`
+		Country        *string  `json:"country"`
+		FavoriteGenres []string `json:"favorite_genres"`
+		Digest         *bool    `json:"digest"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.DisplayName != nil {
+		profile.DisplayName = strings.TrimSpace(*input.DisplayName)
+	}
+
+	if input.Bio != nil {
+		profile.Bio = strings.TrimSpace(*input.Bio)
+	}
+
+	if input.AvatarURL != nil {
+		profile.AvatarURL = strings.TrimSpace(*input.AvatarURL)
+	}
+
+	// Country codes are stored in uppercase, like those of release dates
+	if input.Country != nil {
+		profile.Country = strings.ToUpper(strings.TrimSpace(*input.Country))
+	}
+
+	// Genres are stored in lowercase, like those of movies, so that they can be compared
+	if input.FavoriteGenres != nil {
+		profile.FavoriteGenres = make([]string, len(input.FavoriteGenres))
+		for i, genre := range input.FavoriteGenres {
+			profile.FavoriteGenres[i] = strings.ToLower(strings.TrimSpace(genre))
+		}
+	}
+
+	if input.Digest != nil {
+		profile.Digest = input.Digest
+	}
+
+	v := validator.New()
+
+	if data.ValidateProfile(v, profile); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.requestModels(r).Users.UpdateProfile(user, profile)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeCurrentUser(w, r, http.StatusOK, user, profile)
+}
+
+// showUserHandler for the "GET /v1/users/:id" endpoint. This is the public representation of a user, which other
+// users can see, so it only has their name and profile
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.requestModels(r).Users.GetPublic(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authentication describes how a request was authenticated. Requests made with an API key have the key's scopes and
+// no expiry, as API keys don't expire. Requests made by an administrator impersonating the user have the method
+// "impersonation"
+type authentication struct {
+	Method string       `json:"method"`
+	Expiry *time.Time   `json:"expiry,omitempty"`
+	APIKey *data.APIKey `json:"api_key,omitempty"`
+}
+
+// writeCurrentUser sends the private representation of the user, which is the user's account details with their
+// profile, their effective permissions and how they authenticated alongside. For requests made with an API key the
+// effective permissions are those the user has which are also in the key's scopes
+func (app *application) writeCurrentUser(w http.ResponseWriter, r *http.Request, status int, user *data.User, profile *data.Profile) {
+	permissions, err := app.requestModels(r).Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	auth := authentication{Method: "token"}
+	if app.contextGetImpersonation(r) != nil {
+		auth.Method = "impersonation"
+	}
+
+	if key := app.contextGetAPIKey(r); key != nil {
+		auth = authentication{Method: "api_key", APIKey: key}
+
+		permissions = permissions.Intersect(key.Scopes)
+	} else {
+		expiry, err := app.requestModels(r).Tokens.GetExpiry(data.ScopeAuthentication, app.contextGetToken(r))
+		switch {
+		case err == nil:
+			auth.Expiry = &expiry
+		case !errors.Is(err, data.ErrRecordNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	me := struct {
+		*data.User
+		Profile        *data.Profile    `json:"profile"`
+		Permissions    data.Permissions `json:"permissions"`
+		Authentication authentication   `json:"authentication"`
+	}{user, profile, permissions, auth}
+
+	err = app.writeJSON(w, status, envelope{"user": me}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
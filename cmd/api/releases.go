@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"strings"
+)
+
+// updateReleaseDatesHandler for the "PUT /v1/movies/:id/release-dates" endpoint. The request body holds the complete
+// list of release dates for the movie, which replaces any existing ones
+func (app *application) updateReleaseDatesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.requestModels(r).ForcePrimary().Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		ReleaseDates []data.ReleaseDate `json:"release_dates"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Country codes are stored in uppercase, but we accept them in either case
+	for i := range input.ReleaseDates {
+		input.ReleaseDates[i].Country = strings.ToUpper(input.ReleaseDates[i].Country)
+	}
+
+	v := validator.New()
+
+	v.Check(input.ReleaseDates != nil, "release_dates", "must be provided")
+
+	if data.ValidateReleaseDates(v, input.ReleaseDates); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.requestModels(r).ReleaseDates.SetForMovie(movie.ID, input.ReleaseDates)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Read the release dates back from the primary, so that the response has them in the same order as when showing
+	// the movie
+	dates, err := app.requestModels(r).ForcePrimary().ReleaseDates.GetForMovie(movie.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"release_dates": dates}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
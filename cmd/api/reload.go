@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/eazylaykzy/greenlight/internal/configfile"
+	"github.com/eazylaykzy/greenlight/internal/jsonlog"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// reloadableFlags are the flags for the settings which can be changed without restarting, by sending the process a
+// SIGHUP or with the "POST /v1/config/reload" endpoint. Everything else is only read at startup
+var reloadableFlags = []string{
+	"log-level",
+	"log-stack-traces",
+	"log-component-levels",
+	"limiter-enabled",
+	"limiter-rps",
+	"limiter-burst",
+	"limiter-user-rps",
+	"limiter-user-burst",
+	"limiter-policies",
+	"anonymous-limiter-rps",
+	"anonymous-limiter-burst",
+	"cors-trusted-origins",
+	"cors-allowed-methods",
+	"cors-allowed-headers",
+	"cors-exposed-headers",
+	"cors-max-age",
+	"cors-allow-credentials",
+	"maintenance",
+}
+
+// configReloader holds what's needed to read the config again: the flag set and the config that its flags are bound
+// to, the config file, and the flags which were given on the command line, which always keep their values. The mutex
+// stops two reloads from running at the same time, as they both write to the same config
+type configReloader struct {
+	mu      sync.Mutex
+	flags   *flag.FlagSet
+	cfg     *config
+	path    string
+	cmdline []string
+}
+
+// liveConfig returns the config with the latest values of the reloadable settings. Middleware which uses those
+// settings reads them from here rather than from app.config, which never changes once the server has started. Only
+// the reloadable settings can differ between the two
+func (app *application) liveConfig() *config {
+	if cfg, ok := app.live.Load().(*config); ok {
+		return cfg
+	}
+
+	return &app.config
+}
+
+// reloadConfig reads the reloadable settings again from the environment and the config file, and if they're valid
+// switches the server over to them. Requests which are already being handled carry on with the settings that they
+// started with. If any of the new settings is invalid, the problems are added to the validator and the current
+// settings are kept
+func (app *application) reloadConfig(v *validator.Validator) error {
+	if app.reloader == nil {
+		return errors.New("config reloading is not set up")
+	}
+
+	app.reloader.mu.Lock()
+	defer app.reloader.mu.Unlock()
+
+	var fileValues map[string]string
+
+	if app.reloader.path != "" {
+		var err error
+
+		fileValues, err = configfile.Load(app.reloader.path)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The flags are bound to the reloader's copy of the config, so this is the only config that's changed in place.
+	// It isn't read by anything else
+	err := configfile.Reload(app.reloader.flags, fileValues, "GREENLIGHT_", reloadableFlags, app.reloader.cmdline)
+	if err != nil {
+		return err
+	}
+
+	if validateConfig(v, *app.reloader.cfg); !v.Valid() {
+		return nil
+	}
+
+	live := *app.liveConfig()
+	live.logLevel = app.reloader.cfg.logLevel
+	live.log.stackTrace = app.reloader.cfg.log.stackTrace
+	live.log.components = app.reloader.cfg.log.components
+	live.limiter = app.reloader.cfg.limiter
+	live.anonymous.rps = app.reloader.cfg.anonymous.rps
+	live.anonymous.burst = app.reloader.cfg.anonymous.burst
+	live.cors = app.reloader.cfg.cors
+	live.maintenance.enabled = app.reloader.cfg.maintenance.enabled
+
+	level, err := jsonlog.ParseLevel(live.logLevel)
+	if err != nil {
+		return err
+	}
+
+	componentLevels, err := parseComponentLevels(live.log.components)
+	if err != nil {
+		return err
+	}
+
+	app.live.Store(&live)
+	app.logger.SetLevel(level)
+	app.logger.SetStackTraces(live.log.stackTrace)
+	app.logger.SetComponentLevels(componentLevels)
+
+	return nil
+}
+
+// watchReloadSignal launches a background goroutine which reloads the config each time the process receives a
+// SIGHUP. A reload which fails is logged, and the server carries on with its current settings
+func (app *application) watchReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			v := validator.New()
+
+			err := app.reloadConfig(v)
+			switch {
+			case err != nil:
+				app.logger.PrintError(err, map[string]string{"task": "reload config"})
+			case !v.Valid():
+				app.logger.PrintError(errors.New("invalid configuration, keeping the current settings"), v.Errors)
+			default:
+				app.logger.PrintInfo("reloaded config", liveSettings(app.liveConfig()))
+			}
+		}
+	}()
+}
+
+// reloadConfigHandler for the "POST /v1/config/reload" endpoint. This does the same as sending the process a SIGHUP,
+// and responds with the settings in use afterwards
+func (app *application) reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	err := app.reloadConfig(v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	settings := liveSettings(app.liveConfig())
+
+	app.logger.PrintInfo("reloaded config", app.logProperties(r, liveSettings(app.liveConfig())))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"config": settings}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// liveSettings returns the reloadable settings from the config, keyed by their flag names, for logging and for the
+// response to a reload
+func liveSettings(cfg *config) map[string]string {
+	return map[string]string{
+		"log-level":               cfg.logLevel,
+		"log-stack-traces":        strconv.FormatBool(cfg.log.stackTrace),
+		"log-component-levels":    cfg.log.components,
+		"limiter-enabled":         strconv.FormatBool(cfg.limiter.enabled),
+		"limiter-rps":             strconv.FormatFloat(cfg.limiter.rps, 'f', -1, 64),
+		"limiter-burst":           strconv.Itoa(cfg.limiter.burst),
+		"limiter-user-rps":        strconv.FormatFloat(cfg.limiter.userRPS, 'f', -1, 64),
+		"limiter-user-burst":      strconv.Itoa(cfg.limiter.userBurst),
+		"limiter-policies":        cfg.limiter.policies,
+		"anonymous-limiter-rps":   strconv.FormatFloat(cfg.anonymous.rps, 'f', -1, 64),
+		"anonymous-limiter-burst": strconv.Itoa(cfg.anonymous.burst),
+		"cors-trusted-origins":    strings.Join(cfg.cors.trustedOrigins, " "),
+		"cors-allowed-methods":    strings.Join(cfg.cors.allowedMethods, " "),
+		"cors-allowed-headers":    strings.Join(cfg.cors.allowedHeaders, " "),
+		"cors-exposed-headers":    strings.Join(cfg.cors.exposedHeaders, " "),
+		"cors-max-age":            cfg.cors.maxAge.String(),
+		"cors-allow-credentials":  strconv.FormatBool(cfg.cors.allowCredentials),
+		"maintenance":             strconv.FormatBool(cfg.maintenance.enabled),
+	}
+}
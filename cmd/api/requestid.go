@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader is the header that request IDs are read from and sent back in
+const requestIDHeader = "X-Request-ID"
+
+// requestID middleware gives each request an ID, which is sent back in the X-Request-ID response header and included
+// in the request's log entries and error responses, so that a user reporting a failure can quote it and it can be
+// found in the logs. An ID sent by the client or a proxy in the X-Request-ID header is used if it's reasonable,
+// so that the ID can be followed from one service to the next; otherwise a random one is generated
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+
+			_, err := rand.Read(b)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
+// validRequestID reports whether an incoming request ID can be used as it is. It must be no more than 128 characters
+// long, and only contain letters, digits, hyphens, underscores, dots and colons, so that it's safe to log and to put
+// in a header
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// logProperties adds the request's ID to the properties of a log entry made while handling it, so that all the log
+// entries for a request can be found together. properties can be nil, in which case a new map is returned
+func (app *application) logProperties(r *http.Request, properties map[string]string) map[string]string {
+	id := app.contextGetRequestID(r)
+	if id == "" {
+		return properties
+	}
+
+	if properties == nil {
+		properties = make(map[string]string)
+	}
+
+	properties["request_id"] = id
+
+	return properties
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
-	"expvar"
+	"github.com/eazylaykzy/greenlight/internal/prom"
+	"github.com/eazylaykzy/greenlight/internal/storage"
 	"net/http"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -11,29 +13,225 @@ func (app *application) routes() http.Handler {
 	// Initialize a new httprouter router instance.
 	router := httprouter.New()
 
-	router.NotFound = http.HandlerFunc(app.notFoundResponse)
-	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	// The middleware for the API's endpoints. Anonymous requests are rate limited by IP address, and authenticated ones
+	// by account once the user has been authenticated. The number of requests being handled at once is limited for the
+	// server and for each route. Requests are turned away early while the database's circuit breaker is open, and while
+	// the server is in maintenance mode. The middleware which every request goes through, whether it matches a route or
+	// not, wrap the whole router at the end. The rate limiters and the server's concurrency limit are shared by every
+	// route
+	limitIP, limitAccount, limitConcurrency := app.rateLimit(), app.rateLimitAccount(), app.limitConcurrency()
+	api := routeGroup{router: router, stack: stack{
+		limitIP, limitConcurrency, app.limitRouteConcurrency, app.requestDeadline, app.circuitBreaker, app.authenticate,
+		app.maintenanceMode, limitAccount,
+	}}
+
+	// The healthcheck is still served while the database is down or the server is in maintenance mode, so that the
+	// server isn't restarted by its orchestrator and the state of the breaker can be seen
+	health := routeGroup{router: router, stack: stack{limitIP, app.requestDeadline, app.authenticate, limitAccount}}
+
+	router.NotFound = api.stack.thenFunc(app.notFoundResponse)
+	router.MethodNotAllowed = api.stack.thenFunc(app.methodNotAllowedResponse)
+
+	// The groups of routes with stricter rate limits of their own, see the limiter-policies setting. auth is for the
+	// routes which check a password or a token sent by email, and for single sign-on, where starting a sign in stores
+	// its state in the database without authentication. register is for signing up
+	limitAuth := app.rateLimitPolicy("auth")
+	limitRegister := app.rateLimitPolicy("register")
+
+	// The authentication and registration endpoints only take a few short fields, so they accept much smaller request
+	// bodies than the rest, see the body-auth-max-size setting
+	smallBody := func(next http.HandlerFunc) http.HandlerFunc {
+		return app.maxBodySize(app.config.body.authMaxSize, next)
+	}
 
 	// Register the relevant methods, URL patterns and handler functions for the endpoints using the HandlerFunc() method
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	health.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
 	// Use the requirePermission() middleware on each of the /v1/movies** endpoints,
-	// passing in the required permission code as the first parameter.
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	// passing in the required permission code as the first parameter. httprouter doesn't allow fixed segments like
+	// /v1/movies/export alongside the /v1/movies/:id wildcard, so these are registered on the wildcard route with the
+	// fixedParams helper, which dispatches on the parameter value instead. The endpoints for reading movies use
+	// requireReadPermission, so that they're public when anonymous reads are enabled. Exporting the whole catalogue is
+	// too heavy for that, so it always needs the permission. The responses for listing movies, and the reviews and
+	// similar and trending movies, are cached for a while when caching is enabled. Any change to a movie, or to
+	// something shown with one, empties the cache. Showing a single movie isn't cached, as each view is counted
+	api.HandlerFunc(http.MethodGet, "/v1/movies", app.requireReadPermission("movies:read", app.cacheResponse(time.Minute, app.listMoviesHandler)))
+	api.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.invalidateCache(app.createMovieHandler)))
+	api.HandlerFunc(http.MethodDelete, "/v1/movies", app.requirePermission("movies:write", app.invalidateCache(app.batchDeleteMoviesHandler)))
+	api.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.fixedParams("id", map[string]http.HandlerFunc{
+		"export":   app.routeTimeout(app.config.server.writeTimeout, app.requirePermission("movies:read", app.exportMoviesHandler)),
+		"random":   app.requireReadPermission("movies:read", app.randomMovieHandler),
+		"trending": app.requireReadPermission("movies:read", app.cacheResponse(5*time.Minute, app.trendingMoviesHandler)),
+	}, app.requireReadPermission("movies:read", app.showMovieHandler)))
+	api.HandlerFunc(http.MethodPost, "/v1/movies/:id", app.fixedParams("id", map[string]http.HandlerFunc{
+		"import": app.routeTimeout(app.config.server.writeTimeout, app.requirePermission("movies:write", app.maxBodySize(app.config.body.importMaxSize, app.invalidateCache(app.importMoviesHandler)))),
+	}, app.methodNotAllowedResponse))
+	api.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.invalidateCache(app.updateMovieHandler)))
+	api.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.invalidateCache(app.deleteMovieHandler)))
+
+	api.HandlerFunc(http.MethodGet, "/v1/movies/:id/similar", app.requireReadPermission("movies:read", app.cacheResponse(time.Minute, app.similarMoviesHandler)))
+	api.HandlerFunc(http.MethodPut, "/v1/movies/:id/poster", app.requirePermission("movies:write", app.invalidateCache(app.uploadPosterHandler)))
+	api.HandlerFunc(http.MethodPut, "/v1/movies/:id/release-dates", app.requirePermission("movies:write", app.invalidateCache(app.updateReleaseDatesHandler)))
+	api.HandlerFunc(http.MethodPost, "/v1/movies/:id/enrich", app.requirePermission("movies:write", app.invalidateCache(app.enrichMovieHandler)))
+
+	// Reviews and ratings belong to the authenticated user. Every user has the reviews:write permission, which an API
+	// key needs as a scope to write them
+	api.HandlerFunc(http.MethodGet, "/v1/movies/:id/reviews", app.requireReadPermission("movies:read", app.cacheResponse(time.Minute, app.listReviewsHandler)))
+	api.HandlerFunc(http.MethodPost, "/v1/movies/:id/reviews", app.requirePermission("reviews:write", app.invalidateCache(app.createReviewHandler)))
+	api.HandlerFunc(http.MethodPatch, "/v1/movies/:id/reviews", app.requirePermission("reviews:write", app.invalidateCache(app.updateReviewHandler)))
+	api.HandlerFunc(http.MethodDelete, "/v1/movies/:id/reviews", app.requirePermission("reviews:write", app.invalidateCache(app.deleteReviewHandler)))
+
+	// Reviews by their own ID. Users can edit and delete their own reviews, and moderators anybody's
+	api.HandlerFunc(http.MethodPatch, "/v1/reviews/:id", app.requirePermission("reviews:write", app.requireOwnership(app.loadReview, "reviews:moderate", app.invalidateCache(app.updateReviewByIDHandler))))
+	api.HandlerFunc(http.MethodDelete, "/v1/reviews/:id", app.requirePermission("reviews:write", app.requireOwnership(app.loadReview, "reviews:moderate", app.invalidateCache(app.deleteReviewByIDHandler))))
+	api.HandlerFunc(http.MethodPost, "/v1/movies/:id/rating", app.requirePermission("reviews:write", app.invalidateCache(app.rateMovieHandler)))
+
+	// Cast and crew
+	api.HandlerFunc(http.MethodPost, "/v1/people", app.requirePermission("movies:write", app.createPersonHandler))
+	api.HandlerFunc(http.MethodGet, "/v1/people/:id", app.requirePermission("movies:read", app.showPersonHandler))
+	api.HandlerFunc(http.MethodGet, "/v1/people/:id/movies", app.requirePermission("movies:read", app.listPersonMoviesHandler))
 
 	// Users' routes and handlers
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	api.HandlerFunc(http.MethodPost, "/v1/users", limitRegister(smallBody(app.registerUserHandler)))
+	api.HandlerFunc(http.MethodPut, "/v1/users/activated", limitAuth(smallBody(app.activateUserHandler)))
+	api.HandlerFunc(http.MethodPut, "/v1/users/email/confirmed", limitAuth(smallBody(app.confirmEmailHandler)))
+	api.HandlerFunc(http.MethodGet, "/v1/users/:id", app.requireActivatedUser(app.showUserHandler))
+
+	// Opting out of the weekly digest with the token from a digest email
+	api.HandlerFunc(http.MethodPost, "/v1/digest/unsubscribe", app.unsubscribeHandler)
+
+	// Administrators can act as another user for a short time. The token can't be minted with an API key or while
+	// already impersonating someone
+	api.HandlerFunc(http.MethodPost, "/v1/users/:id/impersonation", app.requirePermission("users:impersonate", app.requireUserSession(app.createImpersonationTokenHandler)))
+
+	// The authenticated user's own account. These can't be used with an API key, so that a leaked key can't be used
+	// to take over the account
+	api.HandlerFunc(http.MethodGet, "/v1/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	api.HandlerFunc(http.MethodPatch, "/v1/me", app.requireUserSession(app.updateCurrentUserHandler))
+	api.HandlerFunc(http.MethodPut, "/v1/me/password", app.requireUserSession(app.updatePasswordHandler))
+	api.HandlerFunc(http.MethodPut, "/v1/me/email", app.requireUserSession(app.updateEmailHandler))
+	api.HandlerFunc(http.MethodPost, "/v1/me/2fa/totp", app.requireActivatedUser(app.requireUserSession(app.enrollTOTPHandler)))
+	api.HandlerFunc(http.MethodPost, "/v1/me/2fa/totp/verify", app.requireActivatedUser(app.requireUserSession(app.verifyTOTPHandler)))
+
+	// The user's sessions, that is their authentication tokens
+	api.HandlerFunc(http.MethodGet, "/v1/me/sessions", app.requireUserSession(app.listSessionsHandler))
+	api.HandlerFunc(http.MethodDelete, "/v1/me/sessions", app.requireUserSession(app.deleteOtherSessionsHandler))
+	api.HandlerFunc(http.MethodDelete, "/v1/me/sessions/:id", app.requireUserSession(app.deleteSessionHandler))
+
+	// The attempts to log in to the user's account
+	api.HandlerFunc(http.MethodGet, "/v1/me/security/events", app.requireUserSession(app.listSecurityEventsHandler))
+
+	// API keys for service integrations
+	api.HandlerFunc(http.MethodGet, "/v1/me/api-keys", app.requireActivatedUser(app.requireUserSession(app.listAPIKeysHandler)))
+	api.HandlerFunc(http.MethodPost, "/v1/me/api-keys", app.requireActivatedUser(app.requireUserSession(app.createAPIKeyHandler)))
+	api.HandlerFunc(http.MethodDelete, "/v1/me/api-keys/:id", app.requireActivatedUser(app.requireUserSession(app.deleteAPIKeyHandler)))
+
+	// Exports of everything tied to the user's account. The download link is emailed to the user and is signed rather
+	// than needing an authentication token
+	api.HandlerFunc(http.MethodPost, "/v1/me/export", app.requireUserSession(app.createDataExportHandler))
+	api.HandlerFunc(http.MethodGet, "/v1/me/exports", app.requireUserSession(app.listDataExportsHandler))
+	api.HandlerFunc(http.MethodGet, "/v1/me/exports/:id", app.requireUserSession(app.showDataExportHandler))
+	api.HandlerFunc(http.MethodGet, "/v1/exports/:id/download", app.downloadDataExportHandler)
+
+	// The authenticated user's own watchlist, which every user has the permissions for, as for reviews
+	api.HandlerFunc(http.MethodGet, "/v1/me/watchlist", app.requirePermission("watchlist:read", app.listWatchlistHandler))
+	api.HandlerFunc(http.MethodPost, "/v1/me/watchlist/:movieID", app.requirePermission("watchlist:write", app.addToWatchlistHandler))
+	api.HandlerFunc(http.MethodDelete, "/v1/me/watchlist/:movieID", app.requirePermission("watchlist:write", app.removeFromWatchlistHandler))
+
+	// Invitations to sign up, which are required when the server is in invite-only mode
+	api.HandlerFunc(http.MethodGet, "/v1/invitations", app.requirePermission("users:invite", app.listInvitationsHandler))
+	api.HandlerFunc(http.MethodPost, "/v1/invitations", app.requirePermission("users:invite", app.createInvitationHandler))
+	api.HandlerFunc(http.MethodDelete, "/v1/invitations/:id", app.requirePermission("users:invite", app.revokeInvitationHandler))
+
+	api.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", limitAuth(smallBody(app.createAuthenticationTokenHandler)))
+	api.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", limitAuth(smallBody(app.createMagicLinkHandler)))
+	api.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link/exchange", limitAuth(smallBody(app.exchangeMagicLinkHandler)))
+	api.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", limitAuth(smallBody(app.refreshAuthenticationTokenHandler)))
+	api.HandlerFunc(http.MethodGet, "/v1/tokens/oidc", limitAuth(app.createSSOAuthorizationHandler))
+	api.HandlerFunc(http.MethodPost, "/v1/tokens/oidc/callback", limitAuth(smallBody(app.ssoCallbackHandler)))
+
+	// When posters are stored on the local disk, serve them straight from the storage directory
+	if local, ok := app.storage.(*storage.Local); ok {
+		api.Handler(http.MethodGet, "/uploads/*filepath", http.StripPrefix("/uploads", http.FileServer(http.Dir(local.Dir()))))
+	}
+
+	// The operational endpoints are served on the admin listener instead, when there is one
+	if app.config.adminAddr == "" {
+		app.opsRoutes(api)
+	}
+
+	// Return the httprouter instance, wrapped in the middleware which every request goes through
+	return stack{
+		app.requestID, app.metrics, app.advertiseHTTP3, app.compress, app.recoverPanic, app.enableCORS, app.ipFilter,
+	}.then(router)
+}
+
+// opsRoutes registers the operational endpoints, for the administrators and the tools which run the server, with the
+// middleware of the api group: the metrics and the debug endpoints, the settings which can be changed while the
+// server is running, the email queue, the IP blocks, and every user's login events. They're served with the rest of
+// the API, or on the admin listener when admin-addr is set, so that they can't be reached from the internet
+func (app *application) opsRoutes(api routeGroup) {
+	// The outgoing email queue, for administrators to see the emails which are waiting to be sent and those which
+	// couldn't be, and the audit log of every attempt to send one
+	api.HandlerFunc(http.MethodGet, "/v1/emails", app.requirePermission("security:read", app.listEmailsHandler))
+	api.HandlerFunc(http.MethodGet, "/v1/emails/deliveries", app.requirePermission("security:read", app.listEmailDeliveriesHandler))
+
+	// Networks blocked while the server is running, on top of those in the ip-deny setting
+	api.HandlerFunc(http.MethodGet, "/v1/ip-blocks", app.requirePermission("security:read", app.listIPBlocksHandler))
+	api.HandlerFunc(http.MethodPost, "/v1/ip-blocks", app.requirePermission("security:write", app.createIPBlockHandler))
+	api.HandlerFunc(http.MethodDelete, "/v1/ip-blocks/:id", app.requirePermission("security:write", app.deleteIPBlockHandler))
+
+	// Every user's attempts to log in, for administrators
+	api.HandlerFunc(http.MethodGet, "/v1/security/events", app.requirePermission("security:read", app.listAllSecurityEventsHandler))
+
+	// Purge the expired tokens now, rather than waiting for the scheduled cleanup
+	api.HandlerFunc(http.MethodPost, "/v1/tokens/cleanup", app.requirePermission("security:write", app.purgeExpiredTokensHandler))
+
+	// Reload the settings which can be changed without restarting, as a SIGHUP does
+	api.HandlerFunc(http.MethodPost, "/v1/config/reload", app.requirePermission("security:write", app.reloadConfigHandler))
+
+	// Look at and change the log level while the server is running
+	api.HandlerFunc(http.MethodGet, "/v1/config/log-level", app.requirePermission("security:read", app.showLogLevelHandler))
+	api.HandlerFunc(http.MethodPut, "/v1/config/log-level", app.requirePermission("security:write", app.updateLogLevelHandler))
+
+	// Look at and switch maintenance mode while the server is running
+	api.HandlerFunc(http.MethodGet, "/v1/config/maintenance", app.requirePermission("security:read", app.showMaintenanceHandler))
+	api.HandlerFunc(http.MethodPut, "/v1/config/maintenance", app.requirePermission("security:write", app.updateMaintenanceHandler))
+
+	// Serve the Prometheus metrics. They're scraped often, and from inside the network, so they're left out of the
+	// rate limiting, and are still served while the database is down or the server is in maintenance mode
+	api.router.Handler(http.MethodGet, "/metrics", prom.Handler())
+
+	// Register the GET /debug/vars endpoint with the expvar metrics, and the runtime's profiles under /debug/pprof,
+	// unless the debug endpoints are switched off, as they are by default in production. They're only for
+	// administrators, as the profiles give away a lot about the server and are costly to gather. Gathering a CPU
+	// profile or a trace takes a while, so those requests can take as long as the write timeout
+	if app.config.debugEndpoints {
+		debug := app.requirePermission("debug:read", app.debugHandler().ServeHTTP)
+
+		api.HandlerFunc(http.MethodGet, "/debug/vars", debug)
+		api.HandlerFunc(http.MethodGet, "/debug/pprof/*profile", app.routeTimeout(app.config.server.writeTimeout, debug))
+	}
+
+	// Read the emails kept by the development mail catcher, when it's used instead of a real provider
+	if app.mailCatcher != nil {
+		api.HandlerFunc(http.MethodGet, "/debug/mail", app.listCaughtEmailsHandler)
+		api.HandlerFunc(http.MethodDelete, "/debug/mail", app.clearCaughtEmailsHandler)
+		api.HandlerFunc(http.MethodGet, "/debug/mail/:id", app.showCaughtEmailHandler)
+	}
+}
 
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+// fixedParams returns a handler for a wildcard route which sends requests where the named URL parameter has one of
+// the fixed values in the routes map to the corresponding handler, and every other request on to next
+func (app *application) fixedParams(name string, routes map[string]http.HandlerFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := httprouter.ParamsFromContext(r.Context()).ByName(name)
 
-	// Register a new GET /debug/vars endpoint pointing to the expvar handler.
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+		if handler, ok := routes[value]; ok {
+			handler(w, r)
+			return
+		}
 
-	// Return the httprouter instance.
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+		next(w, r)
+	}
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// recordLogin records an attempt to log in, in the background so that it doesn't slow down the response. user is nil
+// when the email address doesn't belong to a user. When a successful login is from a device that the user hasn't
+// logged in from before, they're sent an email about it, in case it wasn't them
+func (app *application) recordLogin(r *http.Request, user *data.User, email, method, failure string) {
+	event := &data.LoginEvent{
+		Email:     email,
+		Method:    method,
+		Success:   failure == "",
+		Reason:    failure,
+		IP:        app.clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+
+	if user != nil {
+		event.UserID = &user.ID
+		event.Email = user.Email
+	}
+
+	app.background("login event", func() {
+		newDevice := false
+
+		if user != nil && event.Success {
+			var err error
+
+			newDevice, err = app.models.LoginEvents.IsNewDevice(user.ID, event.IP, event.UserAgent)
+			if err != nil {
+				app.loggers.models.PrintError(err, app.logProperties(r, nil))
+			}
+		}
+
+		err := app.models.LoginEvents.Insert(event)
+		if err != nil {
+			app.loggers.models.PrintError(err, app.logProperties(r, nil))
+			return
+		}
+
+		if newDevice {
+			err = app.sendEmail(user.Email, "new_device_login.tmpl", map[string]interface{}{
+				"userName":  user.Name,
+				"time":      event.CreatedAt.UTC().Format(time.RFC1123),
+				"ip":        event.IP,
+				"userAgent": event.UserAgent,
+			})
+			if err != nil {
+				app.loggers.mailer.PrintError(err, app.logProperties(r, nil))
+			}
+		}
+	})
+}
+
+// listSecurityEventsHandler for the "GET /v1/me/security/events" endpoint. This lists the attempts to log in to the
+// user's account, most recent first, so that they can check for any they don't recognise
+func (app *application) listSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	app.listLoginEvents(w, r, app.contextGetUser(r).ID)
+}
+
+// listAllSecurityEventsHandler for the "GET /v1/security/events" endpoint. This lists the attempts to log in to any
+// account, for administrators. The user_id query string parameter limits the list to one user
+func (app *application) listAllSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	userID := int64(app.readInt(r.URL.Query(), "user_id", 0, v))
+	v.Check(userID >= 0, "user_id", "must be a positive integer")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.listLoginEvents(w, r, userID)
+}
+
+// listLoginEvents sends a page of login events for a user (or for every user, when userID is 0). The success query
+// string parameter limits the list to successful or failed attempts
+func (app *application) listLoginEvents(w http.ResponseWriter, r *http.Request, userID int64) {
+	var input struct {
+		Success *bool
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	if s := qs.Get("success"); s != "" {
+		success, err := strconv.ParseBool(s)
+		if err != nil {
+			v.AddError("success", "must be a boolean value")
+		}
+		input.Success = &success
+	}
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{"created_at", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.requestModels(r).LoginEvents.GetAll(userID, input.Success, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
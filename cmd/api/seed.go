@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/jsonlog"
+	"github.com/eazylaykzy/greenlight/internal/seed"
+)
+
+// seedTimeout is how long loading the sample data can take, as each user's password is hashed on the way in
+const seedTimeout = time.Minute
+
+// runSeed loads the sample set in the file at path, or the built-in set if path is empty, into the database, and logs
+// how many movies and users were added and how many were already there. The sample users have known passwords, so
+// seeding is refused in production
+func runSeed(cfg config, models data.Models, logger *jsonlog.Logger, path string) error {
+	if cfg.env == "production" {
+		return errors.New("the database can't be seeded in production")
+	}
+
+	set, err := seed.Load(path)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), seedTimeout)
+	defer cancel()
+
+	result, err := seed.Apply(ctx, models, set)
+	if err != nil {
+		return err
+	}
+
+	logger.PrintInfo("database seeded", map[string]string{
+		"movies_added":   strconv.Itoa(result.MoviesAdded),
+		"movies_skipped": strconv.Itoa(result.MoviesSkipped),
+		"users_added":    strconv.Itoa(result.UsersAdded),
+		"users_skipped":  strconv.Itoa(result.UsersSkipped),
+	})
+
+	return nil
+}
@@ -4,23 +4,92 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/systemd"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
-	"time"
 )
 
 func (app *application) serve() error {
-	// Declare an HTTP server
+	// Declare an HTTP server. It listens on the TCP port, or on a Unix domain socket when listen is set
+	addr := fmt.Sprintf(":%d", app.config.port)
+	if app.config.listen.addr != "" {
+		addr = app.config.listen.addr
+	}
+
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Addr:         addr,
 		Handler:      app.routes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  app.config.server.idleTimeout,
+		ReadTimeout:  app.config.server.readTimeout,
+		WriteTimeout: app.config.server.writeTimeout,
+	}
+
+	// Take over the socket passed by systemd with socket activation, if there is one. Otherwise listen before starting
+	// anything else, so that the server stops straight away if the address is in use
+	ln, err := app.systemdListener()
+	if err != nil {
+		return err
+	}
+
+	if ln != nil {
+		srv.Addr = ln.Addr().String()
+	} else {
+		ln, err = app.listen(addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	// When the server is serving HTTPS itself, set up its TLS config and the plain HTTP server which redirects to it
+	// and, with autocert, answers the certificate challenges
+	var httpSrv *http.Server
+
+	if app.config.tlsEnabled() {
+		var m *autocert.Manager
+
+		srv.TLSConfig, m = app.tlsConfig()
+		httpSrv = app.serveHTTP(m)
 	}
 
+	// Serve HTTP/3 alongside HTTPS, when it's enabled
+	h3Srv, err := app.serveHTTP3(srv)
+	if err != nil {
+		return err
+	}
+
+	// Serve the debug endpoints on their own loopback listener, when there is one
+	debugSrv := app.serveDebug()
+
+	// Serve the operational endpoints on the admin listener, when there is one
+	adminSrv := app.serveAdmin()
+
+	// Start flushing the buffered movie view counts to the database in the background
+	stopViewFlusher := app.startViewFlusher()
+
+	// Read the networks blocked with the "/v1/ip-blocks" endpoints, and keep reading them from the database
+	stopIPBlockRefresher := app.startIPBlockRefresher()
+
+	// Start purging the expired tokens from the database on a schedule
+	stopTokenCleaner := app.startTokenCleaner()
+
+	// Start sending the queued emails, including any left over from before the last restart
+	stopEmailWorkers := app.startEmailWorkers()
+
+	// Start sending the weekly digest emails to the users who have opted in
+	stopDigestSender := app.startDigestSender()
+
+	// Reload the reloadable settings whenever the process receives a SIGHUP
+	app.watchReloadSignal()
+
+	// Change the log level whenever the process receives a SIGUSR1 or SIGUSR2
+	app.watchLogLevelSignals()
+
 	// Create a shutdownError channel. We will use this to receive any errors returned by the graceful Shutdown function
 	shutdownError := make(chan error)
 
@@ -36,14 +105,17 @@ func (app *application) serve() error {
 		// Read the signal from the quit channel. This code will block until a signal is received
 		s := <-quit
 
+		// Let systemd know that the server is shutting down, so that it doesn't take it for a crash
+		app.notifySystemd(systemd.Stopping)
+
 		// Log a "shutting down server" message when a signal is caught. Notice that we also call the
 		// String method on the signal to get the signal name and include it in the log entry properties
 		app.logger.PrintInfo("shutting down server", map[string]string{
 			"signal": s.String(),
 		})
 
-		// Create a context with a 5-second timeout
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		// Create a context with the server-shutdown-timeout, which is how long the requests being handled have to finish
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.server.shutdownTimeout)
 		defer cancel()
 
 		// Call Shutdown() on the server like before, but now we only send on the
@@ -53,16 +125,46 @@ func (app *application) serve() error {
 			shutdownError <- err
 		}
 
+		if httpSrv != nil {
+			_ = httpSrv.Shutdown(ctx)
+		}
+
+		if debugSrv != nil {
+			_ = debugSrv.Shutdown(ctx)
+		}
+
+		if adminSrv != nil {
+			_ = adminSrv.Shutdown(ctx)
+		}
+
+		if h3Srv != nil {
+			_ = h3Srv.Close()
+		}
+
 		// Log a message to say that we're waiting for any background goroutines to
 		// complete their tasks.
 		app.logger.PrintInfo("completing background tasks", map[string]string{
-			"addr": srv.Addr,
+			"addr":    srv.Addr,
+			"timeout": app.config.server.tasksTimeout.String(),
 		})
 
-		// Call Wait() to block until our WaitGroup counter is zero --- essentially blocking until the background
-		// goroutines have finished. Then we return nil on the shutdownError channel, to indicate that the shutdown
-		// completed without any issues.
-		app.wg.Wait()
+		// Stop the workers and wait for the background goroutines to finish, for up to server-tasks-timeout, so that a
+		// task which is stuck, such as an email being retried against a provider which is down, can't stop the server
+		// from exiting. The tasks still running after that are logged and abandoned. Then we return nil on the
+		// shutdownError channel, to indicate that the shutdown completed.
+		app.waitForTasks(func() {
+			// The server is no longer handling requests, so no more views will be counted. Stop the flusher
+			// and write out whatever is left in the buffer
+			app.runTask("view flusher", stopViewFlusher)
+			app.runTask("token cleaner", stopTokenCleaner)
+			app.runTask("ip block refresher", stopIPBlockRefresher)
+			app.runTask("digest sender", stopDigestSender)
+
+			// Stop the email workers once they've finished the emails they're sending. Emails which are still queued,
+			// including any queued by the background goroutines, stay in the database and are sent after a restart
+			app.runTask("email workers", stopEmailWorkers)
+		}, app.config.server.tasksTimeout)
+
 		shutdownError <- nil
 	}()
 
@@ -70,12 +172,23 @@ func (app *application) serve() error {
 	app.logger.PrintInfo("starting server", map[string]string{
 		"addr": srv.Addr,
 		"env":  app.config.env,
+		"tls":  strconv.FormatBool(app.config.tlsEnabled()),
 	})
 
-	// Calling Shutdown on our server will cause ListenAndServe to immediately return a http.ErrServerClosed error.
+	// The server is listening, so let systemd know that it's ready, and start the watchdog's keep-alive pings
+	app.notifySystemd(systemd.Ready)
+	stopWatchdog := app.startWatchdog()
+	defer stopWatchdog()
+
+	// Calling Shutdown on our server will cause Serve to immediately return a http.ErrServerClosed error.
 	// So if we see this error, it is actually a good thing and an indication that the graceful shutdown has started.
 	// So we check specifically for this, only returning the error if it is NOT http.ErrServerClosed
-	err := srv.ListenAndServe()
+	if app.config.tlsEnabled() {
+		// With autocert the certificate and key file names are empty, as the TLS config provides the certificates
+		err = srv.ServeTLS(ln, app.config.tls.certFile, app.config.tls.keyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -94,3 +207,42 @@ func (app *application) serve() error {
 
 	return nil
 }
+
+// listen returns the listener for the server's address, which is a TCP address or, with the "unix:" prefix, the path
+// of a Unix domain socket. A socket left behind by a server which didn't shut down cleanly is removed first, as long as
+// nothing is listening on it, and the new socket is given the permissions in listen-socket-mode
+func (app *application) listen(addr string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, _ := strconv.ParseUint(app.config.listen.socketMode, 8, 32)
+
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
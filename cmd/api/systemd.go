@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/systemd"
+	"net"
+	"time"
+)
+
+// systemdListener returns the socket passed by systemd with socket activation, or nil if the server wasn't started
+// that way. When the socket unit passes more than one socket, the server's is the one named "api", with
+// FileDescriptorName=api, and the others are closed
+func (app *application) systemdListener() (net.Listener, error) {
+	listeners, err := systemd.Listeners()
+	if err != nil || len(listeners) == 0 {
+		return nil, err
+	}
+
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+
+	var api net.Listener
+
+	for _, ln := range listeners {
+		if ln.Name == "api" && api == nil {
+			api = ln
+			continue
+		}
+
+		ln.Close()
+	}
+
+	if api == nil {
+		return nil, fmt.Errorf("systemd passed %d sockets, and none of them is named api", len(listeners))
+	}
+
+	return api, nil
+}
+
+// notifySystemd tells systemd about the state of the service, when it was started by systemd. Failures are only
+// logged, as the server works just the same without
+func (app *application) notifySystemd(states ...string) {
+	if err := systemd.Notify(states...); err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// startWatchdog sends systemd's watchdog a keep-alive ping at half the interval it expects them, when the unit has
+// WatchdogSec set, so that systemd restarts the service if it hangs. It returns the function which stops the pings
+func (app *application) startWatchdog() (stop func()) {
+	interval := systemd.WatchdogInterval()
+	if interval == 0 {
+		return func() {}
+	}
+
+	app.logger.PrintInfo("starting systemd watchdog", map[string]string{
+		"interval": interval.String(),
+	})
+
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				app.notifySystemd(systemd.Watchdog)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
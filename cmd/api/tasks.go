@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errBackgroundTaskAbandoned is logged for each background task which is still running when the server stops waiting
+var errBackgroundTaskAbandoned = errors.New("background task abandoned at shutdown")
+
+// runningTask is a background task which hasn't finished yet
+type runningTask struct {
+	name    string
+	started time.Time
+}
+
+// taskList keeps track of the background tasks which are running, so that those which haven't finished when the
+// server shuts down can be logged. The zero value is ready to use
+type taskList struct {
+	mu      sync.Mutex
+	nextID  uint64
+	running map[uint64]runningTask
+}
+
+// start adds a task with the name to the list, and returns the function which takes it off again once it's finished
+func (l *taskList) start(name string) (finish func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.running == nil {
+		l.running = make(map[uint64]runningTask)
+	}
+
+	id := l.nextID
+	l.nextID++
+	l.running[id] = runningTask{name: name, started: time.Now()}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		delete(l.running, id)
+	}
+}
+
+// list returns the tasks which are running, with the longest running first
+func (l *taskList) list() []runningTask {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tasks := make([]runningTask, 0, len(l.running))
+	for _, task := range l.running {
+		tasks = append(tasks, task)
+	}
+
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].started.Before(tasks[j].started) })
+
+	return tasks
+}
+
+// runTask runs fn straight away as a task with the name, so that it's logged if it's still running when the server
+// gives up on waiting for the background tasks
+func (app *application) runTask(name string, fn func()) {
+	finish := app.tasks.start(name)
+	defer finish()
+
+	fn()
+}
+
+// waitForTasks waits for the background tasks, and the workers stopped by stopWorkers, to finish, for up to the
+// timeout. If they haven't all finished by then, the tasks still running are logged as abandoned. They carry on until
+// the process exits, and work such as a queued email is picked up again after a restart
+func (app *application) waitForTasks(stopWorkers func(), timeout time.Duration) {
+	done := make(chan struct{})
+
+	go func() {
+		stopWorkers()
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	for _, task := range app.tasks.list() {
+		app.logger.PrintError(errBackgroundTaskAbandoned, map[string]string{
+			"task":        task.name,
+			"running_for": time.Since(task.started).Round(time.Millisecond).String(),
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/jsonlog"
+)
+
+// newTestApplication returns an application with the mock models, which handles requests without a database, and
+// with the rate limiters, the cache and the mailer switched off. Log entries are thrown away
+func newTestApplication() *application {
+	logger := jsonlog.New(io.Discard, jsonlog.LevelInfo)
+
+	app := &application{
+		logger: logger,
+		models: data.NewMockModels(),
+		views:  newViewCounter(),
+	}
+
+	app.config.body.maxSize = 1_048_576
+	app.config.body.authMaxSize = 16_384
+
+	app.loggers.mailer = logger
+	app.loggers.limiter = logger
+	app.loggers.models = logger
+
+	return app
+}
+
+// testRoutes returns the routes of a test application. They're only built once for all the tests, as the metrics
+// middleware publishes its expvar variables when it's created, which can only be done once
+var testRoutes = sync.OnceValue(func() http.Handler {
+	return newTestApplication().routes()
+})
+
+// testServer serves the test application's routes for a test
+type testServer struct {
+	*httptest.Server
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	ts := httptest.NewServer(testRoutes())
+	t.Cleanup(ts.Close)
+
+	return &testServer{ts}
+}
+
+// get makes a GET request for the path, authenticated with the token if it isn't empty, and returns the response's
+// status code, headers and body
+func (ts *testServer) get(t *testing.T, path, token string, header http.Header) (int, http.Header, string) {
+	t.Helper()
+
+	return ts.do(t, http.MethodGet, path, token, header, "")
+}
+
+// do makes a request with the method and JSON body for the path, in the same way as get
+func (ts *testServer) do(t *testing.T, method, path, token string, header http.Header, body string) (int, http.Header, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rs.Body.Close()
+
+	b, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs.StatusCode, rs.Header, string(bytes.TrimSpace(b))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// tlsEnabled reports whether the server should serve HTTPS itself, either with a certificate and key from files or
+// with certificates obtained from Let's Encrypt
+func (cfg config) tlsEnabled() bool {
+	return cfg.tls.certFile != "" || len(cfg.tls.autocert.domains) > 0
+}
+
+// tlsCipherSuites are the cipher suites accepted for TLS 1.2, which are those with forward secrecy and authenticated
+// encryption. TLS 1.3's cipher suites can't be configured, and are all of this kind
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// tlsConfig returns the TLS settings for the server. Only tls-min-version and above are accepted, with the elliptic
+// curves which have assembly implementations and the cipher suites in tlsCipherSuites. HTTP/2 is offered ahead of
+// HTTP/1.1. With autocert the certificates come from the autocert manager, which is also returned so that it can
+// answer the HTTP challenges. Otherwise the manager is nil, and the certificate and key files are loaded by
+// ListenAndServeTLS
+func (app *application) tlsConfig() (*tls.Config, *autocert.Manager) {
+	minVersion := uint16(tls.VersionTLS12)
+	if app.config.tls.minVersion == "1.3" {
+		minVersion = tls.VersionTLS13
+	}
+
+	cfg := &tls.Config{
+		MinVersion:       minVersion,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites:     tlsCipherSuites,
+		NextProtos:       []string{"h2", "http/1.1"},
+	}
+
+	if len(app.config.tls.autocert.domains) == 0 {
+		return cfg, nil
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(app.config.tls.autocert.domains...),
+		Cache:      autocert.DirCache(app.config.tls.autocert.cacheDir),
+		Email:      app.config.tls.autocert.email,
+	}
+
+	// The manager answers the TLS-ALPN challenges, and fetches and renews certificates as needed
+	cfg.GetCertificate = m.GetCertificate
+	cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+
+	return cfg, m
+}
+
+// serveHTTP starts the plain HTTP server which goes alongside the HTTPS one. With autocert it listens on the autocert
+// HTTP port, and answers Let's Encrypt's HTTP challenges. Otherwise it listens on tls-redirect-port. Either way, it
+// redirects every other request to HTTPS. It returns the server, so that it can be shut down with the main one, or nil
+// if the port is disabled
+func (app *application) serveHTTP(m *autocert.Manager) *http.Server {
+	port, handler, task := app.config.tls.redirectPort, app.redirectToHTTPS(), "https redirects"
+	if m != nil {
+		port, handler, task = app.config.tls.autocert.httpPort, m.HTTPHandler(handler), "acme challenges"
+	}
+
+	if port == 0 {
+		return nil
+	}
+
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		Handler:      handler,
+		IdleTimeout:  app.config.server.idleTimeout,
+		ReadTimeout:  app.config.server.readTimeout,
+		WriteTimeout: app.config.server.writeTimeout,
+	}
+
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.logger.PrintError(err, map[string]string{"addr": srv.Addr, "task": task})
+		}
+	}()
+
+	return srv
+}
+
+// redirectToHTTPS returns a handler which permanently redirects requests to the same URL on the HTTPS server. Only GET
+// and HEAD requests are redirected, as clients may not send the body of other requests again, and others are refused
+// so that they aren't silently sent over plain HTTP
+func (app *application) redirectToHTTPS() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if app.config.port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(app.config.port))
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
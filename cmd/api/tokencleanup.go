@@ -0,0 +1,114 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// tokenCleanupMetrics publishes how much work the expired token cleanup has done, alongside the other metrics under
+// the "/debug/vars" endpoint
+var tokenCleanupMetrics = expvar.NewMap("token_cleanup")
+
+// purgeExpiredTokens deletes the tokens which expired longer ago than the configured retention period, a batch at a
+// time until there are none left, and returns how many were deleted. Expired tokens are kept for a while rather than
+// deleted straight away so that, for example, someone following an old activation link can still be sent a new one.
+// Only one purge runs at a time, so a manual purge waits for a scheduled one which is already running
+func (app *application) purgeExpiredTokens() (int64, error) {
+	app.tokenCleanup.Lock()
+	defer app.tokenCleanup.Unlock()
+
+	before := time.Now().Add(-app.config.tokens.cleanupRetention)
+
+	var total int64
+
+	for {
+		deleted, err := app.models.Tokens.DeleteExpired(before, app.config.tokens.cleanupBatchSize)
+
+		total += deleted
+		tokenCleanupMetrics.Add("purged", deleted)
+
+		if err != nil {
+			return total, err
+		}
+
+		if deleted < int64(app.config.tokens.cleanupBatchSize) {
+			break
+		}
+	}
+
+	tokenCleanupMetrics.Add("runs", 1)
+
+	lastRun := new(expvar.Int)
+	lastRun.Set(time.Now().Unix())
+	tokenCleanupMetrics.Set("last_run", lastRun)
+
+	return total, nil
+}
+
+// startTokenCleaner launches a background goroutine which purges the expired tokens at the configured interval. An
+// interval of zero disables the scheduled cleanup, leaving only the manual trigger. It returns a function which stops
+// the goroutine, waiting for a purge which is under way to finish, and which should be called during shutdown
+func (app *application) startTokenCleaner() func() {
+	if app.config.tokens.cleanupInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(app.config.tokens.cleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				purged, err := app.purgeExpiredTokens()
+				if err != nil {
+					app.loggers.models.PrintError(err, map[string]string{
+						"task":   "purge expired tokens",
+						"purged": strconv.FormatInt(purged, 10),
+					})
+					continue
+				}
+
+				if purged > 0 {
+					app.logger.PrintInfo("purged expired tokens", map[string]string{
+						"purged": strconv.FormatInt(purged, 10),
+					})
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// purgeExpiredTokensHandler for the "POST /v1/tokens/cleanup" endpoint. This lets an administrator purge the expired
+// tokens straight away, rather than waiting for the next scheduled cleanup
+func (app *application) purgeExpiredTokensHandler(w http.ResponseWriter, r *http.Request) {
+	purged, err := app.purgeExpiredTokens()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("purged expired tokens", map[string]string{
+		"purged":       strconv.FormatInt(purged, 10),
+		"requested_by": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"purged": purged}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
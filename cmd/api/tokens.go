@@ -11,8 +11,12 @@ import (
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the email and password from the request body.
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email        string `json:"email"`
+		Password     string `json:"password"`
+		TOTPCode     string `json:"totp_code"`
+		RecoveryCode string `json:"recovery_code"`
+		RememberMe   bool   `json:"remember_me"`
+		DeviceID     string `json:"device_id"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -21,10 +25,13 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	// Validate the email and password provided by the client.
+	// Validate the email and password provided by the client, and the device identifier if they want to be remembered.
 	v := validator.New()
 	data.ValidateEmail(v, input.Email)
 	data.ValidatePasswordPlaintext(v, input.Password)
+	if input.RememberMe {
+		data.ValidateDeviceID(v, input.DeviceID)
+	}
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
@@ -32,10 +39,11 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	// Lookup the user record based on the email address. If no matching user was found, then we call the
 	// app.invalidCredentialsResponse helper to send a 401 Unauthorized response to the client.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.requestModels(r).Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			app.recordLogin(r, nil, input.Email, data.LoginMethodPassword, data.LoginFailureUnknownEmail)
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -53,20 +61,323 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	// If the passwords don't match, then we call the app.invalidCredentialsResponse helper again and return.
 	if !match {
+		app.recordLogin(r, user, input.Email, data.LoginMethodPassword, data.LoginFailureInvalidPassword)
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// If the user has two-factor authentication enabled, they also need to send a code from their authenticator app
+	// (or one of their recovery codes). When neither has been sent we tell the client that a second step is needed,
+	// so that it can ask the user for a code and then repeat the request with it included
+	secret, err := app.requestModels(r).TwoFactor.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if secret != nil && secret.Enabled {
+		if input.TOTPCode == "" && input.RecoveryCode == "" {
+			app.recordLogin(r, user, user.Email, data.LoginMethodPassword, data.LoginFailureSecondFactorRequired)
+			app.twoFactorRequiredResponse(w, r)
+			return
+		}
+
+		ok, err := app.checkSecondFactor(r, user.ID, input.TOTPCode, input.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			app.recordLogin(r, user, user.Email, data.LoginMethodPassword, data.LoginFailureInvalidSecondFactor)
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+	}
+
+	// Now that we have the user's plaintext password, upgrade their password hash if it was made with an older
+	// algorithm or weaker parameters than we now use. A failure here shouldn't stop the user from signing in
+	err = app.requestModels(r).Users.RehashPassword(user, input.Password)
+	if err != nil {
+		app.loggers.models.PrintError(err, app.logProperties(r, nil))
+	}
+
+	// Otherwise, if the password is correct, we generate a new token with a 24-hour expiry time and the scope
+	// 'authentication', recording the client's IP address and user agent so the user can recognise the session later.
+	// A remember-me device token is issued alongside it if the client asked for one
+	tokens, err := app.issueLoginTokens(r, user, input.RememberMe, input.DeviceID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.recordLogin(r, user, user.Email, data.LoginMethodPassword, "")
+
+	// Encode the tokens to JSON and send them in the response along with a 201 Created status code.
+	err = app.writeJSON(w, http.StatusCreated, tokens, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// magicLinkTTL is how long a magic link can be used for. It's kept short, as anyone who gets hold of the link can use
+// it to log in
+const magicLinkTTL = 15 * time.Minute
+
+// createMagicLinkHandler for the "POST /v1/tokens/magic-link" endpoint. This emails the user a single-use login
+// token, which can be exchanged for an authentication token without the user's password. The response is the same
+// whether or not there's an account with the email address, so that the endpoint can't be used to find out who has
+// an account
+func (app *application) createMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	message := "if an account exists for this email address, a login link has been sent to it"
+
+	user, err := app.requestModels(r).Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, envelope{"message": message}, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// Only the most recently requested link can be used, so remove the tokens for any earlier requests
+	err = app.requestModels(r).Tokens.DeleteAllForUser(data.ScopeMagicLink, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.requestModels(r).Tokens.NewSingleUse(user.ID, magicLinkTTL, data.ScopeMagicLink)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background("magic link email", func() {
+		err := app.sendEmail(user.Email, "magic_link.tmpl", map[string]interface{}{
+			"userName":   user.Name,
+			"loginToken": token.Plaintext,
+		})
+		if err != nil {
+			app.loggers.mailer.PrintError(err, app.logProperties(r, nil))
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// exchangeMagicLinkHandler for the "POST /v1/tokens/magic-link/exchange" endpoint. This exchanges a magic link token
+// for a normal authentication token. Each magic link token can only be exchanged once. Users with two-factor
+// authentication enabled still need to send a code, as the link only replaces their password
+func (app *application) exchangeMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		TOTPCode       string `json:"totp_code"`
+		RecoveryCode   string `json:"recovery_code"`
+		RememberMe     bool   `json:"remember_me"`
+		DeviceID       string `json:"device_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if input.RememberMe {
+		data.ValidateDeviceID(v, input.DeviceID)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.requestModels(r).Users.GetForToken(data.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.recordLogin(r, nil, "", data.LoginMethodMagicLink, data.LoginFailureInvalidToken)
+			v.AddError("token", "invalid or expired login token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// The second factor is checked before the token is used up, so that the client can ask the user for a code and
+	// then repeat the request with the same token
+	secret, err := app.requestModels(r).TwoFactor.Get(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if secret != nil && secret.Enabled {
+		if input.TOTPCode == "" && input.RecoveryCode == "" {
+			app.recordLogin(r, user, user.Email, data.LoginMethodMagicLink, data.LoginFailureSecondFactorRequired)
+			app.twoFactorRequiredResponse(w, r)
+			return
+		}
+
+		ok, err := app.checkSecondFactor(r, user.ID, input.TOTPCode, input.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			app.recordLogin(r, user, user.Email, data.LoginMethodMagicLink, data.LoginFailureInvalidSecondFactor)
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+	}
+
+	// Use up the token. If another request has exchanged it in the meantime, this one fails
+	_, err = app.requestModels(r).Tokens.Use(data.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.recordLogin(r, user, user.Email, data.LoginMethodMagicLink, data.LoginFailureInvalidToken)
+			v.AddError("token", "invalid or expired login token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	tokens, err := app.issueLoginTokens(r, user, input.RememberMe, input.DeviceID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.recordLogin(r, user, user.Email, data.LoginMethodMagicLink, "")
+
+	err = app.writeJSON(w, http.StatusCreated, tokens, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// issueLoginTokens creates the tokens for a user who has just logged in: an authentication token, and a remember-me
+// device token too if rememberMe is set. They're returned in an envelope ready to send to the client
+func (app *application) issueLoginTokens(r *http.Request, user *data.User, rememberMe bool, deviceID string) (envelope, error) {
+	ip, userAgent := app.clientIP(r), r.UserAgent()
+
+	if !rememberMe {
+		deviceID = ""
+	}
+
+	token, err := app.requestModels(r).Tokens.NewSession(user.ID, 24*time.Hour, ip, userAgent, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := envelope{"authentication_token": token}
+
+	if rememberMe {
+		deviceToken, err := app.requestModels(r).Tokens.NewDeviceToken(user.ID, app.config.tokens.deviceTTL, ip, userAgent, deviceID)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens["device_token"] = deviceToken
+	}
+
+	return tokens, nil
+}
+
+// refreshAuthenticationTokenHandler for the "POST /v1/tokens/refresh" endpoint. This lets a client which logged in
+// with remember_me set get a new authentication token without the user logging in again, by sending its device token
+// along with the same device identifier. The device token is used up, and a new one is sent back in its place
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		DeviceToken string `json:"device_token"`
+		DeviceID    string `json:"device_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.DeviceToken != "", "device_token", "must be provided")
+	v.Check(len(input.DeviceToken) == 26, "device_token", "must be 26 bytes long")
+	data.ValidateDeviceID(v, input.DeviceID)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userID, err := app.requestModels(r).Tokens.ConsumeDeviceToken(input.DeviceToken, input.DeviceID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidDeviceTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	user, err := app.requestModels(r).Users.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidDeviceTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	tokens, err := app.issueLoginTokens(r, user, true, input.DeviceID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Encode the token to JSON and send it in the response along with a 201 Created status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJSON(w, http.StatusCreated, tokens, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/totp"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"time"
+)
+
+const (
+	// totpIssuer is the name shown for the account in the user's authenticator app
+	totpIssuer = "Greenlight"
+
+	// totpSkew is the number of time steps either side of the current one for which codes are accepted, to allow for
+	// the clock on the user's device being a little out
+	totpSkew = 1
+)
+
+// enrollTOTPHandler for the "POST /v1/me/2fa/totp" endpoint. This generates a new TOTP secret for the user and
+// returns it along with the otpauth:// provisioning URI, which the client can show as a QR code for the user to scan
+// with their authenticator app. Two-factor authentication isn't turned on until a code has been verified with the
+// "POST /v1/me/2fa/totp/verify" endpoint
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.requestModels(r).TwoFactor.Enroll(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorEnabled):
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	response := envelope{
+		"totp": map[string]string{
+			"secret":           secret,
+			"provisioning_uri": totp.ProvisioningURI(totpIssuer, user.Email, secret),
+		},
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, response, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// verifyTOTPHandler for the "POST /v1/me/2fa/totp/verify" endpoint. A valid code from the user's authenticator app
+// turns on two-factor authentication, and the response holds the user's recovery codes. These are only ever shown
+// here, so the user needs to keep them somewhere safe
+func (app *application) verifyTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	if v.Check(input.Code != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret, err := app.requestModels(r).TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "must be enrolled before it can be verified")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if secret.Enabled {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	counter, ok := totp.Validate(secret.Secret, input.Code, time.Now(), totpSkew)
+	if !ok {
+		v.AddError("code", "is incorrect or has expired")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, err := app.requestModels(r).TwoFactor.Enable(user.ID, counter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorEnabled):
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkSecondFactor is used when signing in a user who has two-factor authentication enabled. It reports whether the
+// TOTP code or the recovery code (whichever was provided) is valid. Each code can only be used once
+func (app *application) checkSecondFactor(r *http.Request, userID int64, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return app.requestModels(r).TwoFactor.UseRecoveryCode(userID, recoveryCode)
+	}
+
+	secret, err := app.requestModels(r).TwoFactor.Get(userID)
+	if err != nil {
+		return false, err
+	}
+
+	counter, ok := totp.Validate(secret.Secret, code, time.Now(), totpSkew)
+	if !ok {
+		return false, nil
+	}
+
+	return app.requestModels(r).TwoFactor.UseCounter(userID, counter)
+}
@@ -11,9 +11,10 @@ import (
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Create an anonymous struct to hold the expected data from the request body
 	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Name       string `json:"name"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		InviteCode string `json:"invite_code"`
 	}
 
 	// Parse the request body into the anonymous struct
@@ -41,15 +42,70 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	v := validator.New()
 
-	// Validate the user struct and return the error messages to the client if any of the checks fail
-	if data.ValidateUser(v, user); !v.Valid() {
+	// Validate the user struct, and check the password against the password policy. If the policy's breach lookup
+	// fails we carry on without it, as it's better to let the user sign up than to turn them away
+	data.ValidateUser(v, user)
+
+	err = app.passwords.Validate(v, "password", input.Password)
+	if err != nil {
+		app.logger.PrintError(err, app.logProperties(r, nil))
+	}
+
+	// Return the error messages to the client if any of the checks fail
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	// Insert the user data into the database
-	err = app.models.Users.Insert(user)
+	// Use up the invitation that the user is signing up with. This is only checked once everything else is valid,
+	// so that a mistake elsewhere in the request doesn't use the invitation up
+	invitation, err := app.consumeInvitation(r, v, input.InviteCode, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Insert the user data into the database, along with their permission and activation token, in one transaction so
+	// that a failure part of the way through can't leave a user who can never be activated. If this fails, the
+	// invitation is put back so that it can be used again
+	var token *data.Token
+
+	err = app.requestModels(r).WithTx(r.Context(), func(models data.Models) error {
+		err := models.Users.Insert(user)
+		if err != nil {
+			return err
+		}
+
+		if invitation != nil {
+			err = models.Invitations.SetUsedBy(invitation.ID, user.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Add the default permissions for the new user.
+		err = models.Permissions.AddForUser(user.ID, data.DefaultPermissions...)
+		if err != nil {
+			return err
+		}
+
+		// After the user record has been created in the database, generate a new activation token for the user.
+		token, err = models.Tokens.NewSingleUse(user.ID, app.config.tokens.activationTTL, data.ScopeActivation)
+		return err
+	})
 	if err != nil {
+		if invitation != nil {
+			releaseErr := app.requestModels(r).Invitations.Release(invitation.ID)
+			if releaseErr != nil {
+				app.logger.PrintError(releaseErr, app.logProperties(r, nil))
+			}
+		}
+
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError method to manually add a message
 		// to the validator instance, and then call our failedValidationResponse helper
@@ -63,34 +119,21 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Add the "movies:read" permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// After the user record has been created in the database, generate a new activation token for the user.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
 	// Launch a background goroutine to send the welcome email, with the activation token.
-	app.background(func() {
+	app.background("welcome email", func() {
 		// As there are now multiple pieces of data that we want to pass to our email templates, we create a map to act
 		// as a 'holding structure' for the data. This contains the plaintext version of the activation token for the
 		// user, along with their ID.
 		activationTokenData := map[string]interface{}{
 			"activationToken": token.Plaintext,
 			"userID":          user.ID,
+			"expiry":          humanDuration(app.config.tokens.activationTTL),
 		}
 
 		// Send the welcome email, passing in the map above as dynamic data.
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", activationTokenData)
+		err = app.sendEmail(user.Email, "user_welcome.tmpl", activationTokenData)
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			app.loggers.mailer.PrintError(err, app.logProperties(r, nil))
 		}
 	})
 
@@ -123,12 +166,38 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Retrieve the details of the user associated with the token using the GetForToken method. If no matching record
-	// is found, then we let the client know that the token they provided is not valid.
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	// is found, then we let the client know that the token they provided is not valid, unless the token has expired,
+	// in which case we say so and send the user a new one.
+	user, err := app.requestModels(r).Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired activation token")
+			expired, err := app.resendActivationToken(r, input.TokenPlaintext)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if expired {
+				v.AddError("token", "expired activation token, a new one has been sent to your email address")
+			} else {
+				v.AddError("token", "invalid activation token")
+			}
+
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// Use up the token, so that it can't be replayed. If another request has used it in the meantime, this one fails
+	_, err = app.requestModels(r).Tokens.Use(data.ScopeActivation, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid activation token")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -142,7 +211,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// Save the updated user record in our database, checking for any edit conflicts in
 	// the same way that we did for our movie records.
-	err = app.models.Users.Update(user)
+	err = app.requestModels(r).Users.Update(user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -155,7 +224,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// If everything went successfully, then we delete all activation tokens for the user.
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = app.requestModels(r).Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -167,3 +236,325 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// resendActivationToken checks whether an activation token which wasn't found is one which has expired, and if so
+// replaces it with a new token which is emailed to the user. It reports whether the token had expired. Replacing the
+// expired token means that sending it again is treated as an invalid token, so each expired token can only trigger
+// one email
+func (app *application) resendActivationToken(r *http.Request, tokenPlaintext string) (bool, error) {
+	user, err := app.requestModels(r).Users.GetForExpiredToken(data.ScopeActivation, tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	err = app.requestModels(r).Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	// A user who has activated their account since (which removes their activation tokens, so this is unlikely)
+	// doesn't need a new token
+	if user.Activated {
+		return true, nil
+	}
+
+	token, err := app.requestModels(r).Tokens.NewSingleUse(user.ID, app.config.tokens.activationTTL, data.ScopeActivation)
+	if err != nil {
+		return false, err
+	}
+
+	app.background("activation email", func() {
+		err := app.sendEmail(user.Email, "activation_token.tmpl", map[string]interface{}{
+			"activationToken": token.Plaintext,
+			"expiry":          humanDuration(app.config.tokens.activationTTL),
+		})
+		if err != nil {
+			app.loggers.mailer.PrintError(err, nil)
+		}
+	})
+
+	return true, nil
+}
+
+// updatePasswordHandler for the "PUT /v1/me/password" endpoint. The user must send their current password along with
+// the new one. Once the password has been changed, all the user's other authentication tokens are revoked, so any
+// other devices (or anyone else who knew the old password) are signed out
+func (app *application) updatePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+
+	// The basic password checks are made with a separate validator, so that the errors are reported under the
+	// new_password key rather than the password key used by ValidatePasswordPlaintext
+	pv := validator.New()
+	data.ValidatePasswordPlaintext(pv, input.NewPassword)
+	if message, ok := pv.Errors["password"]; ok {
+		v.AddError("new_password", message)
+	}
+
+	v.Check(input.NewPassword != input.CurrentPassword, "new_password", "must be different from the current password")
+
+	err = app.passwords.Validate(v, "new_password", input.NewPassword)
+	if err != nil {
+		app.logger.PrintError(err, app.logProperties(r, nil))
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("current_password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(input.NewPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.requestModels(r).Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// Revoke every authentication token for the user except the one used for this request
+	err = app.requestModels(r).Tokens.DeleteAllForUserExcept(data.ScopeAuthentication, user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.requestModels(r).Tokens.DeleteDevicesExcept(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Let the user know their password was changed, in case it wasn't them
+	app.background("password changed email", func() {
+		err := app.sendEmail(user.Email, "password_changed.tmpl", map[string]interface{}{
+			"userName": user.Name,
+		})
+		if err != nil {
+			app.loggers.mailer.PrintError(err, app.logProperties(r, nil))
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully changed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateEmailHandler for the "PUT /v1/me/email" endpoint. The new email address isn't used straight away. It's stored
+// as the user's pending email, and a confirmation token is sent to it. The email address is only changed once the
+// token is sent to the "PUT /v1/users/email/confirmed" endpoint, proving that the new address belongs to the user. A
+// notice is also sent to the old address, in case someone else is trying to take over the account
+func (app *application) updateEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Email != user.Email, "email", "must be different from the current email address")
+	v.Check(input.Password != "", "password", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Ask for the user's password, so that someone with access to an unattended session can't take over the account
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Check up front that the new address isn't already in use. The unique constraint on the email column is checked
+	// again when the change is confirmed, in case another user claims the address in the meantime
+	_, err = app.requestModels(r).Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.requestModels(r).Users.SetPendingEmail(user, input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// Only the most recently requested change can be confirmed, so remove the tokens for any earlier requests
+	err = app.requestModels(r).Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.requestModels(r).Tokens.NewSingleUse(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background("email change confirmation", func() {
+		err := app.sendEmail(input.Email, "email_change_confirm.tmpl", map[string]interface{}{
+			"userName":          user.Name,
+			"confirmationToken": token.Plaintext,
+		})
+		if err != nil {
+			app.loggers.mailer.PrintError(err, app.logProperties(r, nil))
+		}
+
+		err = app.sendEmail(user.Email, "email_change_notice.tmpl", map[string]interface{}{
+			"userName": user.Name,
+		})
+		if err != nil {
+			app.loggers.mailer.PrintError(err, app.logProperties(r, nil))
+		}
+	})
+
+	message := "a confirmation email has been sent to the new email address"
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailHandler for the "PUT /v1/users/email/confirmed" endpoint. Like activating an account, this doesn't
+// need the user to be authenticated, as having the token proves that they received the email
+func (app *application) confirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.requestModels(r).Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired confirmation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	_, err = app.requestModels(r).Tokens.Use(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired confirmation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.requestModels(r).Users.ConfirmPendingEmail(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired confirmation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	err = app.requestModels(r).Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// viewCounter buffers movie view counts in memory, so that showing a movie doesn't need a database write. The counts
+// are written to the database in a single batch each time the buffer is flushed
+type viewCounter struct {
+	mu     sync.Mutex
+	counts map[int64]int64
+}
+
+func newViewCounter() *viewCounter {
+	return &viewCounter{counts: make(map[int64]int64)}
+}
+
+// record counts a single view of a movie
+func (c *viewCounter) record(movieID int64) {
+	c.mu.Lock()
+	c.counts[movieID]++
+	c.mu.Unlock()
+}
+
+// take returns the buffered counts and resets the buffer
+func (c *viewCounter) take() map[int64]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := c.counts
+	c.counts = make(map[int64]int64)
+
+	return counts
+}
+
+// flushViews writes the buffered view counts to the database. If the write fails the counts are logged and dropped,
+// as view counts are only used for the trending listings and losing a few isn't worth retrying for
+func (app *application) flushViews() {
+	counts := app.views.take()
+
+	err := app.models.Views.Add(counts)
+	if err != nil {
+		app.loggers.models.PrintError(err, map[string]string{
+			"task": "flush movie views",
+		})
+	}
+}
+
+// startViewFlusher launches a background goroutine which flushes the buffered view counts at the configured interval.
+// It returns a function which stops the goroutine and then does a final flush, which should be called during shutdown
+// once the server has stopped accepting requests
+func (app *application) startViewFlusher() func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(app.config.views.flushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				app.flushViews()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		app.flushViews()
+	}
+}
+
+// trendingMoviesHandler for the "GET /v1/movies/trending" endpoint. The window query string parameter selects how
+// far back the views are counted, and "all" lists the most popular movies of all time
+func (app *application) trendingMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Window string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Window = app.readString(qs, "window", "week")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-views")
+	input.Filters.SortSafelist = []string{"views", "-views"}
+
+	days, ok := data.TrendingWindows[input.Window]
+	v.Check(ok, "window", "must be one of day, week, month or all")
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, metadata, err := app.requestModels(r).Views.GetTrending(days, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
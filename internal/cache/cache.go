@@ -0,0 +1,22 @@
+// Package cache stores responses for a while, so that they can be served again without doing the work of making them.
+// Every entry is dropped at once by Invalidate, when the records that the responses were made from change
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMiss is returned by Get when there's no entry for the key, or the entry has expired or been invalidated
+var (
+	ErrMiss = errors.New("cache miss")
+)
+
+// Cache is the interface that each of our cache backends implement. Get also returns the generation of the cache,
+// which goes up each time it's invalidated. It's passed back to Set, so that a value which was made before an
+// invalidation, from records which have changed since, is never served afterwards
+type Cache interface {
+	Get(key string) (value []byte, generation uint64, err error)
+	Set(key string, generation uint64, value []byte, ttl time.Duration) error
+	Invalidate() error
+}
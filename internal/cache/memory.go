@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Memory keeps the entries in the server's memory, so each server has its own cache. It holds up to a maximum number
+// of entries, after which the expired ones are dropped to make room, and then any others
+type Memory struct {
+	mu         sync.Mutex
+	maxEntries int
+	generation uint64
+	entries    map[string]memoryEntry
+}
+
+// memoryEntry is a value in the cache, with when it expires
+type memoryEntry struct {
+	value  []byte
+	expiry time.Time
+}
+
+// NewMemory returns an in-memory cache which holds up to maxEntries entries
+func NewMemory(maxEntries int) *Memory {
+	return &Memory{
+		maxEntries: maxEntries,
+		entries:    make(map[string]memoryEntry),
+	}
+}
+
+// Get returns the value stored under the key
+func (m *Memory) Get(key string) ([]byte, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, m.generation, ErrMiss
+	}
+
+	if time.Now().After(entry.expiry) {
+		delete(m.entries, key)
+		return nil, m.generation, ErrMiss
+	}
+
+	return entry.value, m.generation, nil
+}
+
+// Set stores the value under the key until the ttl runs out, unless the cache has been invalidated since the
+// generation was read
+func (m *Memory) Set(key string, generation uint64, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if generation != m.generation {
+		return nil
+	}
+
+	if _, ok := m.entries[key]; !ok && len(m.entries) >= m.maxEntries {
+		m.evict()
+	}
+
+	m.entries[key] = memoryEntry{value: value, expiry: time.Now().Add(ttl)}
+
+	return nil
+}
+
+// Invalidate drops every entry
+func (m *Memory) Invalidate() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.generation++
+	m.entries = make(map[string]memoryEntry)
+
+	return nil
+}
+
+// evict makes room for a new entry, by dropping the expired entries or, if none have expired, whichever entry comes
+// first in the map's random order. The mutex must be held
+func (m *Memory) evict() {
+	now := time.Now()
+
+	for key, entry := range m.entries {
+		if now.After(entry.expiry) {
+			delete(m.entries, key)
+		}
+	}
+
+	for key := range m.entries {
+		if len(m.entries) < m.maxEntries {
+			break
+		}
+
+		delete(m.entries, key)
+	}
+}
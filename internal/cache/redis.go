@@ -0,0 +1,296 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisTimeout is how long connecting to Redis, and each command, is allowed to take. The cache is only worth having
+// if it's quick, so a slow Redis server is treated as an error and the response is made without it
+const redisTimeout = time.Second
+
+// Redis keeps the entries in a Redis server, so that they're shared by every server. Commands are sent in the Redis
+// serialization protocol (RESP) over a small pool of connections. The generation is kept under its own key, and
+// stored at the start of each entry, so that Get can tell whether an entry was made before the last invalidation
+type Redis struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	db       int
+	prefix   string
+	idle     chan *redisConn
+}
+
+// redisConn is a connection to the Redis server
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedis returns a cache which keeps its entries in the Redis server at the URL, in the format
+// redis://[[username]:password@]host[:port][/db], or rediss:// for a TLS connection. The keys start with the prefix,
+// so that the server can be shared with other applications
+func NewRedis(rawURL, prefix string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("redis: unsupported URL scheme %q", u.Scheme)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	c := &Redis{
+		addr:   addr,
+		tls:    u.Scheme == "rediss",
+		prefix: prefix,
+		idle:   make(chan *redisConn, 16),
+	}
+
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		c.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid database %q", db)
+		}
+	}
+
+	return c, nil
+}
+
+// Get returns the value stored under the key. The generation and the entry are read with a single MGET command
+func (c *Redis) Get(key string) ([]byte, uint64, error) {
+	reply, err := c.do("MGET", c.prefix+"generation", c.prefix+"entry:"+key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return nil, 0, fmt.Errorf("redis: unexpected reply to MGET: %v", reply)
+	}
+
+	var generation uint64
+
+	if s, ok := values[0].([]byte); ok {
+		generation, err = strconv.ParseUint(string(s), 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("redis: invalid generation %q", s)
+		}
+	}
+
+	entry, ok := values[1].([]byte)
+	if !ok || len(entry) < 8 || binary.BigEndian.Uint64(entry) != generation {
+		return nil, generation, ErrMiss
+	}
+
+	return entry[8:], generation, nil
+}
+
+// Set stores the value under the key until the ttl runs out, with the generation in front of it
+func (c *Redis) Set(key string, generation uint64, value []byte, ttl time.Duration) error {
+	entry := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(entry, generation)
+	entry = append(entry, value...)
+
+	_, err := c.do("SET", c.prefix+"entry:"+key, string(entry), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+
+	return err
+}
+
+// Invalidate moves the cache on to the next generation, so that every entry stored before now is ignored. The old
+// entries are left for Redis to drop when they expire
+func (c *Redis) Invalidate() error {
+	_, err := c.do("INCR", c.prefix+"generation")
+	return err
+}
+
+// Ping checks that the Redis server can be reached and is answering commands
+func (c *Redis) Ping() error {
+	_, err := c.do("PING")
+	return err
+}
+
+// do sends a command and returns its reply. A connection is taken from the pool, or made if there isn't one, and put
+// back afterwards unless something went wrong with it
+func (c *Redis) do(args ...string) (interface{}, error) {
+	var (
+		rc  *redisConn
+		err error
+	)
+
+	select {
+	case rc = <-c.idle:
+	default:
+		rc, err = c.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(args...)
+
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+
+	return reply, err
+}
+
+// dial connects to the Redis server, then authenticates and selects the database if the URL has them
+func (c *Redis) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if c.tls {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+
+		if _, err := rc.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if c.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+// redisError is an error reply from the Redis server. The connection can still be used after one
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do sends a command as an array of bulk strings, and reads the reply
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	err := rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	return rc.readReply()
+}
+
+// readReply reads a reply, which is a string, an error, an integer, a bulk string (as a []byte, or nil if it's null)
+// or an array of replies
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk string length %q", line[1:])
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid array length %q", line[1:])
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i], err = rc.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
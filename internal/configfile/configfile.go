@@ -0,0 +1,393 @@
+// Package configfile loads settings for a command's flags from a config file and from environment variables. Rather
+// than describing the config a second time, the file's keys are the names of the flags, so every flag can be set from
+// a file. Sections are joined to the keys inside them with hyphens, so these two YAML files are the same:
+//
+//	db-dsn: postgres://greenlight@localhost/greenlight
+//	db-max-open-conns: 50
+//
+//	db:
+//	  dsn: postgres://greenlight@localhost/greenlight
+//	  max_open_conns: 50
+//
+// and so is this TOML file:
+//
+//	[db]
+//	dsn = "postgres://greenlight@localhost/greenlight"
+//	max_open_conns = 50
+//
+// Underscores in keys are treated as hyphens. Values are written the same way as they would be on the command line,
+// so durations are strings such as "15m", and lists are strings separated as described in the flag's usage:
+//
+//	cors:
+//	  trusted_origins: "https://example.com https://*.example.com"
+//	ip_allow: 10.0.0.0/8 192.168.0.0/16
+//	password_require_classes: lower,upper,digit
+//
+// Only the parts of YAML and TOML which are needed for flag values are supported. That's YAML block mappings
+// (indented with spaces) and TOML tables and dotted keys, holding scalars: numbers, booleans, and strings which are
+// unquoted (in YAML), double-quoted with backslash escapes, or single-quoted. Comments start with "#". Lists (YAML
+// "- item" sequences and "[a, b]" flow sequences, and TOML arrays), YAML "{}" flow mappings, TOML inline tables and
+// arrays of tables, multi-line strings, and YAML anchors, aliases and tags aren't supported, and are an error rather
+// than being misread. Lists are written as strings because the flags which take them don't all separate their items
+// in the same way.
+//
+// When a flag is set in more than one place, the order of precedence is:
+//
+//  1. the command-line flag
+//  2. the environment variable, named after the flag with a prefix, such as GREENLIGHT_DB_DSN for -db-dsn
+//  3. the config file
+//  4. the flag's default value, which can be changed with SetDefaults
+package configfile
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Load reads the settings from a config file. The format is chosen by the file's extension, which must be .yaml, .yml
+// or .toml. Only the subset of each format described in the package documentation is supported
+func Load(path string) (map[string]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]string
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		values, err = parseYAML(string(contents))
+	case ".toml":
+		values, err = parseTOML(string(contents))
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q (use .yaml, .yml or .toml)", ext)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return values, nil
+}
+
+// Apply sets each flag in fs which wasn't given on the command line, from its environment variable if that's set or
+// otherwise from the config file values. The environment variable for a flag is envPrefix followed by the flag name
+// in upper case, with hyphens replaced by underscores. Flags named in skip, such as the flag naming the config file,
+// are left alone. An error is returned if the config file has a key which isn't a flag, or a value which the flag
+// doesn't accept
+func Apply(fs *flag.FlagSet, values map[string]string, envPrefix string, skip ...string) error {
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		skipped[f.Name] = true
+	})
+
+	if err := checkKeys(fs, values); err != nil {
+		return err
+	}
+
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || skipped[f.Name] {
+			return
+		}
+
+		envName := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+
+		if value, ok := os.LookupEnv(envName); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value for %s: %w", envName, setErr)
+			}
+			return
+		}
+
+		if value, ok := values[f.Name]; ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value for %s in config file: %w", f.Name, setErr)
+			}
+		}
+	})
+
+	return err
+}
+
+// Reload sets the named flags again, after the environment variables or the config file have changed, so that some
+// of the settings can be changed without restarting. Each flag is set from its environment variable or config file
+// value in the same way as Apply, or back to its default value if it's no longer set in either. Flags named in
+// cmdline, which should be the flags given on the command line at startup, are left alone, as they take precedence
+// over everything else. Note that flag.FlagSet.Set marks a flag as set, so the flags set by Apply can't be told apart
+// from the ones given on the command line afterwards, which is why these need to be passed in
+func Reload(fs *flag.FlagSet, values map[string]string, envPrefix string, names, cmdline []string) error {
+	if err := checkKeys(fs, values); err != nil {
+		return err
+	}
+
+	skipped := make(map[string]bool)
+	for _, name := range cmdline {
+		skipped[name] = true
+	}
+
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown flag %s", name)
+		}
+
+		if skipped[name] {
+			continue
+		}
+
+		envName := envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+
+		value, source := f.DefValue, "default"
+		if envValue, ok := os.LookupEnv(envName); ok {
+			value, source = envValue, envName
+		} else if fileValue, ok := values[name]; ok {
+			value, source = fileValue, "config file"
+		}
+
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value for %s from %s: %w", name, source, err)
+		}
+	}
+
+	return nil
+}
+
+// SetDefaults changes the default values of flags in fs, for example to apply defaults which depend on another
+// setting. The flags which have already been set, on the command line or by Apply, keep their values, and the others
+// are set to their new defaults. As Reload sets flags which are no longer in the environment or config file back to
+// their default values, it uses the new defaults too. An error is returned if a flag doesn't exist or doesn't accept
+// its new default
+func SetDefaults(fs *flag.FlagSet, defaults map[string]string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for name, value := range defaults {
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown flag %s", name)
+		}
+
+		if !set[name] {
+			if err := f.Value.Set(value); err != nil {
+				return fmt.Errorf("invalid default for %s: %w", name, err)
+			}
+		}
+
+		f.DefValue = value
+	}
+
+	return nil
+}
+
+// checkKeys returns an error naming the keys in the config file values which aren't flags in fs
+func checkKeys(fs *flag.FlagSet, values map[string]string) error {
+	var unknown []string
+
+	for key := range values {
+		if fs.Lookup(key) == nil {
+			unknown = append(unknown, key)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown config file settings: %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// parseYAML reads a block-style YAML mapping, in which nested mappings are sections
+func parseYAML(contents string) (map[string]string, error) {
+	values := make(map[string]string)
+
+	// sections holds the open sections, each with the indentation of its key
+	type section struct {
+		indent int
+		key    string
+	}
+
+	var sections []section
+
+	for i, line := range strings.Split(contents, "\n") {
+		lineNo := i + 1
+
+		line = strings.TrimRight(stripComment(line), " \t\r")
+		if strings.TrimSpace(line) == "" || line == "---" {
+			continue
+		}
+
+		if strings.Contains(line[:len(line)-len(strings.TrimLeft(line, " \t"))], "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", lineNo)
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			return nil, fmt.Errorf("line %d: lists aren't supported, write the value as a string", lineNo)
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNo)
+		}
+
+		// Close the sections which this line isn't indented inside of
+		for len(sections) > 0 && sections[len(sections)-1].indent >= indent {
+			sections = sections[:len(sections)-1]
+		}
+
+		// Section keys already include the sections around them, so only the innermost one is needed
+		key = normalizeKey(key)
+		if len(sections) > 0 {
+			key = sections[len(sections)-1].key + "-" + key
+		}
+
+		value = strings.TrimSpace(value)
+
+		if value == "" {
+			sections = append(sections, section{indent: indent, key: key})
+			continue
+		}
+
+		parsed, err := parseValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		if _, exists := values[key]; exists {
+			return nil, fmt.Errorf("line %d: %s is set more than once", lineNo, key)
+		}
+
+		values[key] = parsed
+	}
+
+	return values, nil
+}
+
+// parseTOML reads a TOML document made up of tables and key/value pairs, in which the tables are sections
+func parseTOML(contents string) (map[string]string, error) {
+	values := make(map[string]string)
+
+	table := ""
+
+	for i, line := range strings.Split(contents, "\n") {
+		lineNo := i + 1
+
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header", lineNo)
+			}
+
+			table = normalizeKey(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected \"key = value\"", lineNo)
+		}
+
+		key = normalizeKey(key)
+		if table != "" {
+			key = table + "-" + key
+		}
+
+		parsed, err := parseValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		if _, exists := values[key]; exists {
+			return nil, fmt.Errorf("line %d: %s is set more than once", lineNo, key)
+		}
+
+		values[key] = parsed
+	}
+
+	return values, nil
+}
+
+// parseValue returns the flag value for a scalar from a config file. Quoted strings are unquoted, and anything else
+// is used as it is, which covers numbers, booleans and unquoted YAML strings. Values which start like one of the
+// unsupported parts of either format are an error
+func parseValue(value string) (string, error) {
+	switch {
+	case value == "":
+		return "", errors.New("missing value")
+	case strings.HasPrefix(value, `"""`) || strings.HasPrefix(value, "'''") || strings.ContainsAny(value[:1], "|>"):
+		return "", errors.New("multi-line strings aren't supported")
+	case strings.ContainsAny(value[:1], "&*!"):
+		return "", errors.New("anchors, aliases and tags aren't supported")
+	case strings.HasPrefix(value, `"`):
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted string %s", value)
+		}
+		return unquoted, nil
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("invalid quoted string %s", value)
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	case strings.HasPrefix(value, "[") || strings.HasPrefix(value, "{"):
+		return "", errors.New("lists and inline tables aren't supported, write the value as a string")
+	default:
+		return value, nil
+	}
+}
+
+// stripComment removes a "#" comment from the end of a line, ignoring any "#" inside a quoted string
+func stripComment(line string) string {
+	var (
+		quote   rune
+		escaped bool
+	)
+
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// normalizeKey turns a config file key into the form used by flag names. Dots (in TOML's dotted keys) and underscores
+// are both treated as hyphens
+func normalizeKey(key string) string {
+	key = strings.Trim(strings.TrimSpace(key), `"'`)
+	key = strings.ReplaceAll(key, ".", "-")
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
@@ -0,0 +1,172 @@
+package configfile
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	contents := `
+---
+# The database
+db:
+  dsn: "postgres://greenlight@localhost/greenlight?sslmode=disable#not-a-comment"
+  max_open_conns: 50 # a comment
+cors:
+  trusted-origins: "https://example.com https://*.example.com"
+ip_allow: 10.0.0.0/8 192.168.0.0/16
+password_require_classes: lower,upper,digit
+smtp.sender: 'Greenlight <no-reply@greenlight.com>'
+limiter:
+  enabled: false
+  burst:
+    size: 4
+sender_name: 'It''s Greenlight'
+`
+
+	want := map[string]string{
+		"db-dsn":                   "postgres://greenlight@localhost/greenlight?sslmode=disable#not-a-comment",
+		"db-max-open-conns":        "50",
+		"cors-trusted-origins":     "https://example.com https://*.example.com",
+		"ip-allow":                 "10.0.0.0/8 192.168.0.0/16",
+		"password-require-classes": "lower,upper,digit",
+		"smtp-sender":              "Greenlight <no-reply@greenlight.com>",
+		"limiter-enabled":          "false",
+		"limiter-burst-size":       "4",
+		"sender-name":              "It's Greenlight",
+	}
+
+	got, err := parseYAML(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	contents := `
+# The database
+port = 4000
+
+[db]
+dsn = "postgres://greenlight@localhost/greenlight"
+max_open_conns = 50 # a comment
+
+[cors]
+trusted_origins = "https://example.com https://*.example.com"
+ip.allow = '10.0.0.0/8 192.168.0.0/16'
+`
+
+	want := map[string]string{
+		"port":                 "4000",
+		"db-dsn":               "postgres://greenlight@localhost/greenlight",
+		"db-max-open-conns":    "50",
+		"cors-trusted-origins": "https://example.com https://*.example.com",
+		"cors-ip-allow":        "10.0.0.0/8 192.168.0.0/16",
+	}
+
+	got, err := parseTOML(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+// The parts of each format which aren't supported are an error, rather than being read as something else
+func TestUnsupported(t *testing.T) {
+	tests := []struct {
+		name      string
+		parse     func(string) (map[string]string, error)
+		contents  string
+		wantError string
+	}{
+		{name: "YAML block sequence", parse: parseYAML, contents: "ip_allow:\n  - 10.0.0.0/8\n", wantError: "lists aren't supported"},
+		{name: "YAML flow sequence", parse: parseYAML, contents: "ip_allow: [10.0.0.0/8]\n", wantError: "lists and inline tables aren't supported"},
+		{name: "YAML flow mapping", parse: parseYAML, contents: "db: {dsn: x}\n", wantError: "lists and inline tables aren't supported"},
+		{name: "YAML block scalar", parse: parseYAML, contents: "db_dsn: |\n  postgres://x\n", wantError: "multi-line strings aren't supported"},
+		{name: "YAML anchor", parse: parseYAML, contents: "db_dsn: &dsn postgres://x\n", wantError: "anchors, aliases and tags aren't supported"},
+		{name: "YAML tag", parse: parseYAML, contents: "port: !!str 4000\n", wantError: "anchors, aliases and tags aren't supported"},
+		{name: "YAML tab indent", parse: parseYAML, contents: "db:\n\tdsn: x\n", wantError: "indent with spaces"},
+		{name: "YAML repeated key", parse: parseYAML, contents: "db_dsn: x\ndb:\n  dsn: y\n", wantError: "db-dsn is set more than once"},
+		{name: "YAML missing colon", parse: parseYAML, contents: "db_dsn\n", wantError: `expected "key: value"`},
+		{name: "TOML array", parse: parseTOML, contents: "ip_allow = [\"10.0.0.0/8\"]\n", wantError: "lists and inline tables aren't supported"},
+		{name: "TOML inline table", parse: parseTOML, contents: "db = { dsn = \"x\" }\n", wantError: "lists and inline tables aren't supported"},
+		{name: "TOML array of tables", parse: parseTOML, contents: "[[db]]\ndsn = \"x\"\n", wantError: "invalid table header"},
+		{name: "TOML multi-line string", parse: parseTOML, contents: "db_dsn = \"\"\"x\"\"\"\n", wantError: "multi-line strings aren't supported"},
+		{name: "TOML multi-line literal string", parse: parseTOML, contents: "db_dsn = '''x'''\n", wantError: "multi-line strings aren't supported"},
+		{name: "TOML missing value", parse: parseTOML, contents: "db_dsn =\n", wantError: "missing value"},
+		{name: "TOML bad quoted string", parse: parseTOML, contents: "db_dsn = \"x\n", wantError: "invalid quoted string"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.parse(tt.contents)
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("got error %v; want one containing %q", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+
+	port := fs.Int("port", 4000, "")
+	env := fs.String("env", "development", "")
+	dsn := fs.String("db-dsn", "", "")
+	maxOpen := fs.Int("db-max-open-conns", 25, "")
+
+	err := fs.Parse([]string{"-port", "5000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TEST_ENV", "staging")
+
+	values := map[string]string{
+		"port":   "6000",
+		"env":    "production",
+		"db-dsn": "postgres://greenlight@localhost/greenlight",
+	}
+
+	err = Apply(fs, values, "TEST_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line wins over the config file, the environment wins over the config file, the config file wins
+	// over the default, and the default is used when nothing else sets the flag
+	if *port != 5000 {
+		t.Errorf("got port %d; want the command-line value 5000", *port)
+	}
+
+	if *env != "staging" {
+		t.Errorf("got env %q; want the environment value %q", *env, "staging")
+	}
+
+	if *dsn != "postgres://greenlight@localhost/greenlight" {
+		t.Errorf("got db-dsn %q; want the config file value", *dsn)
+	}
+
+	if *maxOpen != 25 {
+		t.Errorf("got db-max-open-conns %d; want the default 25", *maxOpen)
+	}
+
+	err = Apply(fs, map[string]string{"db-max-idle-conns": "5"}, "TEST_")
+	if err == nil || !strings.Contains(err.Error(), "unknown config file settings: db-max-idle-conns") {
+		t.Errorf("got error %v; want one naming the unknown setting", err)
+	}
+
+	err = Apply(fs, map[string]string{"db-max-open-conns": "lots"}, "TEST_")
+	if err == nil || !strings.Contains(err.Error(), "invalid value for db-max-open-conns in config file") {
+		t.Errorf("got error %v; want one naming the invalid setting", err)
+	}
+}
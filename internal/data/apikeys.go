@@ -0,0 +1,205 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, which makes them easy to recognise (for example, by secret scanners) and
+// distinguishes them from the tokens used by people signing in
+const apiKeyPrefix = "gl_"
+
+// APIKey struct represents a long-lived key for a machine client to authenticate with. A key acts on behalf of the
+// user who created it, but only with the permissions listed in its Scopes, and has its own rate limit in requests per
+// second. Only the hash of the key is stored. The plaintext is returned once, when the key is created, and after that
+// the key is identified by its Prefix
+type APIKey struct {
+	ID        int64       `json:"id"`
+	CreatedAt time.Time   `json:"created_at"`
+	UserID    int64       `json:"-"`
+	Name      string      `json:"name"`
+	Plaintext string      `json:"key,omitempty"`
+	Prefix    string      `json:"prefix"`
+	Hash      []byte      `json:"-"`
+	Scopes    Permissions `json:"scopes"`
+	RateLimit int         `json:"rate_limit"`
+
+	// HashVersion is the version of the pepper key that the hash was made with
+	HashVersion int `json:"-"`
+}
+
+// APIKeyModel struct which wraps the connection pool
+type APIKeyModel struct {
+	DB DBTX
+
+	requestContext
+}
+
+// New generates a new API key for a user and inserts it in the api_keys table. The returned key holds the plaintext
+func (m APIKeyModel) New(key *APIKey) error {
+	randomBytes := make([]byte, 20)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	key.Plaintext = apiKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	key.Prefix = key.Plaintext[:len(apiKeyPrefix)+6]
+
+	key.Hash, key.HashVersion = hashToken(key.Plaintext)
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, scopes, rate_limit, hash_version)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`
+
+	args := []interface{}{key.UserID, key.Name, key.Prefix, key.Hash, []string(key.Scopes), key.RateLimit,
+		key.HashVersion}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetAllForUser returns all of a specific user's API keys, newest first. The plaintext keys aren't available
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, created_at, user_id, name, prefix, scopes, rate_limit
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id DESC`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(&key.ID, &key.CreatedAt, &key.UserID, &key.Name, &key.Prefix, array((*[]string)(&key.Scopes)), &key.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetForPlaintext returns the API key with the given plaintext, along with the user that it belongs to. If there's
+// no such key, ErrRecordNotFound is returned
+func (m APIKeyModel) GetForPlaintext(plaintext string) (*APIKey, *User, error) {
+	hashes, versions := tokenHashes(plaintext)
+
+	query := `
+		SELECT api_keys.id, api_keys.created_at, api_keys.user_id, api_keys.name, api_keys.prefix, api_keys.scopes,
+			api_keys.rate_limit, users.id, users.created_at, users.name, users.email, users.password_hash,
+			users.activated, users.version
+		FROM api_keys
+		INNER JOIN users ON users.id = api_keys.user_id
+		WHERE (api_keys.hash, api_keys.hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[]))`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	var (
+		key  APIKey
+		user User
+	)
+
+	err := m.DB.QueryRowContext(ctx, query, hashes, versions).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		array((*[]string)(&key.Scopes)),
+		&key.RateLimit,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return &key, &user, nil
+}
+
+// Delete removes one of a specific user's API keys. ErrRecordNotFound is returned if the user has no key with that ID
+func (m APIKeyModel) Delete(id, userID int64) error {
+	query := `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// ValidateAPIKeyPlaintext checks that an API key is in the format we issue them in
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(strings.HasPrefix(plaintext, apiKeyPrefix), "key", "must be an API key")
+	v.Check(len(plaintext) == len(apiKeyPrefix)+32, "key", "must be 35 bytes long")
+}
+
+// ValidateAPIKey checks a new API key. The scopes must all be permissions that the user has, as a key can never do
+// more than the user who created it. The rate limit must be between 1 and maxRateLimit requests per second
+func ValidateAPIKey(v *validator.Validator, key *APIKey, permissions Permissions, maxRateLimit int) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(key.Scopes), "scopes", "must not contain duplicate values")
+
+	for _, scope := range key.Scopes {
+		v.Check(permissions.Include(scope), "scopes", "must only contain permissions that you have")
+	}
+
+	v.Check(key.RateLimit >= 1, "rate_limit", "must be at least 1")
+	v.Check(key.RateLimit <= maxRateLimit, "rate_limit", "must not be more than the maximum allowed")
+}
@@ -0,0 +1,347 @@
+package data
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/jackc/pgx/v5/pgconn"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of running a query while the circuit breaker for the database is open, so that
+// requests fail straight away rather than each waiting out the query timeout
+var ErrCircuitOpen = errors.New("database unavailable: circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets every call through. It's the state while the database is working
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a single call through, as a probe, to find out whether the database has recovered
+	BreakerHalfOpen
+	// BreakerOpen turns every call away with ErrCircuitOpen until the cooldown has passed
+	BreakerOpen
+)
+
+// String returns the name of the state
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// Breaker is a circuit breaker for a database. It opens after a number of calls in a row have failed because the
+// database couldn't be reached, and turns calls away while it's open. Once the cooldown has passed it's half-open, and
+// lets one call through: if it succeeds the breaker closes again, and if it fails the breaker opens for another cooldown
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	// OnStateChange, if set, is called with the new state each time the breaker changes state. It's called with the
+	// mutex held, so it mustn't use the breaker
+	OnStateChange func(state BreakerState)
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker returns a closed circuit breaker which opens after threshold failures in a row, and stays open for the
+// cooldown before letting a probe through
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// State returns the state of the breaker. An open breaker whose cooldown has passed is reported as half-open
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.checkCooldown()
+
+	return b.state
+}
+
+// RetryAfter returns how long is left of the cooldown while the breaker is open, and zero otherwise
+func (b *Breaker) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.checkCooldown()
+
+	if b.state != BreakerOpen {
+		return 0
+	}
+
+	return b.cooldown - time.Since(b.openedAt)
+}
+
+// allow returns ErrCircuitOpen if a call mustn't be made now. While the breaker is half-open, only the first call is
+// let through, and the others are turned away until its result is known
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.checkCooldown()
+
+	switch {
+	case b.state == BreakerOpen:
+		return ErrCircuitOpen
+	case b.state == BreakerHalfOpen && b.probing:
+		return ErrCircuitOpen
+	case b.state == BreakerHalfOpen:
+		b.probing = true
+	}
+
+	return nil
+}
+
+// record records the result of a call which was let through by allow. Only errors which show that the database
+// couldn't be reached count as failures. Others, such as constraint violations, show that it's working
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasProbe := b.probing
+	b.probing = false
+
+	switch {
+	case isUnavailable(err):
+		b.failures++
+
+		if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+			b.openedAt = time.Now()
+			b.setState(BreakerOpen)
+		}
+	case errors.Is(err, context.Canceled) || errors.Is(err, driver.ErrSkip):
+		// The call was given up on by the client, or is being retried another way, so it says nothing either way.
+		// If it was the probe, the next call is let through as the probe instead
+	default:
+		b.failures = 0
+
+		if wasProbe || b.state != BreakerClosed {
+			b.setState(BreakerClosed)
+		}
+	}
+}
+
+// checkCooldown moves an open breaker to half-open once its cooldown has passed. The mutex must be held
+func (b *Breaker) checkCooldown() {
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		b.setState(BreakerHalfOpen)
+	}
+}
+
+// setState changes the state of the breaker. The mutex must be held
+func (b *Breaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+
+	b.state = state
+
+	if b.OnStateChange != nil {
+		b.OnStateChange(state)
+	}
+}
+
+// isUnavailable reports whether an error shows that the database couldn't be reached, or didn't answer in time
+func isUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// Connection exceptions (class 08), and the server shutting down or refusing new connections (57P01 to 57P03)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "57P01", "57P02", "57P03":
+			return true
+		}
+
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+
+	return false
+}
+
+// NewBreakerConnector returns a connector for sql.OpenDB which guards the connections made by connector with the
+// circuit breaker. Making a connection, and each query, statement and transaction started on one, is turned away with
+// ErrCircuitOpen while the breaker is open, and its result is recorded with the breaker otherwise
+func NewBreakerConnector(connector driver.Connector, b *Breaker) driver.Connector {
+	return &breakerConnector{Connector: connector, breaker: b}
+}
+
+// breakerConnector is a driver.Connector whose connections are guarded by a circuit breaker
+type breakerConnector struct {
+	driver.Connector
+	breaker *Breaker
+}
+
+// Connect makes a new connection, unless the breaker is open
+func (c *breakerConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	conn, err := c.Connector.Connect(ctx)
+	c.breaker.record(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &breakerConn{conn: conn, breaker: c.breaker}, nil
+}
+
+// breakerConn is a connection whose calls are guarded by a circuit breaker. The driver's connection is expected to
+// implement the context-aware interfaces, as pgx's does
+type breakerConn struct {
+	conn    driver.Conn
+	breaker *Breaker
+}
+
+// guard runs fn unless the breaker is open, and records its result
+func (c *breakerConn) guard(fn func() error) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+
+	err := fn()
+	c.breaker.record(err)
+
+	return err
+}
+
+// Prepare and PrepareContext prepare a statement. Its executions aren't guarded, as the models don't prepare any
+func (c *breakerConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *breakerConn) PrepareContext(ctx context.Context, query string) (stmt driver.Stmt, err error) {
+	err = c.guard(func() error {
+		if p, ok := c.conn.(driver.ConnPrepareContext); ok {
+			stmt, err = p.PrepareContext(ctx, query)
+		} else {
+			stmt, err = c.conn.Prepare(query)
+		}
+
+		return err
+	})
+
+	return stmt, err
+}
+
+// Close closes the connection, whatever the state of the breaker
+func (c *breakerConn) Close() error {
+	return c.conn.Close()
+}
+
+// Begin and BeginTx start a transaction. The statements run in it go through QueryContext and ExecContext
+func (c *breakerConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *breakerConn) BeginTx(ctx context.Context, opts driver.TxOptions) (tx driver.Tx, err error) {
+	err = c.guard(func() error {
+		if b, ok := c.conn.(driver.ConnBeginTx); ok {
+			tx, err = b.BeginTx(ctx, opts)
+		} else {
+			tx, err = c.conn.Begin()
+		}
+
+		return err
+	})
+
+	return tx, err
+}
+
+// QueryContext and ExecContext run a statement. They return driver.ErrSkip if the driver's connection doesn't
+// implement them, so that database/sql prepares the statement instead
+func (c *breakerConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (rows driver.Rows, err error) {
+	q, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	err = c.guard(func() error {
+		rows, err = q.QueryContext(ctx, query, args)
+		return err
+	})
+
+	return rows, err
+}
+
+func (c *breakerConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (result driver.Result, err error) {
+	e, ok := c.conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	err = c.guard(func() error {
+		result, err = e.ExecContext(ctx, query, args)
+		return err
+	})
+
+	return result, err
+}
+
+// Ping checks that the connection is still alive
+func (c *breakerConn) Ping(ctx context.Context) error {
+	p, ok := c.conn.(driver.Pinger)
+	if !ok {
+		return nil
+	}
+
+	return c.guard(func() error {
+		return p.Ping(ctx)
+	})
+}
+
+// CheckNamedValue lets the driver check and convert the arguments of a statement itself, so that slices can be passed
+// to pgx, which sends them as arrays. The arguments are converted by database/sql otherwise
+func (c *breakerConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+
+	return driver.ErrSkip
+}
+
+// ResetSession and IsValid let the driver tell database/sql when a connection shouldn't go back into the pool
+func (c *breakerConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *breakerConn) IsValid() bool {
+	if v, ok := c.conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+
+	return true
+}
@@ -0,0 +1,127 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// DigestRecipient struct is a user who is due the weekly digest email, with what's needed to put it together
+type DigestRecipient struct {
+	UserID         int64
+	Name           string
+	Email          string
+	FavoriteGenres []string
+}
+
+// ClaimDigests picks up to limit activated users who have opted in to the digest, have at least one favorite genre,
+// and haven't been sent a digest for at least the interval, and marks them as sent now. Rows which another instance
+// is claiming at the same time are skipped, so each digest is only sent once
+func (m UserModel) ClaimDigests(interval time.Duration, limit int) ([]*DigestRecipient, error) {
+	query := `
+		UPDATE users
+		SET digest_sent_at = NOW()
+		WHERE id IN (
+			SELECT id
+			FROM users
+			WHERE digest AND activated AND cardinality(favorite_genres) > 0
+			AND (digest_sent_at IS NULL OR digest_sent_at <= NOW() - make_interval(secs => $1))
+			ORDER BY id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, name, email, favorite_genres`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, interval.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var recipients []*DigestRecipient
+
+	for rows.Next() {
+		var recipient DigestRecipient
+
+		err := rows.Scan(&recipient.UserID, &recipient.Name, &recipient.Email, array(&recipient.FavoriteGenres))
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, &recipient)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
+
+// Unsubscribe opts a user out of the digest
+func (m UserModel) Unsubscribe(userID int64) error {
+	query := `
+		UPDATE users
+		SET digest = false, version = version + 1
+		WHERE id = $1 AND digest`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+
+	return err
+}
+
+// GetAddedSince returns up to limit of the movies added since the given time which have any of the genres, newest
+// first
+func (m MovieModel) GetAddedSince(since time.Time, genres []string, limit int) ([]*Movie, error) {
+	query := `
+		SELECT id, created_at, title, year, runtime, genres, average_rating, ratings_count, version
+		FROM movies
+		WHERE created_at > $1 AND genres && $2
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, query, since, genres, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			array(&movie.Genres),
+			&movie.AverageRating,
+			&movie.RatingsCount,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
@@ -0,0 +1,123 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The outcomes recorded for attempts to send an email. An attempt which fails is either retried later or, once the
+// email has used up all of its attempts, is the one which leaves it dead
+const (
+	EmailDeliverySent    = "sent"
+	EmailDeliveryRetried = "retried"
+	EmailDeliveryDead    = "dead"
+)
+
+// EmailDelivery struct records an attempt to send an email from the queue. The recipient is only recorded as a hash
+// (see HashRecipient), so that the audit log can be kept without holding on to users' email addresses
+type EmailDelivery struct {
+	ID            int64     `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	EmailID       int64     `json:"email_id"`
+	Template      string    `json:"template"`
+	RecipientHash string    `json:"recipient_hash"`
+	Provider      string    `json:"provider"`
+	Attempt       int       `json:"attempt"`
+	DurationMS    int64     `json:"duration_ms"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// HashRecipient returns the hex encoded SHA-256 hash of an email address, ignoring case, which is how the recipient
+// is recorded in email deliveries. The deliveries for an address can be found by hashing it the same way
+func HashRecipient(email string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(hash[:])
+}
+
+// EmailDeliveryModel struct which wraps the connection pool
+type EmailDeliveryModel struct {
+	DB DBTX
+
+	requestContext
+}
+
+// Insert records an attempt to send an email
+func (m EmailDeliveryModel) Insert(delivery *EmailDelivery) error {
+	query := `
+		INSERT INTO email_deliveries (email_id, template, recipient_hash, provider, attempt, duration_ms, outcome, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`
+
+	args := []interface{}{delivery.EmailID, delivery.Template, delivery.RecipientHash, delivery.Provider,
+		delivery.Attempt, delivery.DurationMS, delivery.Outcome, delivery.Error}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&delivery.ID, &delivery.CreatedAt)
+}
+
+// GetAll returns email deliveries, most recent first by default. The list is limited to the given outcomes unless
+// outcomes is empty, to one template unless template is empty, and to one recipient unless recipientHash is empty
+func (m EmailDeliveryModel) GetAll(outcomes []string, template, recipientHash string, filters Filters) ([]*EmailDelivery, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, email_id, template, recipient_hash, provider, attempt, duration_ms,
+			outcome, error
+		FROM email_deliveries
+		WHERE (outcome = ANY($1) OR cardinality($1::text[]) = 0)
+		AND (template = $2 OR $2 = '')
+		AND (recipient_hash = $3 OR $3 = '')
+		ORDER BY %s %s, id DESC
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	args := []interface{}{outcomes, template, recipientHash, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*EmailDelivery{}
+
+	for rows.Next() {
+		var delivery EmailDelivery
+
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.EmailID,
+			&delivery.Template,
+			&delivery.RecipientHash,
+			&delivery.Provider,
+			&delivery.Attempt,
+			&delivery.DurationMS,
+			&delivery.Outcome,
+			&delivery.Error,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return deliveries, metadata, nil
+}
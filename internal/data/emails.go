@@ -0,0 +1,264 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The statuses of an email in the outgoing queue. An email is pending until a worker claims it, and sending while the
+// worker tries to send it. If that fails it goes back to pending to be retried later, until it runs out of attempts
+// and is dead. Emails which are sent are deleted from the queue
+const (
+	EmailStatusPending = "pending"
+	EmailStatusSending = "sending"
+	EmailStatusDead    = "dead"
+)
+
+// Email struct is an email waiting in the outgoing queue, or one which couldn't be sent. The email is queued already
+// rendered from its template, so that the data for the template (which can hold tokens) isn't stored, and Message and
+// Attachments aren't included in the JSON as the message can still contain links with tokens. They're only loaded by
+// Claim, and cleared when an email is dead. Data is only set for an email which was queued with the data for its
+// template, before emails were stored rendered, and numbers in it come back from the database as json.Number
+type Email struct {
+	ID            int64                  `json:"id"`
+	CreatedAt     time.Time              `json:"created_at"`
+	Recipient     string                 `json:"recipient"`
+	Template      string                 `json:"template"`
+	Message       *EmailMessage          `json:"-"`
+	Data          map[string]interface{} `json:"-"`
+	Attachments   []EmailAttachment      `json:"-"`
+	Status        string                 `json:"status"`
+	Attempts      int                    `json:"attempts"`
+	NextAttemptAt time.Time              `json:"next_attempt_at"`
+	LastError     string                 `json:"last_error,omitempty"`
+}
+
+// EmailMessage struct is the subject and bodies of a queued email, rendered from its template
+type EmailMessage struct {
+	Subject   string `json:"subject"`
+	PlainBody string `json:"plain_body"`
+	HTMLBody  string `json:"html_body"`
+}
+
+// EmailAttachment struct is a file attached to a queued email. The content is stored base64 encoded in the JSON
+type EmailAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"`
+}
+
+// EmailModel struct which wraps the connection pool
+type EmailModel struct {
+	DB DBTX
+
+	requestContext
+}
+
+// Insert adds a rendered email to the queue, to be sent as soon as a worker is free
+func (m EmailModel) Insert(email *Email) error {
+	message, err := json.Marshal(email.Message)
+	if err != nil {
+		return err
+	}
+
+	attachments := email.Attachments
+	if attachments == nil {
+		attachments = []EmailAttachment{}
+	}
+
+	attachmentsJSON, err := json.Marshal(attachments)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO emails (recipient, template, message, attachments)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, status, attempts, next_attempt_at`
+
+	args := []interface{}{email.Recipient, email.Template, message, attachmentsJSON}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&email.ID,
+		&email.CreatedAt,
+		&email.Status,
+		&email.Attempts,
+		&email.NextAttemptAt,
+	)
+}
+
+// Claim takes the next email which is due to be sent, marks it as sending and counts the attempt. The email is leased
+// to the caller: if it isn't sent, retried or killed before the lease runs out, for example because the process died
+// while sending it, another worker can claim it again. SKIP LOCKED lets the workers claim emails at the same time
+// without waiting for one another. ErrRecordNotFound is returned if no email is due
+func (m EmailModel) Claim(lease time.Duration) (*Email, error) {
+	query := `
+		UPDATE emails
+		SET status = $1, attempts = attempts + 1, next_attempt_at = NOW() + make_interval(secs => $2)
+		WHERE id = (
+			SELECT id
+			FROM emails
+			WHERE status IN ($3, $1) AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, created_at, recipient, template, message, data, attachments, status, attempts,
+			next_attempt_at, last_error`
+
+	var (
+		email       Email
+		message     []byte
+		data        []byte
+		attachments []byte
+	)
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, EmailStatusSending, lease.Seconds(), EmailStatusPending).Scan(
+		&email.ID,
+		&email.CreatedAt,
+		&email.Recipient,
+		&email.Template,
+		&message,
+		&data,
+		&attachments,
+		&email.Status,
+		&email.Attempts,
+		&email.NextAttemptAt,
+		&email.LastError,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if message != nil {
+		if err := json.Unmarshal(message, &email.Message); err != nil {
+			return nil, fmt.Errorf("decode message for email %d: %w", email.ID, err)
+		}
+	} else {
+		// The email was queued before emails were stored rendered, so it's rendered from the data for its template.
+		// Decode the numbers as json.Number, so that IDs come back exactly as they went in rather than as float64
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+
+		if err := dec.Decode(&email.Data); err != nil {
+			return nil, fmt.Errorf("decode data for email %d: %w", email.ID, err)
+		}
+	}
+
+	if err := json.Unmarshal(attachments, &email.Attachments); err != nil {
+		return nil, fmt.Errorf("decode attachments for email %d: %w", email.ID, err)
+	}
+
+	return &email, nil
+}
+
+// Delete removes an email from the queue once it has been sent
+func (m EmailModel) Delete(id int64) error {
+	query := `DELETE FROM emails WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+
+	return err
+}
+
+// Retry puts an email which couldn't be sent back in the queue, to be tried again at the given time
+func (m EmailModel) Retry(id int64, at time.Time, lastError string) error {
+	query := `
+		UPDATE emails
+		SET status = $2, next_attempt_at = $3, last_error = $4
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, EmailStatusPending, at, lastError)
+
+	return err
+}
+
+// Kill marks an email which has run out of attempts as dead. It stays in the table, where an administrator can see
+// it, but its message, attachments and any template data are cleared, as they can hold tokens and it's never sent
+func (m EmailModel) Kill(id int64, lastError string) error {
+	query := `
+		UPDATE emails
+		SET status = $2, last_error = $3, message = NULL, data = '{}', attachments = '[]'
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, EmailStatusDead, lastError)
+
+	return err
+}
+
+// GetAll returns a page of the emails in the queue, limited to one status when status isn't empty
+func (m EmailModel) GetAll(status string, filters Filters) ([]*Email, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, recipient, template, status, attempts, next_attempt_at, last_error
+		FROM emails
+		WHERE (status = $1 OR $1 = '')
+		ORDER BY %s %s, id DESC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	emails := []*Email{}
+
+	for rows.Next() {
+		var email Email
+
+		err := rows.Scan(
+			&totalRecords,
+			&email.ID,
+			&email.CreatedAt,
+			&email.Recipient,
+			&email.Template,
+			&email.Status,
+			&email.Attempts,
+			&email.NextAttemptAt,
+			&email.LastError,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		emails = append(emails, &email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return emails, metadata, nil
+}
@@ -0,0 +1,380 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrExportInProgress error for users asking for a data export while one is already being prepared for them
+var (
+	ErrExportInProgress = errors.New("export in progress")
+)
+
+// The statuses that a data export goes through. An export is pending until a worker picks it up, and then either
+// complete, when the archive is ready to download, or failed
+const (
+	ExportStatusPending  = "pending"
+	ExportStatusRunning  = "running"
+	ExportStatusComplete = "complete"
+	ExportStatusFailed   = "failed"
+)
+
+// DataExport struct tracks a request by a user for an archive of all of their data. Expiry is when the archive stops
+// being available to download, and is only set once the export is complete
+type DataExport struct {
+	ID          int64      `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UserID      int64      `json:"-"`
+	Status      string     `json:"status"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	Expiry      *time.Time `json:"expiry,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+}
+
+// ExportedReview struct is a review as it appears in a user's data export, with the title of the movie alongside
+type ExportedReview struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	MovieID    int64     `json:"movie_id"`
+	MovieTitle string    `json:"movie_title"`
+	Title      string    `json:"title"`
+	Body       string    `json:"body"`
+}
+
+// ExportedRating struct is a rating as it appears in a user's data export
+type ExportedRating struct {
+	MovieID    int64     `json:"movie_id"`
+	MovieTitle string    `json:"movie_title"`
+	Score      int16     `json:"score"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ExportedWatchlistItem struct is a movie on a user's watchlist as it appears in their data export
+type ExportedWatchlistItem struct {
+	MovieID    int64     `json:"movie_id"`
+	MovieTitle string    `json:"movie_title"`
+	AddedAt    time.Time `json:"added_at"`
+}
+
+// DataExportModel struct which wraps the connection pool
+type DataExportModel struct {
+	DB DBTX
+
+	requestContext
+}
+
+// Insert records a new pending export for a user. ErrExportInProgress is returned if the user already has an export
+// which is pending or running, which the data_exports_user_id_in_progress_idx index enforces
+func (m DataExportModel) Insert(export *DataExport) error {
+	query := `
+		INSERT INTO data_exports (user_id, status)
+		VALUES ($1, $2)
+		RETURNING id, created_at, status`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, export.UserID, ExportStatusPending).Scan(
+		&export.ID,
+		&export.CreatedAt,
+		&export.Status,
+	)
+	if err != nil {
+		switch {
+		case isConstraintViolation(err, "data_exports_user_id_in_progress_idx"):
+			return ErrExportInProgress
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get retrieves one of a user's exports. ErrRecordNotFound is returned if the user has no export with that ID
+func (m DataExportModel) Get(id, userID int64) (*DataExport, error) {
+	query := `
+		SELECT id, created_at, user_id, status, completed_at, expiry, size
+		FROM data_exports
+		WHERE id = $1 AND user_id = $2`
+
+	var export DataExport
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&export.ID,
+		&export.CreatedAt,
+		&export.UserID,
+		&export.Status,
+		&export.CompletedAt,
+		&export.Expiry,
+		&export.Size,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &export, nil
+}
+
+// GetAllForUser returns a user's exports, most recent first
+func (m DataExportModel) GetAllForUser(userID int64) ([]*DataExport, error) {
+	query := `
+		SELECT id, created_at, user_id, status, completed_at, expiry, size
+		FROM data_exports
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC`
+
+	exports := []*DataExport{}
+
+	err := m.queryForUser(query, userID, func(rows *sql.Rows) error {
+		var export DataExport
+
+		err := rows.Scan(
+			&export.ID,
+			&export.CreatedAt,
+			&export.UserID,
+			&export.Status,
+			&export.CompletedAt,
+			&export.Expiry,
+			&export.Size,
+		)
+		if err != nil {
+			return err
+		}
+
+		exports = append(exports, &export)
+		return nil
+	})
+
+	return exports, err
+}
+
+// SetRunning marks an export as having been picked up by a worker
+func (m DataExportModel) SetRunning(id int64) error {
+	query := `UPDATE data_exports SET status = $2 WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, ExportStatusRunning)
+
+	return err
+}
+
+// Complete stores the finished archive for an export, which can then be downloaded until the expiry time
+func (m DataExportModel) Complete(id int64, archive []byte, expiry time.Time) error {
+	query := `
+		UPDATE data_exports
+		SET status = $2, completed_at = NOW(), expiry = $3, size = $4, archive = $5
+		WHERE id = $1`
+
+	args := []interface{}{id, ExportStatusComplete, expiry, len(archive), archive}
+
+	ctx, cancel := context.WithTimeout(m.parent(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+
+	return err
+}
+
+// Fail marks an export as failed, so that the user can ask for another one
+func (m DataExportModel) Fail(id int64) error {
+	query := `UPDATE data_exports SET status = $2, completed_at = NOW() WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, ExportStatusFailed)
+
+	return err
+}
+
+// GetArchive returns the archive for a complete export. ErrRecordNotFound is returned if there's no such export, or
+// if it isn't complete or has expired
+func (m DataExportModel) GetArchive(id int64) ([]byte, error) {
+	query := `
+		SELECT archive
+		FROM data_exports
+		WHERE id = $1 AND status = $2 AND expiry > NOW()`
+
+	var archive []byte
+
+	ctx, cancel := context.WithTimeout(m.parent(), 10*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, ExportStatusComplete).Scan(&archive)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return archive, nil
+}
+
+// DeleteExpiredArchives frees up the space used by a user's archives which can no longer be downloaded. The export
+// records themselves are kept, so the user can still see when they asked for their data
+func (m DataExportModel) DeleteExpiredArchives(userID int64) error {
+	query := `
+		UPDATE data_exports
+		SET archive = NULL
+		WHERE user_id = $1 AND expiry <= NOW() AND archive IS NOT NULL`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+
+	return err
+}
+
+// GetReviews returns all of the reviews that a user has written, oldest first
+func (m DataExportModel) GetReviews(userID int64) ([]*ExportedReview, error) {
+	query := `
+		SELECT reviews.id, reviews.created_at, reviews.movie_id, movies.title, reviews.title, reviews.body
+		FROM reviews
+		INNER JOIN movies ON movies.id = reviews.movie_id
+		WHERE reviews.user_id = $1
+		ORDER BY reviews.created_at, reviews.id`
+
+	reviews := []*ExportedReview{}
+
+	err := m.queryForUser(query, userID, func(rows *sql.Rows) error {
+		var review ExportedReview
+
+		err := rows.Scan(&review.ID, &review.CreatedAt, &review.MovieID, &review.MovieTitle, &review.Title,
+			&review.Body)
+		if err != nil {
+			return err
+		}
+
+		reviews = append(reviews, &review)
+		return nil
+	})
+
+	return reviews, err
+}
+
+// GetRatings returns all of a user's ratings, oldest first
+func (m DataExportModel) GetRatings(userID int64) ([]*ExportedRating, error) {
+	query := `
+		SELECT ratings.movie_id, movies.title, ratings.score, ratings.created_at
+		FROM ratings
+		INNER JOIN movies ON movies.id = ratings.movie_id
+		WHERE ratings.user_id = $1
+		ORDER BY ratings.created_at, ratings.movie_id`
+
+	ratings := []*ExportedRating{}
+
+	err := m.queryForUser(query, userID, func(rows *sql.Rows) error {
+		var rating ExportedRating
+
+		err := rows.Scan(&rating.MovieID, &rating.MovieTitle, &rating.Score, &rating.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		ratings = append(ratings, &rating)
+		return nil
+	})
+
+	return ratings, err
+}
+
+// GetWatchlist returns every movie on a user's watchlist, in the order they were added
+func (m DataExportModel) GetWatchlist(userID int64) ([]*ExportedWatchlistItem, error) {
+	query := `
+		SELECT watchlist.movie_id, movies.title, watchlist.added_at
+		FROM watchlist
+		INNER JOIN movies ON movies.id = watchlist.movie_id
+		WHERE watchlist.user_id = $1
+		ORDER BY watchlist.added_at, watchlist.movie_id`
+
+	items := []*ExportedWatchlistItem{}
+
+	err := m.queryForUser(query, userID, func(rows *sql.Rows) error {
+		var item ExportedWatchlistItem
+
+		err := rows.Scan(&item.MovieID, &item.MovieTitle, &item.AddedAt)
+		if err != nil {
+			return err
+		}
+
+		items = append(items, &item)
+		return nil
+	})
+
+	return items, err
+}
+
+// GetLoginEvents returns a user's whole login history, oldest first
+func (m DataExportModel) GetLoginEvents(userID int64) ([]*LoginEvent, error) {
+	query := `
+		SELECT id, created_at, user_id, email, method, success, reason, ip, user_agent, impersonator_id
+		FROM login_events
+		WHERE user_id = $1
+		ORDER BY created_at, id`
+
+	events := []*LoginEvent{}
+
+	err := m.queryForUser(query, userID, func(rows *sql.Rows) error {
+		var event LoginEvent
+
+		err := rows.Scan(
+			&event.ID,
+			&event.CreatedAt,
+			&event.UserID,
+			&event.Email,
+			&event.Method,
+			&event.Success,
+			&event.Reason,
+			&event.IP,
+			&event.UserAgent,
+			&event.ImpersonatorID,
+		)
+		if err != nil {
+			return err
+		}
+
+		events = append(events, &event)
+		return nil
+	})
+
+	return events, err
+}
+
+// queryForUser runs a query which takes a user ID as its only argument, calling scan for each row returned
+func (m DataExportModel) queryForUser(query string, userID int64, scan func(rows *sql.Rows) error) error {
+	ctx, cancel := context.WithTimeout(m.parent(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		err := scan(rows)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -1,25 +1,81 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/eazylaykzy/greenlight/internal/validator"
 	"math"
 	"strings"
+	"time"
 )
 
+// ErrInvalidCursor is returned when a pagination cursor can't be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Filters struct holds the pagination and sorting parameters for a listing, along with the optional year and runtime
+// ranges used when listing movies. A zero value for any of the range bounds means that bound isn't applied.
+// ReleasedIn (a country code) and ReleasedBefore (a date) limit movies to those released in that country, before that
+// date, or both, and are ignored when empty.
+// If UseCursor is true, the listing uses keyset pagination instead of Page, starting after the position encoded in
+// Cursor (or at the beginning if Cursor is empty)
 type Filters struct {
-	Page         int
-	PageSize     int
-	Sort         string
-	SortSafelist []string
+	Page           int
+	PageSize       int
+	Sort           string
+	SortSafelist   []string
+	YearMin        int
+	YearMax        int
+	RuntimeMin     int
+	RuntimeMax     int
+	ReleasedIn     string
+	ReleasedBefore string
+	Cursor         string
+	UseCursor      bool
 }
 
 // Metadata struct for holding the pagination metadata
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+}
+
+// cursor holds the position of the last record on a page of a keyset paginated listing: the value of the sort column
+// and the ID of the record. The sort is included so that a cursor can't be reused with a different sort order, which
+// would make the position meaningless. The value is kept as a string and PostgreSQL converts it back to the type of
+// the sort column when it's compared
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+// encode returns the cursor as an opaque string for the client to send back to get the next page
+func (c cursor) encode() string {
+	js, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+// decodeCursor is the inverse of cursor.encode, returning ErrInvalidCursor if the string isn't a valid cursor
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	err = json.Unmarshal(js, &c)
+	if err != nil || c.ID < 1 {
+		return c, ErrInvalidCursor
+	}
+
+	return c, nil
 }
 
 // calculateMetadata function calculates the appropriate pagination metadata values given the total number of records,
@@ -46,9 +102,40 @@ func (f Filters) limit() int {
 }
 
 func (f Filters) offset() int {
+	if f.UseCursor {
+		return 0
+	}
 	return (f.Page - 1) * f.PageSize
 }
 
+// keyset returns an SQL condition which skips past the records up to and including the cursor position, for the
+// given sort expression. The listing must be ordered by the sort column and then by id ascending. The arg parameter is
+// the number of the first placeholder parameter to use, and the condition's values are returned for appending to the
+// query's args. If there's no cursor the condition is simply TRUE
+func (f Filters) keyset(column string, arg int) (string, []interface{}) {
+	if !f.UseCursor || f.Cursor == "" {
+		return "TRUE", nil
+	}
+
+	// The cursor has already been checked by ValidateFilters
+	c, _ := decodeCursor(f.Cursor)
+
+	operator := ">"
+	if f.sortDirection() == "DESC" {
+		operator = "<"
+	}
+
+	condition := fmt.Sprintf("(%[1]s %[2]s $%[3]d OR (%[1]s = $%[3]d AND id > $%[4]d))", column, operator, arg, arg+1)
+
+	return condition, []interface{}{c.Value, c.ID}
+}
+
+// nextCursor returns the cursor for the page after the one ending with the record that has the given ID and sort
+// column value
+func (f Filters) nextCursor(value string, id int64) string {
+	return cursor{Sort: f.Sort, Value: value, ID: id}.encode()
+}
+
 // sortColumn check that the client-provided Sort field matches one of the entries in our SortSafelist and if it does,
 // extract the column name from the Sort field by stripping the leading hyphen character (if one exists)
 func (f Filters) sortColumn() string {
@@ -77,4 +164,35 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+
+	// Check that the range bounds are sensible, and that each range isn't the wrong way round. The bounds are only
+	// compared with each other when both of them have been provided
+	v.Check(f.YearMin >= 0, "year_min", "must not be negative")
+	v.Check(f.YearMax >= 0, "year_max", "must not be negative")
+	v.Check(f.YearMin == 0 || f.YearMax == 0 || f.YearMin <= f.YearMax, "year_max", "must not be less than year_min")
+	v.Check(f.RuntimeMin >= 0, "runtime_min", "must not be negative")
+	v.Check(f.RuntimeMax >= 0, "runtime_max", "must not be negative")
+	v.Check(f.RuntimeMin == 0 || f.RuntimeMax == 0 || f.RuntimeMin <= f.RuntimeMax, "runtime_max",
+		"must not be less than runtime_min")
+
+	// Check the release filters are a country code and a date
+	v.Check(f.ReleasedIn == "" || validator.Matches(f.ReleasedIn, CountryRX), "released_in",
+		"must be a two letter ISO 3166-1 country code")
+
+	if f.ReleasedBefore != "" {
+		_, err := time.Parse(ReleaseDateLayout, f.ReleasedBefore)
+		v.Check(err == nil, "released_before", "must be a date in the format YYYY-MM-DD")
+	}
+
+	// Check that the cursor is one we issued for the same sort order. A cursor replaces the page parameter, so the
+	// two can't be used together
+	if f.UseCursor {
+		v.Check(f.Page == 1, "page", "must not be used with cursor")
+
+		if f.Cursor != "" {
+			c, err := decodeCursor(f.Cursor)
+			v.Check(err == nil, "cursor", "must be a cursor returned by a previous request")
+			v.Check(err != nil || c.Sort == f.Sort, "cursor", "was issued for a different sort order")
+		}
+	}
 }
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// The algorithms that new password hashes can be made with
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// argon2idPrefix starts every Argon2id hash. Hashes are stored in the PHC string format,
+// "$argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>", so the algorithm and its parameters are
+// kept with each hash. bcrypt hashes have their own "$2a$<cost>$" format, which is how the two are told apart
+const argon2idPrefix = "$argon2id$"
+
+// ErrInvalidHash is returned when a stored password hash can't be parsed
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// Argon2idParams struct holds the parameters for Argon2id hashing. Memory is in KiB
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordHashing struct sets how new password hashes are made
+type PasswordHashing struct {
+	Algorithm  string
+	Argon2id   Argon2idParams
+	BcryptCost int
+}
+
+// Hashing is the configuration used for new password hashes. It's set from the application config at startup. The
+// Argon2id defaults are the minimum recommended by OWASP, which keeps the memory used by each login modest
+var Hashing = PasswordHashing{
+	Algorithm: HashArgon2id,
+	Argon2id: Argon2idParams{
+		Memory:      19 * 1024,
+		Iterations:  2,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	},
+	BcryptCost: 12,
+}
+
+// ValidateHashing checks a password hashing configuration
+func ValidateHashing(h PasswordHashing) error {
+	switch h.Algorithm {
+	case HashArgon2id:
+		if h.Argon2id.Memory < 8*uint32(h.Argon2id.Parallelism) || h.Argon2id.Iterations < 1 || h.Argon2id.Parallelism < 1 {
+			return errors.New("argon2id needs at least 1 iteration, 1 thread, and 8 KiB of memory per thread")
+		}
+	case HashBcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown password hashing algorithm %q", h.Algorithm)
+	}
+
+	return nil
+}
+
+// hashPassword hashes a password with the current Hashing configuration
+func hashPassword(plaintextPassword string) ([]byte, error) {
+	if Hashing.Algorithm == HashBcrypt {
+		return bcrypt.GenerateFromPassword([]byte(plaintextPassword), Hashing.BcryptCost)
+	}
+
+	params := Hashing.Argon2id
+
+	salt := make([]byte, params.SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintextPassword), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	hash := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, params.Memory, params.Iterations,
+		params.Parallelism, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	return []byte(hash), nil
+}
+
+// comparePassword checks a password against a hash made with either algorithm
+func comparePassword(hash []byte, plaintextPassword string) (bool, error) {
+	if !bytes.HasPrefix(hash, []byte(argon2idPrefix)) {
+		err := bcrypt.CompareHashAndPassword(hash, []byte(plaintextPassword))
+		if err != nil {
+			switch {
+			case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+
+		return true, nil
+	}
+
+	params, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(plaintextPassword), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+// needsRehash reports whether a hash was made with a different algorithm or different parameters from the current
+// Hashing configuration
+func needsRehash(hash []byte) bool {
+	if !bytes.HasPrefix(hash, []byte(argon2idPrefix)) {
+		if Hashing.Algorithm != HashBcrypt {
+			return true
+		}
+
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost != Hashing.BcryptCost
+	}
+
+	if Hashing.Algorithm != HashArgon2id {
+		return true
+	}
+
+	params, salt, _, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+
+	current := Hashing.Argon2id
+
+	return params.Memory != current.Memory || params.Iterations != current.Iterations ||
+		params.Parallelism != current.Parallelism || params.KeyLength != current.KeyLength ||
+		uint32(len(salt)) != current.SaltLength
+}
+
+// decodeArgon2idHash parses an Argon2id hash in the PHC string format
+func decodeArgon2idHash(hash []byte) (*Argon2idParams, []byte, []byte, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	var params Argon2idParams
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrInvalidHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return &params, salt, key, nil
+}
+
+// RehashPassword replaces a user's password hash with one made with the current Hashing configuration, when the user
+// has just signed in with the plaintext password. The version isn't changed, as the password itself is the same, but
+// the hash is only replaced if it hasn't been changed in the meantime (by the user changing their password, say)
+func (m UserModel) RehashPassword(user *User, plaintextPassword string) error {
+	if !needsRehash(user.Password.hash) {
+		return nil
+	}
+
+	oldHash := user.Password.hash
+
+	err := user.Password.Set(plaintextPassword)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE users SET password_hash = $1 WHERE id = $2 AND password_hash = $3`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, user.Password.hash, user.ID, oldHash)
+
+	return err
+}
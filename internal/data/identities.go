@@ -0,0 +1,123 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// OIDCState struct holds what we need to remember about a sign in with an OpenID Connect provider between sending the
+// user to the provider and the provider sending them back. The state itself is only stored as a hash
+type OIDCState struct {
+	Nonce        string
+	CodeVerifier string
+}
+
+// IdentityModel struct which wraps the connection pool. Identities link users to their accounts with an OpenID
+// Connect provider, which are identified by the provider's issuer and the user's subject
+type IdentityModel struct {
+	DB DBTX
+
+	requestContext
+}
+
+// InsertState stores the nonce and PKCE code verifier for a sign in, keyed by its state. Expired states from sign ins
+// which were never completed are removed at the same time
+func (m IdentityModel) InsertState(state string, oidcState *OIDCState, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM oidc_states WHERE expiry < NOW()`)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO oidc_states (hash, nonce, code_verifier, expiry, hash_version)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	hash, version := hashToken(state)
+
+	_, err = m.DB.ExecContext(ctx, query, hash, oidcState.Nonce, oidcState.CodeVerifier, time.Now().Add(ttl), version)
+
+	return err
+}
+
+// ConsumeState retrieves and deletes the details of a sign in, so that each state can only be used once.
+// ErrRecordNotFound is returned if there's no such state, or it has expired
+func (m IdentityModel) ConsumeState(state string) (*OIDCState, error) {
+	query := `
+		DELETE FROM oidc_states
+		WHERE (hash, hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[])) AND expiry > NOW()
+		RETURNING nonce, code_verifier`
+
+	hashes, versions := tokenHashes(state)
+
+	var oidcState OIDCState
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hashes, versions).Scan(&oidcState.Nonce, &oidcState.CodeVerifier)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &oidcState, nil
+}
+
+// GetUser retrieves the user linked to an identity. ErrRecordNotFound is returned if the identity isn't linked to a
+// user yet
+func (m IdentityModel) GetUser(issuer, subject string) (*User, error) {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		FROM users
+		INNER JOIN user_identities ON users.id = user_identities.user_id
+		WHERE user_identities.issuer = $1 AND user_identities.subject = $2`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Link links an identity to a user
+func (m IdentityModel) Link(issuer, subject string, userID int64) error {
+	query := `
+		INSERT INTO user_identities (issuer, subject, user_id)
+		VALUES ($1, $2, $3)`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, issuer, subject, userID)
+
+	return err
+}
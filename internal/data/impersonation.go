@@ -0,0 +1,138 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Impersonation struct describes an authentication token which an administrator minted to act as another user. It's
+// kept alongside the user that a request is authenticated as, so that who is really making the request is never lost
+type Impersonation struct {
+	ImpersonatorID    int64     `json:"impersonator_id"`
+	ImpersonatorEmail string    `json:"impersonator_email"`
+	Expiry            time.Time `json:"expiry"`
+}
+
+// Get retrieves a user by their ID
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// GetForSession retrieves the user that an authentication token belongs to, like GetForToken. If the token was minted
+// by an administrator to impersonate the user, the details of the impersonation are returned too; otherwise the
+// returned Impersonation is nil
+func (m UserModel) GetForSession(tokenPlaintext string) (*User, *Impersonation, error) {
+	tokenHashes, hashVersions := tokenHashes(tokenPlaintext)
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+			users.version, tokens.expiry, impersonators.id, impersonators.email
+		FROM users
+		INNER JOIN tokens ON (users.id = tokens.user_id)
+		LEFT JOIN users AS impersonators ON (impersonators.id = tokens.impersonator_id)
+		WHERE ((tokens.hash, tokens.hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[]))
+			AND tokens.scope = $3 AND tokens.expiry > $4)`
+
+	args := []interface{}{tokenHashes, hashVersions, ScopeAuthentication, time.Now()}
+
+	var (
+		user              User
+		expiry            time.Time
+		impersonatorID    *int64
+		impersonatorEmail *string
+	)
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&expiry,
+		&impersonatorID,
+		&impersonatorEmail,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if impersonatorID == nil {
+		return &user, nil, nil
+	}
+
+	impersonation := &Impersonation{
+		ImpersonatorID:    *impersonatorID,
+		ImpersonatorEmail: *impersonatorEmail,
+		Expiry:            expiry,
+	}
+
+	return &user, impersonation, nil
+}
+
+// NewImpersonation creates an authentication token for a user on behalf of an administrator, who is recorded against
+// the token. The IP address and user agent are the administrator's, as for any other session
+func (m TokenModel) NewImpersonation(userID, impersonatorID int64, ttl time.Duration, ip, userAgent string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, impersonator_id, hash_version)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, ip, truncateUserAgent(userAgent),
+		impersonatorID, token.HashVersion}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+
+	return token, err
+}
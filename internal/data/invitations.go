@@ -0,0 +1,232 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"time"
+)
+
+// The statuses of an invitation. They aren't stored, but worked out from the used, revoked and expiry times
+const (
+	InvitationStatusPending = "pending"
+	InvitationStatusUsed    = "used"
+	InvitationStatusRevoked = "revoked"
+	InvitationStatusExpired = "expired"
+)
+
+// Invitation struct represents an invitation for someone to sign up, sent to their email address by an administrator.
+// Code holds the plaintext invite code, and is only set when the invitation is created
+type Invitation struct {
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	Email     string     `json:"email"`
+	Code      string     `json:"-"`
+	InvitedBy *int64     `json:"invited_by,omitempty"`
+	Expiry    time.Time  `json:"expiry"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	UsedBy    *int64     `json:"used_by,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Status    string     `json:"status"`
+}
+
+// ValidateInviteCode checks that an invite code has been provided and is in the same format as our tokens
+func ValidateInviteCode(v *validator.Validator, code string) {
+	v.Check(code != "", "invite_code", "must be provided")
+	v.Check(len(code) == 26, "invite_code", "must be 26 bytes long")
+}
+
+// InvitationModel struct which wraps the connection pool
+type InvitationModel struct {
+	DB DBTX
+
+	requestContext
+}
+
+// New creates an invitation for an email address, which can be used until the ttl runs out. The invite codes are
+// made in the same way as our tokens, and only their hashes are stored
+func (m InvitationModel) New(email string, invitedBy int64, ttl time.Duration) (*Invitation, error) {
+	token, err := generateToken(0, ttl, "")
+	if err != nil {
+		return nil, err
+	}
+
+	invitation := &Invitation{
+		Email:     email,
+		Code:      token.Plaintext,
+		InvitedBy: &invitedBy,
+		Expiry:    token.Expiry,
+		Status:    InvitationStatusPending,
+	}
+
+	query := `
+		INSERT INTO invitations (email, hash, invited_by, expiry, hash_version)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, expiry`
+
+	args := []interface{}{email, token.Hash, invitedBy, token.Expiry, token.HashVersion}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt, &invitation.Expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+// GetAll returns a page of invitations, most recent first by default. If status isn't empty only the invitations
+// with that status are returned
+func (m InvitationModel) GetAll(status string, filters Filters) ([]*Invitation, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, email, invited_by, expiry, used_at, used_by, revoked_at, status
+		FROM (
+			SELECT *, CASE
+				WHEN used_at IS NOT NULL THEN 'used'
+				WHEN revoked_at IS NOT NULL THEN 'revoked'
+				WHEN expiry <= NOW() THEN 'expired'
+				ELSE 'pending'
+			END AS status
+			FROM invitations
+		) AS invitations
+		WHERE (status = $1 OR $1 = '')
+		ORDER BY %s %s, id DESC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	invitations := []*Invitation{}
+
+	for rows.Next() {
+		var invitation Invitation
+
+		err := rows.Scan(
+			&totalRecords,
+			&invitation.ID,
+			&invitation.CreatedAt,
+			&invitation.Email,
+			&invitation.InvitedBy,
+			&invitation.Expiry,
+			&invitation.UsedAt,
+			&invitation.UsedBy,
+			&invitation.RevokedAt,
+			&invitation.Status,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		invitations = append(invitations, &invitation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return invitations, metadata, nil
+}
+
+// Revoke stops a pending invitation from being used. ErrRecordNotFound is returned if there's no pending invitation
+// with that ID
+func (m InvitationModel) Revoke(id int64) error {
+	query := `
+		UPDATE invitations
+		SET revoked_at = NOW()
+		WHERE id = $1 AND used_at IS NULL AND revoked_at IS NULL AND expiry > NOW()`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Consume uses up the pending invitation with the given code, which must have been sent to the given email address.
+// This is done in a single UPDATE so that two sign-ups can't both use the same invitation. ErrRecordNotFound is
+// returned if there's no such pending invitation
+func (m InvitationModel) Consume(code, email string) (*Invitation, error) {
+	query := `
+		UPDATE invitations
+		SET used_at = NOW()
+		WHERE (hash, hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[]))
+		AND email = $3 AND used_at IS NULL AND revoked_at IS NULL AND expiry > NOW()
+		RETURNING id, created_at, email, invited_by, expiry, used_at`
+
+	hashes, versions := tokenHashes(code)
+
+	invitation := Invitation{Status: InvitationStatusUsed}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hashes, versions, email).Scan(
+		&invitation.ID,
+		&invitation.CreatedAt,
+		&invitation.Email,
+		&invitation.InvitedBy,
+		&invitation.Expiry,
+		&invitation.UsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
+
+// Release puts back an invitation which was consumed by a sign-up that then failed, so that it can be used again
+func (m InvitationModel) Release(id int64) error {
+	query := `UPDATE invitations SET used_at = NULL WHERE id = $1 AND used_by IS NULL`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+
+	return err
+}
+
+// SetUsedBy records the user who signed up with an invitation
+func (m InvitationModel) SetUsedBy(id, userID int64) error {
+	query := `UPDATE invitations SET used_by = $2 WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, userID)
+
+	return err
+}
@@ -0,0 +1,194 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net"
+	"time"
+)
+
+// ErrDuplicateIPBlock error for blocking a network which is already blocked
+var ErrDuplicateIPBlock = errors.New("duplicate ip block")
+
+// IPBlock struct represents a network which an administrator has blocked while the server is running, such as the
+// range that an abusive client is sending requests from. The block is lifted at its expiry, if it has one
+type IPBlock struct {
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	Network   string     `json:"network"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedBy *int64     `json:"created_by,omitempty"`
+	Expiry    *time.Time `json:"expiry,omitempty"`
+}
+
+// ValidateIPBlock checks that the network is an IP address or a network in CIDR notation, and that the expiry, if
+// there is one, is in the future
+func ValidateIPBlock(v *validator.Validator, block *IPBlock) {
+	v.Check(block.Network != "", "network", "must be provided")
+
+	if block.Network != "" && net.ParseIP(block.Network) == nil {
+		_, _, err := net.ParseCIDR(block.Network)
+		v.Check(err == nil, "network", "must be an IP address or a network in CIDR notation")
+	}
+
+	v.Check(len(block.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+	v.Check(block.Expiry == nil || block.Expiry.After(time.Now()), "expiry", "must be in the future")
+}
+
+// IPBlockModel struct which wraps the connection pool
+type IPBlockModel struct {
+	DB DBTX
+
+	requestContext
+}
+
+// Insert blocks a network. The network is stored as a PostgreSQL cidr, so a bare IP address becomes a network of one
+// address, and the normalised network is read back into the IPBlock. A block on the same network which has expired is
+// replaced, and ErrDuplicateIPBlock is returned if the network is still blocked
+func (m IPBlockModel) Insert(block *IPBlock) error {
+	query := `
+		INSERT INTO ip_blocks (network, reason, created_by, expiry)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (network) DO UPDATE
+		SET created_at = NOW(), reason = EXCLUDED.reason, created_by = EXCLUDED.created_by, expiry = EXCLUDED.expiry
+		WHERE ip_blocks.expiry <= NOW()
+		RETURNING id, created_at, network`
+
+	args := []interface{}{block.Network, block.Reason, block.CreatedBy, block.Expiry}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	// When the network is still blocked, the update doesn't happen and no row is returned
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&block.ID, &block.CreatedAt, &block.Network)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrDuplicateIPBlock
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAll returns a page of the blocks which haven't expired, most recent first by default
+func (m IPBlockModel) GetAll(filters Filters) ([]*IPBlock, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, network, reason, created_by, expiry
+		FROM ip_blocks
+		WHERE expiry IS NULL OR expiry > NOW()
+		ORDER BY %s %s, id DESC
+		LIMIT $1 OFFSET $2`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	blocks := []*IPBlock{}
+
+	for rows.Next() {
+		var block IPBlock
+
+		err := rows.Scan(
+			&totalRecords,
+			&block.ID,
+			&block.CreatedAt,
+			&block.Network,
+			&block.Reason,
+			&block.CreatedBy,
+			&block.Expiry,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		blocks = append(blocks, &block)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return blocks, metadata, nil
+}
+
+// GetActiveNetworks returns every network which is blocked at the moment, in CIDR notation, for the servers to keep
+// in memory
+func (m IPBlockModel) GetActiveNetworks() ([]string, error) {
+	query := `
+		SELECT network
+		FROM ip_blocks
+		WHERE expiry IS NULL OR expiry > NOW()`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	networks := []string{}
+
+	for rows.Next() {
+		var network string
+
+		if err := rows.Scan(&network); err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return networks, nil
+}
+
+// Delete lifts a block. ErrRecordNotFound is returned if there's no block with that ID
+func (m IPBlockModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM ip_blocks
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The ways of logging in which are recorded in the login events
+const (
+	LoginMethodPassword  = "password"
+	LoginMethodMagicLink = "magic-link"
+	LoginMethodSSO       = "sso"
+
+	// LoginMethodImpersonation is recorded when an administrator starts acting as another user
+	LoginMethodImpersonation = "impersonation"
+)
+
+// The reasons recorded for failed login attempts
+const (
+	LoginFailureUnknownEmail         = "unknown_email"
+	LoginFailureInvalidPassword      = "invalid_password"
+	LoginFailureSecondFactorRequired = "second_factor_required"
+	LoginFailureInvalidSecondFactor  = "invalid_second_factor"
+	LoginFailureInvalidToken         = "invalid_token"
+)
+
+// LoginEvent struct records an attempt to log in. UserID is nil when the attempt was for an email address which
+// doesn't belong to any user. Reason is empty for successful attempts. ImpersonatorID is the administrator who logged
+// in as the user, for impersonation events
+type LoginEvent struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    *int64    `json:"user_id,omitempty"`
+	Email     string    `json:"email"`
+	Method    string    `json:"method"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+
+	ImpersonatorID *int64 `json:"impersonator_id,omitempty"`
+}
+
+// LoginEventModel struct which wraps the connection pool
+type LoginEventModel struct {
+	DB DBTX
+
+	requestContext
+}
+
+// Insert records a login event
+func (m LoginEventModel) Insert(event *LoginEvent) error {
+	query := `
+		INSERT INTO login_events (user_id, email, method, success, reason, ip, user_agent, impersonator_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`
+
+	args := []interface{}{event.UserID, event.Email, event.Method, event.Success, event.Reason, event.IP,
+		truncateUserAgent(event.UserAgent), event.ImpersonatorID}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// IsNewDevice reports whether a successful login by a user is from a device that we haven't seen them log in from
+// before, that is a new combination of IP address and user agent. A user's first ever login doesn't count, as every
+// device is new then
+func (m LoginEventModel) IsNewDevice(userID int64, ip, userAgent string) (bool, error) {
+	query := `
+		SELECT count(*) > 0, count(*) FILTER (WHERE ip = $2 AND user_agent = $3) = 0
+		FROM login_events
+		WHERE user_id = $1 AND success AND impersonator_id IS NULL`
+
+	var hasLoggedIn, unseen bool
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, ip, truncateUserAgent(userAgent)).Scan(&hasLoggedIn, &unseen)
+	if err != nil {
+		return false, err
+	}
+
+	return hasLoggedIn && unseen, nil
+}
+
+// GetAll returns login events, most recent first by default. If userID isn't 0 only that user's events are returned,
+// and if success isn't nil only successful (or failed) attempts are
+func (m LoginEventModel) GetAll(userID int64, success *bool, filters Filters) ([]*LoginEvent, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, user_id, email, method, success, reason, ip, user_agent,
+			impersonator_id
+		FROM login_events
+		WHERE (user_id = $1 OR $1 = 0)
+		AND (success = $2 OR $2 IS NULL)
+		ORDER BY %s %s, id DESC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, success, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*LoginEvent{}
+
+	for rows.Next() {
+		var event LoginEvent
+
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.UserID,
+			&event.Email,
+			&event.Method,
+			&event.Success,
+			&event.Reason,
+			&event.IP,
+			&event.UserAgent,
+			&event.ImpersonatorID,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return events, metadata, nil
+}
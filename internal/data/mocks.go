@@ -0,0 +1,644 @@
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+// The credentials of the user that the mocks know about, who has the ID 1 and can read and write movies. The token
+// authenticates as the user, whatever its scope
+const (
+	MockUserEmail      = "alice@example.com"
+	MockUserPassword   = "pa55word"
+	MockTokenPlaintext = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+)
+
+// NewMockModels returns a Models struct whose stores are mocks, so that the handlers can be tested without a database.
+// The mocks know about one user, see MockUserEmail, and one movie, both with the ID 1. Inserts give new records the
+// ID 2, updates and deletes succeed, and anything else that's looked up isn't found or is empty
+func NewMockModels() Models {
+	return Models{
+		Users:        mockUserStore{},
+		Movies:       mockMovieStore{},
+		Tokens:       mockTokenStore{},
+		Permissions:  mockPermissionStore{},
+		Reviews:      mockReviewStore{},
+		Ratings:      mockRatingStore{},
+		Watchlist:    mockWatchlistStore{},
+		People:       mockPersonStore{},
+		Views:        mockViewStore{},
+		ReleaseDates: mockReleaseDateStore{},
+		TwoFactor:    mockTwoFactorStore{},
+		APIKeys:      mockAPIKeyStore{},
+		Identities:   mockIdentityStore{},
+		LoginEvents:  mockLoginEventStore{},
+		DataExports:  mockDataExportStore{},
+		Invitations:  mockInvitationStore{},
+		Emails:       mockEmailStore{},
+		Deliveries:   mockEmailDeliveryStore{},
+		IPBlocks:     mockIPBlockStore{},
+	}
+}
+
+// mockPasswordHash returns the hash of MockUserPassword. It's only made once, as hashing passwords is slow on purpose
+var mockPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := hashPassword(MockUserPassword)
+	return hash
+})
+
+// mockUser returns the user that the mocks know about. It's a new copy each time, so that tests can change it
+func mockUser() *User {
+	user := &User{
+		ID:        1,
+		CreatedAt: time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Name:      "Alice",
+		Email:     MockUserEmail,
+		Activated: true,
+		Version:   1,
+	}
+
+	user.Password.hash = mockPasswordHash()
+	return user
+}
+
+// mockMovie returns the movie that the mocks know about. It's a new copy each time, so that tests can change it
+func mockMovie() *Movie {
+	return &Movie{
+		ID:        1,
+		CreatedAt: time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Title:     "Casablanca",
+		Year:      1942,
+		Runtime:   102,
+		Genres:    []string{"drama", "romance", "war"},
+		Version:   1,
+	}
+}
+
+type mockUserStore struct{}
+
+func (m mockUserStore) Insert(user *User) error {
+	if user.Email == MockUserEmail {
+		return ErrDuplicateEmail
+	}
+
+	user.ID, user.CreatedAt, user.Version = 2, time.Now(), 1
+	return nil
+}
+
+func (m mockUserStore) GetByEmail(email string) (*User, error) {
+	if email != MockUserEmail {
+		return nil, ErrRecordNotFound
+	}
+
+	return mockUser(), nil
+}
+
+func (m mockUserStore) Update(user *User) error {
+	user.Version++
+	return nil
+}
+
+func (m mockUserStore) SetPendingEmail(user *User, email string) error {
+	return nil
+}
+
+func (m mockUserStore) ConfirmPendingEmail(user *User) error {
+	return nil
+}
+
+func (m mockUserStore) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	if tokenPlaintext != MockTokenPlaintext {
+		return nil, ErrRecordNotFound
+	}
+
+	return mockUser(), nil
+}
+
+func (m mockUserStore) GetForExpiredToken(tokenScope, tokenPlaintext string) (*User, error) {
+	return nil, ErrRecordNotFound
+}
+
+func (m mockUserStore) ClaimDigests(interval time.Duration, limit int) ([]*DigestRecipient, error) {
+	return nil, nil
+}
+
+func (m mockUserStore) Unsubscribe(userID int64) error {
+	return nil
+}
+
+func (m mockUserStore) RehashPassword(user *User, plaintextPassword string) error {
+	return nil
+}
+
+func (m mockUserStore) Get(id int64) (*User, error) {
+	if id != 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	return mockUser(), nil
+}
+
+func (m mockUserStore) GetForSession(tokenPlaintext string) (*User, *Impersonation, error) {
+	if tokenPlaintext != MockTokenPlaintext {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	return mockUser(), nil, nil
+}
+
+func (m mockUserStore) GetProfile(userID int64) (*Profile, error) {
+	if userID != 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	return &Profile{DisplayName: "Alice"}, nil
+}
+
+func (m mockUserStore) GetPublic(id int64) (*PublicUser, error) {
+	if id != 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	user := mockUser()
+	return &PublicUser{ID: user.ID, CreatedAt: user.CreatedAt, Name: user.Name, Profile: Profile{DisplayName: "Alice"}}, nil
+}
+
+func (m mockUserStore) UpdateProfile(user *User, profile *Profile) error {
+	return nil
+}
+
+type mockMovieStore struct{}
+
+func (m mockMovieStore) Insert(movie *Movie) error {
+	movie.ID, movie.CreatedAt, movie.Version = 2, time.Now(), 1
+	return nil
+}
+
+func (m mockMovieStore) InsertMany(movies []*Movie, batchSize int) error {
+	return nil
+}
+
+func (m mockMovieStore) Get(id int64) (*Movie, error) {
+	if id != 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	return mockMovie(), nil
+}
+
+func (m mockMovieStore) GetAll(query string, fields []string, genres []string, highlight bool, filters Filters) ([]*Movie, Metadata, error) {
+	return []*Movie{mockMovie()}, calculateMetadata(1, filters.Page, filters.PageSize), nil
+}
+
+func (m mockMovieStore) GetRandom(title string, genres []string) (*Movie, error) {
+	return mockMovie(), nil
+}
+
+func (m mockMovieStore) Export(title string, genres []string, fn func(movie *Movie) error) error {
+	return fn(mockMovie())
+}
+
+func (m mockMovieStore) Update(movie *Movie) error {
+	if movie.ID != 1 {
+		return ErrEditConflict
+	}
+
+	movie.Version++
+	return nil
+}
+
+func (m mockMovieStore) UpdatePoster(movie *Movie) error {
+	return nil
+}
+
+func (m mockMovieStore) Delete(id int64) error {
+	if id != 1 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m mockMovieStore) DeleteMany(ids []int64) (map[int64]string, error) {
+	return nil, nil
+}
+
+func (m mockMovieStore) GetAddedSince(since time.Time, genres []string, limit int) ([]*Movie, error) {
+	return []*Movie{mockMovie()}, nil
+}
+
+func (m mockMovieStore) GetSimilarCandidates(movie *Movie, limit int) ([]*SimilarMovie, error) {
+	return nil, nil
+}
+
+func (m mockMovieStore) WithDuplicateCheck(enabled bool) MovieStore {
+	return m
+}
+
+type mockTokenStore struct{}
+
+func (m mockTokenStore) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	return generateToken(userID, ttl, scope)
+}
+
+func (m mockTokenStore) NewSingleUse(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	return generateToken(userID, ttl, scope)
+}
+
+func (m mockTokenStore) NewLimited(userID int64, ttl time.Duration, scope string, maxUses int) (*Token, error) {
+	return generateToken(userID, ttl, scope)
+}
+
+func (m mockTokenStore) Insert(token *Token) error {
+	return nil
+}
+
+func (m mockTokenStore) DeleteAllForUser(scope string, userID int64) error {
+	return nil
+}
+
+func (m mockTokenStore) DeleteAllForUserExcept(scope string, userID int64, tokenPlaintext string) error {
+	return nil
+}
+
+func (m mockTokenStore) Use(scope, tokenPlaintext string) (int64, error) {
+	if tokenPlaintext != MockTokenPlaintext {
+		return 0, ErrRecordNotFound
+	}
+
+	return 1, nil
+}
+
+func (m mockTokenStore) GetExpiry(scope, tokenPlaintext string) (time.Time, error) {
+	if tokenPlaintext != MockTokenPlaintext {
+		return time.Time{}, ErrRecordNotFound
+	}
+
+	return time.Now().Add(24 * time.Hour), nil
+}
+
+func (m mockTokenStore) DeleteExpired(before time.Time, limit int) (int64, error) {
+	return 0, nil
+}
+
+func (m mockTokenStore) NewImpersonation(userID, impersonatorID int64, ttl time.Duration, ip, userAgent string) (*Token, error) {
+	return generateToken(userID, ttl, ScopeAuthentication)
+}
+
+func (m mockTokenStore) NewSession(userID int64, ttl time.Duration, ip, userAgent, deviceID string) (*Token, error) {
+	return generateToken(userID, ttl, ScopeAuthentication)
+}
+
+func (m mockTokenStore) NewDeviceToken(userID int64, ttl time.Duration, ip, userAgent, deviceID string) (*Token, error) {
+	return generateToken(userID, ttl, ScopeAuthentication)
+}
+
+func (m mockTokenStore) Touch(tokenPlaintext, ip, userAgent string) error {
+	return nil
+}
+
+func (m mockTokenStore) ConsumeDeviceToken(tokenPlaintext, deviceID string) (int64, error) {
+	return 0, nil
+}
+
+func (m mockTokenStore) DeleteDevicesExcept(userID int64, currentToken string) error {
+	return nil
+}
+
+func (m mockTokenStore) GetSessionsForUser(userID int64, currentToken string) ([]*Session, error) {
+	return nil, nil
+}
+
+func (m mockTokenStore) DeleteSession(id, userID int64) error {
+	return nil
+}
+
+type mockPermissionStore struct{}
+
+func (m mockPermissionStore) GetAllForUser(userID int64) (Permissions, error) {
+	if userID != 1 {
+		return Permissions{}, nil
+	}
+
+	return append(Permissions{"movies:write"}, DefaultPermissions...), nil
+}
+
+func (m mockPermissionStore) AddForUser(userID int64, codes ...string) error {
+	return nil
+}
+
+func (m mockPermissionStore) GrantForUser(userID int64, codes ...string) (Permissions, error) {
+	return Permissions(codes), nil
+}
+
+type mockReviewStore struct{}
+
+func (m mockReviewStore) Insert(review *Review) error {
+	return nil
+}
+
+func (m mockReviewStore) Get(id int64) (*Review, error) {
+	return nil, ErrRecordNotFound
+}
+
+func (m mockReviewStore) GetForUser(movieID, userID int64) (*Review, error) {
+	return nil, ErrRecordNotFound
+}
+
+func (m mockReviewStore) GetAllForMovie(movieID int64, filters Filters) ([]*Review, Metadata, error) {
+	return nil, Metadata{}, nil
+}
+
+func (m mockReviewStore) Update(review *Review) error {
+	return nil
+}
+
+func (m mockReviewStore) Delete(id int64) error {
+	return nil
+}
+
+type mockRatingStore struct{}
+
+func (m mockRatingStore) Set(rating *Rating, movie *Movie) error {
+	return nil
+}
+
+type mockWatchlistStore struct{}
+
+func (m mockWatchlistStore) Add(userID, movieID int64) error {
+	return nil
+}
+
+func (m mockWatchlistStore) Remove(userID, movieID int64) error {
+	return nil
+}
+
+func (m mockWatchlistStore) GetAllForUser(userID int64, filters Filters) ([]*Movie, Metadata, error) {
+	return nil, Metadata{}, nil
+}
+
+type mockPersonStore struct{}
+
+func (m mockPersonStore) Insert(person *Person) error {
+	return nil
+}
+
+func (m mockPersonStore) Get(id int64) (*Person, error) {
+	return nil, ErrRecordNotFound
+}
+
+func (m mockPersonStore) GetMovies(personID int64, role string, filters Filters) ([]*Movie, Metadata, error) {
+	return nil, Metadata{}, nil
+}
+
+func (m mockPersonStore) GetCreditsForMovie(movieID int64) ([]Credit, error) {
+	if movieID != 1 {
+		return nil, nil
+	}
+
+	return []Credit{{PersonID: 1, Name: "Humphrey Bogart", Role: RoleActor}}, nil
+}
+
+func (m mockPersonStore) SetCreditsForMovie(movieID int64, credits []Credit) error {
+	return nil
+}
+
+func (m mockPersonStore) CountExisting(ids []int64) (int, error) {
+	return 0, nil
+}
+
+type mockViewStore struct{}
+
+func (m mockViewStore) Add(counts map[int64]int64) error {
+	return nil
+}
+
+func (m mockViewStore) GetTrending(days int, filters Filters) ([]*TrendingMovie, Metadata, error) {
+	return nil, Metadata{}, nil
+}
+
+type mockReleaseDateStore struct{}
+
+func (m mockReleaseDateStore) GetForMovie(movieID int64) ([]ReleaseDate, error) {
+	if movieID != 1 {
+		return nil, nil
+	}
+
+	return []ReleaseDate{{Country: "US", Type: ReleaseTheatrical, Date: "1943-01-23"}}, nil
+}
+
+func (m mockReleaseDateStore) SetForMovie(movieID int64, dates []ReleaseDate) error {
+	return nil
+}
+
+type mockTwoFactorStore struct{}
+
+func (m mockTwoFactorStore) Get(userID int64) (*TOTPSecret, error) {
+	return nil, ErrRecordNotFound
+}
+
+func (m mockTwoFactorStore) Enroll(userID int64, secret string) error {
+	return nil
+}
+
+func (m mockTwoFactorStore) Enable(userID int64, counter int64) ([]string, error) {
+	return nil, nil
+}
+
+func (m mockTwoFactorStore) UseCounter(userID int64, counter int64) (bool, error) {
+	return false, nil
+}
+
+func (m mockTwoFactorStore) UseRecoveryCode(userID int64, code string) (bool, error) {
+	return false, nil
+}
+
+type mockAPIKeyStore struct{}
+
+func (m mockAPIKeyStore) New(key *APIKey) error {
+	return nil
+}
+
+func (m mockAPIKeyStore) GetAllForUser(userID int64) ([]*APIKey, error) {
+	return nil, nil
+}
+
+func (m mockAPIKeyStore) GetForPlaintext(plaintext string) (*APIKey, *User, error) {
+	return nil, nil, ErrRecordNotFound
+}
+
+func (m mockAPIKeyStore) Delete(id, userID int64) error {
+	return nil
+}
+
+type mockIdentityStore struct{}
+
+func (m mockIdentityStore) InsertState(state string, oidcState *OIDCState, ttl time.Duration) error {
+	return nil
+}
+
+func (m mockIdentityStore) ConsumeState(state string) (*OIDCState, error) {
+	return nil, ErrRecordNotFound
+}
+
+func (m mockIdentityStore) GetUser(issuer, subject string) (*User, error) {
+	return nil, ErrRecordNotFound
+}
+
+func (m mockIdentityStore) Link(issuer, subject string, userID int64) error {
+	return nil
+}
+
+type mockLoginEventStore struct{}
+
+func (m mockLoginEventStore) Insert(event *LoginEvent) error {
+	return nil
+}
+
+func (m mockLoginEventStore) IsNewDevice(userID int64, ip, userAgent string) (bool, error) {
+	return false, nil
+}
+
+func (m mockLoginEventStore) GetAll(userID int64, success *bool, filters Filters) ([]*LoginEvent, Metadata, error) {
+	return nil, Metadata{}, nil
+}
+
+type mockDataExportStore struct{}
+
+func (m mockDataExportStore) Insert(export *DataExport) error {
+	return nil
+}
+
+func (m mockDataExportStore) Get(id, userID int64) (*DataExport, error) {
+	return nil, ErrRecordNotFound
+}
+
+func (m mockDataExportStore) GetAllForUser(userID int64) ([]*DataExport, error) {
+	return nil, nil
+}
+
+func (m mockDataExportStore) SetRunning(id int64) error {
+	return nil
+}
+
+func (m mockDataExportStore) Complete(id int64, archive []byte, expiry time.Time) error {
+	return nil
+}
+
+func (m mockDataExportStore) Fail(id int64) error {
+	return nil
+}
+
+func (m mockDataExportStore) GetArchive(id int64) ([]byte, error) {
+	return nil, nil
+}
+
+func (m mockDataExportStore) DeleteExpiredArchives(userID int64) error {
+	return nil
+}
+
+func (m mockDataExportStore) GetReviews(userID int64) ([]*ExportedReview, error) {
+	return nil, nil
+}
+
+func (m mockDataExportStore) GetRatings(userID int64) ([]*ExportedRating, error) {
+	return nil, nil
+}
+
+func (m mockDataExportStore) GetWatchlist(userID int64) ([]*ExportedWatchlistItem, error) {
+	return nil, nil
+}
+
+func (m mockDataExportStore) GetLoginEvents(userID int64) ([]*LoginEvent, error) {
+	return nil, nil
+}
+
+type mockInvitationStore struct{}
+
+func (m mockInvitationStore) New(email string, invitedBy int64, ttl time.Duration) (*Invitation, error) {
+	invitation := &Invitation{
+		ID:        2,
+		CreatedAt: time.Now(),
+		Email:     email,
+		Code:      MockTokenPlaintext,
+		InvitedBy: &invitedBy,
+		Expiry:    time.Now().Add(ttl),
+		Status:    InvitationStatusPending,
+	}
+
+	return invitation, nil
+}
+
+func (m mockInvitationStore) GetAll(status string, filters Filters) ([]*Invitation, Metadata, error) {
+	return nil, Metadata{}, nil
+}
+
+func (m mockInvitationStore) Revoke(id int64) error {
+	return nil
+}
+
+func (m mockInvitationStore) Consume(code, email string) (*Invitation, error) {
+	return nil, ErrRecordNotFound
+}
+
+func (m mockInvitationStore) Release(id int64) error {
+	return nil
+}
+
+func (m mockInvitationStore) SetUsedBy(id, userID int64) error {
+	return nil
+}
+
+type mockEmailStore struct{}
+
+func (m mockEmailStore) Insert(email *Email) error {
+	return nil
+}
+
+func (m mockEmailStore) Claim(lease time.Duration) (*Email, error) {
+	return nil, ErrRecordNotFound
+}
+
+func (m mockEmailStore) Delete(id int64) error {
+	return nil
+}
+
+func (m mockEmailStore) Retry(id int64, at time.Time, lastError string) error {
+	return nil
+}
+
+func (m mockEmailStore) Kill(id int64, lastError string) error {
+	return nil
+}
+
+func (m mockEmailStore) GetAll(status string, filters Filters) ([]*Email, Metadata, error) {
+	return nil, Metadata{}, nil
+}
+
+type mockEmailDeliveryStore struct{}
+
+func (m mockEmailDeliveryStore) Insert(delivery *EmailDelivery) error {
+	return nil
+}
+
+func (m mockEmailDeliveryStore) GetAll(outcomes []string, template, recipientHash string, filters Filters) ([]*EmailDelivery, Metadata, error) {
+	return nil, Metadata{}, nil
+}
+
+type mockIPBlockStore struct{}
+
+func (m mockIPBlockStore) Insert(block *IPBlock) error {
+	return nil
+}
+
+func (m mockIPBlockStore) GetAll(filters Filters) ([]*IPBlock, Metadata, error) {
+	return nil, Metadata{}, nil
+}
+
+func (m mockIPBlockStore) GetActiveNetworks() ([]string, error) {
+	return nil, nil
+}
+
+func (m mockIPBlockStore) Delete(id int64) error {
+	return nil
+}
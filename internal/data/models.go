@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 // ErrRecordNotFound error. We'll return this from our Get() method when
@@ -12,18 +14,414 @@ var (
 	ErrRecordNotFound = errors.New("record not found")
 )
 
+// QueryTimeout is how long each query made by the models can take before it's cancelled. It's set from the config when
+// the application starts. Bulk operations, such as imports and exports, allow themselves longer
+var QueryTimeout = 3 * time.Second
+
+// Models holds the stores which the handlers read and write the application's data through. NewModels returns them
+// backed by PostgreSQL, and NewMockModels returns them backed by mocks
 type Models struct {
-	Users       UserModel
-	Movies      MovieModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Users        UserStore
+	Movies       MovieStore
+	Tokens       TokenStore
+	Permissions  PermissionStore
+	Reviews      ReviewStore
+	Ratings      RatingStore
+	Watchlist    WatchlistStore
+	People       PersonStore
+	Views        ViewStore
+	ReleaseDates ReleaseDateStore
+	TwoFactor    TwoFactorStore
+	APIKeys      APIKeyStore
+	Identities   IdentityStore
+	LoginEvents  LoginEventStore
+	DataExports  DataExportStore
+	Invitations  InvitationStore
+	Emails       EmailStore
+	Deliveries   EmailDeliveryStore
+	IPBlocks     IPBlockStore
+
+	// db is the connection pool which the SQL models share, or nil for the mocks
+	db *sql.DB
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels returns a Models struct with each model wrapping the given connection pool. The catalog's reads, such as
+// listing movies, are made with readDB, which can be a read replica's pool, or db itself when there's no replica.
+// Duplicate checking for new movies is enabled by default
+func NewModels(db, readDB *sql.DB) Models {
+	conn, readConn := pool{DB: db}, pool{DB: readDB}
+
 	return Models{
-		Users:       UserModel{DB: db},
-		Movies:      MovieModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Users:        UserModel{DB: conn},
+		Movies:       MovieModel{DB: conn, ReadDB: readConn, DuplicateCheck: true},
+		Tokens:       TokenModel{DB: conn},
+		Permissions:  PermissionModel{DB: conn},
+		Reviews:      ReviewModel{DB: conn, ReadDB: readConn},
+		Ratings:      RatingModel{DB: conn},
+		Watchlist:    WatchlistModel{DB: conn},
+		People:       PersonModel{DB: conn, ReadDB: readConn},
+		Views:        ViewModel{DB: conn, ReadDB: readConn},
+		ReleaseDates: ReleaseDateModel{DB: conn, ReadDB: readConn},
+		TwoFactor:    TwoFactorModel{DB: conn},
+		APIKeys:      APIKeyModel{DB: conn},
+		Identities:   IdentityModel{DB: conn},
+		LoginEvents:  LoginEventModel{DB: conn},
+		DataExports:  DataExportModel{DB: conn},
+		Invitations:  InvitationModel{DB: conn},
+		Emails:       EmailModel{DB: conn},
+		Deliveries:   EmailDeliveryModel{DB: conn},
+		IPBlocks:     IPBlockModel{DB: conn},
+		db:           db,
+	}
+}
+
+// Ping checks that the database can be reached, with a connection from the pool that every model shares. The mocks
+// have no database, so it always succeeds for them
+func (m Models) Ping(ctx context.Context) error {
+	if m.db == nil {
+		return nil
+	}
+
+	return m.db.PingContext(ctx)
+}
+
+// WithContext returns a copy of the models whose queries are made under ctx, which is usually the context of the
+// request they're being used for. Their timeouts are then cut short by the request's deadline, and the queries are
+// cancelled when the client goes away. The models returned by NewModels use context.Background, which is what work
+// that carries on after the response has been sent should use. Stores which don't make queries, such as the mocks,
+// are left as they are
+func (m Models) WithContext(ctx context.Context) Models {
+	rc := requestContext{ctx: ctx}
+
+	m.Users = withContext(m.Users, rc)
+	m.Movies = withContext(m.Movies, rc)
+	m.Tokens = withContext(m.Tokens, rc)
+	m.Permissions = withContext(m.Permissions, rc)
+	m.Reviews = withContext(m.Reviews, rc)
+	m.Ratings = withContext(m.Ratings, rc)
+	m.Watchlist = withContext(m.Watchlist, rc)
+	m.People = withContext(m.People, rc)
+	m.Views = withContext(m.Views, rc)
+	m.ReleaseDates = withContext(m.ReleaseDates, rc)
+	m.TwoFactor = withContext(m.TwoFactor, rc)
+	m.APIKeys = withContext(m.APIKeys, rc)
+	m.Identities = withContext(m.Identities, rc)
+	m.LoginEvents = withContext(m.LoginEvents, rc)
+	m.DataExports = withContext(m.DataExports, rc)
+	m.Invitations = withContext(m.Invitations, rc)
+	m.Emails = withContext(m.Emails, rc)
+	m.Deliveries = withContext(m.Deliveries, rc)
+	m.IPBlocks = withContext(m.IPBlocks, rc)
+
+	return m
+}
+
+// withConn returns a copy of the models whose queries are made with conn, such as a transaction. See WithTx
+func (m Models) withConn(conn DBTX) Models {
+	m.Users = withConn(m.Users, conn)
+	m.Movies = withConn(m.Movies, conn)
+	m.Tokens = withConn(m.Tokens, conn)
+	m.Permissions = withConn(m.Permissions, conn)
+	m.Reviews = withConn(m.Reviews, conn)
+	m.Ratings = withConn(m.Ratings, conn)
+	m.Watchlist = withConn(m.Watchlist, conn)
+	m.People = withConn(m.People, conn)
+	m.Views = withConn(m.Views, conn)
+	m.ReleaseDates = withConn(m.ReleaseDates, conn)
+	m.TwoFactor = withConn(m.TwoFactor, conn)
+	m.APIKeys = withConn(m.APIKeys, conn)
+	m.Identities = withConn(m.Identities, conn)
+	m.LoginEvents = withConn(m.LoginEvents, conn)
+	m.DataExports = withConn(m.DataExports, conn)
+	m.Invitations = withConn(m.Invitations, conn)
+	m.Emails = withConn(m.Emails, conn)
+	m.Deliveries = withConn(m.Deliveries, conn)
+	m.IPBlocks = withConn(m.IPBlocks, conn)
+
+	return m
+}
+
+// ForcePrimary returns a copy of the models which make all their reads from the primary, rather than the read
+// replica. Replicas lag a little behind the primary, so this is for reads which have to see what was just written,
+// such as when fetching a record to update it, or reading back the changes made by the same request
+func (m Models) ForcePrimary() Models {
+	m.Movies = forcePrimary(m.Movies)
+	m.People = forcePrimary(m.People)
+	m.Reviews = forcePrimary(m.Reviews)
+	m.ReleaseDates = forcePrimary(m.ReleaseDates)
+	m.Views = forcePrimary(m.Views)
+
+	return m
+}
+
+// requestContext is embedded in each model, and holds the context which its queries are made under. See WithContext
+type requestContext struct {
+	ctx context.Context
+}
+
+// parent returns the context which the model's queries derive their timeouts from
+func (rc requestContext) parent() context.Context {
+	if rc.ctx == nil {
+		return context.Background()
+	}
+
+	return rc.ctx
+}
+
+// contextual is implemented by the SQL models, and returns a copy of the model whose queries are made under rc
+type contextual[S any] interface {
+	withContext(rc requestContext) S
+}
+
+// withContext returns a copy of the store whose queries are made under rc, if it's one of the SQL models
+func withContext[S any](store S, rc requestContext) S {
+	if c, ok := any(store).(contextual[S]); ok {
+		return c.withContext(rc)
+	}
+
+	return store
+}
+
+// replicated is implemented by the SQL models which read from the read replica, and returns a copy of the model which
+// reads from the primary instead
+type replicated[S any] interface {
+	forcePrimary() S
+}
+
+// forcePrimary returns a copy of the store which reads from the primary, if it's one of the SQL models with a replica
+func forcePrimary[S any](store S) S {
+	if r, ok := any(store).(replicated[S]); ok {
+		return r.forcePrimary()
+	}
+
+	return store
+}
+
+// connected is implemented by the SQL models, and returns a copy of the model whose queries are made with conn
+type connected[S any] interface {
+	withConn(conn DBTX) S
+}
+
+// withConn returns a copy of the store whose queries are made with conn, if it's one of the SQL models
+func withConn[S any](store S, conn DBTX) S {
+	if c, ok := any(store).(connected[S]); ok {
+		return c.withConn(conn)
 	}
+
+	return store
+}
+
+func (m APIKeyModel) withContext(rc requestContext) APIKeyStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m DataExportModel) withContext(rc requestContext) DataExportStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m EmailDeliveryModel) withContext(rc requestContext) EmailDeliveryStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m EmailModel) withContext(rc requestContext) EmailStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m IPBlockModel) withContext(rc requestContext) IPBlockStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m IdentityModel) withContext(rc requestContext) IdentityStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m InvitationModel) withContext(rc requestContext) InvitationStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m LoginEventModel) withContext(rc requestContext) LoginEventStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m MovieModel) withContext(rc requestContext) MovieStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m PermissionModel) withContext(rc requestContext) PermissionStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m PersonModel) withContext(rc requestContext) PersonStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m RatingModel) withContext(rc requestContext) RatingStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m ReleaseDateModel) withContext(rc requestContext) ReleaseDateStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m ReviewModel) withContext(rc requestContext) ReviewStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m TokenModel) withContext(rc requestContext) TokenStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m TwoFactorModel) withContext(rc requestContext) TwoFactorStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m UserModel) withContext(rc requestContext) UserStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m ViewModel) withContext(rc requestContext) ViewStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m WatchlistModel) withContext(rc requestContext) WatchlistStore {
+	m.requestContext = rc
+	return m
+}
+
+func (m APIKeyModel) withConn(conn DBTX) APIKeyStore {
+	m.DB = conn
+	return m
+}
+
+func (m DataExportModel) withConn(conn DBTX) DataExportStore {
+	m.DB = conn
+	return m
+}
+
+func (m EmailDeliveryModel) withConn(conn DBTX) EmailDeliveryStore {
+	m.DB = conn
+	return m
+}
+
+func (m EmailModel) withConn(conn DBTX) EmailStore {
+	m.DB = conn
+	return m
+}
+
+func (m IPBlockModel) withConn(conn DBTX) IPBlockStore {
+	m.DB = conn
+	return m
+}
+
+func (m IdentityModel) withConn(conn DBTX) IdentityStore {
+	m.DB = conn
+	return m
+}
+
+func (m InvitationModel) withConn(conn DBTX) InvitationStore {
+	m.DB = conn
+	return m
+}
+
+func (m LoginEventModel) withConn(conn DBTX) LoginEventStore {
+	m.DB = conn
+	return m
+}
+
+func (m MovieModel) withConn(conn DBTX) MovieStore {
+	m.DB, m.ReadDB = conn, conn
+	return m
+}
+
+func (m PermissionModel) withConn(conn DBTX) PermissionStore {
+	m.DB = conn
+	return m
+}
+
+func (m PersonModel) withConn(conn DBTX) PersonStore {
+	m.DB, m.ReadDB = conn, conn
+	return m
+}
+
+func (m RatingModel) withConn(conn DBTX) RatingStore {
+	m.DB = conn
+	return m
+}
+
+func (m ReleaseDateModel) withConn(conn DBTX) ReleaseDateStore {
+	m.DB, m.ReadDB = conn, conn
+	return m
+}
+
+func (m ReviewModel) withConn(conn DBTX) ReviewStore {
+	m.DB, m.ReadDB = conn, conn
+	return m
+}
+
+func (m TokenModel) withConn(conn DBTX) TokenStore {
+	m.DB = conn
+	return m
+}
+
+func (m TwoFactorModel) withConn(conn DBTX) TwoFactorStore {
+	m.DB = conn
+	return m
+}
+
+func (m UserModel) withConn(conn DBTX) UserStore {
+	m.DB = conn
+	return m
+}
+
+func (m ViewModel) withConn(conn DBTX) ViewStore {
+	m.DB, m.ReadDB = conn, conn
+	return m
+}
+
+func (m WatchlistModel) withConn(conn DBTX) WatchlistStore {
+	m.DB = conn
+	return m
+}
+
+func (m MovieModel) forcePrimary() MovieStore {
+	m.ReadDB = m.DB
+	return m
+}
+
+func (m PersonModel) forcePrimary() PersonStore {
+	m.ReadDB = m.DB
+	return m
+}
+
+func (m ReviewModel) forcePrimary() ReviewStore {
+	m.ReadDB = m.DB
+	return m
+}
+
+func (m ReleaseDateModel) forcePrimary() ReleaseDateStore {
+	m.ReadDB = m.DB
+	return m
+}
+
+func (m ViewModel) forcePrimary() ViewStore {
+	m.ReadDB = m.DB
+	return m
 }
@@ -6,37 +6,121 @@ import (
 	"errors"
 	"fmt"
 	"github.com/eazylaykzy/greenlight/internal/validator"
-	"github.com/lib/pq"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Movie struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"` // Use the - directive
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`    // Add the omitempty directive
-	Runtime   Runtime   `json:"runtime,omitempty"` // Add the omitempty directive
-	Genres    []string  `json:"genres,omitempty"`  // Add the omitempty directive
-	Version   int32     `json:"version"`
+	ID            int64         `json:"id"`
+	CreatedAt     time.Time     `json:"-"` // Use the - directive
+	Title         string        `json:"title"`
+	Description   string        `json:"description,omitempty"`
+	Year          int32         `json:"year,omitempty"`    // Add the omitempty directive
+	Runtime       Runtime       `json:"runtime,omitempty"` // Add the omitempty directive
+	Genres        []string      `json:"genres,omitempty"`  // Add the omitempty directive
+	AverageRating float64       `json:"average_rating"`
+	RatingsCount  int32         `json:"ratings_count"`
+	People        []Credit      `json:"people,omitempty"`
+	ReleaseDates  []ReleaseDate `json:"release_dates,omitempty"`
+	PosterKey     string        `json:"-"`
+	PosterURL     string        `json:"poster_url,omitempty"`
+	Relevance     float32       `json:"relevance,omitempty"` // Only set when searching
+	Highlight     string        `json:"highlight,omitempty"` // Only set when highlighting is requested
+	Version       int32         `json:"version"`
 }
 
-// MovieModel struct type that wraps a sql.DB connection pool
+// MovieFields lists the JSON field names of a movie, which clients can pick from when asking for a sparse fieldset
+var MovieFields = []string{
+	"id", "title", "description", "year", "runtime", "genres", "average_rating", "ratings_count", "people", "release_dates",
+	"poster_url", "relevance", "highlight", "version",
+}
+
+// movieRelevance is the SQL expression used by GetAll to rank how relevant each movie is to a search. It's needed in
+// the keyset pagination condition as well as the select list, so it's only written out once here. It expects the
+// tsquery string as $1 and the fields being searched as $6
+const movieRelevance = `CASE WHEN $1 = '' THEN 0 ELSE ts_rank(
+				CASE WHEN 'title' = ANY($6) THEN setweight(search_vector, 'A') ELSE ''::tsvector END ||
+				CASE WHEN 'description' = ANY($6) THEN setweight(description_vector, 'C') ELSE ''::tsvector END,
+				to_tsquery('english', $1)) + COALESCE((
+					SELECT max(ts_rank(setweight(people.name_vector, 'B'), to_tsquery('simple', $1)))
+					FROM movies_people
+					INNER JOIN people ON people.id = movies_people.person_id
+					WHERE movies_people.movie_id = movies.id
+					AND ((movies_people.role = 'director' AND 'director' = ANY($6))
+						OR (movies_people.role = 'actor' AND 'cast' = ANY($6)))
+					AND people.name_vector @@ to_tsquery('simple', $1)), 0) END`
+
+// sortValue returns the value of one of the sortable movie listing columns as a string, for use in a pagination cursor
+func (movie *Movie) sortValue(column string) string {
+	switch column {
+	case "title":
+		return movie.Title
+	case "year":
+		return strconv.FormatInt(int64(movie.Year), 10)
+	case "runtime":
+		return strconv.FormatInt(int64(movie.Runtime), 10)
+	case "relevance":
+		return strconv.FormatFloat(float64(movie.Relevance), 'g', -1, 32)
+	default:
+		return strconv.FormatInt(movie.ID, 10)
+	}
+}
+
+// DuplicateMovieError is returned by Insert when duplicate checking is enabled and there is already a movie with the
+// same normalized title and year. The ID field holds the ID of the existing movie
+type DuplicateMovieError struct {
+	ID int64
+}
+
+func (e *DuplicateMovieError) Error() string {
+	return fmt.Sprintf("duplicate of movie %d", e.ID)
+}
+
+// MovieModel struct type that wraps a sql.DB connection pool. The lookups and listings of movies read from ReadDB,
+// which is the read replica's pool when there is one. If DuplicateCheck is true, Insert refuses to create a movie with
+// the same normalized title and year as an existing one. As MovieModel is a value type, a handler can turn the check
+// off for a single insert with WithDuplicateCheck, which returns a copy of the model
 type MovieModel struct {
-	DB *sql.DB
+	DB             DBTX
+	ReadDB         DBTX
+	DuplicateCheck bool
+
+	requestContext
+}
+
+// WithDuplicateCheck returns a copy of the model with the duplicate check for inserts switched on or off
+func (m MovieModel) WithDuplicateCheck(enabled bool) MovieStore {
+	m.DuplicateCheck = enabled
+	return m
 }
 
 // Insert method for inserting a new record in the movies' table.
 // The Insert method accepts a pointer to a movie struct, which should contain the data for the new record
 func (m MovieModel) Insert(movie *Movie) error {
+	if m.DuplicateCheck {
+		id, err := m.findDuplicate(movie.Title, movie.Year)
+		if err != nil {
+			return err
+		}
+
+		if id != 0 {
+			return &DuplicateMovieError{ID: id}
+		}
+	}
+
 	// Define the SQL query for inserting a new record in the movies table and returning the system-generated data
-	query := `INSERT INTO movies (title, year, runtime, genres) VALUES ($1, $2, $3, $4) RETURNING id, created_at, version`
+	query := `
+		INSERT INTO movies (title, description, year, runtime, genres)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, version`
 
 	// Create an args slice containing the values for the placeholder parameters from the movie struct. Declaring this
 	// slice immediately next to our SQL query helps to make it nice and clear *what values are being used where* in the query
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []interface{}{movie.Title, movie.Description, movie.Year, movie.Runtime, movie.Genres}
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 	defer cancel()
 
 	// Use the QueryRow method to execute the SQL query on our connection pool, passing in the args slice as a
@@ -44,6 +128,101 @@ func (m MovieModel) Insert(movie *Movie) error {
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
 
+// findDuplicate returns the ID of an existing movie with the same normalized title and year, or 0 if there isn't one.
+// The normalization expression matches the movies_normalized_title_year_idx index, so this is an index lookup
+func (m MovieModel) findDuplicate(title string, year int32) (int64, error) {
+	query := `
+		SELECT id
+		FROM movies
+		WHERE regexp_replace(lower(title), '[^[:alnum:]]+', '', 'g') = regexp_replace(lower($1), '[^[:alnum:]]+', '', 'g')
+		AND year = $2
+		ORDER BY id
+		LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	var id int64
+
+	err := m.DB.QueryRowContext(ctx, query, title, year).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, nil
+		default:
+			return 0, err
+		}
+	}
+
+	return id, nil
+}
+
+// InsertMany method inserts a large number of movies in a single transaction, so either all of them are inserted or
+// none of them are. The rows are sent to the database in batches using multi-row INSERT statements, which is much
+// faster than one round trip per movie. Like Insert, the system-generated data is read back into each movie struct
+func (m MovieModel) InsertMany(movies []*Movie, batchSize int) error {
+	// Importing a large catalog can take a while, so this uses a much more generous timeout than our other queries
+	ctx, cancel := context.WithTimeout(m.parent(), 60*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op if the transaction has already been committed
+	defer func(tx Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	for start := 0; start < len(movies); start += batchSize {
+		end := start + batchSize
+		if end > len(movies) {
+			end = len(movies)
+		}
+
+		batch := movies[start:end]
+
+		// Build the VALUES list for this batch, numbering the placeholder parameters as we go
+		values := make([]string, 0, len(batch))
+		args := make([]interface{}, 0, len(batch)*5)
+
+		for i, movie := range batch {
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", i*5+1, i*5+2, i*5+3, i*5+4, i*5+5))
+			args = append(args, movie.Title, movie.Description, movie.Year, movie.Runtime, movie.Genres)
+		}
+
+		query := `INSERT INTO movies (title, description, year, runtime, genres) VALUES ` + strings.Join(values, ", ") + `
+			RETURNING id, created_at, version`
+
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+
+		// PostgreSQL returns the rows from a multi-row INSERT in the same order as the VALUES list,
+		// so we can scan them straight back into the batch
+		i := 0
+		for rows.Next() {
+			err = rows.Scan(&batch[i].ID, &batch[i].CreatedAt, &batch[i].Version)
+			if err != nil {
+				_ = rows.Close()
+				return err
+			}
+			i++
+		}
+
+		if err = rows.Err(); err != nil {
+			_ = rows.Close()
+			return err
+		}
+
+		_ = rows.Close()
+	}
+
+	return tx.Commit()
+}
+
 // Get method for fetching a specific record from the movies table
 func (m MovieModel) Get(id int64) (*Movie, error) {
 	// The PostgreSQL bigserial type that we're using for the movie ID starts auto-incrementing at 1 by default, so we
@@ -54,28 +233,37 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	}
 
 	// Define the SQL query for retrieving the movie data
-	query := `SELECT id, created_at, title, year, runtime, genres, version FROM movies WHERE id = $1`
+	query := `
+		SELECT id, created_at, title, description, year, runtime, genres, average_rating, ratings_count, poster_key,
+			poster_url, version
+		FROM movies
+		WHERE id = $1`
 
 	// Declare a Movie struct to hold the data returned by the query
 	var movie Movie
 
 	// Use the context.WithTimeout function to create a context.Context which carries a 3-second timeout deadline.
 	// Note that we're using the empty context.Background as the 'parent' context
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 
 	// Importantly, use defer to make sure that we cancel the context before the Get method returns
 	defer cancel()
 
 	// Use the QueryRowContext method to execute the query, passing in the context with the deadline as the first
 	// argument, providing id value as a placeholder parameter, and scan the response data into the fields of the Movie
-	// struct. Importantly, notice that we need to convert the scan target for the genres' column using the pq.Array adapter function
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	// struct. Importantly, notice that we need to convert the scan target for the genres' column using the array adapter function
+	err := m.ReadDB.QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
 		&movie.Title,
+		&movie.Description,
 		&movie.Year,
 		&movie.Runtime,
-		pq.Array(&movie.Genres),
+		array(&movie.Genres),
+		&movie.AverageRating,
+		&movie.RatingsCount,
+		&movie.PosterKey,
+		&movie.PosterURL,
 		&movie.Version,
 	)
 
@@ -94,30 +282,84 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-// GetAll method returns a slice of movies
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// GetAll method returns a slice of movies. The query is searched for in the given fields (see SearchFields) with
+// prefix matching, and a movie matches if any one of those fields contains all the words in the query. Each movie's
+// relevance to the search is returned in its Relevance field (and can be sorted on), with title matches counting for
+// the most. If highlight is true, the Highlight field holds the title with the matching words wrapped in <mark> tags.
+// The year and runtime ranges and the release filters in filters narrow the results further
+func (m MovieModel) GetAll(query string, fields []string, genres []string, highlight bool, filters Filters) ([]*Movie, Metadata, error) {
 	// Construct the SQL query to retrieve all movie records, add an ORDER BY clause and interpolate the sort column and
 	// direction. Importantly notice that we also include a secondary sort on the movie ID to ensure a consistent ordering.
-	// `count(*) OVER()` is an SQL query known to be the window function which counts the total (filtered) records
-	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+	// `count(*) OVER()` is an SQL query known to be the window function which counts the total (filtered) records.
+	// The title and description each have their own full-text index, and people's names are matched through the
+	// people_name_vector_idx index using the simple configuration. The ranking and highlighting are skipped when
+	// there's nothing to search for, as ts_headline in particular is relatively expensive
+	//
+	// With keyset pagination, the keyset condition skips straight past the movies on the earlier pages, and we fetch
+	// one extra movie to find out whether there's another page after this one. Counting every matching movie would
+	// defeat the point, so the total isn't calculated
+	sortColumn := filters.sortColumn()
+
+	sortExpr := sortColumn
+	if sortColumn == "relevance" {
+		sortExpr = movieRelevance
+	}
+
+	keyset, keysetArgs := filters.keyset(sortExpr, 13)
+
+	count := "count(*) OVER()"
+	limit := filters.limit()
+
+	if filters.UseCursor {
+		count = "0"
+		limit++
+	}
+
+	stmt := fmt.Sprintf(`
+		SELECT %s, id, created_at, title, description, year, runtime, genres, average_rating, ratings_count,
+			poster_url, version, %s AS relevance,
+			CASE WHEN $1 = '' OR NOT $5 THEN '' ELSE ts_headline('english', title, to_tsquery('english', $1),
+				'StartSel=<mark>, StopSel=</mark>, HighlightAll=true') END AS highlight
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		WHERE ($1 = ''
+			OR ('title' = ANY($6) AND search_vector @@ to_tsquery('english', $1))
+			OR ('description' = ANY($6) AND description_vector @@ to_tsquery('english', $1))
+			OR id IN (
+				SELECT movies_people.movie_id
+				FROM movies_people
+				INNER JOIN people ON people.id = movies_people.person_id
+				WHERE people.name_vector @@ to_tsquery('simple', $1)
+				AND ((movies_people.role = 'director' AND 'director' = ANY($6))
+					OR (movies_people.role = 'actor' AND 'cast' = ANY($6)))))
 		AND (genres @> $2 OR $2 = '{}')
+		AND (year >= $7 OR $7 = 0) AND (year <= $8 OR $8 = 0)
+		AND (runtime >= $9 OR $9 = 0) AND (runtime <= $10 OR $10 = 0)
+		AND (($11 = '' AND $12 = '') OR EXISTS (
+			SELECT 1
+			FROM release_dates
+			WHERE release_dates.movie_id = movies.id
+			AND (release_dates.country = $11 OR $11 = '')
+			AND release_dates.date < COALESCE(NULLIF($12, '')::date, 'infinity')))
+		AND %s
 		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		LIMIT $3 OFFSET $4`, count, movieRelevance, keyset, sortColumn, filters.sortDirection())
 
 	// Create a context with a 3-second timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 	defer cancel()
 
 	// Here, we call the limit() and offset() methods on the Filters' struct to
 	// get the appropriate values for the LIMIT and OFFSET clauses
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []interface{}{
+		searchQuery(query), genres, limit, filters.offset(), highlight, fields,
+		filters.YearMin, filters.YearMax, filters.RuntimeMin, filters.RuntimeMax,
+		filters.ReleasedIn, filters.ReleasedBefore,
+	}
+	args = append(args, keysetArgs...)
 
 	// And then pass the args slice to QueryContext() as a variadic parameter,
 	// this returns a sql.Rows resultset containing the result
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.ReadDB.QueryContext(ctx, stmt, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -142,10 +384,16 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.ID,
 			&movie.CreatedAt,
 			&movie.Title,
+			&movie.Description,
 			&movie.Year,
 			&movie.Runtime,
-			pq.Array(&movie.Genres),
+			array(&movie.Genres),
+			&movie.AverageRating,
+			&movie.RatingsCount,
+			&movie.PosterURL,
 			&movie.Version,
+			&movie.Relevance,
+			&movie.Highlight,
 		)
 
 		if err != nil {
@@ -161,6 +409,20 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		return nil, Metadata{}, err
 	}
 
+	// With keyset pagination, the metadata holds the cursor for the next page instead of the page numbers. If the extra
+	// movie was found then there is a next page, and it starts after the last movie that we're returning
+	if filters.UseCursor {
+		metadata := Metadata{PageSize: filters.PageSize}
+
+		if len(movies) > filters.PageSize {
+			movies = movies[:filters.PageSize]
+			last := movies[len(movies)-1]
+			metadata.NextCursor = filters.nextCursor(last.sortValue(sortColumn), last.ID)
+		}
+
+		return movies, metadata, nil
+	}
+
 	// Generate a Metadata struct, passing in the total record count and pagination parameters from the client
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 
@@ -168,27 +430,146 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	return movies, metadata, nil
 }
 
+// GetRandom method returns a single movie picked at random from the movies matching the title and genres filters, or
+// ErrRecordNotFound if nothing matches. Rather than sorting the whole table with ORDER BY random(), this counts the
+// matching movies first and then skips a random number of them, which lets PostgreSQL use the same indexes as GetAll
+func (m MovieModel) GetRandom(title string, genres []string) (*Movie, error) {
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	query := `
+		SELECT count(*)
+		FROM movies
+		WHERE (search_vector @@ to_tsquery('english', $1) OR $1 = '')
+		AND (genres @> $2 OR $2 = '{}')`
+
+	var count int64
+
+	err := m.ReadDB.QueryRowContext(ctx, query, searchQuery(title), genres).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+
+	if count == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	// The random offset is calculated by PostgreSQL, somewhere between 0 and count-1
+	query = `
+		SELECT id, created_at, title, description, year, runtime, genres, average_rating, ratings_count, poster_key,
+			poster_url, version
+		FROM movies
+		WHERE (search_vector @@ to_tsquery('english', $1) OR $1 = '')
+		AND (genres @> $2 OR $2 = '{}')
+		ORDER BY id
+		LIMIT 1 OFFSET floor(random() * $3::bigint)::bigint`
+
+	var movie Movie
+
+	err = m.ReadDB.QueryRowContext(ctx, query, searchQuery(title), genres, count).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Description,
+		&movie.Year,
+		&movie.Runtime,
+		array(&movie.Genres),
+		&movie.AverageRating,
+		&movie.RatingsCount,
+		&movie.PosterKey,
+		&movie.PosterURL,
+		&movie.Version,
+	)
+
+	// A movie could have been deleted between the two queries, leaving the offset past the end of the results
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &movie, nil
+}
+
+// Export method calls fn for every movie matching the title and genres filters, in ID order. Unlike GetAll, the
+// movies are never collected into a slice. Each row is scanned and handed to fn while the cursor moves through the
+// resultset, so the whole catalog can be exported without holding it all in memory. If fn returns an error, the
+// iteration stops and that error is returned
+func (m MovieModel) Export(title string, genres []string, fn func(movie *Movie) error) error {
+	query := `
+		SELECT id, created_at, title, description, year, runtime, genres, average_rating, ratings_count, poster_url,
+			version
+		FROM movies
+		WHERE (search_vector @@ to_tsquery('english', $1) OR $1 = '')
+		AND (genres @> $2 OR $2 = '{}')
+		ORDER BY id ASC`
+
+	// Streaming a large catalog to a slow client can take a while, so allow much longer than our usual 3 seconds
+	ctx, cancel := context.WithTimeout(m.parent(), 5*time.Minute)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, query, searchQuery(title), genres)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Description,
+			&movie.Year,
+			&movie.Runtime,
+			array(&movie.Genres),
+			&movie.AverageRating,
+			&movie.RatingsCount,
+			&movie.PosterURL,
+			&movie.Version,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(&movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
 // Update method for updating a specific record in the movies table
 func (m MovieModel) Update(movie *Movie) error {
 	// Declare the SQL query for updating the record and returning the new version number
 	query := `
 		UPDATE movies 
-		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1 
-		WHERE id = $5 AND version = $6 
+		SET title = $1, description = $2, year = $3, runtime = $4, genres = $5, version = version + 1 
+		WHERE id = $6 AND version = $7 
 		RETURNING version`
 
 	// Create an args slice containing the values for the placeholder parameters
 	args := []interface{}{
 		movie.Title,
+		movie.Description,
 		movie.Year,
 		movie.Runtime,
-		pq.Array(movie.Genres),
+		movie.Genres,
 		movie.ID,
 		movie.Version,
 	}
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 	defer cancel()
 
 	// Use the QueryRow method to execute the query, passing in the args slice as a variadic parameter and scanning the
@@ -207,6 +588,33 @@ func (m MovieModel) Update(movie *Movie) error {
 	return nil
 }
 
+// UpdatePoster method records a new poster for a specific movie. Like Update, this checks against the version field
+// and returns ErrEditConflict if the movie has been changed (or deleted) since it was read
+func (m MovieModel) UpdatePoster(movie *Movie) error {
+	query := `
+		UPDATE movies
+		SET poster_key = $1, poster_url = $2, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING version`
+
+	args := []interface{}{movie.PosterKey, movie.PosterURL, movie.ID, movie.Version}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Delete method for deleting a specific record from the movies table
 func (m MovieModel) Delete(id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1
@@ -218,7 +626,7 @@ func (m MovieModel) Delete(id int64) error {
 	query := `DELETE FROM movies WHERE id = $1`
 
 	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 	defer cancel()
 
 	// Execute the SQL query using the Exec method, passing in the id variable as
@@ -243,9 +651,49 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
+// DeleteMany method deletes all the movies with the given IDs in a single statement, so either all of them are deleted
+// or none of them are. It returns a map from the ID of each movie that was deleted to its poster key (which is empty
+// if the movie had no poster in storage). IDs which didn't match a movie are simply missing from the map
+func (m MovieModel) DeleteMany(ids []int64) (map[int64]string, error) {
+	query := `DELETE FROM movies WHERE id = ANY($1) RETURNING id, poster_key`
+
+	ctx, cancel := context.WithTimeout(m.parent(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deleted := make(map[int64]string, len(ids))
+
+	for rows.Next() {
+		var (
+			id        int64
+			posterKey string
+		)
+
+		err := rows.Scan(&id, &posterKey)
+		if err != nil {
+			return nil, err
+		}
+
+		deleted[id] = posterKey
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
 func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Title != "", "title", "must be provided")
 	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
+	v.Check(len(movie.Description) <= 5000, "description", "must not be more than 5000 bytes long")
 	v.Check(movie.Year != 0, "year", "must be provided")
 	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
 	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
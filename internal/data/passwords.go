@@ -0,0 +1,201 @@
+package data
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// The character classes that a password policy can require
+const (
+	PasswordClassLower  = "lower"
+	PasswordClassUpper  = "upper"
+	PasswordClassDigit  = "digit"
+	PasswordClassSymbol = "symbol"
+)
+
+// PasswordClasses lists the character classes in the order that they're reported in
+var PasswordClasses = []string{PasswordClassLower, PasswordClassUpper, PasswordClassDigit, PasswordClassSymbol}
+
+// BreachChecker looks passwords up in a list of passwords which have appeared in data breaches
+type BreachChecker interface {
+	Breached(password string) (bool, error)
+}
+
+// PasswordPolicy holds the rules that new passwords must follow. The rules are only applied when a password is set,
+// so changing the policy doesn't lock out users whose existing passwords don't follow it. Each rule is reported under
+// its own error key, "<key>.<rule>", so that clients can tell which rules a password breaks:
+//
+//	length   - shorter than MinLength bytes
+//	entropy  - less than MinEntropy bits, by the estimate of PasswordEntropy
+//	classes  - missing one of the RequiredClasses of character
+//	banned   - in the Banned list
+//	breached - has appeared in a data breach, according to Breaches
+type PasswordPolicy struct {
+	MinLength       int
+	MinEntropy      float64
+	RequiredClasses []string
+	Banned          map[string]bool
+	Breaches        BreachChecker
+}
+
+// DefaultPasswordPolicy returns the policy used when nothing else has been configured, which only requires 8 bytes
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{MinLength: 8}
+}
+
+// Validate checks a new password against the policy, adding any errors to the validator under the given key. The
+// basic checks of ValidatePasswordPlaintext should be made as well. If the breach lookup fails the password is
+// accepted as far as that rule is concerned (so an outage of the breach service doesn't stop people from signing up),
+// and the error is returned for the caller to log
+func (p *PasswordPolicy) Validate(v *validator.Validator, key, password string) error {
+	if password == "" {
+		return nil
+	}
+
+	v.Check(len(password) >= p.MinLength, key+".length", fmt.Sprintf("must be at least %d bytes long", p.MinLength))
+
+	if p.MinEntropy > 0 {
+		v.Check(PasswordEntropy(password) >= p.MinEntropy, key+".entropy", "is too easy to guess, try a longer password with a wider mix of characters")
+	}
+
+	for _, class := range p.RequiredClasses {
+		if !hasPasswordClass(password, class) {
+			v.AddError(key+".classes", fmt.Sprintf("must contain at least one character from each of: %s", strings.Join(p.RequiredClasses, ", ")))
+			break
+		}
+	}
+
+	v.Check(!p.Banned[normalizeBannedPassword(password)], key+".banned", "is too common, please choose another password")
+
+	if p.Breaches != nil && v.Valid() {
+		breached, err := p.Breaches.Breached(password)
+		if err != nil {
+			return err
+		}
+
+		v.Check(!breached, key+".breached", "has appeared in a data breach, please choose another password")
+	}
+
+	return nil
+}
+
+// PasswordEntropy returns a rough estimate of the strength of a password in bits. It's the number of bits needed to
+// pick each character at random from the classes of character that the password uses, with characters which repeat
+// the one before them not counted. This is much simpler than a real password strength estimator, which also looks for
+// words, dates and keyboard patterns, but it catches short passwords and those drawn from a small set of characters
+func PasswordEntropy(password string) float64 {
+	var (
+		pool     int
+		classes  = map[string]bool{}
+		length   int
+		previous rune = -1
+	)
+
+	for _, r := range password {
+		class := passwordClass(r)
+		if !classes[class] {
+			classes[class] = true
+			pool += passwordClassSize(class)
+		}
+
+		if r != previous {
+			length++
+		}
+		previous = r
+	}
+
+	if pool == 0 {
+		return 0
+	}
+
+	return float64(length) * math.Log2(float64(pool))
+}
+
+// ValidatePasswordClasses checks that a list of required character classes only has known classes
+func ValidatePasswordClasses(classes []string) error {
+	for _, class := range classes {
+		if !validator.In(class, PasswordClasses...) {
+			return fmt.Errorf("unknown password character class %q (must be one of %s)", class, strings.Join(PasswordClasses, ", "))
+		}
+	}
+
+	return nil
+}
+
+// LoadBannedPasswords reads a list of banned passwords from a file, with one password on each line. Blank lines and
+// lines starting with # are ignored. Passwords are compared without regard to case
+func LoadBannedPasswords(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	banned := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		banned[normalizeBannedPassword(line)] = true
+	}
+
+	return banned, scanner.Err()
+}
+
+// normalizeBannedPassword puts a password in the form that banned passwords are compared in
+func normalizeBannedPassword(password string) string {
+	return strings.ToLower(strings.TrimSpace(password))
+}
+
+// passwordClass returns the class of a character. ASCII characters other than letters and digits are symbols, and
+// anything outside of ASCII is "other", which counts as a symbol for the required classes
+func passwordClass(r rune) string {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return PasswordClassLower
+	case r >= 'A' && r <= 'Z':
+		return PasswordClassUpper
+	case r >= '0' && r <= '9':
+		return PasswordClassDigit
+	case r > unicode.MaxASCII:
+		return "other"
+	default:
+		return PasswordClassSymbol
+	}
+}
+
+// passwordClassSize returns the number of characters in a class. Non-ASCII characters are counted as one large class
+func passwordClassSize(class string) int {
+	switch class {
+	case PasswordClassLower, PasswordClassUpper:
+		return 26
+	case PasswordClassDigit:
+		return 10
+	case PasswordClassSymbol:
+		return 33
+	default:
+		return 100
+	}
+}
+
+// hasPasswordClass reports whether a password has a character of the given class
+func hasPasswordClass(password, class string) bool {
+	for _, r := range password {
+		c := passwordClass(r)
+		if c == class || (c == "other" && class == PasswordClassSymbol) {
+			return true
+		}
+	}
+
+	return false
+}
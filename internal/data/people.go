@@ -0,0 +1,249 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"time"
+)
+
+// Roles that a person can have on a movie. These match the movies_people_role_check constraint in the database
+const (
+	RoleActor    = "actor"
+	RoleDirector = "director"
+	RoleWriter   = "writer"
+)
+
+// ErrUnknownPerson is returned when a credit refers to a person ID which doesn't exist
+var (
+	ErrUnknownPerson = errors.New("unknown person")
+)
+
+// Person struct represents an individual member of a movie's cast or crew
+type Person struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Name      string    `json:"name"`
+	Version   int32     `json:"version"`
+}
+
+// Credit struct links a person to a movie in a specific role. The Name field is only populated when reading credits
+// back from the database, clients only need to send the person ID and role
+type Credit struct {
+	PersonID int64  `json:"person_id"`
+	Name     string `json:"name,omitempty"`
+	Role     string `json:"role"`
+}
+
+// PersonModel struct which wraps the connection pool. Get, GetMovies and GetCreditsForMovie read from ReadDB, which
+// is the read replica's pool when there is one
+type PersonModel struct {
+	DB     DBTX
+	ReadDB DBTX
+
+	requestContext
+}
+
+// Insert a new record in the people table
+func (m PersonModel) Insert(person *Person) error {
+	query := `INSERT INTO people (name) VALUES ($1) RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, person.Name).Scan(&person.ID, &person.CreatedAt, &person.Version)
+}
+
+// Get fetches a specific record from the people table
+func (m PersonModel) Get(id int64) (*Person, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, name, version FROM people WHERE id = $1`
+
+	var person Person
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.ReadDB.QueryRowContext(ctx, query, id).Scan(&person.ID, &person.CreatedAt, &person.Name, &person.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &person, nil
+}
+
+// GetMovies returns a page of the movies that a person has worked on, optionally limited to a single role. A movie is
+// only listed once, even if the person has more than one role on it
+func (m PersonModel) GetMovies(personID int64, role string, filters Filters) ([]*Movie, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, average_rating, ratings_count, poster_url,
+			version
+		FROM movies
+		WHERE id IN (SELECT movie_id FROM movies_people WHERE person_id = $1 AND (role = $2 OR $2 = ''))
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, query, personID, role, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			array(&movie.Genres),
+			&movie.AverageRating,
+			&movie.RatingsCount,
+			&movie.PosterURL,
+			&movie.Version,
+		)
+
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return movies, metadata, nil
+}
+
+// GetCreditsForMovie returns the cast and crew of a specific movie, including each person's name
+func (m PersonModel) GetCreditsForMovie(movieID int64) ([]Credit, error) {
+	query := `
+		SELECT people.id, people.name, movies_people.role
+		FROM movies_people
+		INNER JOIN people ON people.id = movies_people.person_id
+		WHERE movies_people.movie_id = $1
+		ORDER BY movies_people.role, people.name`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	credits := []Credit{}
+
+	for rows.Next() {
+		var credit Credit
+
+		err := rows.Scan(&credit.PersonID, &credit.Name, &credit.Role)
+		if err != nil {
+			return nil, err
+		}
+
+		credits = append(credits, credit)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credits, nil
+}
+
+// SetCreditsForMovie replaces the cast and crew of a specific movie with the provided credits. The old credits are
+// removed and the new ones are inserted in a single transaction, so a failure never leaves a movie half-credited. If
+// any of the credits refers to a person that doesn't exist, ErrUnknownPerson is returned
+func (m PersonModel) SetCreditsForMovie(movieID int64, credits []Credit) error {
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op if the transaction has already been committed
+	defer func(tx Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM movies_people WHERE movie_id = $1`, movieID)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO movies_people (movie_id, person_id, role) VALUES ($1, $2, $3)`
+
+	for _, credit := range credits {
+		_, err = tx.ExecContext(ctx, query, movieID, credit.PersonID, credit.Role)
+		if err != nil {
+			switch {
+			case isConstraintViolation(err, "movies_people_person_id_fkey"):
+				return ErrUnknownPerson
+			default:
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CountExisting returns how many of the provided person IDs exist in the people table. This lets handlers check that
+// all the credits refer to real people before they start writing anything to the database
+func (m PersonModel) CountExisting(ids []int64) (int, error) {
+	query := `SELECT count(*) FROM people WHERE id = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	var count int
+
+	err := m.DB.QueryRowContext(ctx, query, ids).Scan(&count)
+
+	return count, err
+}
+
+func ValidatePerson(v *validator.Validator, person *Person) {
+	v.Check(person.Name != "", "name", "must be provided")
+	v.Check(len(person.Name) <= 500, "name", "must not be more than 500 bytes long")
+}
+
+func ValidateCredits(v *validator.Validator, credits []Credit) {
+	seen := make(map[Credit]bool)
+
+	for _, credit := range credits {
+		v.Check(credit.PersonID > 0, "people", "must only contain valid person IDs")
+		v.Check(validator.In(credit.Role, RoleActor, RoleDirector, RoleWriter), "people", "role must be one of actor, director or writer")
+		v.Check(!seen[credit], "people", "must not contain duplicate credits")
+		seen[credit] = true
+	}
+}
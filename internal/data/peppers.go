@@ -0,0 +1,113 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenPeppers holds the secret keys, or peppers, that the hashes of our tokens are made with. Each key has a
+// version number, which is stored alongside every hash so that we know which key it was made with. New hashes use the
+// key with the highest version, and lookups try every key, so a new key can be added (and the old one removed once
+// the tokens hashed with it have expired) without signing everybody out. Version 0 is the bare SHA-256 hash that was
+// used before tokens were peppered. Once there are keys it's only tried until UnpepperedUntil, so that the tokens
+// issued before the pepper was added keep working until they expire, but a bare hash isn't accepted after that
+type TokenPeppers struct {
+	Current         int
+	Keys            map[int][]byte
+	UnpepperedUntil time.Time
+}
+
+// Peppers is the set of pepper keys used for token hashes. It's set from the config when the application starts, and
+// has no keys by default, which means that hashes are bare SHA-256 hashes
+var Peppers = TokenPeppers{Keys: map[int][]byte{}}
+
+// ParseTokenPeppers parses the pepper keys from a comma-separated list of "version:secret" pairs, such as
+// "1:oldsecret,2:newsecret". Versions must be positive integers, and the highest one becomes the current key. An empty
+// list means no pepper
+func ParseTokenPeppers(list string) (TokenPeppers, error) {
+	peppers := TokenPeppers{Keys: map[int][]byte{}}
+
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return TokenPeppers{}, errors.New(`token peppers must be in the format "version:secret"`)
+		}
+
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || version < 1 || version > 32767 {
+			return TokenPeppers{}, fmt.Errorf("invalid token pepper version %q", parts[0])
+		}
+
+		if _, exists := peppers.Keys[version]; exists {
+			return TokenPeppers{}, fmt.Errorf("duplicate token pepper version %d", version)
+		}
+
+		if len(parts[1]) < 16 {
+			return TokenPeppers{}, fmt.Errorf("token pepper version %d must be at least 16 bytes long", version)
+		}
+
+		peppers.Keys[version] = []byte(parts[1])
+
+		if version > peppers.Current {
+			peppers.Current = version
+		}
+	}
+
+	return peppers, nil
+}
+
+// hash returns the hash of a token with the given key version, which is an HMAC-SHA256 of the token with the key, or
+// a bare SHA-256 hash for version 0
+func (p TokenPeppers) hash(plaintext string, version int) []byte {
+	if version == 0 {
+		hash := sha256.Sum256([]byte(plaintext))
+		return hash[:]
+	}
+
+	mac := hmac.New(sha256.New, p.Keys[version])
+	mac.Write([]byte(plaintext))
+	return mac.Sum(nil)
+}
+
+// hashToken returns the hash to store for a new token, and the version of the key that it was made with
+func hashToken(plaintext string) ([]byte, int) {
+	return Peppers.hash(plaintext, Peppers.Current), Peppers.Current
+}
+
+// tokenHashes returns the hashes of a token with each of the pepper keys that lookups accept, newest first, along with
+// the key version of each hash. The unpeppered hash is only included when there are no keys, or until the time set
+// with UnpepperedUntil. Lookups match the stored hash and its version as a pair, with
+// "(hash, hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[]))", so that a hash is only accepted with
+// the version of the key it was made with
+func tokenHashes(plaintext string) ([][]byte, []int16) {
+	versions := make([]int, 0, len(Peppers.Keys)+1)
+	for version := range Peppers.Keys {
+		versions = append(versions, version)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	if len(versions) == 0 || time.Now().Before(Peppers.UnpepperedUntil) {
+		versions = append(versions, 0)
+	}
+
+	hashes := make([][]byte, len(versions))
+	hashVersions := make([]int16, len(versions))
+	for i, version := range versions {
+		hashes[i] = Peppers.hash(plaintext, version)
+		hashVersions[i] = int16(version)
+	}
+
+	return hashes, hashVersions
+}
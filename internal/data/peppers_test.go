@@ -0,0 +1,58 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenHashes(t *testing.T) {
+	saved := Peppers
+	t.Cleanup(func() { Peppers = saved })
+
+	peppers, err := ParseTokenPeppers("1:aaaaaaaaaaaaaaaa,2:bbbbbbbbbbbbbbbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unpeppered := sha256.Sum256([]byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ"))
+
+	tests := []struct {
+		name            string
+		peppers         TokenPeppers
+		unpepperedUntil time.Time
+		wantVersions    []int16
+	}{
+		{name: "No keys", peppers: TokenPeppers{Keys: map[int][]byte{}}, wantVersions: []int16{0}},
+		{name: "Keys", peppers: peppers, wantVersions: []int16{2, 1}},
+		{name: "Unpeppered window open", peppers: peppers, unpepperedUntil: time.Now().Add(time.Hour), wantVersions: []int16{2, 1, 0}},
+		{name: "Unpeppered window closed", peppers: peppers, unpepperedUntil: time.Now().Add(-time.Hour), wantVersions: []int16{2, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Peppers = tt.peppers
+			Peppers.UnpepperedUntil = tt.unpepperedUntil
+
+			hashes, versions := tokenHashes("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+
+			if !reflect.DeepEqual(versions, tt.wantVersions) {
+				t.Fatalf("got versions %v; want %v", versions, tt.wantVersions)
+			}
+
+			// Each hash is the one made with the key of the version alongside it, and only the version 0 hash is
+			// the bare SHA-256 hash
+			for i, version := range versions {
+				if want := Peppers.hash("ABCDEFGHIJKLMNOPQRSTUVWXYZ", int(version)); !bytes.Equal(hashes[i], want) {
+					t.Errorf("hash %d isn't the hash for version %d", i, version)
+				}
+
+				if bytes.Equal(hashes[i], unpeppered[:]) != (version == 0) {
+					t.Errorf("hash for version %d: got unpeppered %t", version, version != 0)
+				}
+			}
+		})
+	}
+}
@@ -3,18 +3,26 @@ package data
 import (
 	"context"
 	"database/sql"
-	"github.com/lib/pq"
-	"time"
+	"errors"
+	"fmt"
+	"strings"
 )
 
 // Permissions slice, which we will use to hold the permission codes
 // (like "movies:read" and "movies:write") for a single user.
 type Permissions []string
 
-// Include is a helper method to check whether the Permissions slice contains a specific permission code.
+// DefaultPermissions are granted to every new user, however their account is created. They let the user read movies,
+// review and rate them, and keep a watchlist, and are also the scopes which an API key needs to do those things
+var DefaultPermissions = Permissions{"movies:read", "reviews:write", "watchlist:read", "watchlist:write"}
+
+// Include is a helper method to check whether the Permissions slice contains a specific permission code, either
+// exactly or through a wildcard. Permission codes are hierarchical, with the levels separated by colons, and a code
+// ending in ":*" implies every code underneath it: "movies:*" includes "movies:read" and "movies:write", along with
+// any movie permissions added later. The code "*" on its own includes everything.
 func (p Permissions) Include(code string) bool {
 	for i := range p {
-		if code == p[i] {
+		if implies(p[i], code) {
 			return true
 		}
 	}
@@ -22,9 +30,50 @@ func (p Permissions) Include(code string) bool {
 	return false
 }
 
+// Intersect returns the permissions which are held under both p and other. Because of wildcards this isn't only the
+// codes in both: if p has "movies:*" and other has "movies:read", the intersection is "movies:read"
+func (p Permissions) Intersect(other Permissions) Permissions {
+	intersection := Permissions{}
+
+	add := func(code string) {
+		if !intersection.contains(code) {
+			intersection = append(intersection, code)
+		}
+	}
+
+	for _, code := range p {
+		if other.Include(code) {
+			add(code)
+		}
+	}
+
+	for _, code := range other {
+		if p.Include(code) {
+			add(code)
+		}
+	}
+
+	return intersection
+}
+
+// implies reports whether holding the permission granted is enough for the permission code. The code may be a
+// wildcard itself, in which case granted needs to be the same wildcard or a broader one.
+func implies(granted, code string) bool {
+	switch {
+	case granted == code, granted == "*":
+		return true
+	case strings.HasSuffix(granted, ":*"):
+		return strings.HasPrefix(code, strings.TrimSuffix(granted, "*"))
+	default:
+		return false
+	}
+}
+
 // PermissionModel type.
 type PermissionModel struct {
-	DB *sql.DB
+	DB DBTX
+
+	requestContext
 }
 
 // GetAllForUser method returns all permission codes for a specific user in a Permissions slice.
@@ -36,7 +85,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		INNER JOIN users ON users_permissions.user_id = users.id
 		WHERE users.id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -66,15 +115,125 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
+// ErrUnknownPermission is returned when granting a permission code which doesn't exist
+var ErrUnknownPermission = errors.New("unknown permission")
+
 // AddForUser add the provided permission codes for a specific user. Notice that we're using a
-// variadic parameter for the codes so that we can assign multiple permissions in a single call.
+// variadic parameter for the codes so that we can assign multiple permissions in a single call. Permissions which the
+// user already has are skipped.
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
-	query := `INSERT INTO users_permissions SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+	_, err := m.GrantForUser(userID, codes...)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	return err
+}
+
+// GrantForUser grants any number of permission codes to a specific user in a single transaction, and returns the
+// full set of permissions that the user holds afterwards. Permissions which the user already has are skipped. If any
+// of the codes doesn't exist, ErrUnknownPermission is returned and none of them are granted, so that a typo in a
+// list of codes can't leave the user with only some of them.
+func (m PermissionModel) GrantForUser(userID int64, codes ...string) (Permissions, error) {
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	// Rollback is a no-op if the transaction has already been committed
+	defer func(tx Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	// Insert all the codes with a single statement, and return the codes which were found so that we can tell which
+	// ones don't exist. A code which the user already has is still returned, as it's found even though the insert
+	// is skipped.
+	query := `
+		WITH granted AS (
+			INSERT INTO users_permissions
+			SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+			ON CONFLICT DO NOTHING
+		)
+		SELECT code FROM permissions WHERE code = ANY($2)`
+
+	rows, err := tx.QueryContext(ctx, query, userID, codes)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := scanPermissions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var unknown []string
+
+	for _, code := range codes {
+		if !found.contains(code) {
+			unknown = append(unknown, code)
+		}
+	}
+
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPermission, strings.Join(unknown, ", "))
+	}
+
+	query = `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1
+		ORDER BY permissions.code`
+
+	rows, err = tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := scanPermissions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// contains reports whether the Permissions slice holds exactly the given code, without expanding wildcards
+func (p Permissions) contains(code string) bool {
+	for i := range p {
+		if p[i] == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scanPermissions reads a column of permission codes from the rows, and closes them
+func scanPermissions(rows *sql.Rows) (Permissions, error) {
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
 }
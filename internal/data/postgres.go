@@ -0,0 +1,42 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"sync"
+)
+
+// typeMaps holds the pgx type maps that array scans PostgreSQL arrays with. A type map caches what it learns about
+// Go types, so it can't be shared by scans running at the same time
+var typeMaps = sync.Pool{
+	New: func() interface{} {
+		return pgtype.NewMap()
+	},
+}
+
+// arrayScanner is a sql.Scanner which scans a PostgreSQL array into the slice that dest points to
+type arrayScanner struct {
+	dest interface{}
+}
+
+// array returns a Scan destination for a PostgreSQL array column, such as a movie's genres, which is scanned into the
+// slice that dest points to. Slices passed as query arguments are sent as arrays as they are, by pgx
+func array(dest interface{}) sql.Scanner {
+	return arrayScanner{dest: dest}
+}
+
+func (a arrayScanner) Scan(src interface{}) error {
+	m := typeMaps.Get().(*pgtype.Map)
+	defer typeMaps.Put(m)
+
+	return m.SQLScanner(a.dest).Scan(src)
+}
+
+// isConstraintViolation reports whether err is PostgreSQL refusing a statement because it would violate the named
+// constraint, such as a unique index or a foreign key
+func isConstraintViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.ConstraintName == constraint
+}
@@ -0,0 +1,166 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"net/url"
+	"time"
+)
+
+// Profile struct holds the optional details that a user can share about themselves. Any detail the user hasn't
+// filled in is left as its zero value (and FavoriteGenres as an empty slice). Digest is whether the user has opted in
+// to the weekly digest of new movies in their favorite genres. That's only for the user themselves to see, so it's
+// only set by GetProfile, and left nil in public profiles
+type Profile struct {
+	DisplayName    string   `json:"display_name"`
+	Bio            string   `json:"bio"`
+	AvatarURL      string   `json:"avatar_url"`
+	Country        string   `json:"country"`
+	FavoriteGenres []string `json:"favorite_genres"`
+	Digest         *bool    `json:"digest,omitempty"`
+}
+
+// PublicUser struct is the representation of a user which can be shown to other users. It deliberately leaves out
+// the user's email address, activation status and anything else that only the user themselves should see
+type PublicUser struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	Profile   Profile   `json:"profile"`
+}
+
+// GetProfile retrieves the profile for a specific user
+func (m UserModel) GetProfile(userID int64) (*Profile, error) {
+	query := `
+		SELECT display_name, bio, avatar_url, country, favorite_genres, digest
+		FROM users
+		WHERE id = $1`
+
+	var profile Profile
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&profile.DisplayName,
+		&profile.Bio,
+		&profile.AvatarURL,
+		&profile.Country,
+		array(&profile.FavoriteGenres),
+		&profile.Digest,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &profile, nil
+}
+
+// GetPublic retrieves the public representation of a specific user. Only activated users have a public profile, so
+// ErrRecordNotFound is returned for users who haven't activated their account
+func (m UserModel) GetPublic(id int64) (*PublicUser, error) {
+	query := `
+		SELECT id, created_at, name, display_name, bio, avatar_url, country, favorite_genres
+		FROM users
+		WHERE id = $1 AND activated`
+
+	var user PublicUser
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Profile.DisplayName,
+		&user.Profile.Bio,
+		&user.Profile.AvatarURL,
+		&user.Profile.Country,
+		array(&user.Profile.FavoriteGenres),
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// UpdateProfile saves the profile for a specific user. Like Update, this checks against the version field, and
+// increments it so that the change conflicts with any other update made from the same version of the user. A nil
+// Digest leaves the user's digest setting as it is
+func (m UserModel) UpdateProfile(user *User, profile *Profile) error {
+	query := `
+		UPDATE users
+		SET display_name = $1, bio = $2, avatar_url = $3, country = $4, favorite_genres = $5,
+			digest = COALESCE($6, digest), version = version + 1
+		WHERE id = $7 AND version = $8
+		RETURNING version`
+
+	args := []interface{}{
+		profile.DisplayName,
+		profile.Bio,
+		profile.AvatarURL,
+		profile.Country,
+		profile.FavoriteGenres,
+		profile.Digest,
+		user.ID,
+		user.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateProfile checks a user's profile. Every detail is optional, but the avatar must be an absolute http(s) URL
+// and the country an ISO 3166-1 alpha-2 code
+func ValidateProfile(v *validator.Validator, profile *Profile) {
+	v.Check(len(profile.DisplayName) <= 50, "display_name", "must not be more than 50 bytes long")
+	v.Check(len(profile.Bio) <= 1000, "bio", "must not be more than 1000 bytes long")
+
+	if profile.AvatarURL != "" {
+		u, err := url.Parse(profile.AvatarURL)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "avatar_url",
+			"must be an absolute http or https URL")
+		v.Check(len(profile.AvatarURL) <= 2000, "avatar_url", "must not be more than 2000 bytes long")
+	}
+
+	if profile.Country != "" {
+		v.Check(validator.Matches(profile.Country, CountryRX), "country", "must be an ISO 3166-1 alpha-2 country code")
+	}
+
+	v.Check(profile.FavoriteGenres != nil, "favorite_genres", "must not be null")
+	v.Check(len(profile.FavoriteGenres) <= 10, "favorite_genres", "must not contain more than 10 genres")
+	v.Check(validator.Unique(profile.FavoriteGenres), "favorite_genres", "must not contain duplicate values")
+
+	for _, genre := range profile.FavoriteGenres {
+		v.Check(genre != "", "favorite_genres", "must not contain empty values")
+		v.Check(len(genre) <= 50, "favorite_genres", "must not contain values more than 50 bytes long")
+	}
+}
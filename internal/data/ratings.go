@@ -0,0 +1,82 @@
+package data
+
+import (
+	"context"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"time"
+)
+
+// Rating struct holds a single user's star rating (1 to 5) for a movie
+type Rating struct {
+	MovieID   int64     `json:"movie_id"`
+	UserID    int64     `json:"user_id"`
+	Score     int16     `json:"score"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RatingModel struct which wraps the connection pool
+type RatingModel struct {
+	DB DBTX
+
+	requestContext
+}
+
+// Set inserts the rating, or replaces the score if the user has already rated the movie. The aggregate score on the
+// movies table (average_rating and ratings_count) is recalculated in the same transaction, with the movie's row
+// locked, so reading a movie never needs to count its ratings. The new aggregate values are scanned into the provided
+// movie struct
+func (m RatingModel) Set(rating *Rating, movie *Movie) error {
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op if the transaction has already been committed
+	defer func(tx Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	// Lock the movie's row first, so that ratings of the same movie are saved one at a time. Otherwise two ratings
+	// saved at once could each recalculate the aggregate without seeing the other, and whichever was saved last would
+	// leave the movie with an aggregate that's missing the other rating
+	query := `SELECT id FROM movies WHERE id = $1 FOR UPDATE`
+
+	_, err = tx.ExecContext(ctx, query, rating.MovieID)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO ratings (movie_id, user_id, score)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (movie_id, user_id) DO UPDATE SET score = EXCLUDED.score
+		RETURNING created_at`
+
+	err = tx.QueryRowContext(ctx, query, rating.MovieID, rating.UserID, rating.Score).Scan(&rating.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	// Only the ratings for this one movie are aggregated here, and this happens on write rather than on every read
+	query = `
+		UPDATE movies
+		SET average_rating = aggregate.average, ratings_count = aggregate.count
+		FROM (SELECT coalesce(avg(score), 0) AS average, count(*) AS count FROM ratings WHERE movie_id = $1) AS aggregate
+		WHERE movies.id = $1
+		RETURNING movies.average_rating, movies.ratings_count`
+
+	err = tx.QueryRowContext(ctx, query, rating.MovieID).Scan(&movie.AverageRating, &movie.RatingsCount)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func ValidateRating(v *validator.Validator, rating *Rating) {
+	v.Check(rating.Score >= 1, "score", "must be at least 1")
+	v.Check(rating.Score <= 5, "score", "must not be more than 5")
+}
@@ -0,0 +1,125 @@
+package data
+
+import (
+	"context"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"regexp"
+	"time"
+)
+
+// Types of release that a movie can have in a country. These match the release_dates_type_check constraint in the
+// database
+const (
+	ReleaseTheatrical = "theatrical"
+	ReleaseDigital    = "digital"
+)
+
+// ReleaseDateLayout is the format of release dates in requests and responses
+const ReleaseDateLayout = "2006-01-02"
+
+// CountryRX is a regexp for ISO 3166-1 alpha-2 country codes, which we always store in uppercase
+var CountryRX = regexp.MustCompile("^[A-Z]{2}$")
+
+// ReleaseDate struct represents the date a movie was (or will be) released in a country. Each movie can have at most
+// one release of each type per country
+type ReleaseDate struct {
+	Country string `json:"country"`
+	Type    string `json:"type"`
+	Date    string `json:"date"`
+}
+
+// ReleaseDateModel struct which wraps the connection pool. GetForMovie reads from ReadDB, which is the read replica's
+// pool when there is one
+type ReleaseDateModel struct {
+	DB     DBTX
+	ReadDB DBTX
+
+	requestContext
+}
+
+// GetForMovie returns the release dates of a specific movie, ordered by country and then date
+func (m ReleaseDateModel) GetForMovie(movieID int64) ([]ReleaseDate, error) {
+	query := `
+		SELECT country, type, to_char(date, 'YYYY-MM-DD')
+		FROM release_dates
+		WHERE movie_id = $1
+		ORDER BY country, date, type`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	dates := []ReleaseDate{}
+
+	for rows.Next() {
+		var date ReleaseDate
+
+		err := rows.Scan(&date.Country, &date.Type, &date.Date)
+		if err != nil {
+			return nil, err
+		}
+
+		dates = append(dates, date)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return dates, nil
+}
+
+// SetForMovie replaces the release dates of a specific movie with the provided ones, in a single transaction
+func (m ReleaseDateModel) SetForMovie(movieID int64, dates []ReleaseDate) error {
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op if the transaction has already been committed
+	defer func(tx Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM release_dates WHERE movie_id = $1`, movieID)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO release_dates (movie_id, country, type, date) VALUES ($1, $2, $3, $4)`
+
+	for _, date := range dates {
+		_, err = tx.ExecContext(ctx, query, movieID, date.Country, date.Type, date.Date)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func ValidateReleaseDates(v *validator.Validator, dates []ReleaseDate) {
+	type key struct{ country, kind string }
+	seen := make(map[key]bool)
+
+	for _, date := range dates {
+		v.Check(validator.Matches(date.Country, CountryRX), "release_dates", "country must be a two letter ISO 3166-1 code")
+		v.Check(validator.In(date.Type, ReleaseTheatrical, ReleaseDigital), "release_dates", "type must be theatrical or digital")
+
+		_, err := time.Parse(ReleaseDateLayout, date.Date)
+		v.Check(err == nil, "release_dates", "date must be in the format YYYY-MM-DD")
+
+		k := key{date.Country, date.Type}
+		v.Check(!seen[k], "release_dates", "must not contain more than one release of each type per country")
+		seen[k] = true
+	}
+}
@@ -0,0 +1,255 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"time"
+)
+
+// ErrDuplicateReview error for users trying to write more than one review for the same movie
+var (
+	ErrDuplicateReview = errors.New("duplicate review")
+)
+
+// Review struct represents a single user's written review of a movie. A user can only have one review per movie,
+// which is enforced by the UNIQUE (movie_id, user_id) constraint on the reviews table
+type Review struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	MovieID   int64     `json:"movie_id"`
+	UserID    int64     `json:"user_id"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Version   int32     `json:"version"`
+}
+
+// OwnerID returns the ID of the user who wrote the review
+func (r *Review) OwnerID() int64 {
+	return r.UserID
+}
+
+// ReviewModel struct which wraps the connection pool. GetAllForMovie reads from ReadDB, which is the read replica's
+// pool when there is one
+type ReviewModel struct {
+	DB     DBTX
+	ReadDB DBTX
+
+	requestContext
+}
+
+// Insert a new review record in the database. The id, created_at and version fields are generated by the database,
+// so we read them back into the Review struct using the RETURNING clause
+func (m ReviewModel) Insert(review *Review) error {
+	query := `
+		INSERT INTO reviews (movie_id, user_id, title, body)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version`
+
+	args := []interface{}{review.MovieID, review.UserID, review.Title, review.Body}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	// If the user has already reviewed this movie, the insert will violate the UNIQUE (movie_id, user_id) constraint.
+	// We check for this error specifically, and return our custom ErrDuplicateReview error instead
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.Version)
+	if err != nil {
+		switch {
+		case isConstraintViolation(err, "reviews_movie_id_user_id_key"):
+			return ErrDuplicateReview
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get retrieves a specific review by its ID
+func (m ReviewModel) Get(id int64) (*Review, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, movie_id, user_id, title, body, version
+		FROM reviews
+		WHERE id = $1`
+
+	var review Review
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&review.ID,
+		&review.CreatedAt,
+		&review.MovieID,
+		&review.UserID,
+		&review.Title,
+		&review.Body,
+		&review.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &review, nil
+}
+
+// GetForUser retrieves the review that a specific user wrote for a specific movie
+func (m ReviewModel) GetForUser(movieID, userID int64) (*Review, error) {
+	query := `
+		SELECT id, created_at, movie_id, user_id, title, body, version
+		FROM reviews
+		WHERE movie_id = $1 AND user_id = $2`
+
+	var review Review
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, movieID, userID).Scan(
+		&review.ID,
+		&review.CreatedAt,
+		&review.MovieID,
+		&review.UserID,
+		&review.Title,
+		&review.Body,
+		&review.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &review, nil
+}
+
+// GetAllForMovie returns a page of the reviews for a specific movie, along with the pagination metadata
+func (m ReviewModel) GetAllForMovie(movieID int64, filters Filters) ([]*Review, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, movie_id, user_id, title, body, version
+		FROM reviews
+		WHERE movie_id = $1
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	reviews := []*Review{}
+
+	for rows.Next() {
+		var review Review
+
+		err := rows.Scan(
+			&totalRecords,
+			&review.ID,
+			&review.CreatedAt,
+			&review.MovieID,
+			&review.UserID,
+			&review.Title,
+			&review.Body,
+			&review.Version,
+		)
+
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		reviews = append(reviews, &review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return reviews, metadata, nil
+}
+
+// Update the title and body of a specific review. Like movies, we check against the version field to make sure the
+// review hasn't been changed by another request in the meantime, returning ErrEditConflict if it has
+func (m ReviewModel) Update(review *Review) error {
+	query := `
+		UPDATE reviews
+		SET title = $1, body = $2, version = version + 1
+		WHERE id = $3 AND version = $4
+		RETURNING version`
+
+	args := []interface{}{review.Title, review.Body, review.ID, review.Version}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&review.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes a specific review from the reviews table, returning ErrRecordNotFound if there was nothing to delete
+func (m ReviewModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM reviews WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Title != "", "title", "must be provided")
+	v.Check(len(review.Title) <= 200, "title", "must not be more than 200 bytes long")
+	v.Check(review.Body != "", "body", "must be provided")
+	v.Check(len(review.Body) <= 10_000, "body", "must not be more than 10,000 bytes long")
+}
@@ -0,0 +1,39 @@
+package data
+
+import (
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"strings"
+	"unicode"
+)
+
+// SearchFields lists the fields of a movie which can be searched when listing movies. The director and cast fields
+// match against the names of the people credited on the movie in those roles
+var SearchFields = []string{"title", "description", "director", "cast"}
+
+// searchQuery converts the search terms entered by a client into a PostgreSQL tsquery string. Every word is matched as
+// a prefix (so "star wa" matches "Star Wars"), and all the words must match. Anything other than letters and digits is
+// treated as a word separator, which means the client can't inject tsquery operators of their own. An empty string is
+// returned if there are no words to search for. The result is valid for both the english and simple configurations
+func searchQuery(terms string) string {
+	words := strings.FieldsFunc(terms, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for i := range words {
+		words[i] = words[i] + ":*"
+	}
+
+	return strings.Join(words, " & ")
+}
+
+// ValidateSearchFields checks that the fields a client asked to search are all supported
+func ValidateSearchFields(v *validator.Validator, fields []string) {
+	v.Check(len(fields) >= 1, "search_fields", "must contain at least 1 field")
+
+	for _, field := range fields {
+		if !validator.In(field, SearchFields...) {
+			v.AddError("search_fields", "must only contain title, description, director or cast")
+			return
+		}
+	}
+}
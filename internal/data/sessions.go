@@ -0,0 +1,257 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxUserAgentLength is the most of a client's User-Agent header that we store for a session
+const maxUserAgentLength = 512
+
+// maxDeviceIDLength is the longest device identifier that clients can register a remember-me device token with
+const maxDeviceIDLength = 200
+
+// The types of session that are listed for a user. Device sessions are the long-lived remember-me tokens, which are
+// exchanged for new authentication tokens as they expire
+const (
+	SessionTypeToken  = "token"
+	SessionTypeDevice = "device"
+)
+
+// sessionTouchInterval is how often the last used details of a session are updated. Recording every request would
+// mean a write to the tokens table for every authenticated request, and a minute is precise enough for the user to
+// recognise their sessions
+const sessionTouchInterval = time.Minute
+
+// Session struct represents one of a user's authentication tokens, as shown to the user so that they can see where
+// they're signed in. IP and UserAgent are those of the most recent request made with the token (or of the login, if
+// the token hasn't been used since). Current is set for the token that the request listing the sessions was made with,
+// and Impersonated for tokens which an administrator minted to act as the user. DeviceID is set for remember-me device
+// tokens and for the authentication tokens issued with them
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
+
+	Impersonated bool    `json:"impersonated"`
+	Type         string  `json:"type"`
+	DeviceID     *string `json:"device_id,omitempty"`
+}
+
+// ValidateDeviceID checks the identifier that a client sends with a remember-me login. It's chosen by the client, and
+// should stay the same for as long as the app is installed on the device
+func ValidateDeviceID(v *validator.Validator, deviceID string) {
+	v.Check(deviceID != "", "device_id", "must be provided")
+	v.Check(len(deviceID) <= maxDeviceIDLength, "device_id", fmt.Sprintf("must not be more than %d bytes long", maxDeviceIDLength))
+	v.Check(utf8.ValidString(deviceID), "device_id", "must be valid UTF-8")
+}
+
+// NewSession creates a new authentication token for a user, recording the IP address and user agent of the client
+// that it was issued to. The deviceID is empty unless the token is issued along with a remember-me device token.
+func (m TokenModel) NewSession(userID int64, ttl time.Duration, ip, userAgent, deviceID string) (*Token, error) {
+	return m.newDeviceBound(userID, ttl, ScopeAuthentication, ip, userAgent, deviceID)
+}
+
+// NewDeviceToken creates a long-lived remember-me token for a user, bound to the identifier of the device that it was
+// issued to. It can only be used from that device, to get new authentication tokens without logging in again.
+func (m TokenModel) NewDeviceToken(userID int64, ttl time.Duration, ip, userAgent, deviceID string) (*Token, error) {
+	return m.newDeviceBound(userID, ttl, ScopeDevice, ip, userAgent, deviceID)
+}
+
+// newDeviceBound inserts a token which records the client that it was issued to, and the device that it belongs to
+// if deviceID isn't empty
+func (m TokenModel) newDeviceBound(userID int64, ttl time.Duration, scope, ip, userAgent, deviceID string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, device_id, hash_version)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8)`
+
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, ip, truncateUserAgent(userAgent),
+		deviceID, token.HashVersion}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+
+	return token, err
+}
+
+// Touch records that an authentication token has just been used, and by which IP address and user agent. The update
+// is skipped if the token was already used within the last sessionTouchInterval.
+func (m TokenModel) Touch(tokenPlaintext, ip, userAgent string) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW(), ip = $3, user_agent = $4
+		WHERE (hash, hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[]))
+		AND (last_used_at IS NULL OR last_used_at < NOW() - $5 * INTERVAL '1 second')`
+
+	hashes, versions := tokenHashes(tokenPlaintext)
+
+	args := []interface{}{hashes, versions, ip, truncateUserAgent(userAgent), sessionTouchInterval.Seconds()}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+
+	return err
+}
+
+// ConsumeDeviceToken uses up a remember-me device token, which must be presented from the device that it was issued
+// to, and returns the ID of the user that it belongs to. Device tokens are replaced each time they're used, so a
+// stolen token stops working as soon as either the thief or the real device uses it. ErrRecordNotFound is returned if
+// there's no such unexpired token for the device
+func (m TokenModel) ConsumeDeviceToken(tokenPlaintext, deviceID string) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE (hash, hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[]))
+		AND scope = $3 AND device_id = $4 AND expiry > NOW()
+		RETURNING user_id`
+
+	hashes, versions := tokenHashes(tokenPlaintext)
+
+	var userID int64
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hashes, versions, ScopeDevice, deviceID).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
+
+// DeleteDevicesExcept revokes a user's remember-me device tokens, apart from the one for the device that the token
+// with the plaintext currentToken was issued to (if any). It goes along with DeleteAllForUserExcept, so that signing
+// out everywhere else also stops the other devices from signing themselves back in
+func (m TokenModel) DeleteDevicesExcept(userID int64, currentToken string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope = $2
+		AND device_id IS DISTINCT FROM (
+			SELECT device_id FROM tokens
+			WHERE (hash, hash_version) IN (SELECT * FROM unnest($3::bytea[], $4::smallint[])) AND user_id = $1)`
+
+	hashes, versions := tokenHashes(currentToken)
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, ScopeDevice, hashes, versions)
+
+	return err
+}
+
+// GetSessionsForUser returns a user's unexpired authentication and remember-me device tokens, most recently used
+// first. The token with the plaintext currentToken is marked as the current session.
+func (m TokenModel) GetSessionsForUser(userID int64, currentToken string) ([]*Session, error) {
+	query := `
+		SELECT id, created_at, last_used_at, expiry, ip, user_agent,
+			(hash, hash_version) IN (SELECT * FROM unnest($4::bytea[], $5::smallint[])), impersonator_id IS NOT NULL,
+			CASE WHEN scope = $3 THEN 'device' ELSE 'token' END, device_id
+		FROM tokens
+		WHERE user_id = $1 AND scope IN ($2, $3) AND expiry > NOW()
+		ORDER BY COALESCE(last_used_at, created_at) DESC, id DESC`
+
+	hashes, versions := tokenHashes(currentToken)
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication, ScopeDevice, hashes, versions)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+			&session.Current,
+			&session.Impersonated,
+			&session.Type,
+			&session.DeviceID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteSession revokes one of a user's authentication or remember-me device tokens. Revoking a device token revokes
+// the device as a whole, so the authentication tokens issued to the device are deleted along with it.
+// ErrRecordNotFound is returned if the user has no session with that ID.
+func (m TokenModel) DeleteSession(id, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $2 AND scope IN ($3, $4)
+		AND (id = $1 OR device_id = (SELECT device_id FROM tokens WHERE id = $1 AND user_id = $2 AND scope = $4))`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID, ScopeAuthentication, ScopeDevice)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// truncateUserAgent cuts a User-Agent header down to maxUserAgentLength bytes, so that a client can't fill the tokens
+// table with an enormous header. Any character split by the cut is dropped, as PostgreSQL rejects invalid UTF-8
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) > maxUserAgentLength {
+		return strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+	return userAgent
+}
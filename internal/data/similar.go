@@ -0,0 +1,128 @@
+package data
+
+import (
+	"context"
+	"math"
+	"sort"
+)
+
+// Weights used when ranking similar movies. Shared genres count for the most, followed by shared cast and crew, with
+// year proximity acting mostly as a tie-breaker between movies that are otherwise equally similar
+const (
+	similarGenreWeight  = 0.6
+	similarPeopleWeight = 0.3
+	similarYearWeight   = 0.1
+
+	// similarPeopleCap is the number of shared people at which the people component of the score is maxed out
+	similarPeopleCap = 5
+)
+
+// SimilarMovie wraps a Movie with its similarity to another movie. The Movie fields are embedded, so they appear at
+// the top level of the JSON alongside the score and the counts it was calculated from
+type SimilarMovie struct {
+	*Movie
+	Score        float64 `json:"score"`
+	SharedGenres int     `json:"shared_genres"`
+	SharedPeople int     `json:"shared_people"`
+}
+
+// GetSimilarCandidates returns up to limit movies which share at least one genre or at least one member of the cast
+// and crew with the given movie, along with the number of genres and people they share. The candidates are only
+// roughly ordered here, RankSimilar is responsible for the final ranking
+func (m MovieModel) GetSimilarCandidates(movie *Movie, limit int) ([]*SimilarMovie, error) {
+	query := `
+		WITH movie_people AS (SELECT DISTINCT person_id FROM movies_people WHERE movie_id = $1)
+		SELECT movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres,
+			movies.average_rating, movies.ratings_count, movies.poster_url, movies.version,
+			cardinality(ARRAY(SELECT unnest(movies.genres) INTERSECT SELECT unnest($2::text[]))) AS shared_genres,
+			(SELECT count(DISTINCT movies_people.person_id)
+				FROM movies_people
+				WHERE movies_people.movie_id = movies.id
+				AND movies_people.person_id IN (SELECT person_id FROM movie_people)) AS shared_people
+		FROM movies
+		WHERE movies.id <> $1
+		AND (movies.genres && $2::text[] OR movies.id IN (
+			SELECT movie_id FROM movies_people WHERE person_id IN (SELECT person_id FROM movie_people)))
+		ORDER BY shared_genres + shared_people DESC, abs(movies.year - $3) ASC, movies.id ASC
+		LIMIT $4`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, query, movie.ID, movie.Genres, movie.Year, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	candidates := []*SimilarMovie{}
+
+	for rows.Next() {
+		candidate := SimilarMovie{Movie: &Movie{}}
+
+		err := rows.Scan(
+			&candidate.ID,
+			&candidate.CreatedAt,
+			&candidate.Title,
+			&candidate.Year,
+			&candidate.Runtime,
+			array(&candidate.Genres),
+			&candidate.AverageRating,
+			&candidate.RatingsCount,
+			&candidate.PosterURL,
+			&candidate.Version,
+			&candidate.SharedGenres,
+			&candidate.SharedPeople,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		candidates = append(candidates, &candidate)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return candidates, nil
+}
+
+// RankSimilar scores each candidate against the given movie and returns the best limit candidates, highest score
+// first. Each score is between 0 and 1, and is a weighted sum of:
+//
+//   - the proportion of the two movies' combined genres that they share (the Jaccard index)
+//   - the number of shared cast and crew, up to similarPeopleCap
+//   - how close together the two movies were released, halving for every 10 years apart
+func RankSimilar(movie *Movie, candidates []*SimilarMovie, limit int) []*SimilarMovie {
+	for _, candidate := range candidates {
+		genreScore := 0.0
+		if union := len(movie.Genres) + len(candidate.Genres) - candidate.SharedGenres; union > 0 {
+			genreScore = float64(candidate.SharedGenres) / float64(union)
+		}
+
+		peopleScore := math.Min(float64(candidate.SharedPeople), similarPeopleCap) / similarPeopleCap
+
+		yearScore := math.Pow(0.5, math.Abs(float64(movie.Year-candidate.Year))/10)
+
+		score := similarGenreWeight*genreScore + similarPeopleWeight*peopleScore + similarYearWeight*yearScore
+
+		// Round the score so that it reads nicely in the JSON response
+		candidate.Score = math.Round(score*1000) / 1000
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].ID < candidates[j].ID
+	})
+
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	return candidates
+}
@@ -0,0 +1,197 @@
+package data
+
+import "time"
+
+// The stores are the interfaces which Models holds, one for each table or group of tables. The SQL models, such as
+// MovieModel, implement them with the database, and the mocks returned by NewMockModels implement them in memory, so
+// that the handlers can be tested without PostgreSQL
+
+// UserStore stores users and their accounts
+type UserStore interface {
+	Insert(user *User) error
+	GetByEmail(email string) (*User, error)
+	Update(user *User) error
+	SetPendingEmail(user *User, email string) error
+	ConfirmPendingEmail(user *User) error
+	GetForToken(tokenScope, tokenPlaintext string) (*User, error)
+	GetForExpiredToken(tokenScope, tokenPlaintext string) (*User, error)
+	ClaimDigests(interval time.Duration, limit int) ([]*DigestRecipient, error)
+	Unsubscribe(userID int64) error
+	RehashPassword(user *User, plaintextPassword string) error
+	Get(id int64) (*User, error)
+	GetForSession(tokenPlaintext string) (*User, *Impersonation, error)
+	GetProfile(userID int64) (*Profile, error)
+	GetPublic(id int64) (*PublicUser, error)
+	UpdateProfile(user *User, profile *Profile) error
+}
+
+// MovieStore stores movies
+type MovieStore interface {
+	Insert(movie *Movie) error
+	InsertMany(movies []*Movie, batchSize int) error
+	Get(id int64) (*Movie, error)
+	GetAll(query string, fields []string, genres []string, highlight bool, filters Filters) ([]*Movie, Metadata, error)
+	GetRandom(title string, genres []string) (*Movie, error)
+	Export(title string, genres []string, fn func(movie *Movie) error) error
+	Update(movie *Movie) error
+	UpdatePoster(movie *Movie) error
+	Delete(id int64) error
+	DeleteMany(ids []int64) (map[int64]string, error)
+	GetAddedSince(since time.Time, genres []string, limit int) ([]*Movie, error)
+	GetSimilarCandidates(movie *Movie, limit int) ([]*SimilarMovie, error)
+	WithDuplicateCheck(enabled bool) MovieStore
+}
+
+// TokenStore stores tokens, for activation, authentication, sessions and so on
+type TokenStore interface {
+	New(userID int64, ttl time.Duration, scope string) (*Token, error)
+	NewSingleUse(userID int64, ttl time.Duration, scope string) (*Token, error)
+	NewLimited(userID int64, ttl time.Duration, scope string, maxUses int) (*Token, error)
+	Insert(token *Token) error
+	DeleteAllForUser(scope string, userID int64) error
+	DeleteAllForUserExcept(scope string, userID int64, tokenPlaintext string) error
+	Use(scope, tokenPlaintext string) (int64, error)
+	GetExpiry(scope, tokenPlaintext string) (time.Time, error)
+	DeleteExpired(before time.Time, limit int) (int64, error)
+	NewImpersonation(userID, impersonatorID int64, ttl time.Duration, ip, userAgent string) (*Token, error)
+	NewSession(userID int64, ttl time.Duration, ip, userAgent, deviceID string) (*Token, error)
+	NewDeviceToken(userID int64, ttl time.Duration, ip, userAgent, deviceID string) (*Token, error)
+	Touch(tokenPlaintext, ip, userAgent string) error
+	ConsumeDeviceToken(tokenPlaintext, deviceID string) (int64, error)
+	DeleteDevicesExcept(userID int64, currentToken string) error
+	GetSessionsForUser(userID int64, currentToken string) ([]*Session, error)
+	DeleteSession(id, userID int64) error
+}
+
+// PermissionStore stores users' permissions
+type PermissionStore interface {
+	GetAllForUser(userID int64) (Permissions, error)
+	AddForUser(userID int64, codes ...string) error
+	GrantForUser(userID int64, codes ...string) (Permissions, error)
+}
+
+// ReviewStore stores reviews of movies
+type ReviewStore interface {
+	Insert(review *Review) error
+	Get(id int64) (*Review, error)
+	GetForUser(movieID, userID int64) (*Review, error)
+	GetAllForMovie(movieID int64, filters Filters) ([]*Review, Metadata, error)
+	Update(review *Review) error
+	Delete(id int64) error
+}
+
+// RatingStore stores ratings of movies
+type RatingStore interface {
+	Set(rating *Rating, movie *Movie) error
+}
+
+// WatchlistStore stores users' watchlists
+type WatchlistStore interface {
+	Add(userID, movieID int64) error
+	Remove(userID, movieID int64) error
+	GetAllForUser(userID int64, filters Filters) ([]*Movie, Metadata, error)
+}
+
+// PersonStore stores people, such as actors and directors, and their credits
+type PersonStore interface {
+	Insert(person *Person) error
+	Get(id int64) (*Person, error)
+	GetMovies(personID int64, role string, filters Filters) ([]*Movie, Metadata, error)
+	GetCreditsForMovie(movieID int64) ([]Credit, error)
+	SetCreditsForMovie(movieID int64, credits []Credit) error
+	CountExisting(ids []int64) (int, error)
+}
+
+// ViewStore stores counts of movie views, and the trending movies
+type ViewStore interface {
+	Add(counts map[int64]int64) error
+	GetTrending(days int, filters Filters) ([]*TrendingMovie, Metadata, error)
+}
+
+// ReleaseDateStore stores movies' release dates
+type ReleaseDateStore interface {
+	GetForMovie(movieID int64) ([]ReleaseDate, error)
+	SetForMovie(movieID int64, dates []ReleaseDate) error
+}
+
+// TwoFactorStore stores users' two-factor authentication secrets and recovery codes
+type TwoFactorStore interface {
+	Get(userID int64) (*TOTPSecret, error)
+	Enroll(userID int64, secret string) error
+	Enable(userID int64, counter int64) ([]string, error)
+	UseCounter(userID int64, counter int64) (bool, error)
+	UseRecoveryCode(userID int64, code string) (bool, error)
+}
+
+// APIKeyStore stores users' API keys
+type APIKeyStore interface {
+	New(key *APIKey) error
+	GetAllForUser(userID int64) ([]*APIKey, error)
+	GetForPlaintext(plaintext string) (*APIKey, *User, error)
+	Delete(id, userID int64) error
+}
+
+// IdentityStore stores users' identities with OpenID Connect providers
+type IdentityStore interface {
+	InsertState(state string, oidcState *OIDCState, ttl time.Duration) error
+	ConsumeState(state string) (*OIDCState, error)
+	GetUser(issuer, subject string) (*User, error)
+	Link(issuer, subject string, userID int64) error
+}
+
+// LoginEventStore stores login attempts
+type LoginEventStore interface {
+	Insert(event *LoginEvent) error
+	IsNewDevice(userID int64, ip, userAgent string) (bool, error)
+	GetAll(userID int64, success *bool, filters Filters) ([]*LoginEvent, Metadata, error)
+}
+
+// DataExportStore stores exports of users' data
+type DataExportStore interface {
+	Insert(export *DataExport) error
+	Get(id, userID int64) (*DataExport, error)
+	GetAllForUser(userID int64) ([]*DataExport, error)
+	SetRunning(id int64) error
+	Complete(id int64, archive []byte, expiry time.Time) error
+	Fail(id int64) error
+	GetArchive(id int64) ([]byte, error)
+	DeleteExpiredArchives(userID int64) error
+	GetReviews(userID int64) ([]*ExportedReview, error)
+	GetRatings(userID int64) ([]*ExportedRating, error)
+	GetWatchlist(userID int64) ([]*ExportedWatchlistItem, error)
+	GetLoginEvents(userID int64) ([]*LoginEvent, error)
+}
+
+// InvitationStore stores invitations to sign up
+type InvitationStore interface {
+	New(email string, invitedBy int64, ttl time.Duration) (*Invitation, error)
+	GetAll(status string, filters Filters) ([]*Invitation, Metadata, error)
+	Revoke(id int64) error
+	Consume(code, email string) (*Invitation, error)
+	Release(id int64) error
+	SetUsedBy(id, userID int64) error
+}
+
+// EmailStore stores the queue of emails to send
+type EmailStore interface {
+	Insert(email *Email) error
+	Claim(lease time.Duration) (*Email, error)
+	Delete(id int64) error
+	Retry(id int64, at time.Time, lastError string) error
+	Kill(id int64, lastError string) error
+	GetAll(status string, filters Filters) ([]*Email, Metadata, error)
+}
+
+// EmailDeliveryStore stores the outcomes of delivering emails
+type EmailDeliveryStore interface {
+	Insert(delivery *EmailDelivery) error
+	GetAll(outcomes []string, template, recipientHash string, filters Filters) ([]*EmailDelivery, Metadata, error)
+}
+
+// IPBlockStore stores blocked IP addresses and networks
+type IPBlockStore interface {
+	Insert(block *IPBlock) error
+	GetAll(filters Filters) ([]*IPBlock, Metadata, error)
+	GetActiveNetworks() ([]string, error)
+	Delete(id int64) error
+}
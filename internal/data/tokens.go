@@ -3,9 +3,9 @@ package data
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"github.com/eazylaykzy/greenlight/internal/validator"
 	"time"
 )
@@ -13,6 +13,10 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeEmailChange    = "email-change"
+	ScopeMagicLink      = "magic-link"
+	ScopeDevice         = "device"
+	ScopeUnsubscribe    = "unsubscribe"
 )
 
 // Token struct to hold the data for an individual token. This includes the
@@ -23,6 +27,13 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+
+	// HashVersion is the version of the pepper key that the hash was made with
+	HashVersion int `json:"-"`
+
+	// MaxUses is the number of times that the token can be used before it's used up, or 0 if it can be used any
+	// number of times until it expires
+	MaxUses int `json:"-"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -52,11 +63,9 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	// character for the purpose of our tokens, so we use the WithPadding(base32.NoPadding) method in the line below to omit them
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 
-	// Generate an SHA-256 hash of the plaintext token string. This will be the value that we store in the `hash` field
-	// of our database table. Note that the sha256.Sum256() function returns an *array* of length 32, so to make it
-	// easier to work with we convert it to a slice using the [:] operator before storing it.
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	// Generate a hash of the plaintext token string, peppered with the current pepper key. This will be the value that
+	// we store in the `hash` field of our database table, along with the version of the key that it was made with.
+	token.Hash, token.HashVersion = hashToken(token.Plaintext)
 	return token, nil
 }
 
@@ -67,7 +76,9 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB DBTX
+
+	requestContext
 }
 
 // New method is a shortcut which creates a new Token struct and then inserts the data in the tokens table.
@@ -82,13 +93,40 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
-// Insert adds the data for a specific token to the tokens table.
+// NewSingleUse creates a new token which is used up by the first successful call to Use. This is what tokens sent by
+// email should be, so that a link which is intercepted or replayed can't be used again.
+func (m TokenModel) NewSingleUse(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	return m.NewLimited(userID, ttl, scope, 1)
+}
+
+// NewLimited creates a new token which can be used maxUses times with Use before it's used up.
+func (m TokenModel) NewLimited(userID int64, ttl time.Duration, scope string, maxUses int) (*Token, error) {
+	if maxUses < 1 {
+		return nil, errors.New("a limited-use token must allow at least one use")
+	}
+
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.MaxUses = maxUses
+
+	err = m.Insert(token)
+
+	return token, err
+}
+
+// Insert adds the data for a specific token to the tokens table. A MaxUses of 0 is stored as NULL, which means
+// that the token can be used any number of times.
 func (m TokenModel) Insert(token *Token) error {
-	query := `INSERT INTO tokens (hash, user_id, expiry, scope) VALUES ($1, $2, $3, $4)`
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, hash_version, uses_remaining)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0))`
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.HashVersion, token.MaxUses}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
@@ -100,10 +138,138 @@ func (m TokenModel) Insert(token *Token) error {
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	query := `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 
 	return err
 }
+
+// DeleteAllForUserExcept deletes all tokens for a specific user and scope, apart from the token with the given
+// plaintext. This lets a user sign out everywhere else while staying signed in on the current device.
+func (m TokenModel) DeleteAllForUserExcept(scope string, userID int64, tokenPlaintext string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2
+		AND NOT (hash, hash_version) IN (SELECT * FROM unnest($3::bytea[], $4::smallint[]))`
+
+	hashes, versions := tokenHashes(tokenPlaintext)
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID, hashes, versions)
+
+	return err
+}
+
+// Use records a use of an unexpired token with the given scope and plaintext, and returns the ID of the user that
+// it belongs to. A limited-use token has its remaining uses counted down, and is deleted when its last use is taken.
+// The token's row is locked while this happens, so that concurrent requests can't use it more times than it allows;
+// only one of two requests racing for the last use of a token succeeds. Tokens without a limit are left as they are.
+// ErrRecordNotFound is returned if there's no such token (including when it has already been used up).
+func (m TokenModel) Use(scope, tokenPlaintext string) (int64, error) {
+	hashes, versions := tokenHashes(tokenPlaintext)
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// Rollback is a no-op if the transaction has already been committed
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	query := `
+		SELECT hash, user_id, uses_remaining
+		FROM tokens
+		WHERE (hash, hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[])) AND scope = $3 AND expiry > $4
+		FOR UPDATE`
+
+	var (
+		hash          []byte
+		userID        int64
+		usesRemaining *int
+	)
+
+	err = tx.QueryRowContext(ctx, query, hashes, versions, scope, time.Now()).Scan(&hash, &userID, &usesRemaining)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	switch {
+	case usesRemaining == nil:
+		return userID, nil
+	case *usesRemaining <= 1:
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE hash = $1`, hash)
+	default:
+		_, err = tx.ExecContext(ctx, `UPDATE tokens SET uses_remaining = uses_remaining - 1 WHERE hash = $1`, hash)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// GetExpiry returns the expiry time of an unexpired token with the given scope and plaintext. ErrRecordNotFound is
+// returned if there's no such token.
+func (m TokenModel) GetExpiry(scope, tokenPlaintext string) (time.Time, error) {
+	query := `
+		SELECT expiry FROM tokens
+		WHERE (hash, hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[])) AND scope = $3 AND expiry > $4`
+
+	hashes, versions := tokenHashes(tokenPlaintext)
+
+	var expiry time.Time
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hashes, versions, scope, time.Now()).Scan(&expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return time.Time{}, ErrRecordNotFound
+		default:
+			return time.Time{}, err
+		}
+	}
+
+	return expiry, nil
+}
+
+// DeleteExpired deletes up to limit tokens which expired before the given time, and returns how many were deleted.
+// Deleting in limited batches keeps each statement short, so that a large backlog of expired tokens doesn't hold
+// locks on the tokens table for long
+func (m TokenModel) DeleteExpired(before time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE hash IN (SELECT hash FROM tokens WHERE expiry < $1 LIMIT $2)`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+// recoveryCodeCount is the number of recovery codes issued when two-factor authentication is enabled
+const recoveryCodeCount = 10
+
+// ErrTwoFactorEnabled is returned when trying to enroll a new TOTP secret for a user who already has two-factor
+// authentication enabled
+var (
+	ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+)
+
+// TOTPSecret struct holds a user's TOTP shared secret. The secret is stored when the user enrolls, but two-factor
+// authentication isn't enabled until they have proved their authenticator app is set up by verifying a code with it.
+// LastCounter is the time step of the last code used to sign in, which stops a code being used more than once
+type TOTPSecret struct {
+	UserID      int64
+	Secret      string
+	Enabled     bool
+	LastCounter int64
+}
+
+// TwoFactorModel struct which wraps the connection pool
+type TwoFactorModel struct {
+	DB DBTX
+
+	requestContext
+}
+
+// Get returns the TOTP secret for a specific user, or ErrRecordNotFound if they have never enrolled
+func (m TwoFactorModel) Get(userID int64) (*TOTPSecret, error) {
+	query := `SELECT user_id, secret, enabled, last_counter FROM totp_secrets WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	var secret TOTPSecret
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&secret.UserID, &secret.Secret, &secret.Enabled, &secret.LastCounter)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &secret, nil
+}
+
+// Enroll stores a new (not yet enabled) TOTP secret for a specific user, replacing any earlier enrollment which was
+// never verified. ErrTwoFactorEnabled is returned if the user already has two-factor authentication enabled
+func (m TwoFactorModel) Enroll(userID int64, secret string) error {
+	query := `
+		INSERT INTO totp_secrets (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, created_at = NOW()
+		WHERE totp_secrets.enabled = false`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	return nil
+}
+
+// Enable turns on two-factor authentication for a specific user, once they have verified a code at the given time
+// step. A new set of recovery codes replaces any old ones in the same transaction, and their plaintexts are returned
+// so that they can be shown to the user. This is the only time the plaintext recovery codes are available
+func (m TwoFactorModel) Enable(userID int64, counter int64) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rollback is a no-op if the transaction has already been committed
+	defer func(tx Tx) {
+		_ = tx.Rollback()
+	}(tx)
+
+	query := `UPDATE totp_secrets SET enabled = true, last_counter = $2 WHERE user_id = $1 AND enabled = false`
+
+	result, err := tx.ExecContext(ctx, query, userID, counter)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if rowsAffected == 0 {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		hash, version := hashToken(normalizeRecoveryCode(code))
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (hash, user_id, hash_version) VALUES ($1, $2, $3)`,
+			hash, userID, version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// UseCounter records that a specific user has signed in with the code for the given time step. It returns false
+// without recording anything if that code (or a later one) has already been used, so each code only works once
+func (m TwoFactorModel) UseCounter(userID int64, counter int64) (bool, error) {
+	query := `UPDATE totp_secrets SET last_counter = $2 WHERE user_id = $1 AND enabled = true AND last_counter < $2`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, counter)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// UseRecoveryCode checks a recovery code for a specific user and, if it's valid, deletes it so that it can't be used
+// again. It reports whether the code was valid
+func (m TwoFactorModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+		DELETE FROM recovery_codes
+		WHERE (hash, hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[])) AND user_id = $3`
+
+	hashes, versions := tokenHashes(normalizeRecoveryCode(code))
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, hashes, versions, userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// generateRecoveryCode returns a random recovery code in the format XXXXX-XXXXX. Like our tokens, the codes have
+// enough entropy that a fast SHA-256 hash is fine for storing them
+func generateRecoveryCode() (string, error) {
+	randomBytes := make([]byte, 10)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)[:10]
+
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeRecoveryCode returns the form of a recovery code that gets hashed, so that the user can type it without
+// the hyphen and in any case
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
@@ -0,0 +1,119 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// DBTX is the connection that the SQL models make their queries with. It's the connection pool, unless the models are
+// being used in a transaction started by Models.WithTx, when it's the transaction
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error)
+}
+
+// Tx is a transaction started with DBTX.BeginTx. Rollback is a no-op once it has been committed
+type Tx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	Commit() error
+	Rollback() error
+}
+
+// pool is the DBTX for the connection pool, whose transactions are database transactions
+type pool struct {
+	*sql.DB
+}
+
+func (p pool) BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error) {
+	return p.DB.BeginTx(ctx, opts)
+}
+
+// txConn is the DBTX for a transaction started by Models.WithTx. A model which needs a transaction of its own, such
+// as TokenModel.Use, gets a savepoint in it instead, so that its changes are still committed or rolled back with
+// everything else, while a failure in the model only rolls back what the model did
+type txConn struct {
+	*sql.Tx
+
+	mu         sync.Mutex
+	savepoints int
+}
+
+func (c *txConn) BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error) {
+	c.mu.Lock()
+	c.savepoints++
+	name := fmt.Sprintf("sp_%d", c.savepoints)
+	c.mu.Unlock()
+
+	_, err := c.Tx.ExecContext(ctx, "SAVEPOINT "+name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &savepoint{Tx: c.Tx, ctx: ctx, name: name}, nil
+}
+
+// savepoint is a Tx for a savepoint in a transaction. Committing it releases the savepoint, and rolling it back rolls
+// the transaction back to where the savepoint was made
+type savepoint struct {
+	*sql.Tx
+
+	ctx  context.Context
+	name string
+	done bool
+}
+
+func (s *savepoint) Commit() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+
+	s.done = true
+
+	_, err := s.Tx.ExecContext(s.ctx, "RELEASE SAVEPOINT "+s.name)
+	return err
+}
+
+func (s *savepoint) Rollback() error {
+	if s.done {
+		return sql.ErrTxDone
+	}
+
+	s.done = true
+
+	_, err := s.Tx.ExecContext(s.ctx, "ROLLBACK TO SAVEPOINT "+s.name)
+	return err
+}
+
+// WithTx runs fn in a database transaction, with models whose queries are all made in it under ctx, so that a set of
+// changes across the models, such as creating a user with their permissions and activation token, is either made in
+// full or not at all. The transaction is committed if fn returns nil, and rolled back if it returns an error or panics.
+// Queries made with any other models, such as m itself, aren't part of the transaction. The mocks have no database,
+// so fn is run with them as they are
+func (m Models) WithTx(ctx context.Context, fn func(txModels Models) error) error {
+	if m.db == nil {
+		return fn(m)
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op if the transaction has already been committed
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	err = fn(m.withConn(&txConn{Tx: tx}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
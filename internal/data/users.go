@@ -2,11 +2,9 @@ package data
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"errors"
 	"github.com/eazylaykzy/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 	"time"
 )
 
@@ -31,7 +29,9 @@ var (
 
 // UserModel struct which wraps the connection pool
 type UserModel struct {
-	DB *sql.DB
+	DB DBTX
+
+	requestContext
 }
 
 // Insert a new record in the database for the user. Note that the id, created_at and version fields are all
@@ -44,7 +44,7 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 
 	defer cancel()
 
@@ -54,7 +54,7 @@ func (m UserModel) Insert(user *User) error {
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case isConstraintViolation(err, "users_email_key"):
 			return ErrDuplicateEmail
 		default:
 			return err
@@ -74,7 +74,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 
 	defer cancel()
 
@@ -119,12 +119,12 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case isConstraintViolation(err, "users_email_key"):
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
@@ -135,6 +135,59 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
+// SetPendingEmail records a new email address for a specific user, which replaces their current email address once
+// they have confirmed that it belongs to them. Like Update, this checks against the version field
+func (m UserModel) SetPendingEmail(user *User, email string) error {
+	query := `
+		UPDATE users
+		SET pending_email = $1, version = version + 1
+		WHERE id = $2 AND version = $3
+		RETURNING version`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, email, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ConfirmPendingEmail swaps a specific user's email address for their pending email address, and updates the user
+// struct with the new address. ErrRecordNotFound is returned if the user has no pending email address, and
+// ErrDuplicateEmail if someone else has started using the address since it was requested
+func (m UserModel) ConfirmPendingEmail(user *User) error {
+	query := `
+		UPDATE users
+		SET email = pending_email, pending_email = NULL, version = version + 1
+		WHERE id = $1 AND pending_email IS NOT NULL
+		RETURNING email, version`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID).Scan(&user.Email, &user.Version)
+	if err != nil {
+		switch {
+		case isConstraintViolation(err, "users_email_key"):
+			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
 // password type is a struct containing the plaintext and hashed versions of the password for a user. The plaintext
 // field is a *pointer* to a string, so that we're able to distinguish between a plaintext password not being present in
 // the struct at all, versus a plaintext password which is the empty string ""
@@ -148,9 +201,11 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
+// ValidatePasswordPlaintext makes the basic checks on a password. The rules for new passwords, such as the minimum
+// length, are set by a PasswordPolicy. The maximum length is always checked here, as bcrypt only uses the first 72
+// bytes of a password
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
 	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
 }
 
@@ -174,10 +229,10 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 }
 
-// Set method calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext versions in the struct
+// Set method calculates the hash of a plaintext password, using the algorithm set by Hashing, and stores both the hash
+// and the plaintext versions in the struct
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := hashPassword(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -188,45 +243,80 @@ func (p *password) Set(plaintextPassword string) error {
 }
 
 // Matches method checks whether the provided plaintext password matches the
-// hashed password stored in the struct, and returns a boolean
+// hashed password stored in the struct, and returns a boolean. Hashes made with either bcrypt or Argon2id are supported
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	return comparePassword(p.hash, plaintextPassword)
+}
+
+func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	// Calculate the hashes of the plaintext token provided by the client, one for each of the pepper keys that it
+	// could have been hashed with, along with the version of each key.
+	tokenHashes, hashVersions := tokenHashes(tokenPlaintext)
+
+	// Set up the SQL query.
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		FROM users
+		INNER JOIN tokens ON (users.id = tokens.user_id)
+		WHERE ((tokens.hash, tokens.hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[]))
+			AND tokens.scope = $3 AND tokens.expiry > $4)`
+
+	// Create a slice containing the query arguments. The token hashes are a [][]byte and their versions a []int16,
+	// which pgx sends as PostgreSQL bytea[] and smallint[] arrays to be paired up by unnest, and we pass the current
+	// time as the value to check against the token expiry.
+	args := []interface{}{tokenHashes, hashVersions, tokenScope, time.Now()}
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	// Execute the query, scanning the return values into a User struct. If no matching
+	// record is found we return an ErrRecordNotFound error.
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+
 	if err != nil {
 		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
 		default:
-			return false, err
+			return nil, err
 		}
 	}
 
-	return true, nil
+	// Return the matching user.
+	return &user, nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
-	// Calculate the SHA-256 hash of the plaintext token provided by the client.
-	// Remember that this returns a byte *array* with length 32, not a slice.
-	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+// GetForExpiredToken retrieves the user that a token with the given scope and plaintext was issued to, if the token
+// has expired. This lets us tell a client that their token has expired rather than that it's invalid. Expired tokens
+// are kept until they're replaced, so ErrRecordNotFound is returned for a token which has been used or replaced, as
+// well as for one which never existed
+func (m UserModel) GetForExpiredToken(tokenScope, tokenPlaintext string) (*User, error) {
+	tokenHashes, hashVersions := tokenHashes(tokenPlaintext)
 
-	// Set up the SQL query.
 	query := `
 		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
 		FROM users
 		INNER JOIN tokens ON (users.id = tokens.user_id)
-		WHERE (tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > $3)`
+		WHERE ((tokens.hash, tokens.hash_version) IN (SELECT * FROM unnest($1::bytea[], $2::smallint[]))
+			AND tokens.scope = $3 AND tokens.expiry <= $4)`
 
-	// Create a slice containing the query arguments. Notice how we use the [:] operator to get a slice containing the
-	// token hash, rather than passing in the array (which is not supported by the pq driver), and that we pass the
-	// current time as the value to check against the token expiry.
-	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+	args := []interface{}{tokenHashes, hashVersions, tokenScope, time.Now()}
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
 	defer cancel()
 
-	// Execute the query, scanning the return values into a User struct. If no matching
-	// record is found we return an ErrRecordNotFound error.
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
 		&user.ID,
 		&user.CreatedAt,
@@ -246,7 +336,6 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		}
 	}
 
-	// Return the matching user.
 	return &user, nil
 }
 
@@ -0,0 +1,128 @@
+package data
+
+import (
+	"context"
+	"fmt"
+)
+
+// TrendingWindows maps the time windows supported for trending movies to the number of days of views they cover.
+// The "all" window has no limit, and lists the most popular movies of all time
+var TrendingWindows = map[string]int{
+	"day":   1,
+	"week":  7,
+	"month": 30,
+	"all":   0,
+}
+
+// TrendingMovie wraps a Movie with the number of views it had in the requested time window. The Movie fields are
+// embedded, so they appear at the top level of the JSON alongside the view count
+type TrendingMovie struct {
+	*Movie
+	Views int64 `json:"views"`
+}
+
+// ViewModel struct which wraps the connection pool. Views are counted per movie per day in the movie_views table,
+// which lets us total them up over any window of whole days. GetTrending reads from ReadDB, which is the read
+// replica's pool when there is one
+type ViewModel struct {
+	DB     DBTX
+	ReadDB DBTX
+
+	requestContext
+}
+
+// Add records a batch of views against today's date. The counts map is keyed by movie ID. All the counts are written
+// with a single statement, so the handlers can buffer views in memory and flush them here periodically rather than
+// writing to the database every time a movie is viewed
+func (m ViewModel) Add(counts map[int64]int64) error {
+	if len(counts) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(counts))
+	views := make([]int64, 0, len(counts))
+
+	for id, count := range counts {
+		ids = append(ids, id)
+		views = append(views, count)
+	}
+
+	// The join against movies skips any views for movies which have been deleted since they were counted, which
+	// would otherwise violate the foreign key constraint and lose the whole batch
+	query := `
+		INSERT INTO movie_views (movie_id, day, views)
+		SELECT counts.movie_id, CURRENT_DATE, counts.views
+		FROM unnest($1::bigint[], $2::bigint[]) AS counts (movie_id, views)
+		INNER JOIN movies ON movies.id = counts.movie_id
+		ON CONFLICT (movie_id, day) DO UPDATE SET views = movie_views.views + EXCLUDED.views`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ids, views)
+
+	return err
+}
+
+// GetTrending returns a page of the most viewed movies over the last number of days (including today), along with
+// the pagination metadata. If days is 0, views are counted over all time
+func (m ViewModel) GetTrending(days int, filters Filters) ([]*TrendingMovie, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres,
+			movies.average_rating, movies.ratings_count, movies.poster_url, movies.version, totals.views
+		FROM movies
+		INNER JOIN (
+			SELECT movie_id, sum(views)::bigint AS views
+			FROM movie_views
+			WHERE (day > CURRENT_DATE - $1::integer OR $1 = 0)
+			GROUP BY movie_id
+		) AS totals ON totals.movie_id = movies.id
+		ORDER BY %s %s, movies.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.ReadDB.QueryContext(ctx, query, days, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	movies := []*TrendingMovie{}
+
+	for rows.Next() {
+		movie := TrendingMovie{Movie: &Movie{}}
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			array(&movie.Genres),
+			&movie.AverageRating,
+			&movie.RatingsCount,
+			&movie.PosterURL,
+			&movie.Version,
+			&movie.Views,
+		)
+
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return movies, metadata, nil
+}
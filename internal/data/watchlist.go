@@ -0,0 +1,111 @@
+package data
+
+import (
+	"context"
+	"fmt"
+)
+
+// WatchlistModel struct which wraps the connection pool. The watchlist table is a simple join table between users and
+// movies, so there's no dedicated struct for an entry; reads return the full Movie records instead
+type WatchlistModel struct {
+	DB DBTX
+
+	requestContext
+}
+
+// Add puts a movie on a user's watchlist. Adding a movie which is already on the watchlist is not an error, the
+// existing entry (and the time it was originally added) is simply left in place
+func (m WatchlistModel) Add(userID, movieID int64) error {
+	query := `
+		INSERT INTO watchlist (user_id, movie_id)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id, movie_id) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, movieID)
+
+	return err
+}
+
+// Remove takes a movie off a user's watchlist, returning ErrRecordNotFound if it wasn't on there in the first place
+func (m WatchlistModel) Remove(userID, movieID int64) error {
+	query := `DELETE FROM watchlist WHERE user_id = $1 AND movie_id = $2`
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, movieID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAllForUser returns a page of the full movie records on a user's watchlist, along with the pagination metadata
+func (m WatchlistModel) GetAllForUser(userID int64, filters Filters) ([]*Movie, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres,
+			movies.average_rating, movies.ratings_count, movies.poster_url, movies.version
+		FROM movies
+		INNER JOIN watchlist ON watchlist.movie_id = movies.id
+		WHERE watchlist.user_id = $1
+		ORDER BY %s %s, movies.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(m.parent(), QueryTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			array(&movie.Genres),
+			&movie.AverageRating,
+			&movie.RatingsCount,
+			&movie.PosterURL,
+			&movie.Version,
+		)
+
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return movies, metadata, nil
+}
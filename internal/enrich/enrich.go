@@ -0,0 +1,149 @@
+package enrich
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrNotFound is returned by Lookup when the provider doesn't have a movie matching the title (and year)
+var ErrNotFound = errors.New("enrich: movie not found")
+
+// Metadata holds the details of a movie as reported by the metadata provider. Any detail that the provider doesn't
+// know is left as its zero value
+type Metadata struct {
+	Title       string
+	Description string
+	Year        int32
+	Runtime     int32
+	Genres      []string
+	PosterURL   string
+}
+
+// Client looks up movie metadata from the OMDb API (https://www.omdbapi.com). Outbound requests are rate limited,
+// as the API keys have a daily quota and the free tier is easy to exhaust with a bulk enrichment
+type Client struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+	limiter *rate.Limiter
+}
+
+// New returns a Client for the OMDb API at baseURL, which makes no more than rps requests per second on average, with
+// bursts of up to burst requests
+func New(baseURL, apiKey string, rps float64, burst int) *Client {
+	return &Client{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/",
+		apiKey:  apiKey,
+		limiter: rate.NewLimiter(rate.Limit(rps), burst),
+	}
+}
+
+// Lookup fetches the metadata for the movie with the given title. If year is not 0 it's used to pick between movies
+// with the same title. When the rate limit has been reached, Lookup waits for its turn (or for ctx to be done)
+func (c *Client) Lookup(ctx context.Context, title string, year int32) (*Metadata, error) {
+	err := c.limiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	qs := url.Values{}
+	qs.Set("apikey", c.apiKey)
+	qs.Set("t", title)
+	qs.Set("type", "movie")
+	qs.Set("plot", "short")
+	if year != 0 {
+		qs.Set("y", strconv.FormatInt(int64(year), 10))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"?"+qs.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("enrich: unexpected response status %s", res.Status)
+	}
+
+	// OMDb reports every value as a string, using "N/A" for anything it doesn't know. Failures (including an unknown
+	// movie) are reported with a 200 OK status, a Response of "False" and an Error message
+	var body struct {
+		Response string `json:"Response"`
+		Error    string `json:"Error"`
+		Title    string `json:"Title"`
+		Plot     string `json:"Plot"`
+		Year     string `json:"Year"`
+		Runtime  string `json:"Runtime"`
+		Genre    string `json:"Genre"`
+		Poster   string `json:"Poster"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body.Response != "True" {
+		if strings.Contains(strings.ToLower(body.Error), "not found") {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("enrich: %s", body.Error)
+	}
+
+	metadata := &Metadata{
+		Title:       known(body.Title),
+		Description: known(body.Plot),
+		PosterURL:   known(body.Poster),
+	}
+
+	// The year can be a range such as "2005–2008", in which case the start of the range is used
+	if s := known(body.Year); len(s) >= 4 {
+		year, err := strconv.ParseInt(s[:4], 10, 32)
+		if err == nil {
+			metadata.Year = int32(year)
+		}
+	}
+
+	// The runtime is given in the format "136 min"
+	if s := strings.TrimSuffix(known(body.Runtime), " min"); s != "" {
+		runtime, err := strconv.ParseInt(s, 10, 32)
+		if err == nil {
+			metadata.Runtime = int32(runtime)
+		}
+	}
+
+	// The genres are a comma-separated list such as "Action, Sci-Fi". We store genres in lowercase
+	if s := known(body.Genre); s != "" {
+		for _, genre := range strings.Split(s, ",") {
+			if genre = strings.ToLower(strings.TrimSpace(genre)); genre != "" {
+				metadata.Genres = append(metadata.Genres, genre)
+			}
+		}
+	}
+
+	return metadata, nil
+}
+
+// known returns s, or an empty string if s is OMDb's "N/A" placeholder for an unknown value
+func known(s string) string {
+	if s == "N/A" {
+		return ""
+	}
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,73 @@
+package hibp
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client checks passwords against the Have I Been Pwned Pwned Passwords API (https://haveibeenpwned.com/API/v3),
+// which lists passwords that have appeared in data breaches. It uses the k-anonymity range API, so only the first five
+// characters of the SHA-1 hash of a password are ever sent
+type Client struct {
+	client  *http.Client
+	baseURL string
+}
+
+// New returns a Client for the Pwned Passwords API at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		client:  &http.Client{Timeout: 5 * time.Second},
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Breached reports whether a password has appeared in a data breach
+func (c *Client) Breached(password string) (bool, error) {
+	hash := sha1.Sum([]byte(password))
+	hexHash := strings.ToUpper(hex.EncodeToString(hash[:]))
+	prefix, suffix := hexHash[:5], hexHash[5:]
+
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+"/range/"+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+
+	// Padding adds fake entries to the response, so that its size doesn't give away which range was asked for
+	req.Header.Set("Add-Padding", "true")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("hibp: unexpected response status %s", res.Status)
+	}
+
+	// Each line of the response is the rest of a hash in the range and the number of times it has been seen, in the
+	// format "SUFFIX:COUNT". The padding entries have a count of 0
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if len(parts) != 2 || parts[0] != suffix {
+			continue
+		}
+
+		count, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return false, fmt.Errorf("hibp: invalid count %q", parts[1])
+		}
+
+		return count > 0, nil
+	}
+
+	return false, scanner.Err()
+}
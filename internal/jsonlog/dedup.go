@@ -0,0 +1,166 @@
+package jsonlog
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DedupStats holds the number of error entries which have been written and suppressed by a DedupHandler, for
+// publishing as metrics. Suppressed entries are still counted, so the totals are the same as without deduplication
+type DedupStats struct {
+	Written    int64 `json:"written"`
+	Suppressed int64 `json:"suppressed"`
+}
+
+// DedupHandler is a slog.Handler which stops identical error entries from flooding the log, for example when the
+// database goes down and every request fails the same way. Entries at the ERROR level are counted by their level and
+// message, and only the first few with each message in each interval are passed on. At the end of an interval in
+// which some were held back, a single entry with the same message is written instead, with "repeated" and "interval"
+// properties saying how many. Entries below the ERROR level, and FATAL entries, are always passed on
+type DedupHandler struct {
+	next     slog.Handler
+	interval time.Duration
+	burst    int
+	state    *dedupState
+}
+
+// dedupState is shared by a DedupHandler and the copies of it made by WithAttrs and WithGroup, so that they're
+// counted together
+type dedupState struct {
+	mu      sync.Mutex
+	entries map[dedupKey]*dedupEntry
+
+	written    int64
+	suppressed int64
+}
+
+// dedupKey identifies the entries which are counted as the same
+type dedupKey struct {
+	level   slog.Level
+	message string
+}
+
+// dedupEntry counts the entries with one key in the current interval. handler is the handler which saw the first of
+// them, which the summary is written with so that it has the same attributes
+type dedupEntry struct {
+	count      int
+	suppressed int
+	handler    slog.Handler
+}
+
+// NewDedupHandler returns a DedupHandler which passes on up to burst identical error entries in each interval to
+// next, and suppresses the rest. With an interval of zero, nothing is suppressed but the entries are still counted
+func NewDedupHandler(next slog.Handler, interval time.Duration, burst int) *DedupHandler {
+	return &DedupHandler{
+		next:     next,
+		interval: interval,
+		burst:    burst,
+		state:    &dedupState{entries: make(map[dedupKey]*dedupEntry)},
+	}
+}
+
+// Enabled reports whether records at the level are written
+func (h *DedupHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// WithAttrs returns a DedupHandler which adds the attributes to every record, and shares this one's counts
+func (h *DedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithAttrs(attrs)
+
+	return &h2
+}
+
+// WithGroup returns a DedupHandler which puts attributes in a group, and shares this one's counts
+func (h *DedupHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+
+	return &h2
+}
+
+// withNext returns a DedupHandler which passes records on to a different handler, and shares this one's counts
+func (h *DedupHandler) withNext(next slog.Handler) *DedupHandler {
+	h2 := *h
+	h2.next = next
+
+	return &h2
+}
+
+// Handle passes the record on, unless it's an error which has already been logged as many times as are allowed in the
+// current interval
+func (h *DedupHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < slog.LevelError || record.Level >= slogFatal {
+		return h.next.Handle(ctx, record)
+	}
+
+	h.state.mu.Lock()
+
+	if h.interval <= 0 {
+		h.state.written++
+		h.state.mu.Unlock()
+
+		return h.next.Handle(ctx, record)
+	}
+
+	key := dedupKey{level: record.Level, message: record.Message}
+
+	entry, ok := h.state.entries[key]
+	if !ok {
+		// The first entry with this message starts a new interval, at the end of which the summary is written
+		entry = &dedupEntry{handler: h.next}
+		h.state.entries[key] = entry
+
+		time.AfterFunc(h.interval, func() {
+			h.flush(key)
+		})
+	}
+
+	entry.count++
+
+	if entry.count > h.burst {
+		entry.suppressed++
+		h.state.suppressed++
+		h.state.mu.Unlock()
+
+		return nil
+	}
+
+	h.state.written++
+	h.state.mu.Unlock()
+
+	return h.next.Handle(ctx, record)
+}
+
+// Stats returns the number of error entries which have been written and suppressed so far
+func (h *DedupHandler) Stats() DedupStats {
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+
+	return DedupStats{Written: h.state.written, Suppressed: h.state.suppressed}
+}
+
+// flush ends the interval for a key, writing a summary of the entries which were suppressed during it, if there were
+// any
+func (h *DedupHandler) flush(key dedupKey) {
+	h.state.mu.Lock()
+	entry := h.state.entries[key]
+	delete(h.state.entries, key)
+	h.state.mu.Unlock()
+
+	if entry == nil || entry.suppressed == 0 {
+		return
+	}
+
+	record := slog.NewRecord(time.Now(), key.level, key.message, 0)
+	record.AddAttrs(
+		slog.String("repeated", strconv.Itoa(entry.suppressed)),
+		slog.String("interval", h.interval.String()),
+	)
+
+	_ = entry.handler.Handle(context.Background(), record)
+}
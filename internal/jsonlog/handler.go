@@ -0,0 +1,230 @@
+package jsonlog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handler is a slog.Handler which writes each record as a line of JSON, in the format that the application's logs
+// have always used:
+//
+//	{"level":"ERROR","time":"...","message":"...","properties":{"key":"value"},"trace":"..."}
+//
+// The record's attributes become the properties, with groups nested inside them as objects, and entries at the ERROR
+// level and above include a trimmed stack trace of the code which logged them, unless stack traces are turned off
+type Handler struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	level  slog.Leveler
+	traces *atomic.Bool
+
+	// scopes holds the groups and attributes added with WithGroup and WithAttrs, in the order they were added
+	scopes []scope
+}
+
+// scope is a group or a set of attributes added to a Handler. Attributes which are added after a group go inside it
+type scope struct {
+	group string
+	attrs []slog.Attr
+}
+
+// NewHandler returns a Handler which writes the records at or above the minimum level to out, with stack traces
+func NewHandler(out io.Writer, level slog.Leveler) *Handler {
+	h := &Handler{out: out, mu: &sync.Mutex{}, level: level, traces: new(atomic.Bool)}
+	h.traces.Store(true)
+
+	return h
+}
+
+// SetStackTraces turns the stack traces on ERROR and FATAL entries on or off, for this Handler and the ones made from
+// it with WithAttrs and WithGroup. It's safe to call while the Handler is in use
+func (h *Handler) SetStackTraces(on bool) {
+	h.traces.Store(on)
+}
+
+// StackTraces reports whether ERROR and FATAL entries include a stack trace
+func (h *Handler) StackTraces() bool {
+	return h.traces.Load()
+}
+
+// Enabled reports whether records at the level are written
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// WithAttrs returns a Handler which adds the attributes to every record
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+
+	return h.with(scope{attrs: attrs})
+}
+
+// WithGroup returns a Handler which puts the attributes added afterwards, and those of every record, in a group
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	return h.with(scope{group: name})
+}
+
+// withLevel returns a copy of the Handler with a different minimum level. The copies share the output and its mutex
+func (h *Handler) withLevel(level slog.Leveler) *Handler {
+	h2 := *h
+	h2.level = level
+
+	return &h2
+}
+
+// with returns a copy of the Handler with another scope. The copies share the output and its mutex
+func (h *Handler) with(s scope) *Handler {
+	h2 := *h
+	h2.scopes = append(append([]scope(nil), h.scopes...), s)
+
+	return &h2
+}
+
+// Handle writes the record as a line of JSON
+func (h *Handler) Handle(_ context.Context, record slog.Record) error {
+	// Declare an anonymous struct holding the data for the log entry
+	aux := struct {
+		Level      string                 `json:"level"`
+		Time       string                 `json:"time"`
+		Message    string                 `json:"message"`
+		Properties map[string]interface{} `json:"properties,omitempty"`
+		Trace      string                 `json:"trace,omitempty"`
+	}{
+		Level:   levelName(record.Level),
+		Time:    record.Time.UTC().Format(time.RFC3339),
+		Message: record.Message,
+	}
+
+	if record.Time.IsZero() {
+		aux.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	// Add the handler's attributes, opening each group in turn, and then the record's own attributes in the innermost
+	// group. Groups which end up empty are left out
+	properties := make(map[string]interface{})
+	current := properties
+
+	for _, s := range h.scopes {
+		if s.group != "" {
+			group := make(map[string]interface{})
+			current[s.group] = group
+			current = group
+			continue
+		}
+
+		for _, attr := range s.attrs {
+			addAttr(current, attr)
+		}
+	}
+
+	record.Attrs(func(attr slog.Attr) bool {
+		addAttr(current, attr)
+		return true
+	})
+
+	if pruneEmpty(properties); len(properties) > 0 {
+		aux.Properties = properties
+	}
+
+	// Include a stack trace for entries at the ERROR and FATAL levels. Records which weren't logged from anywhere in
+	// particular, such as the summaries written by DedupHandler, have no caller and so no trace
+	if record.Level >= slog.LevelError && record.PC != 0 && h.traces.Load() {
+		aux.Trace = stackTrace()
+	}
+
+	// Declare a line variable for holding the actual log entry text
+	var line []byte
+
+	// Marshal the anonymous struct to JSON and store it in the line variable. If there was a problem creating
+	// the JSON, set the contents of the log entry to be that plain-text error message instead
+	line, err := json.Marshal(aux)
+	if err != nil {
+		line = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
+	}
+
+	// Lock the mutex so that no two writes to the output destination can happen concurrently.
+	// If we don't do this, it's possible that the text for two or more log entries will be intermingled in the output
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Write the log entry followed by a newline
+	_, err = h.out.Write(append(line, '\n'))
+
+	return err
+}
+
+// levelName returns the name of a slog level as it's written in the log entries. Levels between the named ones are
+// written as the name of the level below them
+func levelName(level slog.Level) string {
+	switch {
+	case level >= slogFatal:
+		return LevelFatal.String()
+	case level >= slog.LevelError:
+		return LevelError.String()
+	case level >= slog.LevelWarn:
+		return "WARN"
+	case level >= slog.LevelInfo:
+		return LevelInfo.String()
+	default:
+		return LevelDebug.String()
+	}
+}
+
+// addAttr adds an attribute to the properties. Groups become nested objects, or are merged into the properties when
+// they have no name, and attributes with an empty key are ignored, as slog handlers are expected to do
+func addAttr(properties map[string]interface{}, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+
+	if attr.Value.Kind() == slog.KindGroup {
+		group := properties
+		if attr.Key != "" {
+			group = make(map[string]interface{})
+			properties[attr.Key] = group
+		}
+
+		for _, a := range attr.Value.Group() {
+			addAttr(group, a)
+		}
+
+		return
+	}
+
+	if attr.Key == "" {
+		return
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindDuration:
+		properties[attr.Key] = attr.Value.Duration().String()
+	case slog.KindTime:
+		properties[attr.Key] = attr.Value.Time().UTC().Format(time.RFC3339)
+	default:
+		value := attr.Value.Any()
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		properties[attr.Key] = value
+	}
+}
+
+// pruneEmpty removes the groups which have nothing in them from the properties
+func pruneEmpty(properties map[string]interface{}) {
+	for key, value := range properties {
+		if group, ok := value.(map[string]interface{}); ok {
+			if pruneEmpty(group); len(group) == 0 {
+				delete(properties, key)
+			}
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package jsonlog
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"io"
+	"log/slog"
 	"os"
-	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,14 +17,21 @@ type Level int8
 // Initialize constants which represent a specific severity level. We use the iota
 // keyword as a shortcut to assign successive integer values to the constants.
 const (
-	LevelInfo Level = iota
+	LevelDebug Level = iota - 1
+	LevelInfo
 	LevelError
 	LevelFatal
 )
 
+// slogFatal is the slog level that FATAL entries are logged at. slog has no level above ERROR, so it's the next one up
+// in slog's steps of four
+const slogFatal = slog.LevelError + 4
+
 // Return a human-friendly string for the severity level
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
 	case LevelError:
@@ -34,92 +43,237 @@ func (l Level) String() string {
 	}
 }
 
-// Logger holds the output destination that the log entries will be written to, the minimum severity level
-// that log entries will be written for, plus a mutex for coordinating the writes
+// slogLevel returns the slog level that entries at this severity level are logged at
+func (l Level) slogLevel() slog.Level {
+	switch l {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelError:
+		return slog.LevelError
+	case LevelFatal:
+		return slogFatal
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// ParseLevel returns the severity level with the given name, such as "info" or "ERROR"
+func ParseLevel(name string) (Level, error) {
+	for _, level := range []Level{LevelDebug, LevelInfo, LevelError, LevelFatal} {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// Logger writes log entries through a Handler, at or above a minimum severity level which can be changed while the
+// logger is in use. The Print methods are kept for the application's own log entries, and Slog returns a *slog.Logger
+// writing to the same output, for code which logs with log/slog
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	handler  *Handler
+	dedup    *DedupHandler
+	slog     *slog.Logger
+	minLevel *slog.LevelVar
+
+	// components holds the levels set for particular components, and is shared by a Logger and the child loggers
+	// made from it with With. component is the name of this logger's component, if it has one
+	components *componentLevels
+	component  string
+}
+
+// componentLevels holds the minimum severity levels of the components which have their own, keyed by component name
+type componentLevels struct {
+	mu     sync.RWMutex
+	levels map[string]slog.Level
+}
+
+// componentLeveler is the slog.Leveler for a component's logger. It uses the component's own level if it has one, and
+// the minimum level of the logger it was made from otherwise
+type componentLeveler struct {
+	component  string
+	components *componentLevels
+	fallback   slog.Leveler
+}
+
+// Level returns the minimum level of the component's log entries
+func (c componentLeveler) Level() slog.Level {
+	c.components.mu.RLock()
+	defer c.components.mu.RUnlock()
+
+	if level, ok := c.components.levels[c.component]; ok {
+		return level
+	}
+
+	return c.fallback.Level()
 }
 
 // New returns a new Logger instance which writes log entries at or above a minimum severity
 // level to a specific output destination
 func New(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+	l := &Logger{
+		minLevel:   new(slog.LevelVar),
+		components: &componentLevels{levels: make(map[string]slog.Level)},
+	}
+	l.minLevel.Set(minLevel.slogLevel())
+
+	l.handler = NewHandler(out, l.minLevel)
+	l.dedup = NewDedupHandler(l.handler, 0, 0)
+	l.slog = slog.New(l.dedup)
+
+	return l
+}
+
+// With returns a child logger which adds a property to every entry it writes, and otherwise writes to the same output
+// in the same way. A "component" property, such as With("component", "mailer"), also gives the child the component's
+// own minimum level, if one has been set with SetLevel on the child or with SetComponentLevels, so that one part of
+// the application can be logged in more or less detail than the rest. Child loggers should be made after
+// Deduplicate has been called, as they carry on with the deduplication they were made with
+func (l *Logger) With(key, value string) *Logger {
+	child := *l
+
+	handler := l.handler
+	if key == "component" {
+		child.component = value
+		handler = l.handler.withLevel(componentLeveler{
+			component:  value,
+			components: l.components,
+			fallback:   l.minLevel,
+		})
+	}
+
+	child.handler = handler.with(scope{attrs: []slog.Attr{slog.String(key, value)}})
+	child.dedup = l.dedup.withNext(child.handler)
+	child.slog = slog.New(child.dedup)
+
+	return &child
+}
+
+// SetLevel changes the minimum severity level that log entries are written for. It's safe to call while the logger
+// is in use, for example to turn on debug logging during an incident. On a component's logger it sets the level of
+// just that component, and on any other logger it sets the level of every component without a level of its own
+func (l *Logger) SetLevel(minLevel Level) {
+	if l.component != "" {
+		l.components.mu.Lock()
+		l.components.levels[l.component] = minLevel.slogLevel()
+		l.components.mu.Unlock()
+
+		return
 	}
+
+	l.minLevel.Set(minLevel.slogLevel())
+}
+
+// SetComponentLevels replaces the levels of the components which have their own minimum severity level. Components
+// which aren't in levels go back to the logger's minimum level
+func (l *Logger) SetComponentLevels(levels map[string]Level) {
+	components := make(map[string]slog.Level, len(levels))
+	for component, level := range levels {
+		components[component] = level.slogLevel()
+	}
+
+	l.components.mu.Lock()
+	l.components.levels = components
+	l.components.mu.Unlock()
+}
+
+// Level returns the minimum severity level that log entries are written for
+func (l *Logger) Level() Level {
+	switch level := l.handler.level.Level(); {
+	case level <= slog.LevelDebug:
+		return LevelDebug
+	case level <= slog.LevelInfo:
+		return LevelInfo
+	case level <= slog.LevelError:
+		return LevelError
+	default:
+		return LevelFatal
+	}
+}
+
+// Deduplicate stops identical error entries from flooding the log, by writing no more than burst of them in each
+// interval and then a summary of how many more there were, as described for DedupHandler. It must be called before
+// the logger is used by more than one goroutine, and before Slog. The counts for Stats start again from zero
+func (l *Logger) Deduplicate(interval time.Duration, burst int) {
+	l.dedup = NewDedupHandler(l.handler, interval, burst)
+	l.slog = slog.New(l.dedup)
+}
+
+// SetStackTraces turns the stack traces, and the wrapped error chains, on ERROR and FATAL entries on or off. They're
+// on by default; turning them off makes the entries much smaller, for when the volume of logs matters more. It's safe
+// to call while the logger is in use
+func (l *Logger) SetStackTraces(on bool) {
+	l.handler.SetStackTraces(on)
+}
+
+// Stats returns the number of error entries which have been written and suppressed
+func (l *Logger) Stats() DedupStats {
+	return l.dedup.Stats()
+}
+
+// Slog returns a *slog.Logger which writes to the same output as the Logger, in the same format and with the same
+// minimum level. Use it with slog.SetDefault so that libraries which log with log/slog, or with the standard log
+// package, end up in the same JSON stream
+func (l *Logger) Slog() *slog.Logger {
+	return l.slog
 }
 
 // Declare some helper methods for writing log entries at the different levels. Notice
 // that these all accept a map as the second parameter which can contain any arbitrary
 // 'properties' that you want to appear in the log entry
 
+// PrintDebug is a Debug level logger, for detail which is only wanted while looking into a problem
+func (l *Logger) PrintDebug(message string, properties map[string]string) {
+	l.print(LevelDebug, message, properties)
+}
+
 // PrintInfo is an Info level logger
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
-	_, _ = l.print(LevelInfo, message, properties)
+	l.print(LevelInfo, message, properties)
 }
 
-// PrintError is an Error level logger
+// PrintError is an Error level logger. When stack traces are on, an error which wraps other errors also has their
+// messages listed in an "error_chain" property
 func (l *Logger) PrintError(err error, properties map[string]string) {
-	_, _ = l.print(LevelError, err.Error(), properties)
+	l.print(LevelError, err.Error(), properties, l.errorChain(err)...)
 }
 
 // PrintFatal is a Fatal level logger
 func (l *Logger) PrintFatal(err error, properties map[string]string) {
-	_, _ = l.print(LevelFatal, err.Error(), properties)
+	l.print(LevelFatal, err.Error(), properties, l.errorChain(err)...)
 	os.Exit(1) // For entries at the FATAL level, we also terminate the application.
 }
 
-// print is an internal method for writing the log entry
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
-	// If the severity level of the log entry is below the minimum
-	// severity for the logger, then return with no further action
-	if level < l.minLevel {
-		return 0, nil
-	}
-
-	// Declare an anonymous struct holding the data for the log entry
-	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
-	}{
-		Level:      level.String(),
-		Time:       time.Now().UTC().Format(time.RFC3339),
-		Message:    message,
-		Properties: properties,
+// errorChain returns the "error_chain" attribute for an error entry, if stack traces are on and the error wraps others
+func (l *Logger) errorChain(err error) []slog.Attr {
+	if !l.handler.StackTraces() {
+		return nil
 	}
 
-	// Include a stack trace for entries at the ERROR and FATAL levels
-	if level > LevelInfo {
-		aux.Trace = string(debug.Stack())
+	chain := errorChain(err)
+	if chain == nil {
+		return nil
 	}
 
-	// Declare a line variable for holding the actual log entry text
-	var line []byte
+	return []slog.Attr{slog.Any("error_chain", chain)}
+}
 
-	// Marshal the anonymous struct to JSON and store it in the line variable. If there was a problem creating
-	// the JSON, set the contents of the log entry to be that plain-text error message instead
-	line, err := json.Marshal(aux)
-	if err != nil {
-		line = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
+// print is an internal method for writing the log entry, which passes the properties on to the handler as attributes,
+// along with any extra attributes
+func (l *Logger) print(level Level, message string, properties map[string]string, extra ...slog.Attr) {
+	attrs := make([]slog.Attr, 0, len(properties)+len(extra))
+	for key, value := range properties {
+		attrs = append(attrs, slog.String(key, value))
 	}
+	attrs = append(attrs, extra...)
 
-	// Lock the mutex so that no two writes to the output destination can happen concurrently.
-	// If we don't do this, it's possible that the text for two or more log entries will be intermingled in the output
-	l.mu.Lock()
-
-	defer l.mu.Unlock()
-
-	// Write the log entry followed by a newline
-	return l.out.Write(append(line, '\n'))
+	l.slog.LogAttrs(context.Background(), level.slogLevel(), message, attrs...)
 }
 
 // Write method is implemented on our Logger type so that it satisfies the
 // io.Writer interface. This writes a log entry at the ERROR level with no additional properties
 func (l *Logger) Write(message []byte) (n int, err error) {
-	return l.print(LevelError, string(message), nil)
+	l.print(LevelError, strings.TrimSuffix(string(message), "\n"), nil)
+	return len(message), nil
 }
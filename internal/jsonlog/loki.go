@@ -0,0 +1,105 @@
+package jsonlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LokiSink ships log entries to Grafana Loki with its push API. Each entry is sent as it is, as a line of JSON, in a
+// stream labelled with the given labels and the entry's level, so that the levels can be picked out with a label
+// matcher. Basic auth credentials can be given in the URL
+type LokiSink struct {
+	url    string
+	labels map[string]string
+	client *http.Client
+}
+
+// NewLokiSink returns a LokiSink for the Loki server at baseURL, such as "http://loki:3100"
+func NewLokiSink(baseURL string, labels map[string]string) *LokiSink {
+	return &LokiSink{
+		url:    strings.TrimSuffix(baseURL, "/") + "/loki/api/v1/push",
+		labels: labels,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Send pushes the entries to Loki, with a stream for each level
+func (s *LokiSink) Send(ctx context.Context, entries []Entry) error {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	streams := make(map[string]*stream)
+	var order []string
+
+	for _, entry := range entries {
+		level := strings.ToLower(entry.fields().Level)
+
+		st, ok := streams[level]
+		if !ok {
+			labels := map[string]string{"level": level}
+			for name, value := range s.labels {
+				labels[name] = value
+			}
+
+			st = &stream{Stream: labels}
+			streams[level] = st
+			order = append(order, level)
+		}
+
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(entry.Time.UnixNano(), 10), string(entry.Line)})
+	}
+
+	body := struct {
+		Streams []*stream `json:"streams"`
+	}{}
+
+	for _, level := range order {
+		body.Streams = append(body.Streams, streams[level])
+	}
+
+	return postJSON(ctx, s.client, s.url, body)
+}
+
+// Close does nothing, as there's no connection to close
+func (s *LokiSink) Close() error {
+	return nil
+}
+
+// postJSON sends body as JSON in a POST request to url, and returns an error unless the response is a success
+func postJSON(ctx context.Context, client *http.Client, url string, body interface{}) error {
+	js, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s responded with %s: %s", url, res.Status, bytes.TrimSpace(msg))
+	}
+
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package jsonlog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLPSink ships log entries to an OpenTelemetry collector, or any other receiver of OTLP logs, over HTTP with the
+// JSON encoding. Each entry becomes a log record with the entry's message as its body and its properties as
+// attributes. The resource attributes, such as "service.name", describe the application
+type OTLPSink struct {
+	url        string
+	attributes map[string]string
+	client     *http.Client
+}
+
+// NewOTLPSink returns an OTLPSink for the OTLP/HTTP endpoint at baseURL, such as "http://collector:4318"
+func NewOTLPSink(baseURL string, attributes map[string]string) *OTLPSink {
+	return &OTLPSink{
+		url:        strings.TrimSuffix(baseURL, "/") + "/v1/logs",
+		attributes: attributes,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// otlpValue is a value in the OTLP JSON encoding. Only string values are used
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpAttribute is an attribute in the OTLP JSON encoding
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpSeverities maps the levels to OTLP severity numbers
+var otlpSeverities = map[string]int{
+	"DEBUG": 5,
+	"INFO":  9,
+	"WARN":  13,
+	"ERROR": 17,
+	"FATAL": 21,
+}
+
+// Send exports the entries as a single batch of log records
+func (s *OTLPSink) Send(ctx context.Context, entries []Entry) error {
+	type logRecord struct {
+		TimeUnixNano   string          `json:"timeUnixNano"`
+		SeverityNumber int             `json:"severityNumber"`
+		SeverityText   string          `json:"severityText"`
+		Body           otlpValue       `json:"body"`
+		Attributes     []otlpAttribute `json:"attributes,omitempty"`
+	}
+
+	records := make([]logRecord, 0, len(entries))
+
+	for _, entry := range entries {
+		f := entry.fields()
+
+		properties := make(map[string]string, len(f.Properties)+1)
+		for key, value := range f.Properties {
+			if s, ok := value.(string); ok {
+				properties[key] = s
+				continue
+			}
+
+			js, _ := json.Marshal(value)
+			properties[key] = string(js)
+		}
+
+		if f.Trace != "" {
+			properties["exception.stacktrace"] = f.Trace
+		}
+
+		records = append(records, logRecord{
+			TimeUnixNano:   strconv.FormatInt(entry.Time.UnixNano(), 10),
+			SeverityNumber: otlpSeverities[f.Level],
+			SeverityText:   f.Level,
+			Body:           otlpValue{StringValue: f.Message},
+			Attributes:     otlpAttributes(properties),
+		})
+	}
+
+	body := map[string]interface{}{
+		"resourceLogs": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": otlpAttributes(s.attributes)},
+				"scopeLogs": []interface{}{
+					map[string]interface{}{
+						"scope":      map[string]string{"name": "github.com/eazylaykzy/greenlight/internal/jsonlog"},
+						"logRecords": records,
+					},
+				},
+			},
+		},
+	}
+
+	return postJSON(ctx, s.client, s.url, body)
+}
+
+// Close does nothing, as there's no connection to close
+func (s *OTLPSink) Close() error {
+	return nil
+}
+
+// otlpAttributes converts a map to OTLP attributes, sorted by key
+func otlpAttributes(values map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]otlpAttribute, len(keys))
+	for i, key := range keys {
+		attributes[i].Key = key
+		attributes[i].Value.StringValue = values[key]
+	}
+
+	return attributes
+}
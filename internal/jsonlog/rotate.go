@@ -0,0 +1,234 @@
+package jsonlog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedTimeFormat is the format of the time added to the names of rotated log files, so that app.log becomes, for
+// example, app-2006-01-02T15-04-05.000.log. It sorts in time order and has no colons, which Windows doesn't allow
+const rotatedTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotationPolicy holds the settings for rotating a log file. A file is rotated once writing to it would take it over
+// MaxSize bytes, or once it's older than MaxAge. Only the newest MaxBackups rotated files are kept, and rotated files
+// are compressed with gzip if Compress is set. A zero MaxSize, MaxAge or MaxBackups means no limit
+type RotationPolicy struct {
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+	Compress   bool
+}
+
+// File is an io.Writer which appends to a log file and rotates it according to its policy. The current file always
+// has the same name, so that it can be followed with tail -F, and rotated files have the time that they were rotated
+// added to their names. It's safe for concurrent use
+type File struct {
+	path   string
+	policy RotationPolicy
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// cleanup tracks the background compression and removal of rotated files, and cleanupMu makes sure that only
+	// one of them runs at a time, so that a file isn't seen both before and after it's compressed
+	cleanup   sync.WaitGroup
+	cleanupMu sync.Mutex
+}
+
+// OpenFile opens the log file at path for appending, creating it and its directory if needed
+func OpenFile(path string, policy RotationPolicy) (*File, error) {
+	f := &File{path: path, policy: policy}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Write appends p to the log file, rotating it first if p would take it over the maximum size or it's too old. An
+// entry which is bigger than the maximum size on its own is still written, to a file of its own
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	tooBig := f.policy.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.policy.MaxSize
+	tooOld := f.policy.MaxAge > 0 && time.Since(f.opened) > f.policy.MaxAge
+
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Close closes the log file, after waiting for any rotated files to finish being compressed
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.cleanup.Wait()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+// open opens the current log file, keeping track of its size. A file which already exists is appended to, and its
+// modification time is taken as the time it was opened, which is the closest there is to when it was created
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	if info.Size() > 0 {
+		f.opened = info.ModTime()
+	}
+
+	return nil
+}
+
+// rotate renames the current log file and opens a new one in its place. Compressing the rotated file and removing old
+// ones happens in the background, so that logging isn't held up
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(f.path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.path, ext), time.Now().UTC().Format(rotatedTimeFormat), ext)
+
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.cleanup.Add(1)
+
+	go func() {
+		defer f.cleanup.Done()
+
+		f.cleanupMu.Lock()
+		defer f.cleanupMu.Unlock()
+
+		if f.policy.Compress {
+			if err := compressFile(rotated); err != nil {
+				fmt.Fprintf(os.Stderr, "jsonlog: unable to compress %s: %v\n", rotated, err)
+			}
+		}
+
+		if err := f.removeBackups(); err != nil {
+			fmt.Fprintf(os.Stderr, "jsonlog: unable to remove old log files: %v\n", err)
+		}
+	}()
+
+	return nil
+}
+
+// removeBackups deletes the oldest rotated log files, so that no more than the maximum number are kept
+func (f *File) removeBackups() error {
+	if f.policy.MaxBackups <= 0 {
+		return nil
+	}
+
+	ext := filepath.Ext(f.path)
+	pattern := strings.TrimSuffix(f.path, ext) + "-*" + ext
+
+	plain, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+
+	compressed, err := filepath.Glob(pattern + ".gz")
+	if err != nil {
+		return err
+	}
+
+	// The names end with the time they were rotated, so sorting them puts them in order, oldest first
+	backups := append(plain, compressed...)
+	sort.Strings(backups)
+
+	for len(backups) > f.policy.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// compressFile replaces the file at path with a gzip compressed copy, with ".gz" added to its name
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+
+	if _, err := io.Copy(zw, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+
+	_ = src.Close()
+
+	return os.Remove(path)
+}
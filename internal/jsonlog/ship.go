@@ -0,0 +1,232 @@
+package jsonlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sink ships log entries somewhere other than a local io.Writer, such as a syslog daemon or a log aggregator. Send is
+// given a batch of entries at a time, and should return an error if they weren't all accepted, so that they can be
+// sent again. A Sink is only used by one goroutine at a time
+type Sink interface {
+	Send(ctx context.Context, entries []Entry) error
+	Close() error
+}
+
+// Entry is a log entry being shipped to a Sink. Line is the entry as written by Handler, without the newline, and
+// Time is when it was written, which is more precise than the time in the entry itself
+type Entry struct {
+	Time time.Time
+	Line []byte
+}
+
+// entryFields holds the fields of a log entry that the sinks need to pick out
+type entryFields struct {
+	Level      string                 `json:"level"`
+	Message    string                 `json:"message"`
+	Properties map[string]interface{} `json:"properties"`
+	Trace      string                 `json:"trace"`
+}
+
+// fields parses the entry's line. A line which isn't JSON, which only happens when an entry can't be marshalled, is
+// returned as an ERROR with the line as its message
+func (e Entry) fields() entryFields {
+	var f entryFields
+
+	if err := json.Unmarshal(e.Line, &f); err != nil {
+		return entryFields{Level: LevelError.String(), Message: string(e.Line)}
+	}
+
+	return f
+}
+
+// ShipperOptions holds the settings for a Shipper. BufferSize is the number of entries which can be waiting to be
+// sent, BatchSize the most that are sent at once, FlushInterval how long an entry can wait for a batch to fill up,
+// and MaxRetries how many more times a batch is sent after the first attempt fails. Zero values are replaced with
+// the defaults
+type ShipperOptions struct {
+	BufferSize    int
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+}
+
+// ShipperStats holds the number of entries which a Shipper has sent, dropped because the buffer was full, and given
+// up on after every attempt to send them failed
+type ShipperStats struct {
+	Shipped int64 `json:"shipped"`
+	Dropped int64 `json:"dropped"`
+	Failed  int64 `json:"failed"`
+}
+
+// Shipper is an io.Writer which sends the log entries written to it to a Sink in the background, so that a slow or
+// unavailable sink never holds up the code doing the logging. Entries are buffered and sent in batches, and a batch
+// which fails is retried with backoff. While the sink is failing the buffer fills up, and once it's full new entries
+// are dropped (and counted) rather than blocking. Use it alongside the usual output with io.MultiWriter
+type Shipper struct {
+	sink Sink
+	opts ShipperOptions
+
+	entries chan Entry
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	statsMu sync.Mutex
+	stats   ShipperStats
+}
+
+// NewShipper returns a Shipper sending the entries written to it to sink, and starts its background goroutine
+func NewShipper(sink Sink, opts ShipperOptions) *Shipper {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 10000
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+
+	s := &Shipper{
+		sink:    sink,
+		opts:    opts,
+		entries: make(chan Entry, opts.BufferSize),
+		done:    make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+// Write queues a log entry to be sent. It never blocks, and never returns an error, so that it can't get in the way
+// of the other outputs in an io.MultiWriter; an entry which doesn't fit in the buffer is dropped
+func (s *Shipper) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		s.count(func(stats *ShipperStats) { stats.Dropped++ })
+		return len(p), nil
+	}
+
+	select {
+	case s.entries <- Entry{Time: time.Now(), Line: line}:
+	default:
+		s.count(func(stats *ShipperStats) { stats.Dropped++ })
+	}
+
+	return len(p), nil
+}
+
+// Close stops accepting entries, waits for the ones in the buffer to be sent, and closes the sink
+func (s *Shipper) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.entries)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+
+	return s.sink.Close()
+}
+
+// Stats returns the number of entries which have been shipped, dropped and failed so far
+func (s *Shipper) Stats() ShipperStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	return s.stats
+}
+
+// count updates the stats
+func (s *Shipper) count(update func(stats *ShipperStats)) {
+	s.statsMu.Lock()
+	update(&s.stats)
+	s.statsMu.Unlock()
+}
+
+// run collects the entries into batches, and sends each batch once it's full or the flush interval has passed since
+// its first entry. It returns once the entries channel has been closed and emptied
+func (s *Shipper) run() {
+	defer close(s.done)
+
+	var batch []Entry
+
+	timer := time.NewTimer(s.opts.FlushInterval)
+	timer.Stop()
+
+	for {
+		select {
+		case entry, ok := <-s.entries:
+			if !ok {
+				s.send(batch)
+				return
+			}
+
+			if len(batch) == 0 {
+				timer.Reset(s.opts.FlushInterval)
+			}
+
+			batch = append(batch, entry)
+
+			if len(batch) >= s.opts.BatchSize {
+				timer.Stop()
+				s.send(batch)
+				batch = nil
+			}
+		case <-timer.C:
+			s.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// send sends a batch to the sink, retrying with exponential backoff if it fails. A batch which still can't be sent
+// after every retry is given up on, and reported on stderr, as there's nowhere else to report it
+func (s *Shipper) send(batch []Entry) {
+	if len(batch) == 0 {
+		return
+	}
+
+	backoff := 500 * time.Millisecond
+
+	var err error
+
+	for attempt := 0; attempt <= s.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = s.sink.Send(ctx, batch)
+		cancel()
+
+		if err == nil {
+			s.count(func(stats *ShipperStats) { stats.Shipped += int64(len(batch)) })
+			return
+		}
+	}
+
+	s.count(func(stats *ShipperStats) { stats.Failed += int64(len(batch)) })
+	fmt.Fprintf(os.Stderr, "jsonlog: unable to ship %d log entries: %v\n", len(batch), err)
+}
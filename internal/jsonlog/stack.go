@@ -0,0 +1,105 @@
+package jsonlog
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// maxStackFrames is the most frames that are included in a stack trace
+const maxStackFrames = 32
+
+// packagePrefix is the prefix of the names of this package's functions, which are left out of stack traces
+var packagePrefix = reflect.TypeOf(Handler{}).PkgPath() + "."
+
+// stackTrace returns a trimmed stack trace of the code which made the log entry. The frames inside the logging code
+// itself (this package, log/slog and the standard log package) are left out from the top, the goroutine's runtime
+// frames from the bottom, and it's cut off after maxStackFrames, so it's only the part which is any use
+func stackTrace() string {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var b strings.Builder
+
+	written, skipping := 0, true
+
+	for {
+		frame, more := frames.Next()
+
+		if skipping && isLoggingFrame(frame.Function) {
+			if !more {
+				break
+			}
+			continue
+		}
+		skipping = false
+
+		if strings.HasPrefix(frame.Function, "runtime.") || written == maxStackFrames {
+			break
+		}
+
+		b.WriteString(frame.Function)
+		b.WriteString("\n\t")
+		b.WriteString(frame.File)
+		b.WriteString(":")
+		b.WriteString(strconv.Itoa(frame.Line))
+		b.WriteString("\n")
+		written++
+
+		if !more {
+			break
+		}
+	}
+
+	return b.String()
+}
+
+// isLoggingFrame reports whether a function is part of the logging code
+func isLoggingFrame(function string) bool {
+	for _, prefix := range []string{packagePrefix, "log/slog.", "log.", "runtime."} {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errorChain returns the messages of the errors which err wraps, outermost first, for an error which was built up with
+// fmt.Errorf("...: %w", err) or errors.Join. Only the errors whose message adds something to the one before are
+// included, and an error which doesn't wrap anything has no chain
+func errorChain(err error) []string {
+	var chain []string
+
+	var walk func(err error, parent string)
+	walk = func(err error, parent string) {
+		if err == nil {
+			return
+		}
+
+		message := err.Error()
+		if message != parent {
+			chain = append(chain, message)
+		}
+
+		switch e := err.(type) {
+		case interface{ Unwrap() []error }:
+			for _, inner := range e.Unwrap() {
+				walk(inner, message)
+			}
+		default:
+			walk(errors.Unwrap(err), message)
+		}
+	}
+
+	walk(err, "")
+
+	if len(chain) < 2 {
+		return nil
+	}
+
+	return chain
+}
@@ -0,0 +1,59 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package jsonlog
+
+import (
+	"context"
+	"log/syslog"
+)
+
+// SyslogSink ships log entries to a syslog daemon, each as a message at the syslog severity matching its level. The
+// message is the entry's line of JSON, so that it can still be parsed once it's been collected
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink connects to the syslog daemon at raddr over network ("udp", "tcp" or "unix"), or to the local one if
+// network and raddr are empty. Messages are sent with the LOG_DAEMON facility and the tag
+func NewSyslogSink(network, raddr, tag string) (*SyslogSink, error) {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyslogSink{w: w}, nil
+}
+
+// Send writes each entry to syslog. The syslog package reconnects if the connection has been lost
+func (s *SyslogSink) Send(_ context.Context, entries []Entry) error {
+	for _, entry := range entries {
+		line := string(entry.Line)
+
+		var err error
+
+		switch entry.fields().Level {
+		case "DEBUG":
+			err = s.w.Debug(line)
+		case "WARN":
+			err = s.w.Warning(line)
+		case "ERROR":
+			err = s.w.Err(line)
+		case "FATAL":
+			err = s.w.Crit(line)
+		default:
+			err = s.w.Info(line)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the connection to the syslog daemon
+func (s *SyslogSink) Close() error {
+	return s.w.Close()
+}
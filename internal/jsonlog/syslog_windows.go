@@ -0,0 +1,24 @@
+package jsonlog
+
+import (
+	"context"
+	"errors"
+)
+
+// SyslogSink isn't available on Windows, which has no syslog
+type SyslogSink struct{}
+
+// NewSyslogSink returns an error, as there's no syslog on Windows
+func NewSyslogSink(network, raddr, tag string) (*SyslogSink, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
+
+// Send does nothing
+func (s *SyslogSink) Send(_ context.Context, _ []Entry) error {
+	return nil
+}
+
+// Close does nothing
+func (s *SyslogSink) Close() error {
+	return nil
+}
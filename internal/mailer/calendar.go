@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"strings"
+	"time"
+)
+
+// CalendarEvent is an event to invite the recipient of an email to, such as a screening. UID identifies the event,
+// so that an updated invite replaces the earlier one in the recipient's calendar rather than adding another
+type CalendarEvent struct {
+	UID         string
+	Summary     string
+	Description string
+	Location    string
+	URL         string
+	Organizer   string
+	Start       time.Time
+	End         time.Time
+}
+
+// CalendarInvite returns an iCalendar (RFC 5545) invite for the event, as an attachment named invite.ics, which mail
+// clients offer to add to the recipient's calendar
+func CalendarInvite(event CalendarEvent) Attachment {
+	const stamp = "20060102T150405Z"
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Greenlight//Greenlight//EN",
+		"METHOD:REQUEST",
+		"BEGIN:VEVENT",
+		"UID:" + icsEscape(event.UID),
+		"DTSTAMP:" + time.Now().UTC().Format(stamp),
+		"DTSTART:" + event.Start.UTC().Format(stamp),
+		"DTEND:" + event.End.UTC().Format(stamp),
+		"SUMMARY:" + icsEscape(event.Summary),
+	}
+
+	if event.Description != "" {
+		lines = append(lines, "DESCRIPTION:"+icsEscape(event.Description))
+	}
+	if event.Location != "" {
+		lines = append(lines, "LOCATION:"+icsEscape(event.Location))
+	}
+	if event.URL != "" {
+		lines = append(lines, "URL:"+event.URL)
+	}
+	if event.Organizer != "" {
+		lines = append(lines, "ORGANIZER:mailto:"+event.Organizer)
+	}
+
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(icsFold(line))
+	}
+
+	return Attachment{
+		Filename:    "invite.ics",
+		ContentType: "text/calendar; charset=UTF-8; method=REQUEST",
+		Data:        []byte(b.String()),
+	}
+}
+
+// icsEscape escapes the characters which have a meaning in iCalendar text values
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icsFold ends a content line with CRLF, folding it onto continuation lines so that no line is longer than 75
+// octets, without splitting a UTF-8 character
+func icsFold(line string) string {
+	var b strings.Builder
+
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74 // continuation lines start with a space
+	}
+
+	b.WriteString(line + "\r\n")
+
+	return b.String()
+}
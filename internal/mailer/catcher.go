@@ -0,0 +1,111 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CaughtMessage is a message kept by a Catcher instead of being sent. The attachments are listed by name and type,
+// without their content
+type CaughtMessage struct {
+	ID          int64              `json:"id"`
+	Date        time.Time          `json:"date"`
+	From        string             `json:"from"`
+	To          string             `json:"to"`
+	Subject     string             `json:"subject"`
+	PlainBody   string             `json:"text,omitempty"`
+	HTMLBody    string             `json:"html,omitempty"`
+	Attachments []CaughtAttachment `json:"attachments,omitempty"`
+}
+
+// CaughtAttachment describes a file attached to a CaughtMessage
+type CaughtAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+// Catcher is a Sender for development which keeps messages in memory rather than sending them, so that emails such
+// as the activation ones can be read without an SMTP server. Only the most recent messages are kept
+type Catcher struct {
+	mu       sync.Mutex
+	messages []CaughtMessage
+	nextID   int64
+	max      int
+}
+
+// NewCatcher returns a Catcher which keeps the latest max messages
+func NewCatcher(max int) *Catcher {
+	return &Catcher{max: max, nextID: 1}
+}
+
+// Send keeps the message, dropping the oldest one if the Catcher is full
+func (c *Catcher) Send(ctx context.Context, msg *Message) error {
+	caught := CaughtMessage{
+		Date:      time.Now(),
+		From:      msg.From,
+		To:        msg.To,
+		Subject:   msg.Subject,
+		PlainBody: msg.PlainBody,
+		HTMLBody:  msg.HTMLBody,
+	}
+
+	for _, a := range msg.Attachments {
+		caught.Attachments = append(caught.Attachments, CaughtAttachment{
+			Filename:    a.Filename,
+			ContentType: a.contentType(),
+			Size:        len(a.Data),
+		})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	caught.ID = c.nextID
+	c.nextID++
+
+	c.messages = append(c.messages, caught)
+	if len(c.messages) > c.max {
+		c.messages = c.messages[len(c.messages)-c.max:]
+	}
+
+	return nil
+}
+
+// List returns the kept messages, newest first, without their bodies
+func (c *Catcher) List() []CaughtMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := make([]CaughtMessage, 0, len(c.messages))
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		msg := c.messages[i]
+		msg.PlainBody, msg.HTMLBody = "", ""
+		list = append(list, msg)
+	}
+
+	return list
+}
+
+// Get returns the kept message with the ID, and false if there's no such message
+func (c *Catcher) Get(id int64) (CaughtMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, msg := range c.messages {
+		if msg.ID == id {
+			return msg, true
+		}
+	}
+
+	return CaughtMessage{}, false
+}
+
+// Clear throws away all the kept messages
+func (c *Catcher) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.messages = nil
+}
@@ -0,0 +1,290 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dkimHeaders are the header fields which are signed when the message has them. From is always signed
+var dkimHeaders = []string{
+	"From", "To", "Cc", "Reply-To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// DKIMKey is a private key for signing messages, with the selector which its public key is published under, in the
+// DNS TXT record <selector>._domainkey.<domain>
+type DKIMKey struct {
+	Selector string
+	Signer   crypto.Signer
+}
+
+// ParseDKIMKey parses a PEM encoded RSA or Ed25519 private key, in PKCS #1 or PKCS #8 form
+func ParseDKIMKey(selector, pemKey string) (DKIMKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return DKIMKey{}, errors.New("dkim: the private key is not PEM encoded")
+	}
+
+	var (
+		key interface{}
+		err error
+	)
+
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return DKIMKey{}, fmt.Errorf("dkim: %w", err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return DKIMKey{Selector: selector, Signer: key}, nil
+	case ed25519.PrivateKey:
+		return DKIMKey{Selector: selector, Signer: key}, nil
+	default:
+		return DKIMKey{}, errors.New("dkim: the private key must be an RSA or Ed25519 key")
+	}
+}
+
+// algorithm returns the name of the key's signing algorithm, as given in the a= tag
+func (k DKIMKey) algorithm() string {
+	if _, ok := k.Signer.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+
+	return "rsa-sha256"
+}
+
+// sign signs the SHA-256 hash of the signed data. Ed25519 signs the hash itself, rather than the data, as RFC 8463
+// specifies
+func (k DKIMKey) sign(hash []byte) ([]byte, error) {
+	if _, ok := k.Signer.(ed25519.PrivateKey); ok {
+		return k.Signer.Sign(rand.Reader, hash, crypto.Hash(0))
+	}
+
+	return k.Signer.Sign(rand.Reader, hash, crypto.SHA256)
+}
+
+// DKIMSigner adds DKIM signatures (RFC 6376) to messages for a domain, so that receivers can check that they were
+// sent by the domain whatever relay they passed through. To rotate keys, publish the new key under a new selector and
+// sign with both the old and the new key until the DNS change has spread, then drop the old one. Each key adds its own
+// DKIM-Signature, and a receiver only needs one of them to check out
+type DKIMSigner struct {
+	domain           string
+	headerRelaxed    bool
+	bodyRelaxed      bool
+	canonicalization string
+	keys             []DKIMKey
+}
+
+// NewDKIMSigner returns a DKIMSigner for the domain, which signs with each of the keys. canonicalization is how the
+// header and the body are canonicalized, as in "relaxed/relaxed", "simple/simple", or "relaxed", which is short for
+// "relaxed/simple"
+func NewDKIMSigner(domain, canonicalization string, keys ...DKIMKey) (*DKIMSigner, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("dkim: at least one key is needed")
+	}
+
+	header, body, found := strings.Cut(canonicalization, "/")
+	if !found {
+		body = "simple"
+	}
+
+	for _, c := range []string{header, body} {
+		if c != "simple" && c != "relaxed" {
+			return nil, fmt.Errorf("dkim: unknown canonicalization %q", canonicalization)
+		}
+	}
+
+	return &DKIMSigner{
+		domain:           domain,
+		headerRelaxed:    header == "relaxed",
+		bodyRelaxed:      body == "relaxed",
+		canonicalization: header + "/" + body,
+		keys:             keys,
+	}, nil
+}
+
+// Sign returns the raw message with a DKIM-Signature header field added at the top for each key. Line endings are
+// normalised to CRLF first, as they are when the message is sent over SMTP
+func (d *DKIMSigner) Sign(raw []byte) ([]byte, error) {
+	raw = bytes.ReplaceAll(bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+
+	header, body, found := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !found {
+		return nil, errors.New("dkim: the message has no body")
+	}
+
+	fields := splitHeaderFields(string(header))
+
+	bodyHash := sha256.Sum256(d.canonicalBody(body))
+
+	// Pick out the fields to sign. When a field appears more than once, the last one is signed, as a receiver looks
+	// for them from the bottom up
+	var (
+		names  []string
+		signed bytes.Buffer
+	)
+
+	for _, name := range dkimHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fieldName(fields[i]), name) {
+				names = append(names, strings.ToLower(name))
+				signed.WriteString(d.canonicalHeader(fields[i]))
+				signed.WriteString("\r\n")
+				break
+			}
+		}
+	}
+
+	if len(names) == 0 || names[0] != "from" {
+		return nil, errors.New("dkim: the message has no From header")
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	var out bytes.Buffer
+
+	for _, key := range d.keys {
+		// The DKIM-Signature field is signed too, with an empty b= tag, and without its final CRLF
+		field := "DKIM-Signature: v=1; a=" + key.algorithm() + "; c=" + d.canonicalization + "; d=" + d.domain +
+			"; s=" + key.Selector + ";\r\n\tt=" + timestamp + "; h=" + strings.Join(names, ":") + ";\r\n\tbh=" +
+			base64.StdEncoding.EncodeToString(bodyHash[:]) + ";\r\n\tb="
+
+		hash := sha256.New()
+		hash.Write(signed.Bytes())
+		hash.Write([]byte(d.canonicalHeader(field)))
+
+		sig, err := key.sign(hash.Sum(nil))
+		if err != nil {
+			return nil, fmt.Errorf("dkim: %w", err)
+		}
+
+		out.WriteString(field)
+		out.WriteString(foldBase64(base64.StdEncoding.EncodeToString(sig)))
+		out.WriteString("\r\n")
+	}
+
+	out.Write(raw)
+
+	return out.Bytes(), nil
+}
+
+// canonicalHeader canonicalizes a header field, without its final CRLF. The relaxed algorithm lower-cases the name,
+// unfolds the value, squeezes runs of whitespace into a single space, and trims the whitespace around the value
+func (d *DKIMSigner) canonicalHeader(field string) string {
+	if !d.headerRelaxed {
+		return field
+	}
+
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(squeezeWhitespace(value))
+}
+
+// canonicalBody canonicalizes the body. Both algorithms drop the empty lines at the end. The relaxed algorithm also
+// squeezes runs of whitespace into a single space and removes the whitespace at the end of each line, and leaves an
+// empty body empty, where the simple one makes it a single CRLF
+func (d *DKIMSigner) canonicalBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+
+	if d.bodyRelaxed {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(squeezeWhitespace(line), " ")
+		}
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		if d.bodyRelaxed {
+			return nil
+		}
+
+		return []byte("\r\n")
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// splitHeaderFields splits a message header into its fields, keeping the folded lines of each field together
+func splitHeaderFields(header string) []string {
+	var fields []string
+
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+
+		fields = append(fields, line)
+	}
+
+	return fields
+}
+
+// fieldName returns the name of a header field
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+// squeezeWhitespace replaces each run of spaces and tabs with a single space
+func squeezeWhitespace(s string) string {
+	var b strings.Builder
+
+	space := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+
+		b.WriteRune(r)
+	}
+
+	if space {
+		b.WriteByte(' ')
+	}
+
+	return b.String()
+}
+
+// foldBase64 folds a long base64 value over several lines. The whitespace is ignored by receivers, which take it out
+// of the b= tag before checking the signature
+func foldBase64(s string) string {
+	var b strings.Builder
+
+	for len(s) > 72 {
+		b.WriteString(s[:72])
+		b.WriteString("\r\n\t ")
+		s = s[72:]
+	}
+
+	b.WriteString(s)
+
+	return b.String()
+}
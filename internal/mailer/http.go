@@ -0,0 +1,33 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newHTTPClient returns the client used for the providers' HTTP APIs, with the same timeout as the SMTP dialer
+func newHTTPClient() *http.Client {
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// do sends a request to a provider's API, and returns an error including the start of the response body if the
+// response doesn't have a 2xx status, as that's where the providers explain what was wrong
+func do(client *http.Client, req *http.Request, provider string) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("mailer: %s responded with %s: %s", provider, res.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
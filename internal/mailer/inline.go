@@ -0,0 +1,142 @@
+package mailer
+
+import (
+	"bytes"
+	"golang.org/x/net/html"
+	"strings"
+)
+
+// cssRule is a rule from a <style> block, with a simple selector: a tag name such as "p", a class such as
+// ".footer", or both, such as "p.footer"
+type cssRule struct {
+	tag          string
+	class        string
+	declarations string
+}
+
+// inlineStyles copies the rules in the document's <style> blocks onto the style attributes of the elements they
+// apply to, as many email clients ignore <style> blocks. Rules are applied in order, and an element's own style
+// attribute comes last, so that it wins. Only simple selectors are inlined; rules with any other selector, such as
+// media queries, are left in the <style> block for the clients which do support it
+func inlineStyles(document string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(document))
+	if err != nil {
+		return "", err
+	}
+
+	var rules []cssRule
+
+	var collect func(n *html.Node)
+	collect = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "style" && n.FirstChild != nil {
+			rules = append(rules, parseCSS(n.FirstChild.Data)...)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			collect(c)
+		}
+	}
+	collect(doc)
+
+	var apply func(n *html.Node)
+	apply = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			var style []string
+
+			for _, rule := range rules {
+				if rule.matches(n) {
+					style = append(style, rule.declarations)
+				}
+			}
+
+			if len(style) > 0 {
+				setStyle(n, style)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			apply(c)
+		}
+	}
+	apply(doc)
+
+	var buf bytes.Buffer
+
+	err = html.Render(&buf, doc)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// parseCSS returns the rules with simple selectors from a style sheet. A rule with a list of selectors, such as
+// "p, li", becomes a rule for each of them
+func parseCSS(css string) []cssRule {
+	var rules []cssRule
+
+	for _, block := range strings.Split(css, "}") {
+		parts := strings.SplitN(block, "{", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		declarations := strings.TrimSuffix(strings.TrimSpace(parts[1]), ";")
+		if declarations == "" {
+			continue
+		}
+
+		for _, selector := range strings.Split(parts[0], ",") {
+			selector = strings.TrimSpace(selector)
+			if selector == "" || strings.ContainsAny(selector, " >+~:[@*#") {
+				continue
+			}
+
+			rule := cssRule{declarations: declarations}
+			rule.tag, rule.class = selector, ""
+			if i := strings.Index(selector, "."); i >= 0 {
+				rule.tag, rule.class = selector[:i], selector[i+1:]
+			}
+
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// matches reports whether the rule applies to an element
+func (r cssRule) matches(n *html.Node) bool {
+	if r.tag != "" && r.tag != n.Data {
+		return false
+	}
+
+	if r.class == "" {
+		return true
+	}
+
+	for _, attr := range n.Attr {
+		if attr.Key == "class" {
+			for _, class := range strings.Fields(attr.Val) {
+				if class == r.class {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// setStyle puts the declarations from the rules in front of an element's own style attribute
+func setStyle(n *html.Node, style []string) {
+	for i, attr := range n.Attr {
+		if attr.Key == "style" {
+			if own := strings.TrimSuffix(strings.TrimSpace(attr.Val), ";"); own != "" {
+				style = append(style, own)
+			}
+			n.Attr[i].Val = strings.Join(style, "; ")
+			return
+		}
+	}
+
+	n.Attr = append(n.Attr, html.Attribute{Key: "style", Val: strings.Join(style, "; ")})
+}
@@ -2,9 +2,12 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
-	"github.com/go-mail/mail/v2"
-	"html/template"
+	"errors"
+	"io"
+	"mime"
+	"path/filepath"
 	"time"
 )
 
@@ -16,72 +19,257 @@ import (
 //go:embed templates
 var templateFS embed.FS
 
-// Mailer struct contains a mail.Dialer instance (used to connect to an SMTP server) and the sender information
-// for your emails (the name and address you want the email to be from, such as "Alice Smith <alice@example.com>")
+// Message is an email rendered from its template, ready to be handed to a Sender. The attachments always have their
+// content in Data
+type Message struct {
+	From        string
+	To          string
+	Subject     string
+	PlainBody   string
+	HTMLBody    string
+	Attachments []Attachment
+}
+
+// Attachment is a file attached to an email, such as an archive or a calendar invite. The content is Data or, if Data
+// is nil, whatever is read from Reader when the email is sent. ContentType is the file's MIME type, such as
+// "application/zip", and is worked out from the file name's extension when it's empty
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	Reader      io.Reader
+}
+
+// Bytes returns the attachment's content, reading it from Reader if it isn't in Data
+func (a Attachment) Bytes() ([]byte, error) {
+	if a.Data != nil || a.Reader == nil {
+		return a.Data, nil
+	}
+
+	return io.ReadAll(a.Reader)
+}
+
+// contentType returns the attachment's MIME type, working it out from the file name if it isn't set
+func (a Attachment) contentType() string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+
+	if t := mime.TypeByExtension(filepath.Ext(a.Filename)); t != "" {
+		return t
+	}
+
+	return "application/octet-stream"
+}
+
+// Sender delivers rendered messages. There's an implementation for SMTP, and for the HTTP APIs of AWS SES, SendGrid
+// and Mailgun, so that a deployment can use whichever provider it has credentials for
+type Sender interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// Pinger is implemented by the Senders which can check that their provider can be reached without sending an email
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Branding holds the name, website, logo and colour that the emails are branded with. Templates use them through the
+// brand function, as in {{brand.Name}}
+type Branding struct {
+	Name    string
+	URL     string
+	LogoURL string
+	Color   string
+}
+
+// Event describes an email for the hooks. Err is only set for OnFailed, and Duration is how long sending the email
+// took, including rendering it and any retries, which is zero for OnQueued
+type Event struct {
+	Recipient string
+	Template  string
+	Duration  time.Duration
+	Err       error
+}
+
+// Hooks are functions which are called when something happens to an email, so that an application using the mailer
+// can add its own behaviour, such as publishing the events to a message bus. Any of them can be nil. They're called
+// synchronously by whatever sends or queues the email, so a hook which does anything slow should hand it off to a
+// goroutine
+type Hooks struct {
+	// OnQueued is called when an email is put in a queue to be sent later, by whatever keeps the queue (see Queued)
+	OnQueued func(Event)
+	// OnSent is called when Send has sent an email
+	OnSent func(Event)
+	// OnFailed is called when Send fails, whether the email couldn't be rendered or couldn't be sent
+	OnFailed func(Event)
+}
+
+// Mailer struct renders the email templates and sends the messages with a Sender, from the sender address (the name
+// and address you want the email to be from, such as "Alice Smith <alice@example.com>"). Hooks can be set to be told
+// about the emails it sends
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	Hooks Hooks
+
+	transport Sender
+	sender    string
+	templates *templateSet
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	// Initialize a new mail.Dialer instance with the given SMTP server settings.
-	// We also configure this to use a 10-second timeout whenever we send an email
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 10 * time.Second
+// New returns a Mailer which sends its messages with transport, from the sender address, branded with brand. Any
+// template can be overridden by a file with the same name in templateDir (with the layout in its layouts
+// subdirectory), and the embedded templates are used for the rest. With reload, the templates are read again for
+// every email rather than cached, so that changes to them show up without a restart
+func New(transport Sender, sender string, brand Branding, templateDir string, reload bool) (Mailer, error) {
+	funcs := map[string]interface{}{
+		"brand": func() Branding { return brand },
+	}
 
-	// Return a Mailer instance containing the dialer and sender information
-	return Mailer{
-		dialer: dialer,
-		sender: sender,
+	templates, err := newTemplateSet(templateDir, reload, funcs)
+	if err != nil {
+		return Mailer{}, err
 	}
+
+	return Mailer{
+		transport: transport,
+		sender:    sender,
+		templates: templates,
+	}, nil
 }
 
 // Send is defined on the Mailer type. This takes the recipient email address as the first parameter, the name of the
-// file containing the templates, and any dynamic data for the templates as an interface{} parameter
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
-	// Use the ParseFS() method to parse the required template file from the embedded file system
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+// file containing the templates, any dynamic data for the templates as an interface{} parameter, and any files to
+// attach. Every email is sent with both a plain-text and an HTML alternative, each rendered inside the shared layout
+func (m Mailer) Send(recipient, templateFile string, data interface{}, attachments ...Attachment) error {
+	start := time.Now()
+
+	msg, err := m.Render(recipient, templateFile, data, attachments...)
+	if err == nil {
+		err = m.deliver(msg)
+	}
+
+	m.report(recipient, templateFile, start, err)
+
+	return err
+}
+
+// SendMessage sends a message which was rendered earlier with Render, such as one which has been waiting in a queue.
+// It's sent from the mailer's sender address, and the hooks are called as they are by Send, with templateFile
+// describing the email to them
+func (m Mailer) SendMessage(templateFile string, msg *Message) error {
+	start := time.Now()
+
+	msg.From = m.sender
+	err := m.deliver(msg)
+
+	m.report(msg.To, templateFile, start, err)
+
+	return err
+}
+
+// report calls the OnSent or OnFailed hook for an email which Send or SendMessage started on at start
+func (m Mailer) report(recipient, templateFile string, start time.Time, err error) {
+	event := Event{Recipient: recipient, Template: templateFile, Duration: time.Since(start), Err: err}
+
+	if err != nil {
+		if m.Hooks.OnFailed != nil {
+			m.Hooks.OnFailed(event)
+		}
+		return
+	}
+
+	if m.Hooks.OnSent != nil {
+		m.Hooks.OnSent(event)
+	}
+}
+
+// Ping checks that the mailer's transport can be reached. It returns errors.ErrUnsupported if the transport can't be
+// checked, as it isn't a Pinger
+func (m Mailer) Ping(ctx context.Context) error {
+	p, ok := m.transport.(Pinger)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+
+	return p.Ping(ctx)
+}
+
+// Queued calls the OnQueued hook for an email which has been queued to be sent later with SendMessage. The mailer doesn't
+// keep a queue itself, so this is for the code which does
+func (m Mailer) Queued(recipient, templateFile string) {
+	if m.Hooks.OnQueued != nil {
+		m.Hooks.OnQueued(Event{Recipient: recipient, Template: templateFile})
+	}
+}
+
+// Render renders an email from its template in the same way as Send, reading the attachments, but doesn't send it.
+// It's for emails which are sent later with SendMessage
+func (m Mailer) Render(recipient, templateFile string, data interface{}, attachments ...Attachment) (*Message, error) {
+	tmpl, err := m.templates.get(templateFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Execute the named template "subject", passing in the dynamic data and storing the result in a bytes.Buffer variable
 	subject := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	err = tmpl.text.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Follow the same pattern to execute the "plainBody" template and store the result in the bytes.Buffer variable
+	// Follow the same pattern to execute the "plainBody" template inside the plain-text layout
 	plainBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
+	err = tmpl.text.ExecuteTemplate(plainBody, "plainLayout", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// And likewise with the "htmlBody" template
+	// And likewise with the "htmlBody" template inside the HTML layout, then copy the layout's styles onto the elements
 	htmlBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	err = tmpl.html.ExecuteTemplate(htmlBody, "htmlLayout", data)
+	if err != nil {
+		return nil, err
+	}
+
+	html, err := inlineStyles(htmlBody.String())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Use the mail.NewMessage function to initialize a new mail.Message instance. Then we use the SetHeader method to set
-	// the email recipient, sender and subject headers, the SetBody method to set the plain-text body, and the AddAlternative
-	// method to set the HTML body. It's important to note that AddAlternative should always be called *after* SetBody
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	msg := &Message{
+		From:      m.sender,
+		To:        recipient,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  html,
+	}
+
+	// Read the attachments now, so that a reader isn't used up by the first attempt to send the email
+	for _, a := range attachments {
+		content, err := a.Bytes()
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Attachments = append(msg.Attachments, Attachment{
+			Filename:    a.Filename,
+			ContentType: a.contentType(),
+			Data:        content,
+		})
+	}
+
+	return msg, nil
+}
+
+// deliver hands a rendered message to the transport, for Send and SendMessage
+func (m Mailer) deliver(msg *Message) error {
+	var err error
 
 	// Try sending the email up to three times before aborting and returning the final
 	// error. We sleep for 500 milliseconds between each attempt.
 	for i := 1; i <= 3; i++ {
-		// Call the DialAndSend method on the dialer, passing in the message to send. This opens a connection to the SMTP server,
-		// sends the message, then closes the connection. If there is a timeout, it will return a "dial tcp: i/o timeout" error
-		err = m.dialer.DialAndSend(msg)
+		// Hand the message to the transport. For SMTP this opens a connection to the server, sends the message, then
+		// closes the connection, and for the HTTP APIs it makes a single request. Both time out after 10 seconds
+		err = m.transport.Send(context.Background(), msg)
 
 		// If everything worked, return nil
 		if nil == err {
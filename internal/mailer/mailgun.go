@@ -0,0 +1,100 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// Mailgun sends messages with the Mailgun Messages API (https://documentation.mailgun.com/docs/mailgun/api-reference)
+type Mailgun struct {
+	client  *http.Client
+	baseURL string
+	domain  string
+	apiKey  string
+}
+
+// NewMailgun returns a Mailgun Sender for the sending domain, using the API key. baseURL is normally
+// "https://api.mailgun.net", or "https://api.eu.mailgun.net" for domains in the EU region
+func NewMailgun(baseURL, domain, apiKey string) *Mailgun {
+	return &Mailgun{
+		client:  newHTTPClient(),
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		domain:  domain,
+		apiKey:  apiKey,
+	}
+}
+
+// Send sends the message
+func (m *Mailgun) Send(ctx context.Context, msg *Message) error {
+	// Messages with attachments have to be sent as multipart/form-data, with a file for each attachment. Those without
+	// are sent as a plain form
+	var (
+		body        io.Reader
+		contentType string
+	)
+
+	fields := [][2]string{
+		{"from", msg.From},
+		{"to", msg.To},
+		{"subject", msg.Subject},
+		{"text", msg.PlainBody},
+		{"html", msg.HTMLBody},
+	}
+
+	if len(msg.Attachments) == 0 {
+		form := url.Values{}
+		for _, field := range fields {
+			form.Set(field[0], field[1])
+		}
+
+		body, contentType = strings.NewReader(form.Encode()), "application/x-www-form-urlencoded"
+	} else {
+		var buf bytes.Buffer
+
+		w := multipart.NewWriter(&buf)
+		for _, field := range fields {
+			if err := w.WriteField(field[0], field[1]); err != nil {
+				return err
+			}
+		}
+
+		for _, a := range msg.Attachments {
+			h := make(textproto.MIMEHeader)
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="attachment"; filename=%q`, a.Filename))
+			h.Set("Content-Type", a.contentType())
+
+			part, err := w.CreatePart(h)
+			if err != nil {
+				return err
+			}
+			if _, err := part.Write(a.Data); err != nil {
+				return err
+			}
+		}
+
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		body, contentType = &buf, w.FormDataContentType()
+	}
+
+	endpoint := m.baseURL + "/v3/" + url.PathEscape(m.domain) + "/messages"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth("api", m.apiKey)
+	req.Header.Set("Content-Type", contentType)
+
+	return do(m.client, req, "Mailgun")
+}
@@ -0,0 +1,87 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+// SendGrid sends messages with the SendGrid v3 Mail Send API (https://docs.sendgrid.com/api-reference/mail-send)
+type SendGrid struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+}
+
+// sendGridAddress is an email address in a SendGrid request
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+// NewSendGrid returns a SendGrid Sender using the API key. baseURL is normally "https://api.sendgrid.com"
+func NewSendGrid(baseURL, apiKey string) *SendGrid {
+	return &SendGrid{
+		client:  newHTTPClient(),
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+	}
+}
+
+// Send sends the message
+func (s *SendGrid) Send(ctx context.Context, msg *Message) error {
+	// SendGrid takes the name and the address separately, so split up addresses such as "Alice Smith <alice@example.com>"
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]interface{}{
+		"personalizations": []map[string]interface{}{
+			{"to": []sendGridAddress{{Email: to.Address, Name: to.Name}}},
+		},
+		"from":    sendGridAddress{Email: from.Address, Name: from.Name},
+		"subject": msg.Subject,
+		"content": []map[string]string{
+			{"type": "text/plain", "value": msg.PlainBody},
+			{"type": "text/html", "value": msg.HTMLBody},
+		},
+	}
+
+	if len(msg.Attachments) > 0 {
+		attachments := make([]map[string]string, 0, len(msg.Attachments))
+		for _, a := range msg.Attachments {
+			attachments = append(attachments, map[string]string{
+				"content":     base64.StdEncoding.EncodeToString(a.Data),
+				"type":        a.contentType(),
+				"filename":    a.Filename,
+				"disposition": "attachment",
+			})
+		}
+		body["attachments"] = attachments
+	}
+
+	js, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+"/v3/mail/send", bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	return do(s.client, req, "SendGrid")
+}
@@ -0,0 +1,90 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/eazylaykzy/greenlight/internal/awssig"
+)
+
+// SES sends messages with the AWS SES v2 SendEmail API
+// (https://docs.aws.amazon.com/ses/latest/APIReference-V2/API_SendEmail.html). Requests are signed with AWS Signature
+// Version 4 by the awssig package, rather than pulling in the AWS SDK for a single call
+type SES struct {
+	client   *http.Client
+	endpoint string
+	signer   awssig.Signer
+}
+
+// sesContent is a piece of text in an SES request
+type sesContent struct {
+	Data    string `json:"Data"`
+	Charset string `json:"Charset"`
+}
+
+// NewSES returns an SES Sender for the AWS region, using the access key
+func NewSES(region, accessKeyID, secretAccessKey string) *SES {
+	return &SES{
+		client:   newHTTPClient(),
+		endpoint: "https://email." + region + ".amazonaws.com",
+		signer: awssig.Signer{
+			Service:         "ses",
+			Region:          region,
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: secretAccessKey,
+		},
+	}
+}
+
+// Send sends the message
+func (s *SES) Send(ctx context.Context, msg *Message) error {
+	body := map[string]interface{}{
+		"FromEmailAddress": msg.From,
+		"Destination": map[string][]string{
+			"ToAddresses": {msg.To},
+		},
+	}
+
+	// Simple content doesn't have attachments, so messages with attachments are sent as the raw MIME message instead
+	if len(msg.Attachments) == 0 {
+		body["Content"] = map[string]interface{}{
+			"Simple": map[string]interface{}{
+				"Subject": sesContent{Data: msg.Subject, Charset: "UTF-8"},
+				"Body": map[string]sesContent{
+					"Text": {Data: msg.PlainBody, Charset: "UTF-8"},
+					"Html": {Data: msg.HTMLBody, Charset: "UTF-8"},
+				},
+			},
+		}
+	} else {
+		var raw bytes.Buffer
+
+		_, err := mimeMessage(msg).WriteTo(&raw)
+		if err != nil {
+			return err
+		}
+
+		// The raw message is a blob, which is base64 encoded in the JSON, as encoding/json does with a []byte
+		body["Content"] = map[string]interface{}{
+			"Raw": map[string][]byte{"Data": raw.Bytes()},
+		}
+	}
+
+	js, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/v2/email/outbound-emails", bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	s.signer.Sign(req, awssig.PayloadHash(js), time.Now())
+
+	return do(s.client, req, "SES")
+}
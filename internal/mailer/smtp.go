@@ -0,0 +1,103 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"github.com/go-mail/mail/v2"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SMTP sends messages through an SMTP server. If DKIM is set, every message is signed with it before it's sent
+type SMTP struct {
+	DKIM   *DKIMSigner
+	dialer *mail.Dialer
+}
+
+// NewSMTP returns an SMTP Sender for the server at host and port, logging in with the username and password
+func NewSMTP(host string, port int, username, password string) *SMTP {
+	// Initialize a new mail.Dialer instance with the given SMTP server settings.
+	// We also configure this to use a 10-second timeout whenever we send an email
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 10 * time.Second
+
+	return &SMTP{dialer: dialer}
+}
+
+// Send sends the message. The SMTP connection isn't cancelled with ctx, but it does time out
+func (s *SMTP) Send(_ context.Context, msg *Message) error {
+	// Call the DialAndSend method on the dialer, passing in the message to send. This opens a connection to the SMTP server,
+	// sends the message, then closes the connection. If there is a timeout, it will return a "dial tcp: i/o timeout" error
+	if s.DKIM == nil {
+		return s.dialer.DialAndSend(mimeMessage(msg))
+	}
+
+	// To sign the message, the connection is opened here and wrapped, so that the message can be signed once it's
+	// been written out, with the envelope addresses still taken from its headers
+	conn, err := s.dialer.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return mail.Send(dkimSender{next: conn, signer: s.DKIM}, mimeMessage(msg))
+}
+
+// Ping checks that the SMTP server can be reached, by opening a connection to it and closing it again without logging
+// in or sending anything
+func (s *SMTP) Ping(ctx context.Context) error {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(s.dialer.Host, strconv.Itoa(s.dialer.Port)))
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// dkimSender is a mail.Sender which signs each message with DKIM before passing it on to the next Sender
+type dkimSender struct {
+	next   mail.Sender
+	signer *DKIMSigner
+}
+
+// Send signs the message and sends it
+func (d dkimSender) Send(from string, to []string, msg io.WriterTo) error {
+	var raw bytes.Buffer
+
+	_, err := msg.WriteTo(&raw)
+	if err != nil {
+		return err
+	}
+
+	signed, err := d.signer.Sign(raw.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return d.next.Send(from, to, bytes.NewBuffer(signed))
+}
+
+// mimeMessage builds the MIME message for a Message, for SMTP and for the providers which take raw messages
+func mimeMessage(msg *Message) *mail.Message {
+	// Use the mail.NewMessage function to initialize a new mail.Message instance. Then we use the SetHeader method to set
+	// the email recipient, sender and subject headers, the SetBody method to set the plain-text body, and the AddAlternative
+	// method to set the HTML body. It's important to note that AddAlternative should always be called *after* SetBody
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.To)
+	m.SetHeader("From", msg.From)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+
+	for _, a := range msg.Attachments {
+		m.AttachReader(a.Filename, bytes.NewReader(a.Data), mail.SetHeader(map[string][]string{
+			"Content-Type": {a.contentType() + `; name="` + a.Filename + `"`},
+		}))
+	}
+
+	return m
+}
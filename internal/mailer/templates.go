@@ -0,0 +1,139 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+// layoutFile is the file holding the layout which every email is rendered inside
+const layoutFile = "layouts/base.tmpl"
+
+// templateSet loads the email templates, from the template directory when one is set and it has the file, and from
+// the templates embedded in the binary otherwise. Parsed templates are cached, unless reload is set, in which case
+// they're read again for every email so that changes to them show up straight away
+type templateSet struct {
+	fsys   fs.FS
+	funcs  map[string]interface{}
+	reload bool
+
+	mu     sync.Mutex
+	parsed map[string]*parsedTemplate
+}
+
+// parsedTemplate is an email template parsed along with the layout, once with text/template for the subject and the
+// plain-text body, so that they aren't HTML escaped, and once with html/template for the HTML body
+type parsedTemplate struct {
+	text *texttemplate.Template
+	html *template.Template
+}
+
+// overlayFS is a file system which opens files from dir if they're there, and from fallback if they aren't
+type overlayFS struct {
+	dir      fs.FS
+	fallback fs.FS
+}
+
+// Open opens the named file from the overlay directory, or from the fallback if the directory doesn't have it
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.dir.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.fallback.Open(name)
+	}
+
+	return f, err
+}
+
+// newTemplateSet returns a templateSet which overrides the embedded templates with those in dir, if dir isn't empty.
+// Every template is parsed straight away, so that a mistake in an override is found at startup rather than when the
+// email is sent
+func newTemplateSet(dir string, reload bool, funcs map[string]interface{}) (*templateSet, error) {
+	embedded, err := fs.Sub(templateFS, "templates")
+	if err != nil {
+		return nil, err
+	}
+
+	fsys := embedded
+
+	if dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("mailer: template directory %s is not a directory", dir)
+		}
+
+		fsys = overlayFS{dir: os.DirFS(dir), fallback: embedded}
+	}
+
+	s := &templateSet{
+		fsys:   fsys,
+		funcs:  funcs,
+		reload: reload,
+		parsed: make(map[string]*parsedTemplate),
+	}
+
+	// Check every template, which are the .tmpl files in the embedded templates directory, apart from the layouts
+	entries, err := fs.ReadDir(embedded, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".tmpl") {
+			continue
+		}
+
+		_, err := s.get(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// get returns the parsed template from the named file, parsing it if it isn't cached
+func (s *templateSet) get(name string) (*parsedTemplate, error) {
+	if s.reload {
+		return s.parse(name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.parsed[name]; ok {
+		return t, nil
+	}
+
+	t, err := s.parse(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.parsed[name] = t
+
+	return t, nil
+}
+
+// parse parses the named template file along with the layout
+func (s *templateSet) parse(name string) (*parsedTemplate, error) {
+	// Use the ParseFS() method to parse the layout and the template file from the file system
+	text, err := texttemplate.New("email").Funcs(s.funcs).ParseFS(s.fsys, layoutFile, name)
+	if err != nil {
+		return nil, err
+	}
+
+	html, err := template.New("email").Funcs(s.funcs).ParseFS(s.fsys, layoutFile, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parsedTemplate{text: text, html: html}, nil
+}
@@ -0,0 +1,141 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Claims holds the claims from a verified ID token. Numbers are kept as json.Number values
+type Claims map[string]interface{}
+
+// String returns the value of a string claim, or an empty string if the claim is missing or isn't a string
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Bool returns the value of a boolean claim. Some providers send booleans such as email_verified as the strings
+// "true" and "false", so those are accepted as well
+func (c Claims) Bool(name string) bool {
+	switch value := c[name].(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+
+	return false
+}
+
+// Values returns the values of a claim which can hold a single string or an array of strings, such as groups or roles.
+// Any values which aren't strings are ignored
+func (c Claims) Values(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+// time returns the value of a NumericDate claim, such as exp, or the zero time if the claim is missing
+func (c Claims) time(name string) time.Time {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(f), 0)
+}
+
+// audienceIncludes reports whether the token was issued for the client. When a token has more than one audience the
+// authorized party must be the client too
+func (c Claims) audienceIncludes(clientID string) bool {
+	audiences := c.Values("aud")
+
+	found := false
+	for _, aud := range audiences {
+		if aud == clientID {
+			found = true
+		}
+	}
+
+	if len(audiences) > 1 && c.String("azp") != clientID {
+		return false
+	}
+
+	return found
+}
+
+// ClaimRule grants permissions to users whose ID token has a claim with a particular value, such as a group that
+// they're a member of
+type ClaimRule struct {
+	Claim       string
+	Value       string
+	Permissions []string
+}
+
+// ParseClaimRules parses claim rules from a space separated list in the format "claim=value=>permission,permission",
+// for example "groups=greenlight-editors=>movies:read,movies:write"
+func ParseClaimRules(s string) ([]ClaimRule, error) {
+	var rules []ClaimRule
+
+	for _, field := range strings.Fields(s) {
+		parts := strings.SplitN(field, "=>", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("oidc: claim rule %q is missing \"=>\"", field)
+		}
+
+		condition := strings.SplitN(parts[0], "=", 2)
+		if len(condition) != 2 || condition[0] == "" || condition[1] == "" {
+			return nil, fmt.Errorf("oidc: claim rule %q must start with claim=value", field)
+		}
+
+		rule := ClaimRule{Claim: condition[0], Value: condition[1]}
+
+		for _, permission := range strings.Split(parts[1], ",") {
+			if permission != "" {
+				rule.Permissions = append(rule.Permissions, permission)
+			}
+		}
+
+		if len(rule.Permissions) == 0 {
+			return nil, fmt.Errorf("oidc: claim rule %q doesn't grant any permissions", field)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Permissions returns the permissions granted to the user by the rules that their claims match
+func (c Claims) Permissions(rules []ClaimRule) []string {
+	var permissions []string
+
+	for _, rule := range rules {
+		for _, value := range c.Values(rule.Claim) {
+			if value == rule.Value {
+				permissions = append(permissions, rule.Permissions...)
+				break
+			}
+		}
+	}
+
+	return unique(permissions)
+}
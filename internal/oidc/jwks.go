@@ -0,0 +1,200 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// jwksRefreshInterval is the least time between fetches of the provider's keys, so that ID tokens with unknown key
+// IDs can't be used to make us hammer the provider
+const jwksRefreshInterval = time.Minute
+
+// publicKey is one of the provider's signing keys
+type publicKey struct {
+	key crypto.PublicKey
+}
+
+// jwk is a JSON Web Key, as published in the provider's JWKS document. Only RSA and elliptic curve keys are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key returns the provider's signing key with the given ID. If we don't have it, the keys are fetched again in case the
+// provider has rotated them
+func (p *Provider) key(ctx context.Context, kid string) (publicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return publicKey{}, ErrInvalidIDToken
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	err := p.getJSON(ctx, p.metadata.JWKSURI, &set)
+	if err != nil {
+		return publicKey{}, err
+	}
+
+	keys := make(map[string]publicKey)
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+
+		keys[k.Kid] = publicKey{key: key}
+	}
+
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	return publicKey{}, ErrInvalidIDToken
+}
+
+// publicKey parses the key material of a JSON Web Key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("oidc: RSA exponent is too large")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("oidc: unsupported elliptic curve")
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("oidc: point is not on the curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, errors.New("oidc: unsupported key type")
+}
+
+// verify checks a JWS signature made with the given algorithm. The algorithm has to match the type of the key, so
+// that a token can't choose a weaker algorithm than the key was meant for. "none" is never accepted
+func (k publicKey) verify(alg string, signed, signature []byte) bool {
+	var hash crypto.Hash
+
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return false
+		}
+
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+
+	case *ecdsa.PublicKey:
+		// Each ES algorithm is for one curve
+		curves := map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+		if curves[alg] != key.Curve.Params().BitSize {
+			return false
+		}
+
+		// ES signatures are the two integers r and s, each padded to the size of the curve, one after the other
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+
+		return ecdsa.Verify(key, digest, r, s)
+	}
+
+	return false
+}
+
+// decodeBigInt decodes a base64url encoded unsigned big-endian integer
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) == 0 {
+		return nil, errors.New("oidc: empty integer")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,295 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidIDToken is returned by Verify when an ID token is malformed, has an invalid signature, or has claims
+	// which don't match what we expect, such as the wrong audience or nonce
+	ErrInvalidIDToken = errors.New("oidc: invalid ID token")
+
+	// ErrExchangeFailed is returned by Exchange when the provider rejects an authorization code
+	ErrExchangeFailed = errors.New("oidc: authorization code exchange failed")
+)
+
+// leeway is the allowance for the difference between our clock and the provider's when checking the times in an ID
+// token
+const leeway = time.Minute
+
+// Config holds the settings for a relying party (that's us) registered with an OpenID Connect provider
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// metadata holds the parts of the provider's discovery document that we use
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID Connect provider, such as Okta or Azure AD, that users can sign in with using the
+// authorization code flow. The provider's signing keys are cached, and fetched again when an ID token is signed with
+// a key that we don't know, which is how providers rotate their keys
+type Provider struct {
+	config   Config
+	client   *http.Client
+	metadata metadata
+
+	mu          sync.Mutex
+	keys        map[string]publicKey
+	keysFetched time.Time
+}
+
+// Discover fetches the discovery document for the issuer in the config, and returns the Provider it describes
+func Discover(ctx context.Context, config Config) (*Provider, error) {
+	p := &Provider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	wellKnown := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+
+	err := p.getJSON(ctx, wellKnown, &p.metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	// The issuer in the discovery document must be the one we asked for, as it's what the ID tokens are checked against
+	if strings.TrimSuffix(p.metadata.Issuer, "/") != strings.TrimSuffix(config.Issuer, "/") {
+		return nil, fmt.Errorf("oidc: discovery document is for issuer %q, not %q", p.metadata.Issuer, config.Issuer)
+	}
+
+	if p.metadata.AuthorizationEndpoint == "" || p.metadata.TokenEndpoint == "" || p.metadata.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing a required endpoint")
+	}
+
+	return p, nil
+}
+
+// Issuer returns the provider's issuer identifier, which together with a user's subject identifies them
+func (p *Provider) Issuer() string {
+	return p.metadata.Issuer
+}
+
+// AuthCodeURL returns the URL to send the user to so that they can sign in with the provider. The state is sent back
+// to us with the authorization code, the nonce is included in the ID token, and the code challenge is the PKCE
+// challenge for the code verifier which must be sent when the code is exchanged
+func (p *Provider) AuthCodeURL(state, nonce, codeChallenge string) (string, error) {
+	u, err := url.Parse(p.metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	scopes := append([]string{"openid"}, p.config.Scopes...)
+
+	qs := u.Query()
+	qs.Set("response_type", "code")
+	qs.Set("client_id", p.config.ClientID)
+	qs.Set("redirect_uri", p.config.RedirectURL)
+	qs.Set("scope", strings.Join(unique(scopes), " "))
+	qs.Set("state", state)
+	qs.Set("nonce", nonce)
+	qs.Set("code_challenge", codeChallenge)
+	qs.Set("code_challenge_method", "S256")
+	u.RawQuery = qs.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange swaps an authorization code for the user's ID token, which must then be checked with Verify
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	// The client credentials are sent with HTTP Basic authentication, which every provider supports. They have to be
+	// form encoded first (RFC 6749 section 2.3.1)
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("oidc: decoding token response: %w", err)
+	}
+
+	switch {
+	case body.Error != "":
+		return "", fmt.Errorf("%w: %s", ErrExchangeFailed, strings.TrimSpace(body.Error+" "+body.ErrorDescription))
+	case res.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("oidc: unexpected token response status %s", res.Status)
+	case body.IDToken == "":
+		return "", errors.New("oidc: token response has no ID token")
+	}
+
+	return body.IDToken, nil
+}
+
+// Verify checks an ID token's signature and claims, and returns the claims. The token must have been issued by the
+// provider, for us, for the sign in with the given nonce, and must not have expired
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (Claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if !key.verify(header.Alg, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidIDToken
+	}
+
+	var claims Claims
+
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.String("iss") != p.metadata.Issuer:
+		return nil, ErrInvalidIDToken
+	case !claims.audienceIncludes(p.config.ClientID):
+		return nil, ErrInvalidIDToken
+	case claims.String("sub") == "":
+		return nil, ErrInvalidIDToken
+	case now.After(claims.time("exp").Add(leeway)):
+		return nil, ErrInvalidIDToken
+	case claims.time("iat").After(now.Add(leeway)):
+		return nil, ErrInvalidIDToken
+	case subtle.ConstantTimeCompare([]byte(claims.String("nonce")), []byte(nonce)) != 1:
+		return nil, ErrInvalidIDToken
+	}
+
+	return claims, nil
+}
+
+// RandomString returns a random URL-safe string, for use as a state, nonce or PKCE code verifier. It has 256 bits of
+// randomness, encoded as 43 characters, which is within the length allowed for a code verifier
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge returns the S256 PKCE code challenge for a code verifier
+func CodeChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// getJSON fetches a JSON document from the provider
+func (p *Provider) getJSON(ctx context.Context, url string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: unexpected response status %s from %s", res.Status, url)
+	}
+
+	return json.NewDecoder(res.Body).Decode(dst)
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT
+func decodeSegment(segment string, dst interface{}) error {
+	js, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(js)))
+	dec.UseNumber()
+
+	return dec.Decode(dst)
+}
+
+// unique returns values without any duplicates, keeping the first of each
+func unique(values []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+
+	for _, value := range values {
+		if value != "" && !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,300 @@
+// Package prom keeps counters, gauges and histograms and serves them in the Prometheus text exposition format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/), so that they can be scraped without pulling in the
+// Prometheus client library
+package prom
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a counter, gauge or histogram which can write itself out in the text format
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// registry holds every metric which has been created, in the order they were created
+var registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// register adds a metric to the registry
+func register(m metric) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	registry.metrics = append(registry.metrics, m)
+}
+
+// Handler returns a handler which responds with every metric in the text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		registry.mu.Lock()
+		metrics := append([]metric(nil), registry.metrics...)
+		registry.mu.Unlock()
+
+		bw := bufio.NewWriter(w)
+		for _, m := range metrics {
+			m.write(bw)
+		}
+
+		_ = bw.Flush()
+	})
+}
+
+// Counter is a value which only goes up, such as the number of emails sent, with a separate value for each
+// combination of its labels' values
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter returns a new counter with the given labels, and registers it. The name should end in "_total"
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+
+	return c
+}
+
+// Inc adds one to the counter for the label values, which are given in the same order as the labels
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for the label values. v must not be negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := labelKey(c.labels, labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[key] += v
+}
+
+// write writes out the counter
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+
+	for _, key := range sortedKeys(c.values) {
+		writeSample(w, c.name, key, "", c.values[key])
+	}
+}
+
+// Gauge is a value which can go up and down, such as the state of a circuit breaker, with a separate value for each
+// combination of its labels' values
+type Gauge struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewGauge returns a new gauge with the given labels, and registers it
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(g)
+
+	return g
+}
+
+// Set sets the gauge to v for the label values
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := labelKey(g.labels, labelValues)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.values[key] = v
+}
+
+// write writes out the gauge
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+
+	for _, key := range sortedKeys(g.values) {
+		writeSample(w, g.name, key, "", g.values[key])
+	}
+}
+
+// Histogram counts observations, such as how long requests take, in buckets, along with their count and sum, with a
+// separate set for each combination of its labels' values
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+// histogramValue holds the observations for one combination of label values. The counts aren't cumulative, unlike
+// the buckets which are written out
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram returns a new histogram with the given upper bounds for its buckets and the given labels, and
+// registers it
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: append([]float64(nil), buckets...),
+		values:  make(map[string]*histogramValue),
+	}
+	sort.Float64s(h.buckets)
+	register(h)
+
+	return h
+}
+
+// Observe records an observation for the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := labelKey(h.labels, labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			value.counts[i]++
+			break
+		}
+	}
+
+	value.count++
+	value.sum += v
+}
+
+// write writes out the histogram
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := h.values[key]
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += value.counts[i]
+			writeSample(w, h.name+"_bucket", key, `le="`+formatFloat(bound)+`"`, float64(cumulative))
+		}
+
+		writeSample(w, h.name+"_bucket", key, `le="+Inf"`, float64(value.count))
+		writeSample(w, h.name+"_sum", key, "", value.sum)
+		writeSample(w, h.name+"_count", key, "", float64(value.count))
+	}
+}
+
+// labelKey returns the labels and their values in the text format, such as `provider="smtp",outcome="sent"`, which
+// is also used to tell the combinations of values apart. A missing value is written as an empty one
+func labelKey(labels, values []string) string {
+	var b strings.Builder
+
+	for i, label := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+
+		b.WriteString(label)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(value))
+		b.WriteByte('"')
+	}
+
+	return b.String()
+}
+
+// labelValueEscaper escapes the characters which have to be escaped in label values
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeHeader writes the HELP and TYPE lines for a metric
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// writeSample writes one sample line, with the labels in key followed by any extra label
+func writeSample(w *bufio.Writer, name, key, extra string, v float64) {
+	labels := key
+	if extra != "" {
+		if labels != "" {
+			labels += ","
+		}
+		labels += extra
+	}
+
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+// formatFloat formats a value the way the text format expects
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// sortedKeys returns the keys of a counter's or gauge's values in order, so that the output is stable
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,137 @@
+// Package reporter sends the details of panics to an error tracking service, such as Sentry or Rollbar, so that they
+// can be grouped, counted and alerted on, in addition to being logged
+package reporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFrames is the most frames that are included in a report's stack trace
+const maxFrames = 64
+
+// Reporter is the interface that each of our error tracking services implement
+type Reporter interface {
+	Report(ctx context.Context, report *Report) error
+}
+
+// Report describes a panic which happened while a request was being handled
+type Report struct {
+	Time time.Time
+
+	// Type is the type of the value which was passed to panic, such as "runtime.boundsError", and Message is the value
+	// itself, formatted as a string
+	Type    string
+	Message string
+
+	// Stack is the stack of the goroutine which panicked, with the frame which called panic first
+	Stack []Frame
+
+	RequestID string
+	Method    string
+	URL       string
+	ClientIP  string
+
+	// UserID is the ID of the authenticated user who made the request, or 0 if it was made anonymously
+	UserID int64
+}
+
+// Frame is one frame of a stack trace
+type Frame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// PanicStack returns the stack of the goroutine which is panicking, when it's called from a deferred function which
+// recovered the panic. The frames of the deferred function and of the runtime's panic handling are left out, so that
+// it starts with the frame which called panic
+func PanicStack() []Frame {
+	pcs := make([]uintptr, maxFrames+16)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var (
+		stack     []Frame
+		panicking bool
+	)
+
+	for {
+		frame, more := frames.Next()
+
+		switch {
+		case frame.Function == "runtime.gopanic":
+			// Everything before this is the deferred function, so start again from the next frame
+			stack, panicking = nil, true
+		case panicking && strings.HasPrefix(frame.Function, "runtime."):
+			// The runtime's frames for panics such as nil pointer dereferences, which called gopanic
+		case frame.Function == "runtime.goexit" || len(stack) == maxFrames:
+			return stack
+		default:
+			panicking = false
+			stack = append(stack, Frame{Function: frame.Function, File: frame.File, Line: frame.Line})
+		}
+
+		if !more {
+			return stack
+		}
+	}
+}
+
+// newEventID returns a random 32 character hex ID for a report, which the services use to drop duplicates
+func newEventID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// userID formats a user ID for a report, which is empty for anonymous requests
+func userID(id int64) string {
+	if id == 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(id, 10)
+}
+
+// newHTTPClient returns the HTTP client used to send reports
+func newHTTPClient() *http.Client {
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// post sends a report to a service's API, and returns an error including the start of the response body if the
+// response doesn't have a 2xx status
+func post(ctx context.Context, client *http.Client, url string, header http.Header, body []byte, service string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	resBody, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("reporter: %s responded with %s: %s", service, res.Status, strings.TrimSpace(string(resBody)))
+	}
+
+	return nil
+}
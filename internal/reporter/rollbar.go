@@ -0,0 +1,87 @@
+package reporter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Rollbar sends reports to Rollbar as items, with its API (https://docs.rollbar.com/reference/create-item)
+type Rollbar struct {
+	client      *http.Client
+	baseURL     string
+	token       string
+	environment string
+	codeVersion string
+}
+
+// NewRollbar returns a Rollbar Reporter using the project access token, which needs the post_server_item scope.
+// baseURL is normally "https://api.rollbar.com". The items are tagged with the environment and code version
+func NewRollbar(baseURL, token, environment, codeVersion string) *Rollbar {
+	return &Rollbar{
+		client:      newHTTPClient(),
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		token:       token,
+		environment: environment,
+		codeVersion: codeVersion,
+	}
+}
+
+// rollbarFrame is a frame of a stack trace in a Rollbar item
+type rollbarFrame struct {
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	Method   string `json:"method"`
+}
+
+// Report sends the report as an item
+func (rb *Rollbar) Report(ctx context.Context, report *Report) error {
+	// Rollbar wants the frames with the most recent call last
+	frames := make([]rollbarFrame, len(report.Stack))
+	for i, frame := range report.Stack {
+		frames[len(frames)-1-i] = rollbarFrame{Filename: frame.File, Lineno: frame.Line, Method: frame.Function}
+	}
+
+	data := map[string]interface{}{
+		"uuid":         newEventID(),
+		"timestamp":    report.Time.Unix(),
+		"level":        "error",
+		"language":     "go",
+		"framework":    "net/http",
+		"environment":  rb.environment,
+		"code_version": rb.codeVersion,
+		"body": map[string]interface{}{
+			"trace": map[string]interface{}{
+				"frames": frames,
+				"exception": map[string]string{
+					"class":   report.Type,
+					"message": report.Message,
+				},
+			},
+		},
+		"request": map[string]string{
+			"url":     report.URL,
+			"method":  report.Method,
+			"user_ip": report.ClientIP,
+		},
+		"custom": map[string]string{
+			"request_id": report.RequestID,
+		},
+	}
+
+	// Rollbar needs an ID for the person, so it's only sent for requests made by a user
+	if report.UserID != 0 {
+		data["person"] = map[string]string{"id": userID(report.UserID)}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return err
+	}
+
+	header := make(http.Header)
+	header.Set("X-Rollbar-Access-Token", rb.token)
+
+	return post(ctx, rb.client, rb.baseURL+"/api/1/item/", header, body, "Rollbar")
+}
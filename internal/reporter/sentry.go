@@ -0,0 +1,109 @@
+package reporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Sentry sends reports to Sentry as events, with its store API (https://develop.sentry.dev/sdk/store/)
+type Sentry struct {
+	client      *http.Client
+	storeURL    string
+	publicKey   string
+	environment string
+	release     string
+}
+
+// NewSentry returns a Sentry Reporter for the project in the DSN, which is in the format
+// https://publicKey@host/projectID. The events are tagged with the environment and release
+func NewSentry(dsn, environment, release string) (*Sentry, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("reporter: Sentry DSN must include the public key")
+	}
+
+	path, projectID, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if projectID == "" {
+		path, projectID = "", path
+	}
+
+	if projectID == "" {
+		return nil, errors.New("reporter: Sentry DSN must include the project ID")
+	}
+
+	if path != "" {
+		path = "/" + path
+	}
+
+	return &Sentry{
+		client:      newHTTPClient(),
+		storeURL:    fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path, projectID),
+		publicKey:   u.User.Username(),
+		environment: environment,
+		release:     release,
+	}, nil
+}
+
+// sentryFrame is a frame of a stack trace in a Sentry event
+type sentryFrame struct {
+	Function string `json:"function"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+}
+
+// Report sends the report as an event
+func (s *Sentry) Report(ctx context.Context, report *Report) error {
+	// Sentry wants the frames with the oldest call first
+	frames := make([]sentryFrame, len(report.Stack))
+	for i, frame := range report.Stack {
+		frames[len(frames)-1-i] = sentryFrame{Function: frame.Function, AbsPath: frame.File, Lineno: frame.Line}
+	}
+
+	event := map[string]interface{}{
+		"event_id":    newEventID(),
+		"timestamp":   report.Time.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"level":       "error",
+		"platform":    "go",
+		"logger":      "greenlight",
+		"environment": s.environment,
+		"release":     s.release,
+		"exception": map[string]interface{}{
+			"values": []map[string]interface{}{{
+				"type":       report.Type,
+				"value":      report.Message,
+				"stacktrace": map[string]interface{}{"frames": frames},
+				"mechanism":  map[string]interface{}{"type": "recover", "handled": true},
+			}},
+		},
+		"request": map[string]string{
+			"url":    report.URL,
+			"method": report.Method,
+		},
+		"user": map[string]string{
+			"id":         userID(report.UserID),
+			"ip_address": report.ClientIP,
+		},
+		"tags": map[string]string{
+			"request_id": report.RequestID,
+		},
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	header := make(http.Header)
+	header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=greenlight/1.0, sentry_key=%s", s.publicKey))
+
+	return post(ctx, s.client, s.storeURL, header, body, "Sentry")
+}
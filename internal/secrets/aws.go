@@ -0,0 +1,122 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/eazylaykzy/greenlight/internal/awssig"
+)
+
+// AWS fetches secrets from AWS Secrets Manager with the GetSecretValue API, signing its requests with AWS Signature
+// Version 4. The path of a reference is the secret's name or ARN. A secret stored as a JSON object has its fields as
+// the keys, and a secret stored as a plain string is returned whole when the reference has no key
+type AWS struct {
+	client   *http.Client
+	endpoint string
+	signer   awssig.Signer
+}
+
+// NewAWS returns an AWS Secrets Manager provider for a region. The endpoint can be empty, in which case the regional
+// endpoint is used. The session token is only needed for temporary credentials, and can be empty
+func NewAWS(endpoint, region, accessKey, secretKey, sessionToken string) *AWS {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", region)
+	}
+
+	return &AWS{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		signer: awssig.Signer{
+			Service:         "secretsmanager",
+			Region:          region,
+			AccessKeyID:     accessKey,
+			SecretAccessKey: secretKey,
+			SessionToken:    sessionToken,
+		},
+	}
+}
+
+// NewAWSFromEnvironment returns an AWS Secrets Manager provider configured from the AWS_REGION (or
+// AWS_DEFAULT_REGION), AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and
+// AWS_ENDPOINT_URL_SECRETS_MANAGER environment variables, which are the ones that the AWS CLI uses
+func NewAWSFromEnvironment() *AWS {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	return NewAWS(
+		os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER"),
+		region,
+		os.Getenv("AWS_ACCESS_KEY_ID"),
+		os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		os.Getenv("AWS_SESSION_TOKEN"),
+	)
+}
+
+// Get fetches the current version of the secret named path
+func (a *AWS) Get(ctx context.Context, path string) (map[string]string, error) {
+	if a.signer.Region == "" || a.signer.AccessKeyID == "" || a.signer.SecretAccessKey == "" {
+		return nil, fmt.Errorf("awssm: %w (set AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)", errNotConfigured)
+	}
+
+	payload, err := json.Marshal(map[string]string{"SecretId": path})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint+"/", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+
+	a.signer.Sign(req, awssig.PayloadHash(payload), time.Now())
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("awssm: unexpected response status %s: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+
+	var body struct {
+		SecretString *string `json:"SecretString"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("awssm: %w", err)
+	}
+
+	if body.SecretString == nil {
+		return nil, fmt.Errorf("awssm: binary secrets aren't supported")
+	}
+
+	// The whole secret is always available under the empty key. If it's a JSON object, its fields are available
+	// under their own names too
+	values := map[string]string{"": *body.SecretString}
+
+	var fields map[string]interface{}
+	if json.Unmarshal([]byte(*body.SecretString), &fields) == nil {
+		for key, value := range stringValues(fields) {
+			values[key] = value
+		}
+	}
+
+	return values, nil
+}
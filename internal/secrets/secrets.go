@@ -0,0 +1,121 @@
+// Package secrets fetches settings such as database credentials from a secrets manager, so that they don't need to be
+// written in a config file or passed on the command line. A setting refers to a secret with a reference in the form
+// "<provider>:<path>#<key>", for example:
+//
+//	vault:secret/greenlight#db_dsn
+//	awssm:greenlight/production#db_dsn
+//
+// The path identifies the secret in the provider, and the key picks one value out of it. Settings which aren't
+// references, because they don't start with the name of a registered provider, are used as they are.
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Provider is a secrets manager that secrets can be fetched from
+type Provider interface {
+	// Get returns the values in the secret at path, keyed by name
+	Get(ctx context.Context, path string) (map[string]string, error)
+}
+
+// Resolver replaces references to secrets with the values of the secrets, fetching each secret from its provider.
+// A secret is only fetched once, however many of its keys are used
+type Resolver struct {
+	providers map[string]Provider
+
+	mu    sync.Mutex
+	cache map[string]map[string]string
+}
+
+// NewResolver returns a Resolver with no providers
+func NewResolver() *Resolver {
+	return &Resolver{
+		providers: make(map[string]Provider),
+		cache:     make(map[string]map[string]string),
+	}
+}
+
+// FromEnvironment returns a Resolver with the Vault and AWS Secrets Manager providers, configured from their usual
+// environment variables. See NewVaultFromEnvironment and NewAWSFromEnvironment
+func FromEnvironment() *Resolver {
+	r := NewResolver()
+	r.Register("vault", NewVaultFromEnvironment())
+	r.Register("awssm", NewAWSFromEnvironment())
+
+	return r
+}
+
+// Register adds a provider, which is used for references starting with "<name>:"
+func (r *Resolver) Register(name string, p Provider) {
+	r.providers[name] = p
+}
+
+// IsReference reports whether value is a reference to a secret with one of the registered providers
+func (r *Resolver) IsReference(value string) bool {
+	name, _, found := strings.Cut(value, ":")
+	if !found {
+		return false
+	}
+
+	_, ok := r.providers[name]
+	return ok
+}
+
+// Resolve returns the value of the secret that value refers to, or value itself if it isn't a reference. The key can
+// be left out for providers which store a secret as a single string, in which case the whole secret is returned
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	if !r.IsReference(value) {
+		return value, nil
+	}
+
+	name, rest, _ := strings.Cut(value, ":")
+	path, key, _ := strings.Cut(rest, "#")
+
+	if path == "" {
+		return "", fmt.Errorf("secrets: %s: missing secret path", value)
+	}
+
+	values, err := r.get(ctx, name, path)
+	if err != nil {
+		return "", fmt.Errorf("secrets: %s:%s: %w", name, path, err)
+	}
+
+	secret, ok := values[key]
+	if !ok {
+		if key == "" {
+			return "", fmt.Errorf("secrets: %s:%s: a key must be given, as in %s:%s#key", name, path, name, path)
+		}
+		return "", fmt.Errorf("secrets: %s:%s: no key %q in the secret", name, path, key)
+	}
+
+	return secret, nil
+}
+
+// get fetches a secret from a provider, or returns it from the cache if it has been fetched already
+func (r *Resolver) get(ctx context.Context, name, path string) (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cacheKey := name + ":" + path
+
+	if values, ok := r.cache[cacheKey]; ok {
+		return values, nil
+	}
+
+	values, err := r.providers[name].Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.cache[cacheKey] = values
+
+	return values, nil
+}
+
+// errNotConfigured is returned by a provider which is used without the settings it needs
+var errNotConfigured = errors.New("provider is not configured")
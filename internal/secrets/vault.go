@@ -0,0 +1,106 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Vault fetches secrets from a HashiCorp Vault KV secrets engine, using the HTTP API with a token. The path of a
+// reference is the API path of the secret, so a secret in a version 2 KV engine is read from its data path, such as
+// "secret/data/greenlight", while a version 1 engine uses the path as it is, such as "secret/greenlight"
+type Vault struct {
+	client    *http.Client
+	addr      string
+	token     string
+	namespace string
+}
+
+// NewVault returns a Vault provider for the server at addr, authenticating with token. The namespace is only needed
+// for Vault Enterprise, and can be empty
+func NewVault(addr, token, namespace string) *Vault {
+	return &Vault{
+		client:    &http.Client{Timeout: 10 * time.Second},
+		addr:      strings.TrimSuffix(addr, "/"),
+		token:     token,
+		namespace: namespace,
+	}
+}
+
+// NewVaultFromEnvironment returns a Vault provider configured from the VAULT_ADDR, VAULT_TOKEN and VAULT_NAMESPACE
+// environment variables, which are the ones that the Vault CLI uses
+func NewVaultFromEnvironment() *Vault {
+	return NewVault(os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_NAMESPACE"))
+}
+
+// Get reads the secret at path. Both versions of the KV engine are supported: version 2 nests the values under a
+// second "data" field, alongside the secret's metadata
+func (v *Vault) Get(ctx context.Context, path string) (map[string]string, error) {
+	if v.addr == "" || v.token == "" {
+		return nil, fmt.Errorf("vault: %w (set VAULT_ADDR and VAULT_TOKEN)", errNotConfigured)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("vault: unexpected response status %s: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+
+	data := body.Data
+
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := data["metadata"]; hasMetadata {
+			data = nested
+		}
+	}
+
+	return stringValues(data), nil
+}
+
+// stringValues converts the values in a secret to strings. Numbers and booleans are formatted as they were written,
+// and other values, such as objects, are kept as JSON
+func stringValues(data map[string]interface{}) map[string]string {
+	values := make(map[string]string, len(data))
+
+	for key, value := range data {
+		switch value := value.(type) {
+		case string:
+			values[key] = value
+		default:
+			js, _ := json.Marshal(value)
+			values[key] = string(js)
+		}
+	}
+
+	return values
+}
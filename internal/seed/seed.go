@@ -0,0 +1,224 @@
+// Package seed loads sample movies and users into the database for development and demo environments. The sample data
+// is a JSON file, with a set embedded in the binary for when no file is given. Seeding is idempotent: movies which are
+// already there, found by their title and year, and users which are already there, found by their email address, are
+// skipped, so it can be run against the same database any number of times
+package seed
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/eazylaykzy/greenlight/internal/data"
+	"github.com/eazylaykzy/greenlight/internal/validator"
+)
+
+//go:embed sample.json
+var sample []byte
+
+// Set is the sample data to load. Movies are given as they are to the API, with the runtime as a string such as
+// "102 mins"
+type Set struct {
+	Movies []data.Movie `json:"movies"`
+	Users  []User       `json:"users"`
+}
+
+// User is a sample user, with their password in plain text so that it's known, and the permission codes to grant them
+// on top of the default permissions
+type User struct {
+	Name        string   `json:"name"`
+	Email       string   `json:"email"`
+	Password    string   `json:"password"`
+	Activated   bool     `json:"activated"`
+	Permissions []string `json:"permissions"`
+}
+
+// Result counts what Apply did with the set
+type Result struct {
+	MoviesAdded   int
+	MoviesSkipped int
+	UsersAdded    int
+	UsersSkipped  int
+}
+
+// Default returns the sample set embedded in the binary
+func Default() (*Set, error) {
+	return parse(sample)
+}
+
+// Load returns the sample set in the JSON file at path, or the embedded set if path is empty
+func Load(path string) (*Set, error) {
+	if path == "" {
+		return Default()
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	set, err := parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return set, nil
+}
+
+// parse decodes and validates a sample set. Unknown fields are an error, so that a typo isn't silently ignored
+func parse(b []byte) (*Set, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	var set Set
+	err := dec.Decode(&set)
+	if err != nil {
+		return nil, err
+	}
+
+	err = set.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &set, nil
+}
+
+// validate checks every movie and user in the set, so that a mistake in the file is found before anything is loaded.
+// The error names the first entry with a problem
+func (s *Set) validate() error {
+	for i := range s.Movies {
+		v := validator.New()
+		data.ValidateMovie(v, &s.Movies[i])
+
+		if !v.Valid() {
+			return fmt.Errorf("movies[%d]: %s", i, describe(v))
+		}
+	}
+
+	emails := make(map[string]bool, len(s.Users))
+
+	for i, user := range s.Users {
+		v := validator.New()
+		v.Check(user.Name != "", "name", "must be provided")
+		v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+		v.Check(!emails[strings.ToLower(user.Email)], "email", "must not be repeated")
+		data.ValidateEmail(v, user.Email)
+		data.ValidatePasswordPlaintext(v, user.Password)
+
+		if !v.Valid() {
+			return fmt.Errorf("users[%d]: %s", i, describe(v))
+		}
+
+		emails[strings.ToLower(user.Email)] = true
+	}
+
+	return nil
+}
+
+// describe returns the validator's errors as a single line, in a stable order
+func describe(v *validator.Validator) string {
+	problems := make([]string, 0, len(v.Errors))
+	for key, message := range v.Errors {
+		problems = append(problems, key+" "+message)
+	}
+
+	sort.Strings(problems)
+
+	return strings.Join(problems, ", ")
+}
+
+// Apply loads the set into the database with the models. Movies are inserted with the duplicate check switched on,
+// so that one with the same title and year as an existing movie is skipped. A user is inserted with their permissions
+// in a single transaction, and a user whose email address is already registered is left as they are, apart from being
+// granted any of their permissions which they don't have yet. The queries are made under ctx
+func Apply(ctx context.Context, models data.Models, set *Set) (Result, error) {
+	var result Result
+
+	models = models.WithContext(ctx)
+
+	movies := models.Movies.WithDuplicateCheck(true)
+
+	// Each movie is a copy, so filling in its ID and version on insert leaves the set as it was loaded
+	for _, movie := range set.Movies {
+		err := movies.Insert(&movie)
+		var duplicate *data.DuplicateMovieError
+		switch {
+		case errors.As(err, &duplicate):
+			result.MoviesSkipped++
+		case err != nil:
+			return result, fmt.Errorf("movie %q: %w", movie.Title, err)
+		default:
+			result.MoviesAdded++
+		}
+	}
+
+	for _, u := range set.Users {
+		added, err := applyUser(ctx, models, u)
+		if err != nil {
+			return result, fmt.Errorf("user %s: %w", u.Email, err)
+		}
+
+		if added {
+			result.UsersAdded++
+		} else {
+			result.UsersSkipped++
+		}
+	}
+
+	return result, nil
+}
+
+// applyUser inserts the user with their permissions, or grants the permissions to the existing user with the same
+// email address. It reports whether the user was inserted
+func applyUser(ctx context.Context, models data.Models, u User) (bool, error) {
+	existing, err := models.Users.GetByEmail(u.Email)
+	switch {
+	case err == nil:
+		return false, grant(models, existing.ID, u.Permissions)
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return false, err
+	}
+
+	user := &data.User{
+		Name:      u.Name,
+		Email:     u.Email,
+		Activated: u.Activated,
+	}
+
+	err = user.Password.Set(u.Password)
+	if err != nil {
+		return false, err
+	}
+
+	err = models.WithTx(ctx, func(models data.Models) error {
+		err := models.Users.Insert(user)
+		if err != nil {
+			return err
+		}
+
+		return grant(models, user.ID, u.Permissions)
+	})
+	if errors.Is(err, data.ErrDuplicateEmail) {
+		// The user was registered since GetByEmail was called, so they're left as they are
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// grant gives the user any of the default permissions, which every user is given when they register, and the
+// permission codes which they don't have yet
+func grant(models data.Models, userID int64, codes []string) error {
+	all := append(data.Permissions{}, data.DefaultPermissions...)
+
+	return models.Permissions.AddForUser(userID, append(all, codes...)...)
+}
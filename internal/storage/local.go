@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Local stores objects as files underneath a directory on the local disk. The baseURL is the public URL that the
+// directory is served from, and is used to build the URL returned by Put
+type Local struct {
+	dir     string
+	baseURL string
+}
+
+// NewLocal returns a Local storage backend which writes to the given directory, creating it if it doesn't exist
+func NewLocal(dir, baseURL string) (*Local, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Local{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}, nil
+}
+
+// Dir returns the directory that the objects are stored in, so that it can be served over HTTP
+func (s *Local) Dir() string {
+	return s.dir
+}
+
+// Put writes the object to a temporary file first and then renames it into place, so that a half-written file is
+// never visible under the final key
+func (s *Local) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) (string, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+
+	// Clean up the temporary file if anything goes wrong. Once it has been renamed this is a no-op
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	_, err = io.Copy(tmp, body)
+	if err != nil {
+		_ = tmp.Close()
+		return "", err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", err
+	}
+
+	return s.baseURL + "/" + key, nil
+}
+
+// Delete removes the file stored under the given key
+func (s *Local) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if err != nil {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return ErrNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
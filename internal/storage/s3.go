@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eazylaykzy/greenlight/internal/awssig"
+)
+
+// S3 stores objects in an S3 bucket, or any other object storage service that speaks the S3 API (MinIO, DigitalOcean
+// Spaces, etc). Requests are signed with AWS Signature Version 4 and use path-style bucket addressing
+type S3 struct {
+	client    *http.Client
+	endpoint  string
+	bucket    string
+	publicURL string
+	signer    awssig.Signer
+}
+
+// NewS3 returns an S3 storage backend. If publicURL is empty, the objects are assumed to be publicly readable
+// straight from the bucket, at <endpoint>/<bucket>/<key>
+func NewS3(endpoint, region, bucket, accessKey, secretKey, publicURL string) *S3 {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	if publicURL == "" {
+		publicURL = endpoint + "/" + bucket
+	}
+
+	return &S3{
+		client:    &http.Client{Timeout: 30 * time.Second},
+		endpoint:  endpoint,
+		bucket:    bucket,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		signer: awssig.Signer{
+			Service:         "s3",
+			Region:          region,
+			AccessKeyID:     accessKey,
+			SecretAccessKey: secretKey,
+		},
+	}
+}
+
+// Put uploads the object with a PUT Object request. The payload is sent unsigned so that it can be streamed
+// straight from the request body, without having to read it all into memory to calculate its hash first
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), body)
+	if err != nil {
+		return "", err
+	}
+
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	err = s.do(req)
+	if err != nil {
+		return "", err
+	}
+
+	return s.publicURL + "/" + key, nil
+}
+
+// Delete removes the object with a DELETE Object request. Note that S3 doesn't report whether the object existed,
+// so unlike the Local backend this never returns ErrNotFound
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	return s.do(req)
+}
+
+func (s *S3) objectURL(key string) string {
+	segments := strings.Split(key, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+
+	return s.endpoint + "/" + url.PathEscape(s.bucket) + "/" + strings.Join(segments, "/")
+}
+
+// do signs and sends the request, turning any non-2xx response into an error. The payload is never signed, which
+// S3 allows, so that uploads can be streamed
+func (s *S3) do(req *http.Request) error {
+	s.signer.Sign(req, awssig.UnsignedPayload, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("s3: %s %s: %s: %s", req.Method, req.URL.Path, res.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned by Delete when there's no object stored under the given key
+var (
+	ErrNotFound = errors.New("object not found")
+)
+
+// Storage is the interface that each of our object storage backends implement. Objects are identified by a key like
+// "posters/1-1650000000.jpg", and Put returns the public URL that clients can use to fetch the object afterwards
+type Storage interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) (string, error)
+	Delete(ctx context.Context, key string) error
+}
@@ -0,0 +1,125 @@
+// Package systemd integrates the server with systemd. It takes over the sockets passed to the process by socket
+// activation, and tells systemd about the state of the service with the sd_notify protocol, including the watchdog's
+// keep-alive pings. Everything is a no-op when the process wasn't started by systemd, so it's safe to use anywhere
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The states sent with Notify
+const (
+	// Ready tells systemd that the service has started up, for units with Type=notify
+	Ready = "READY=1"
+	// Stopping tells systemd that the service is shutting down
+	Stopping = "STOPPING=1"
+	// Watchdog is the keep-alive ping for units with WatchdogSec set, see WatchdogInterval
+	Watchdog = "WATCHDOG=1"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation. The others follow it in order
+const listenFDsStart = 3
+
+// Listener is a socket passed to the process by socket activation, with its name from the socket unit's
+// FileDescriptorName setting, which defaults to the name of the socket unit
+type Listener struct {
+	net.Listener
+	Name string
+}
+
+// Listeners returns the sockets passed to the process by socket activation, in the order of the socket unit's
+// ListenStream settings, or nil if there aren't any. The environment variables which pass them are removed, so that
+// they aren't passed on to any processes started from this one. It can only be called once
+func Listeners() ([]Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	// The sockets are only for this process, rather than for its parent which was started by systemd
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]Listener, 0, n)
+
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+
+		// FileListener duplicates the file descriptor, so the original is closed either way
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, fmt.Errorf("systemd: socket %s: %w", name, err)
+		}
+
+		listeners = append(listeners, Listener{Listener: ln, Name: name})
+	}
+
+	return listeners, nil
+}
+
+// Notify sends the states, such as Ready, to systemd. It does nothing, and returns nil, when the process wasn't
+// started by systemd with NotifyAccess set, which is when the NOTIFY_SOCKET environment variable isn't set
+func Notify(states ...string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// A name starting with "@" is in the abstract namespace, which is written with a leading null byte
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("systemd: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(strings.Join(states, "\n")))
+	if err != nil {
+		return fmt.Errorf("systemd: %w", err)
+	}
+
+	return nil
+}
+
+// WatchdogInterval returns how often systemd expects the Watchdog ping, from the unit's WatchdogSec setting, after
+// which it considers the service hung and restarts it. It returns zero when the watchdog isn't enabled for this process
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
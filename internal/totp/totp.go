@@ -0,0 +1,107 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The parameters below are the defaults from RFC 6238, which are the only ones that every authenticator app supports
+const (
+	// Period is the number of seconds that each code is valid for
+	Period = 30
+
+	// Digits is the length of each code
+	Digits = 6
+
+	// secretBytes is the length of the shared secret. RFC 4226 recommends 160 bits, the size of an SHA-1 output
+	secretBytes = 20
+)
+
+// encoding is the base32 encoding used for secrets, which is the format authenticator apps expect. Padding is left
+// off, as some apps don't accept it
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random shared secret, base32 encoded
+func GenerateSecret() (string, error) {
+	b := make([]byte, secretBytes)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+// ProvisioningURI returns the otpauth:// URI for a secret, which is usually shown to the user as a QR code for their
+// authenticator app to scan. The issuer and account name are displayed in the app to identify the account
+func ProvisioningURI(issuer, account, secret string) string {
+	qs := url.Values{}
+	qs.Set("secret", secret)
+	qs.Set("issuer", issuer)
+	qs.Set("algorithm", "SHA1")
+	qs.Set("digits", fmt.Sprint(Digits))
+	qs.Set("period", fmt.Sprint(Period))
+
+	label := url.PathEscape(issuer + ":" + account)
+
+	return "otpauth://totp/" + label + "?" + qs.Encode()
+}
+
+// Counter returns the time step that t falls in
+func Counter(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code for the secret at the given time step, as described in RFC 4226
+func Code(secret string, counter int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation: the low 4 bits of the last byte pick 4 bytes of the HMAC to use as the code
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value%1_000_000), nil
+}
+
+// Validate checks a code against the secret at time t. To allow for clock drift between the server and the user's
+// device, codes from up to skew time steps either side of t are also accepted. If the code is valid, the time step it
+// belongs to is returned, so that the caller can stop the same code being used twice
+func Validate(secret, code string, t time.Time, skew int) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	current := Counter(t)
+
+	for i := -skew; i <= skew; i++ {
+		expected, err := Code(secret, current+int64(i))
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return current + int64(i), true
+		}
+	}
+
+	return 0, false
+}
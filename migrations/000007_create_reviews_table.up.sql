@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS reviews
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    movie_id   bigint                      NOT NULL REFERENCES movies ON DELETE CASCADE,
+    user_id    bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    title      text                        NOT NULL,
+    body       text                        NOT NULL,
+    version    integer                     NOT NULL DEFAULT 1,
+    UNIQUE (movie_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS reviews_movie_id_idx ON reviews (movie_id);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS ratings
+(
+    movie_id   bigint                      NOT NULL REFERENCES movies ON DELETE CASCADE,
+    user_id    bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    score      smallint                    NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (movie_id, user_id)
+);
+
+ALTER TABLE ratings ADD CONSTRAINT ratings_score_check CHECK (score BETWEEN 1 AND 5);
+
+-- The aggregate score is denormalized onto the movies table so that reading a movie never has to count its ratings.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS average_rating numeric(3, 2) NOT NULL DEFAULT 0;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS ratings_count integer NOT NULL DEFAULT 0;
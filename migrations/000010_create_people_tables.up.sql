@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS people
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name       text                        NOT NULL,
+    version    integer                     NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS movies_people
+(
+    movie_id  bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    person_id bigint NOT NULL REFERENCES people ON DELETE CASCADE,
+    role      text   NOT NULL,
+    PRIMARY KEY (movie_id, person_id, role)
+);
+
+ALTER TABLE movies_people ADD CONSTRAINT movies_people_role_check CHECK (role IN ('actor', 'director', 'writer'));
+
+CREATE INDEX IF NOT EXISTS movies_people_person_id_idx ON movies_people (person_id);
@@ -0,0 +1,4 @@
+-- The normalized title ignores case, whitespace and punctuation, so "The Matrix" and "the matrix!" are treated as the
+-- same title. This must match the expression used by MovieModel when checking for duplicates.
+CREATE INDEX IF NOT EXISTS movies_normalized_title_year_idx
+    ON movies (regexp_replace(lower(title), '[^[:alnum:]]+', '', 'g'), year);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS movie_views
+(
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    day      date   NOT NULL DEFAULT CURRENT_DATE,
+    views    bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (movie_id, day)
+);
+
+CREATE INDEX IF NOT EXISTS movie_views_day_idx ON movie_views (day);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS people_name_vector_idx;
+ALTER TABLE people DROP COLUMN IF EXISTS name_vector;
+DROP INDEX IF EXISTS movies_description_vector_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS description_vector;
+ALTER TABLE movies DROP COLUMN IF EXISTS description;
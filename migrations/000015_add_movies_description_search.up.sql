@@ -0,0 +1,12 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '';
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS description_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('english', description)) STORED;
+
+CREATE INDEX IF NOT EXISTS movies_description_vector_idx ON movies USING GIN (description_vector);
+
+-- People's names are indexed with the simple configuration, so that names aren't stemmed like english words.
+ALTER TABLE people ADD COLUMN IF NOT EXISTS name_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', name)) STORED;
+
+CREATE INDEX IF NOT EXISTS people_name_vector_idx ON people USING GIN (name_vector);
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS movies_year_idx ON movies (year);
+CREATE INDEX IF NOT EXISTS movies_runtime_idx ON movies (runtime);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS release_dates
+(
+    movie_id bigint  NOT NULL REFERENCES movies ON DELETE CASCADE,
+    country  char(2) NOT NULL,
+    type     text    NOT NULL,
+    date     date    NOT NULL,
+    PRIMARY KEY (movie_id, country, type)
+);
+
+ALTER TABLE release_dates ADD CONSTRAINT release_dates_type_check CHECK (type IN ('theatrical', 'digital'));
+
+CREATE INDEX IF NOT EXISTS release_dates_country_date_idx ON release_dates (country, date);
@@ -0,0 +1,6 @@
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS display_name    text   NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS bio             text   NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS avatar_url      text   NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS country         text   NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS favorite_genres text[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'security:read';
+
+DROP TABLE IF EXISTS login_events;
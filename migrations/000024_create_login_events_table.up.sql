@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS login_events
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id    bigint REFERENCES users ON DELETE CASCADE,
+    email      citext                      NOT NULL,
+    method     text                        NOT NULL,
+    success    boolean                     NOT NULL,
+    reason     text                        NOT NULL DEFAULT '',
+    ip         text                        NOT NULL,
+    user_agent text                        NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS login_events_user_id_created_at_idx ON login_events (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS login_events_created_at_idx ON login_events (created_at DESC);
+
+-- Add the permission for viewing every user's login events.
+INSERT INTO permissions (code)
+VALUES ('security:read');
@@ -0,0 +1,9 @@
+DELETE FROM permissions WHERE code = 'users:impersonate';
+
+ALTER TABLE login_events
+    DROP COLUMN IF EXISTS impersonator_id;
+
+DELETE FROM tokens WHERE impersonator_id IS NOT NULL;
+
+ALTER TABLE tokens
+    DROP COLUMN IF EXISTS impersonator_id;
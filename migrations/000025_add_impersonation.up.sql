@@ -0,0 +1,10 @@
+-- Authentication tokens minted by an administrator to act as another user record who the administrator was.
+ALTER TABLE tokens
+    ADD COLUMN IF NOT EXISTS impersonator_id bigint REFERENCES users ON DELETE CASCADE;
+
+ALTER TABLE login_events
+    ADD COLUMN IF NOT EXISTS impersonator_id bigint REFERENCES users ON DELETE SET NULL;
+
+-- Add the permission for impersonating other users.
+INSERT INTO permissions (code)
+VALUES ('users:impersonate');
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS data_exports
+(
+    id           bigserial PRIMARY KEY,
+    created_at   timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id      bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    status       text                        NOT NULL DEFAULT 'pending',
+    completed_at timestamp(0) with time zone,
+    expiry       timestamp(0) with time zone,
+    size         bigint                      NOT NULL DEFAULT 0,
+    archive      bytea
+);
+
+CREATE INDEX IF NOT EXISTS data_exports_user_id_idx ON data_exports (user_id, created_at DESC);
+
+-- Only one export per user can be in progress at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS data_exports_user_id_in_progress_idx ON data_exports (user_id)
+    WHERE status IN ('pending', 'running');
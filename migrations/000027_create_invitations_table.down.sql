@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'users:invite';
+
+DROP TABLE IF EXISTS invitations;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS invitations
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    email      citext                      NOT NULL,
+    hash       bytea                       NOT NULL UNIQUE,
+    invited_by bigint REFERENCES users ON DELETE SET NULL,
+    expiry     timestamp(0) with time zone NOT NULL,
+    used_at    timestamp(0) with time zone,
+    used_by    bigint REFERENCES users ON DELETE SET NULL,
+    revoked_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS invitations_created_at_idx ON invitations (created_at DESC);
+
+-- Add the permission for inviting new users.
+INSERT INTO permissions (code)
+VALUES ('users:invite');
@@ -0,0 +1,6 @@
+DELETE FROM tokens WHERE scope = 'device';
+
+DROP INDEX IF EXISTS tokens_user_id_device_id_idx;
+
+ALTER TABLE tokens
+    DROP COLUMN IF EXISTS device_id;
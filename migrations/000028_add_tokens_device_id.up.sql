@@ -0,0 +1,5 @@
+-- Remember-me device tokens, and the authentication tokens issued with them, record the device that they belong to.
+ALTER TABLE tokens
+    ADD COLUMN IF NOT EXISTS device_id text;
+
+CREATE INDEX IF NOT EXISTS tokens_user_id_device_id_idx ON tokens (user_id, device_id) WHERE device_id IS NOT NULL;
@@ -0,0 +1,3 @@
+-- Add the permission for moderating other users' reviews.
+INSERT INTO permissions (code)
+VALUES ('reviews:moderate');
@@ -0,0 +1,7 @@
+-- Add the wildcard permissions, which imply every permission under them. "*" implies every permission there is.
+INSERT INTO permissions (code)
+VALUES ('*'),
+       ('movies:*'),
+       ('reviews:*'),
+       ('security:*'),
+       ('users:*');
@@ -0,0 +1,5 @@
+ALTER TABLE oidc_states DROP COLUMN IF EXISTS hash_version;
+ALTER TABLE recovery_codes DROP COLUMN IF EXISTS hash_version;
+ALTER TABLE invitations DROP COLUMN IF EXISTS hash_version;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS hash_version;
+ALTER TABLE tokens DROP COLUMN IF EXISTS hash_version;
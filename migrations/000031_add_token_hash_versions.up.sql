@@ -0,0 +1,7 @@
+-- Record which version of the pepper key each token hash was made with. Existing hashes are bare SHA-256 hashes,
+-- which are version 0.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS hash_version smallint NOT NULL DEFAULT 0;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS hash_version smallint NOT NULL DEFAULT 0;
+ALTER TABLE invitations ADD COLUMN IF NOT EXISTS hash_version smallint NOT NULL DEFAULT 0;
+ALTER TABLE recovery_codes ADD COLUMN IF NOT EXISTS hash_version smallint NOT NULL DEFAULT 0;
+ALTER TABLE oidc_states ADD COLUMN IF NOT EXISTS hash_version smallint NOT NULL DEFAULT 0;
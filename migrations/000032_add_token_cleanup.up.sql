@@ -0,0 +1,6 @@
+-- Index the token expiry times, so that the expired tokens can be found without scanning the whole table.
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
+
+-- Add the permission for maintenance tasks such as purging expired tokens.
+INSERT INTO permissions (code)
+VALUES ('security:write');
@@ -0,0 +1,3 @@
+-- Count down the uses left for limited-use tokens. NULL means that the token can be used any number of times until it
+-- expires, which is how all the existing tokens behave.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS uses_remaining integer CHECK (uses_remaining > 0);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS emails
+(
+    id              bigserial PRIMARY KEY,
+    created_at      timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    recipient       citext                      NOT NULL,
+    template        text                        NOT NULL,
+    data            jsonb                       NOT NULL DEFAULT '{}',
+    status          text                        NOT NULL DEFAULT 'pending',
+    attempts        integer                     NOT NULL DEFAULT 0,
+    next_attempt_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_error      text                        NOT NULL DEFAULT ''
+);
+
+-- Index the emails which are waiting to be sent, so that the workers can find the next one without scanning the
+-- dead letters.
+CREATE INDEX IF NOT EXISTS emails_next_attempt_at_idx ON emails (next_attempt_at)
+    WHERE status IN ('pending', 'sending');
+CREATE INDEX IF NOT EXISTS emails_status_created_at_idx ON emails (status, created_at DESC);
@@ -0,0 +1,2 @@
+-- The files attached to each email, as a JSON array with the content base64 encoded.
+ALTER TABLE emails ADD COLUMN IF NOT EXISTS attachments jsonb NOT NULL DEFAULT '[]';
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS email_deliveries
+(
+    id             bigserial PRIMARY KEY,
+    created_at     timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    email_id       bigint                      NOT NULL,
+    template       text                        NOT NULL,
+    recipient_hash text                        NOT NULL,
+    provider       text                        NOT NULL,
+    attempt        integer                     NOT NULL,
+    duration_ms    integer                     NOT NULL,
+    outcome        text                        NOT NULL,
+    error          text                        NOT NULL DEFAULT ''
+);
+
+-- The email_id isn't a foreign key, as emails are deleted from the queue once they've been sent.
+CREATE INDEX IF NOT EXISTS email_deliveries_outcome_created_at_idx ON email_deliveries (outcome, created_at DESC);
+CREATE INDEX IF NOT EXISTS email_deliveries_recipient_hash_idx ON email_deliveries (recipient_hash);
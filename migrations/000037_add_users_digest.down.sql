@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS users_digest_sent_at_idx;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS digest,
+    DROP COLUMN IF EXISTS digest_sent_at;
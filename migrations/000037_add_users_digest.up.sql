@@ -0,0 +1,6 @@
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS digest         boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS digest_sent_at timestamp(0) with time zone;
+
+-- Index the users who have opted in to the weekly digest, so that the digest job doesn't scan every user.
+CREATE INDEX IF NOT EXISTS users_digest_sent_at_idx ON users (digest_sent_at) WHERE digest;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS ip_blocks
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    network    cidr UNIQUE                 NOT NULL,
+    reason     text                        NOT NULL DEFAULT '',
+    created_by bigint                      REFERENCES users ON DELETE SET NULL,
+    expiry     timestamp(0) with time zone
+);
@@ -0,0 +1,3 @@
+-- Add the permission for the debug endpoints, with the expvar metrics and the runtime's profiles.
+INSERT INTO permissions (code)
+VALUES ('debug:read');
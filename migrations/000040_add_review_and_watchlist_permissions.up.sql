@@ -0,0 +1,10 @@
+-- Add the permissions for writing reviews and ratings and for the watchlist, so that they can be given to API keys as
+-- scopes. Every user could already do these things, so every existing user is granted them.
+INSERT INTO permissions (code)
+VALUES ('reviews:write'), ('watchlist:read'), ('watchlist:write');
+
+INSERT INTO users_permissions
+SELECT users.id, permissions.id FROM users
+CROSS JOIN permissions
+WHERE permissions.code IN ('reviews:write', 'watchlist:read', 'watchlist:write')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,6 @@
+-- Queued emails are stored rendered from their templates, rather than as the data for the templates, which can hold
+-- tokens. The data column is only read for emails which were queued before this migration.
+ALTER TABLE emails ADD COLUMN IF NOT EXISTS message jsonb;
+
+-- Dead emails are never sent, so their contents are cleared.
+UPDATE emails SET data = '{}', attachments = '[]' WHERE status = 'dead';
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS oidc_states_expiry_idx;
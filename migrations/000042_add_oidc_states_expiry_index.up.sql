@@ -0,0 +1,2 @@
+-- Index the sign in states by expiry, as the expired ones are deleted each time a sign in is started.
+CREATE INDEX IF NOT EXISTS oidc_states_expiry_idx ON oidc_states (expiry);
@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL migrations for the database schema, so that the API can bring the schema up to
+// date itself with golang-migrate, without the migration files having to be deployed alongside the binary
+package migrations
+
+import "embed"
+
+// FS holds the up and down migrations, named as golang-migrate expects, such as 000001_create_movies_table.up.sql
+//
+//go:embed *.sql
+var FS embed.FS